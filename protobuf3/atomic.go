@@ -0,0 +1,151 @@
+//go:build go1.19
+// +build go1.19
+
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Encoding the sync/atomic value types (atomic.Int64 and friends) as the values they hold
+ */
+
+import (
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+func init() {
+	atomicTypes[reflect.TypeOf(atomic.Bool{})] = atomicType{reflect.TypeOf(false), (*Buffer).enc_atomic_Bool, (*Buffer).dec_atomic_Bool}
+	atomicTypes[reflect.TypeOf(atomic.Int32{})] = atomicType{reflect.TypeOf(int32(0)), (*Buffer).enc_atomic_Int32, (*Buffer).dec_atomic_Int32}
+	atomicTypes[reflect.TypeOf(atomic.Int64{})] = atomicType{reflect.TypeOf(int64(0)), (*Buffer).enc_atomic_Int64, (*Buffer).dec_atomic_Int64}
+	atomicTypes[reflect.TypeOf(atomic.Uint32{})] = atomicType{reflect.TypeOf(uint32(0)), (*Buffer).enc_atomic_Uint32, (*Buffer).dec_atomic_Uint32}
+	atomicTypes[reflect.TypeOf(atomic.Uint64{})] = atomicType{reflect.TypeOf(uint64(0)), (*Buffer).enc_atomic_Uint64, (*Buffer).dec_atomic_Uint64}
+}
+
+// Encode an atomic.Bool.
+func (o *Buffer) enc_atomic_Bool(p *Properties, base unsafe.Pointer) {
+	if !(*atomic.Bool)(unsafe.Pointer(uintptr(base) + p.offset)).Load() {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, 1)
+}
+
+// Encode an atomic.Int32.
+func (o *Buffer) enc_atomic_Int32(p *Properties, base unsafe.Pointer) {
+	x := (*atomic.Int32)(unsafe.Pointer(uintptr(base) + p.offset)).Load()
+	if x == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, uint64(x))
+}
+
+// Encode an atomic.Int64.
+func (o *Buffer) enc_atomic_Int64(p *Properties, base unsafe.Pointer) {
+	x := (*atomic.Int64)(unsafe.Pointer(uintptr(base) + p.offset)).Load()
+	if x == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, uint64(x))
+}
+
+// Encode an atomic.Uint32.
+func (o *Buffer) enc_atomic_Uint32(p *Properties, base unsafe.Pointer) {
+	x := (*atomic.Uint32)(unsafe.Pointer(uintptr(base) + p.offset)).Load()
+	if x == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, uint64(x))
+}
+
+// Encode an atomic.Uint64.
+func (o *Buffer) enc_atomic_Uint64(p *Properties, base unsafe.Pointer) {
+	x := (*atomic.Uint64)(unsafe.Pointer(uintptr(base) + p.offset)).Load()
+	if x == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, x)
+}
+
+// Decode an atomic.Bool.
+func (o *Buffer) dec_atomic_Bool(p *Properties, base unsafe.Pointer) error {
+	u, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	(*atomic.Bool)(unsafe.Pointer(uintptr(base) + p.offset)).Store(u != 0)
+	return nil
+}
+
+// Decode an atomic.Int32.
+func (o *Buffer) dec_atomic_Int32(p *Properties, base unsafe.Pointer) error {
+	u, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	(*atomic.Int32)(unsafe.Pointer(uintptr(base) + p.offset)).Store(int32(u))
+	return nil
+}
+
+// Decode an atomic.Int64.
+func (o *Buffer) dec_atomic_Int64(p *Properties, base unsafe.Pointer) error {
+	u, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	(*atomic.Int64)(unsafe.Pointer(uintptr(base) + p.offset)).Store(int64(u))
+	return nil
+}
+
+// Decode an atomic.Uint32.
+func (o *Buffer) dec_atomic_Uint32(p *Properties, base unsafe.Pointer) error {
+	u, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	(*atomic.Uint32)(unsafe.Pointer(uintptr(base) + p.offset)).Store(uint32(u))
+	return nil
+}
+
+// Decode an atomic.Uint64.
+func (o *Buffer) dec_atomic_Uint64(p *Properties, base unsafe.Pointer) error {
+	u, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	(*atomic.Uint64)(unsafe.Pointer(uintptr(base) + p.offset)).Store(u)
+	return nil
+}
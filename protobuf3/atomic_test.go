@@ -0,0 +1,113 @@
+//go:build go1.19
+// +build go1.19
+
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// This code is derived from earlier code which was itself:
+//
+// Copyright 2014 The Go Authors.  All rights reserved.
+// https://github.com/golang/protobuf
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mistsys/protobuf3/protobuf3"
+)
+
+type AtomicMsg struct {
+	I atomic.Int64  `protobuf:"varint,1"`
+	B atomic.Bool   `protobuf:"varint,2"`
+	Z atomic.Int32  `protobuf:"zigzag32,3"`
+	U atomic.Uint64 `protobuf:"fixed64,4"`
+}
+
+type NonAtomicMsg struct {
+	I int64  `protobuf:"varint,1"`
+	B bool   `protobuf:"varint,2"`
+	Z int32  `protobuf:"zigzag32,3"`
+	U uint64 `protobuf:"fixed64,4"`
+}
+
+func TestAtomicFields(t *testing.T) {
+	var m AtomicMsg
+	m.I.Store(-5)
+	m.B.Store(true)
+	m.Z.Store(-6)
+	m.U.Store(7)
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := protobuf3.Marshal(&NonAtomicMsg{I: -5, B: true, Z: -6, U: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var m2 AtomicMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.I.Load() != -5 || !m2.B.Load() || m2.Z.Load() != -6 || m2.U.Load() != 7 {
+		t.Errorf("Unmarshal = %d, %v, %d, %d", m2.I.Load(), m2.B.Load(), m2.Z.Load(), m2.U.Load())
+	}
+
+	// zero values are elided, like the values the atomic types hold
+	pb, err = protobuf3.Marshal(&AtomicMsg{})
+	if err != nil || len(pb) != 0 {
+		t.Errorf("Marshal(zero) = % x, %v", pb, err)
+	}
+
+	j, err := protobuf3.MarshalJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"i":-5,"b":true,"z":-6,"u":7}` {
+		t.Errorf("MarshalJSON = %s", j)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(&m).Elem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "int64 i = 1;") || !strings.Contains(s, "sint32 z = 3;") || !strings.Contains(s, "fixed64 u = 4;") {
+		t.Errorf("AsProtobuf =\n%s", s)
+	}
+}
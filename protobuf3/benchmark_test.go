@@ -35,6 +35,7 @@ package protobuf3_test
 
 import (
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/mistsys/protobuf3/protobuf3"
@@ -1207,3 +1208,196 @@ func BenchmarkUnmarshalSliceOfStructMsg(b *testing.B) {
 		protobuf3.Unmarshal(pb, &m)
 	}
 }
+
+func benchmarkParallelMarshal(b *testing.B, workers int) {
+	m := makeParallelMsg(50000)
+	opts := protobuf3.MarshalOptions{Parallelism: workers}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := opts.Marshal(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerialMarshal(b *testing.B)    { benchmarkParallelMarshal(b, 0) }
+func BenchmarkParallelMarshal4(b *testing.B) { benchmarkParallelMarshal(b, 4) }
+
+type Fixed64SliceMsg struct {
+	S []uint64 `protobuf:"fixed64,1"`
+}
+
+func BenchmarkMarshalFixed64Slice(b *testing.B) {
+	m := Fixed64SliceMsg{S: make([]uint64, 10000)}
+	for i := range m.S {
+		m.S[i] = uint64(i) * 0x0101010101
+	}
+	b.SetBytes(int64(8 * len(m.S)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := protobuf3.Marshal(&m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshalReuse(b *testing.B, reuse bool) {
+	var m NestedPtrStructMsg
+	for i := 0; i < 1000; i++ {
+		m.many = append(m.many, &InnerMsg{int32(i)})
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	opts := protobuf3.UnmarshalOptions{Reuse: reuse}
+	var t NestedPtrStructMsg
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.many = t.many[:0]
+		err := opts.Unmarshal(pb, &t)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalSliceOfPtrStruct(b *testing.B)      { benchmarkUnmarshalReuse(b, false) }
+func BenchmarkUnmarshalSliceOfPtrStructReuse(b *testing.B) { benchmarkUnmarshalReuse(b, true) }
+
+type SameSizeInnerMsg struct {
+	ID   uint64 `protobuf:"fixed64,1"`
+	Name string `protobuf:"bytes,2"`
+	Pos  struct {
+		X float64 `protobuf:"fixed64,1"`
+		Y float64 `protobuf:"fixed64,2"`
+	} `protobuf:"bytes,3"`
+}
+
+type SameSizeMsg struct {
+	Items []SameSizeInnerMsg `protobuf:"bytes,1"`
+}
+
+func BenchmarkMarshalSameSizeMessages(b *testing.B) { benchmarkMarshalSameSizeMessages(b, false) }
+func BenchmarkMarshalSameSizeMessagesSizeCache(b *testing.B) {
+	benchmarkMarshalSameSizeMessages(b, true)
+}
+
+func benchmarkMarshalSameSizeMessages(b *testing.B, sizeCache bool) {
+	var m SameSizeMsg
+	for i := 0; i < 2000; i++ {
+		var e SameSizeInnerMsg
+		e.ID = uint64(i)
+		e.Name = strings.Repeat("x", 200) // large enough that the length needs two bytes
+		e.Pos.X, e.Pos.Y = float64(i), -float64(i)
+		m.Items = append(m.Items, e)
+	}
+	// marshal into a preallocated Buffer so that growing the output buffer doesn't dominate the time spent encoding
+	buf := protobuf3.NewBuffer(make([]byte, 0, 1<<20))
+	buf.SetSizeCache(sizeCache)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := buf.Marshal(&m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkMarshalWithHint(b *testing.B, hint bool) {
+	var m SameSizeMsg
+	for i := 0; i < 100; i++ {
+		var e SameSizeInnerMsg
+		e.ID = uint64(i)
+		e.Name = "item " + strconv.Itoa(i)
+		m.Items = append(m.Items, e)
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := 0
+	if hint {
+		n = len(pb)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := protobuf3.MarshalWithHint(&m, n)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalWithoutHint(b *testing.B) { benchmarkMarshalWithHint(b, false) }
+func BenchmarkMarshalWithHint(b *testing.B)    { benchmarkMarshalWithHint(b, true) }
+
+type AlternatingSizeInnerMsg struct {
+	B []byte `protobuf:"bytes,1"`
+}
+
+type AlternatingSizeMsg struct {
+	Items []*AlternatingSizeInnerMsg `protobuf:"bytes,1"`
+}
+
+func BenchmarkMarshalAlternatingSizeMessages(b *testing.B) {
+	benchmarkMarshalAlternatingSizeMessages(b, false)
+}
+func BenchmarkMarshalAlternatingSizeMessagesSizeCache(b *testing.B) {
+	benchmarkMarshalAlternatingSizeMessages(b, true)
+}
+
+// the lengths of the messages alternate between needing one and three bytes, so the length of the previous message
+// is always the wrong guess, and every message has to be moved once it is encoded
+func benchmarkMarshalAlternatingSizeMessages(b *testing.B, sizeCache bool) {
+	var m AlternatingSizeMsg
+	for i := 0; i < 200; i++ {
+		n := 100
+		if i&1 != 0 {
+			n = 20000
+		}
+		m.Items = append(m.Items, &AlternatingSizeInnerMsg{B: make([]byte, n)})
+	}
+	buf := protobuf3.NewBuffer(make([]byte, 0, 1<<22))
+	buf.SetSizeCache(sizeCache)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := buf.Marshal(&m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type PackedInt64Msg struct {
+	A []int64 `protobuf:"varint,1"`
+	B []int64 `protobuf:"zigzag64,2"`
+	C []int32 `protobuf:"varint,3"`
+}
+
+func BenchmarkMarshalPackedInt64(b *testing.B) {
+	var m PackedInt64Msg
+	for i := 0; i < 1000; i++ {
+		m.A = append(m.A, int64(i)*int64(i))
+		m.B = append(m.B, -int64(i))
+		m.C = append(m.C, int32(i))
+	}
+	dst := make([]byte, 1<<16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := protobuf3.MarshalToBuffer(dst, &m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Bitset, a compact set of boolean flags
+ */
+
+import (
+	"math/bits"
+)
+
+// Bitset is a set of boolean flags, one bit per flag, which encodes as a bytes field holding the bits in order: flag i is
+// bit i%8 of byte i/8. Trailing zero bytes are not encoded, so an empty Bitset encodes as nothing. A dense set of flags
+// encodes in an eighth of the space of the equivalent packed []bool. The zero value is an empty Bitset.
+type Bitset []uint64
+
+// Get returns the value of flag i. Flags beyond the end of the Bitset are false.
+func (b Bitset) Get(i int) bool {
+	w := i / 64
+	return w < len(b) && b[w]&(1<<(uint(i)%64)) != 0
+}
+
+// Set sets flag i to v, growing the Bitset as needed.
+func (b *Bitset) Set(i int, v bool) {
+	w := i / 64
+	if w >= len(*b) {
+		if !v {
+			return // the flag is already false
+		}
+		grown := make(Bitset, w+1, (w+1)*2)
+		copy(grown, *b)
+		*b = grown
+	}
+	if v {
+		(*b)[w] |= 1 << (uint(i) % 64)
+	} else {
+		(*b)[w] &^= 1 << (uint(i) % 64)
+	}
+}
+
+// Count returns the number of flags which are set
+func (b Bitset) Count() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// AppendProtobuf3 appends the bits to buf, least significant bit of the first word first
+func (b *Bitset) AppendProtobuf3(buf []byte) ([]byte, error) {
+	words := *b
+	for len(words) != 0 && words[len(words)-1] == 0 {
+		words = words[:len(words)-1]
+	}
+	for i, w := range words {
+		n := 8
+		if i == len(words)-1 {
+			n = (bits.Len64(w) + 7) / 8 // skip the trailing zero bytes
+		}
+		for j := 0; j < n; j++ {
+			buf = append(buf, byte(w>>(8*uint(j))))
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalProtobuf3 replaces the contents of the Bitset with the bits in data
+func (b *Bitset) UnmarshalProtobuf3(data []byte) error {
+	words := make(Bitset, (len(data)+7)/8)
+	for i, c := range data {
+		words[i/8] |= uint64(c) << (8 * (uint(i) % 8))
+	}
+	*b = words
+	return nil
+}
+
+// AsProtobuf3 returns the protobuf type of the Bitset. It needs no definition.
+func (*Bitset) AsProtobuf3() (string, string, []string) {
+	return "bytes", "", nil
+}
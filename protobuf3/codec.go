@@ -0,0 +1,146 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Registry of alternative encodings of the numbers in varint fields
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// VarintCodec is an alternative encoding of the numbers in varint fields, for peers which aren't quite protobuf.
+// Fields whose tag has the "codec=name" attribute are encoded with the codec registered with that name, while keeping
+// the protobuf tags and the varint wiretype. To keep the rest of the message decodable by others (who skip the field
+// as an unknown varint) the encoding ought to end with the first byte whose high bit is clear, like a varint does.
+// NOTE WELL the .proto generated by AsProtobuf can't express the codec, so both ends must agree to use it.
+type VarintCodec interface {
+	// AppendVarint appends the encoding of x to b and returns the extended slice
+	AppendVarint(b []byte, x uint64) []byte
+	// ConsumeVarint decodes the number at the start of b, and returns it and the number of bytes it occupied
+	ConsumeVarint(b []byte) (x uint64, n int, err error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]VarintCodec{
+		"sleb128": SignedLEB128{},
+	}
+)
+
+// RegisterVarintCodec registers codec under the given name, for use by fields whose tag has the "codec=name"
+// attribute. Since the properties of struct types are cached, codecs must be registered before the structs which use
+// them are first marshaled or unmarshaled (typically in an init() func). The codec SignedLEB128 is pre-registered as
+// "sleb128".
+func RegisterVarintCodec(name string, codec VarintCodec) {
+	codecsMu.Lock()
+	codecs[name] = codec
+	codecsMu.Unlock()
+}
+
+// lookupVarintCodec returns the codec registered under name, or nil
+func lookupVarintCodec(name string) VarintCodec {
+	codecsMu.RLock()
+	codec := codecs[name]
+	codecsMu.RUnlock()
+	return codec
+}
+
+// setCodec replaces p's value encoder and decoder with the codec registered under name
+func (p *Properties) setCodec(name string) error {
+	codec := lookupVarintCodec(name)
+	if codec == nil {
+		return fmt.Errorf("protobuf3: tag of %q names unregistered varint codec %q", p.Name, name)
+	}
+	if p.WireType != WireVarint {
+		return fmt.Errorf("protobuf3: tag of %q has codec=%s, but codecs only apply to varint fields, not %v", p.Name, name, p.WireType)
+	}
+	p.valEnc = func(o *Buffer, x uint64) {
+		o.buf = codec.AppendVarint(o.buf, x)
+	}
+	p.valSize = func(x uint64) int {
+		var b [16]byte
+		return len(codec.AppendVarint(b[:0], x))
+	}
+	p.valDec = func(o *Buffer) (uint64, error) {
+		x, n, err := codec.ConsumeVarint(o.buf[o.index:])
+		if err != nil {
+			return 0, err
+		}
+		o.index += uint(n)
+		return x, nil
+	}
+	return nil
+}
+
+// SignedLEB128 is the VarintCodec of signed LEB128, as used by DWARF and WebAssembly. Like a varint it stores 7 bits per
+// byte, least significant first, but the value is sign extended from the last byte, so small negative numbers are
+// short (-1 is the single byte 0x7f) rather than taking 10 bytes as they do in a varint.
+type SignedLEB128 struct{}
+
+// AppendVarint appends the signed LEB128 encoding of int64(x) to b
+func (SignedLEB128) AppendVarint(b []byte, x uint64) []byte {
+	v := int64(x)
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7 // arithmetic shift
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+var errLEB128Overflow = errors.New("protobuf3: signed LEB128 integer overflow")
+
+// ConsumeVarint decodes the signed LEB128 number at the start of b, and returns it as a uint64
+func (SignedLEB128) ConsumeVarint(b []byte) (uint64, int, error) {
+	var x int64
+	var shift uint
+	for i, c := range b {
+		if i == 10 {
+			return 0, 0, errLEB128Overflow
+		}
+		x |= int64(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				x |= -1 << shift // sign extend
+			}
+			return uint64(x), i + 1, nil
+		}
+	}
+	return 0, 0, io.ErrUnexpectedEOF
+}
@@ -40,11 +40,15 @@ package protobuf3
  */
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"reflect"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -54,6 +58,36 @@ import (
 // errOverflow is returned when an integer is too large to be represented.
 var errOverflow = errors.New("protobuf3: integer overflow")
 
+// ErrMaxDepth is the error (wrapped in a DecodeError) returned when the messages being decoded are nested more deeply
+// than the Buffer's maximum depth. See Buffer.SetMaxDepth.
+var ErrMaxDepth = errors.New("protobuf3: max nesting depth exceeded")
+
+// ErrMaxSize is the error returned when the length of a message or a length-delimited field being decoded exceeds the
+// Buffer's maximum size. See Buffer.SetMaxSize.
+var ErrMaxSize = errors.New("protobuf3: length exceeds the max size")
+
+// DefaultMaxDepth is the maximum nesting depth of decoded messages, unless Buffer.SetMaxDepth says otherwise. The message
+// passed to Unmarshal is at depth 1.
+const DefaultMaxDepth = 100
+
+// DecodeError is the error returned by Unmarshal when the protobuf can't be decoded.
+// It records where in the buffer decoding failed, which helps when debugging corrupt input.
+type DecodeError struct {
+	Offset int    // byte offset into the buffer being unmarshaled at which decoding failed
+	Field  uint32 // id of the field being decoded, or 0 if it isn't known
+	Err    error  // the underlying error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field != 0 {
+		return fmt.Sprintf("%v (field %d at offset %d)", e.Err, e.Field, e.Offset)
+	}
+	return fmt.Sprintf("%v (at offset %d)", e.Err, e.Offset)
+}
+
+// Unwrap returns the underlying error, so errors.Is(err, io.ErrUnexpectedEOF) and the like work.
+func (e *DecodeError) Unwrap() error { return e.Err }
+
 // The fundamental decoders that interpret bytes on the wire.
 // Those that take integer types all return uint64 and are
 // therefore of type valueDecoder.
@@ -272,6 +306,29 @@ func (p *Buffer) DecodeFixed32() (uint64, error) {
 	return uint64(le32tocpu(*(*uint32)(unsafe.Pointer(&p.buf[i-4])))), nil
 }
 
+// decodeFixed64BigEndian reads a big-endian 64-bit integer from the Buffer, as written by encodeFixed64BigEndian
+func (p *Buffer) decodeFixed64BigEndian() (uint64, error) {
+	i := p.index + 8
+	if i < 8 || i > ulen(p.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := p.buf[i-8 : i]
+	p.index = i
+	return uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32 |
+		uint64(b[4])<<24 | uint64(b[5])<<16 | uint64(b[6])<<8 | uint64(b[7]), nil
+}
+
+// decodeFixed32BigEndian reads a big-endian 32-bit integer from the Buffer, as written by encodeFixed32BigEndian
+func (p *Buffer) decodeFixed32BigEndian() (uint64, error) {
+	i := p.index + 4
+	if i < 4 || i > ulen(p.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := p.buf[i-4 : i]
+	p.index = i
+	return uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3]), nil
+}
+
 // DecodeZigzag64 reads a zigzag-encoded 64-bit integer
 // from the Buffer.
 // This is the format used for the sint64 protocol buffer type.
@@ -335,6 +392,9 @@ func (p *Buffer) DecodeRawBytes() ([]byte, error) {
 		}
 		i = p.index
 	}
+	if p.maxSize != 0 && c > p.maxSize {
+		return nil, ErrMaxSize
+	}
 
 	end := i + c
 	if end < i || end > n {
@@ -426,6 +486,9 @@ func (p *Buffer) SkipRawBytes() error {
 		}
 		i = p.index
 	}
+	if p.maxSize != 0 && c > p.maxSize {
+		return ErrMaxSize
+	}
 
 	end := i + c
 	if end < i || end > n {
@@ -454,11 +517,378 @@ func Unmarshal(bytes []byte, pb Message) error {
 	return err
 }
 
+// UnmarshalMerge decodes bytes into pb, merging them with pb's existing contents by the standard protobuf rules: scalar
+// fields (including strings and bytes) are overwritten, repeated fields are appended to, map entries are added (or
+// overwritten), and messages, held by value or by a non-nil pointer, are merged recursively. Since that is what Unmarshal
+// does too, UnmarshalMerge is the same as Unmarshal; it states the intent where it matters, such as when reassembling a
+// message which was split across several payloads.
+func UnmarshalMerge(bytes []byte, pb Message) error {
+	return Unmarshal(bytes, pb)
+}
+
+// UnmarshalWithPresence is like Unmarshal, and also returns the set of tags of the fields which appeared in bytes
+// (including any unknown fields). This lets callers check for required fields, or tell a field which was sent holding
+// its zero value from one which wasn't sent at all, without wrapping each field. Only the tags of the message itself are
+// returned, not those of any nested messages. If pb implements Marshaler the set is empty, since pb decodes itself.
+// If there is an error the set holds the tags decoded before the error.
+func UnmarshalWithPresence(bytes []byte, pb Message) (map[uint32]bool, error) {
+	seen := make(map[uint32]bool)
+	buf := newBuffer(bytes)
+	buf.seen = seen
+	err := buf.Unmarshal(pb)
+	buf.release()
+	return seen, err
+}
+
+// UnmarshalDelimited parses a protocol buffer prefixed by its varint encoded length, as written by MarshalDelimited,
+// and writes the decoded result to pb. It returns the number of bytes consumed, so that a stream of delimited messages
+// can be decoded one after another. Any bytes following the message are ignored.
+func UnmarshalDelimited(bytes []byte, pb Message) (int, error) {
+	return UnmarshalOptions{}.UnmarshalDelimited(bytes, pb)
+}
+
+// UnmarshalLengthDelimited is an alias of UnmarshalDelimited, for callers parsing a length prefixed message (as
+// EncodeRawBytes writes it) embedded in a larger frame. The number of bytes consumed is the length prefix plus the message.
+func UnmarshalLengthDelimited(bytes []byte, pb Message) (consumed int, err error) {
+	return UnmarshalDelimited(bytes, pb)
+}
+
+// UnmarshalTrailerLength parses the last protocol buffer framed in bytes by MarshalTrailerLength (the message followed
+// by its length as a 4 byte little-endian footer) and writes the decoded result to pb. It returns the offset in bytes at
+// which the frame begins, so that a sequence of frames can be decoded from the last to the first.
+func UnmarshalTrailerLength(bytes []byte, pb Message) (int, error) {
+	end := len(bytes) - 4
+	if end < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := uint64(bytes[end]) | uint64(bytes[end+1])<<8 | uint64(bytes[end+2])<<16 | uint64(bytes[end+3])<<24
+	if n > uint64(end) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	start := end - int(n)
+	err := Unmarshal(bytes[start:end:end], pb)
+	if err != nil {
+		if de, ok := err.(*DecodeError); ok {
+			de.Offset += start // make the offset relative to the start of bytes
+		}
+		return 0, err
+	}
+	return start, nil
+}
+
+// ReadTrailerLength reads r until EOF and decodes the single protocol buffer framed by MarshalTrailerLength it
+// contains into pb. Since the length follows the message, the whole frame must be read before the message can be found.
+func ReadTrailerLength(r io.Reader, pb Message) error {
+	var data bytes.Buffer
+	_, err := data.ReadFrom(r)
+	if err != nil {
+		return err
+	}
+	start, err := UnmarshalTrailerLength(data.Bytes(), pb)
+	if err != nil {
+		return err
+	}
+	if start != 0 {
+		return fmt.Errorf("protobuf3: %d bytes precede the %d byte trailer length framed message", start, data.Len()-start)
+	}
+	return nil
+}
+
+// UnmarshalVersioned parses a protocol buffer prefixed by a version byte, as written by MarshalVersioned, and writes
+// the decoded result to pb. It returns the version byte so the caller can tell which format the message was written in.
+// Callers which need to decode older versions into a different type can peek at bytes[0] before choosing pb.
+func UnmarshalVersioned(bytes []byte, pb Message) (byte, error) {
+	if len(bytes) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	version := bytes[0]
+	err := Unmarshal(bytes[1:], pb)
+	if err != nil {
+		if de, ok := err.(*DecodeError); ok {
+			de.Offset++ // make the offset relative to the start of bytes
+		}
+		return version, err
+	}
+	return version, nil
+}
+
+// UnmarshalSelfDescribing parses a message prefixed by its schema hash, as written by MarshalSelfDescribing, and
+// writes the decoded result to pb. If the hash doesn't match the SchemaHash of pb's type an error is returned and
+// pb is not modified.
+func UnmarshalSelfDescribing(bytes []byte, pb Message) error {
+	if len(bytes) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	hash, err := SchemaHash(reflect.TypeOf(pb))
+	if err != nil {
+		return err
+	}
+	buf := newBuffer(bytes)
+	defer buf.release()
+	h, _ := buf.DecodeFixed64()
+	if h != hash {
+		return fmt.Errorf("protobuf3: schema hash %016x of the message doesn't match schema hash %016x of %T", h, hash, pb)
+	}
+	return buf.Unmarshal(pb) // note that buf holds all of bytes, so any DecodeError.Offset is relative to the start of bytes
+}
+
+// UnmarshalOptions configures how messages are decoded. The zero value is the default behavior.
+type UnmarshalOptions struct {
+	// RejectTrailing causes UnmarshalDelimited to return an error if any bytes follow the message,
+	// for callers which expect exactly one framed message per buffer and want to catch framing bugs.
+	// It has no effect on Unmarshal: without a length there is no way to tell where a message ends,
+	// so Unmarshal always decodes all of the buffer, and any trailing bytes are decoded as more fields of the message.
+	RejectTrailing bool
+
+	// Lenient causes fields whose wiretype doesn't match the wiretype of the corresponding Go field to be skipped,
+	// as if they were unknown fields. By default such a mismatch is an error, since the message was most likely
+	// encoded using an incompatible schema.
+	Lenient bool
+
+	// Reuse causes repeated fields of pointers to messages ([]*T) to decode into the messages referenced from the
+	// spare capacity of the slice, rather than allocating new ones. This lets a caller which repeatedly decodes into
+	// the same target truncate the slice (s = s[:0]) and avoid allocating the messages again. The reused messages are
+	// zeroed before they are decoded into, so nothing is left over from their previous contents (but neither are any
+	// allocations they referenced reused). The caller must not retain any other references to the reused messages.
+	Reuse bool
+
+	// Cipher decrypts the fields tagged with the "encrypt" attribute. Unmarshaling a message containing such fields
+	// without a Cipher is an error.
+	Cipher Cipher
+
+	// AllowedTags, if not nil, is the set of field tags which the message may contain. A field with any other tag is
+	// an error, even if the message type has a field with that tag. This is stricter than ignoring unknown fields, and
+	// suits ingest paths which must enforce a minimal schema. Only the fields of the message itself are checked, since
+	// the tags of any nested messages are from other schemas.
+	AllowedTags map[uint32]bool
+
+	// OnUnknown, if not nil, is called with the tag, wiretype and encoded value of each field which the message (or any
+	// message nested within it) has no Go field for, as the field is skipped. For a WireBytes field the value excludes
+	// the length. value refers to the input, so it must be copied if it is retained. This is handy for counting the
+	// fields which a newer schema has added, to measure schema drift.
+	OnUnknown func(tag uint32, wire WireType, value []byte)
+
+	// SkipValidate causes messages which implement Validator to not be validated after they are decoded.
+	SkipValidate bool
+}
+
+// Unmarshal is like the package level Unmarshal, using the options.
+func (opts UnmarshalOptions) Unmarshal(bytes []byte, pb Message) error {
+	buf := newBuffer(bytes)
+	buf.lenient = opts.Lenient
+	buf.reuse = opts.Reuse
+	buf.cipher = opts.Cipher
+	buf.onUnknown = opts.OnUnknown
+	buf.skipValidate = opts.SkipValidate
+	var err error
+	if opts.AllowedTags != nil {
+		err = buf.checkAllowedTags(opts.AllowedTags)
+	}
+	if err == nil {
+		err = buf.Unmarshal(pb)
+	}
+	buf.release()
+	return err
+}
+
+// checkAllowedTags scans the fields of the message in the buffer and returns an error if any field's tag isn't in allowed.
+// It leaves the buffer's read position unchanged. Malformed fields end the scan, leaving them for the decoder to report.
+func (o *Buffer) checkAllowedTags(allowed map[uint32]bool) error {
+	start := o.index
+	defer func() { o.index = start }()
+	for o.index < ulen(o.buf) {
+		offset := o.index
+		x, err := o.DecodeVarint()
+		if err != nil {
+			return nil
+		}
+		tag := uint32(x >> 3)
+		if !allowed[tag] {
+			return &DecodeError{Offset: int(offset), Field: tag, Err: fmt.Errorf("protobuf3: field %d isn't one of the allowed tags", tag)}
+		}
+		if o.skip(nil, WireType(x&7)) != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// UnmarshalDelimited is like the package level UnmarshalDelimited, using the options.
+func (opts UnmarshalOptions) UnmarshalDelimited(bytes []byte, pb Message) (int, error) {
+	n, k := DecodeVarint(bytes)
+	if k == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	end := uint64(k) + n
+	if end < n || end > uint64(len(bytes)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if opts.RejectTrailing && end != uint64(len(bytes)) {
+		return 0, fmt.Errorf("protobuf3: %d trailing bytes after the %d byte delimited message", uint64(len(bytes))-end, end)
+	}
+	err := opts.Unmarshal(bytes[k:end:end], pb)
+	if err != nil {
+		if de, ok := err.(*DecodeError); ok {
+			de.Offset += k // make the offset relative to the start of bytes
+		}
+		return 0, err
+	}
+	return int(end), nil
+}
+
+var (
+	decodeTransformsMu sync.RWMutex
+	decodeTransforms   = make(map[decodeTransformKey]func(reflect.Value))
+)
+
+type decodeTransformKey struct {
+	t         reflect.Type
+	fieldName string
+}
+
+// RegisterDecodeTransform registers fn to be called each time field fieldName (the Go name of the field) of struct type t
+// has been decoded. fn is passed the (settable) field, and can alter its value. This is useful when the meaning of a field
+// has changed and old messages must be migrated as they are read (a field whose units changed, for instance).
+// For slice fields ([]T, but not []byte) fn is called with each element as it is appended to the slice rather than with the field.
+// Since the properties of struct types are cached, transforms must be registered before t is first marshaled or
+// unmarshaled (typically in an init() func).
+func RegisterDecodeTransform(t reflect.Type, fieldName string, fn func(reflect.Value)) {
+	decodeTransformsMu.Lock()
+	decodeTransforms[decodeTransformKey{t, fieldName}] = fn
+	decodeTransformsMu.Unlock()
+}
+
+var (
+	messageFactoriesMu sync.RWMutex
+	messageFactories   = make(map[decodeTransformKey]func() Message)
+)
+
+// RegisterMessageFactory registers fn to construct the message decoded into interface field fieldName (the Go name of the
+// field) of struct type t. The dynamic type of the message isn't encoded on the wire, so when the field is nil the decoder
+// needs to be told what type of message to allocate. fn must return a pointer to a message (of a type assignable to the
+// field). When the field already holds a non-nil pointer the message is decoded into it and fn isn't called.
+// Like decode transforms, factories must be registered before t is first marshaled or unmarshaled.
+func RegisterMessageFactory(t reflect.Type, fieldName string, fn func() Message) {
+	messageFactoriesMu.Lock()
+	messageFactories[decodeTransformKey{t, fieldName}] = fn
+	messageFactoriesMu.Unlock()
+}
+
+// lookupMessageFactory returns the factory registered for field fieldName of struct type t, or nil
+func lookupMessageFactory(t reflect.Type, fieldName string) func() Message {
+	messageFactoriesMu.RLock()
+	fn := messageFactories[decodeTransformKey{t, fieldName}]
+	messageFactoriesMu.RUnlock()
+	return fn
+}
+
+// Merger is the interface implemented by messages which merge decoded data into themselves. Since Unmarshal merges
+// into existing data, by default field by field, a message which implements Merger is instead decoded into a new
+// message of the same type, and ProtoMerge is called with it. This happens for the message passed to Unmarshal, and
+// for message fields (T or non-nil *T) of type T. Elements of repeated fields are new values, so aren't merged.
+type Merger interface {
+	ProtoMerge(src Message)
+}
+
+var mergerType = reflect.TypeOf((*Merger)(nil)).Elem()
+
+// wrapMerger wraps p.dec in a decoder which calls ProtoMerge, if field f holds a message which implements Merger
+func (p *Properties) wrapMerger(f *reflect.StructField) {
+	if p.sprop == nil || p.isMarshaler || p.isAppender || !reflect.PtrTo(p.stype).Implements(mergerType) {
+		return
+	}
+	isPtr := f.Type == reflect.PtrTo(p.stype)
+	if f.Type != p.stype && !isPtr {
+		return // a repeated field
+	}
+
+	dec := p.dec
+	p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+		ptr := unsafe.Pointer(uintptr(base) + p.offset)
+		if isPtr {
+			ptr = *(*unsafe.Pointer)(ptr)
+			if ptr == nil {
+				// there is nothing to merge into
+				return dec(o, p, base)
+			}
+		}
+
+		raw, err := o.DecodeRawBytes()
+		if err != nil {
+			return err
+		}
+		src := reflect.New(p.stype)
+		err = o.unmarshal_message(p.stype, p.sprop, raw, unsafe.Pointer(src.Pointer()))
+		if err != nil {
+			return err
+		}
+		reflect.NewAt(p.stype, ptr).Interface().(Merger).ProtoMerge(src.Interface())
+		return nil
+	}
+}
+
+// wrapDecodeTransform wraps p.dec in a decoder which calls any transform registered for field f of struct type t
+func (p *Properties) wrapDecodeTransform(t reflect.Type, f *reflect.StructField) {
+	decodeTransformsMu.RLock()
+	fn := decodeTransforms[decodeTransformKey{t, f.Name}]
+	decodeTransformsMu.RUnlock()
+	if fn == nil {
+		return
+	}
+
+	dec, ft := p.dec, f.Type
+	if ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8 {
+		p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+			// note p.offset rather than f.Offset, since the field might have been promoted from an embedded struct
+			v := reflect.NewAt(ft, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+			n := v.Len()
+			err := dec(o, p, base)
+			if err == nil {
+				// a packed field can append many elements at once
+				for i := n; i < v.Len(); i++ {
+					fn(v.Index(i))
+				}
+			}
+			return err
+		}
+		return
+	}
+	p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+		err := dec(o, p, base)
+		if err == nil {
+			fn(reflect.NewAt(ft, unsafe.Pointer(uintptr(base)+p.offset)).Elem())
+		}
+		return err
+	}
+}
+
+// Validator is the interface implemented by messages which check themselves once they have been decoded. Unless
+// UnmarshalOptions.SkipValidate is set, Unmarshal calls Validate after decoding into a message which implements
+// Validator, and returns its error. Only the message passed to Unmarshal is validated; it can validate the messages
+// nested within it itself, if need be.
+type Validator interface {
+	Validate() error
+}
+
 // Unmarshal parses the protocol buffer representation in the
 // Buffer and places the decoded result in pb.  If the struct
 // underlying pb does not match the data in the buffer, the results can be
-// unpredictable.
+// unpredictable. If pb implements Validator it is validated once it has been decoded.
 func (p *Buffer) Unmarshal(pb Message) error {
+	if p.maxSize != 0 && ulen(p.buf)-p.index > p.maxSize {
+		return &DecodeError{Offset: int(p.index), Err: ErrMaxSize}
+	}
+	err := p.unmarshal(pb)
+	if err == nil && !p.skipValidate {
+		if v, ok := pb.(Validator); ok {
+			err = v.Validate()
+		}
+	}
+	return err
+}
+
+// unmarshal does the work of Unmarshal, without the validation
+func (p *Buffer) unmarshal(pb Message) error {
 	if pb == nil { // we need a non-nil interface or this won't work
 		return ErrNil // NOTE this could almost qualify for a panic(), because the calling code is clearly quite confused
 	}
@@ -488,15 +918,40 @@ func (p *Buffer) Unmarshal(pb Message) error {
 		return err
 	}
 
+	if m, ok := pb.(Merger); ok {
+		// decode into a new message, and let pb merge it into itself
+		src := reflect.New(t)
+		err := p.unmarshal_struct(t, prop, unsafe.Pointer(src.Pointer()))
+		if err != nil {
+			return err
+		}
+		m.ProtoMerge(src.Interface())
+		return nil
+	}
+
 	return p.unmarshal_struct(t, prop, base)
 }
 
 // unmarshal_struct does the work of unmarshaling a structure.
 func (o *Buffer) unmarshal_struct(st reflect.Type, prop *StructProperties, base unsafe.Pointer) error {
+	// bound the recursion into nested messages, so that malicious input can't exhaust the stack
+	maxDepth := o.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if o.depth >= maxDepth {
+		return &DecodeError{Offset: int(o.index), Err: ErrMaxDepth}
+	}
+	o.depth++ // decremented on each return below. (a deferred closure would cost every message decoded)
+
 	var err error
-	var pidx = 0      // index into prop.props[] where we should start searching for the next tag
-	var ptag = -1     // -1, or the previous tag (matched or not, depending on whether p is nil or not)
-	var p *Properties // nil, or the p where p.Tag == ptag
+	var msg_start = o.index // start of the message, for verifying any checksum field
+	var checksummed = false // true once the checksum field has been verified
+	var pidx = 0            // index into prop.props[] where we should start searching for the next tag
+	var ptag = -1           // -1, or the previous tag (matched or not, depending on whether p is nil or not)
+	var p *Properties       // nil, or the p where p.Tag == ptag
+	var seen = o.seen       // nil, or where to record the tags of the fields
+	o.seen = nil            // (only the fields of the outermost message are recorded)
 	for err == nil && o.index < ulen(o.buf) {
 		start := o.index
 		var wire WireType
@@ -516,15 +971,21 @@ func (o *Buffer) unmarshal_struct(st reflect.Type, prop *StructProperties, base
 			var u uint64
 			u, err = o.DecodeVarint()
 			if err != nil {
-				break
+				o.depth--
+				return &DecodeError{Offset: int(start), Err: err}
 			}
 			wire = WireType(u & 0x7)
 			tag = int(u >> 3)
 			if tag <= 0 {
-				return fmt.Errorf("protobuf3: %s: illegal tag %d (wiretype %v) at index %d of %d", st, tag, wire, start, len(o.buf))
+				o.depth--
+				return &DecodeError{Offset: int(start), Err: fmt.Errorf("protobuf3: %s: illegal tag %d (wiretype %v) at index %d of %d", st, tag, wire, start, len(o.buf))}
 			}
 		}
 
+		if seen != nil {
+			seen[uint32(tag)] = true
+		}
+
 		if tag != ptag {
 			if tag < ptag {
 				// the order on the wire has jumped around. this is legal in protobuf, but unusual. in any case we need to
@@ -545,7 +1006,7 @@ func (o *Buffer) unmarshal_struct(st reflect.Type, prop *StructProperties, base
 		} // else re-use previous search result `p`
 
 		if p == nil {
-			err = o.skip(st, wire)
+			err = o.unknown_field(st, prop, base, start, uint32(tag), wire)
 			continue
 		}
 
@@ -554,14 +1015,109 @@ func (o *Buffer) unmarshal_struct(st reflect.Type, prop *StructProperties, base
 			continue
 		}
 		if wire != p.WireType {
-			err = fmt.Errorf("protobuf3: bad wiretype for field %s.%s: got wiretype %v, wanted %v", st, p.Name, wire, p.WireType)
+			if o.lenient {
+				// treat the field as an unknown field rather than misparse it
+				err = o.unknown_field(st, prop, base, start, uint32(tag), wire)
+				continue
+			}
+			err = &DecodeError{Offset: int(start), Field: p.Tag, Err: fmt.Errorf("protobuf3: bad wiretype for field %s.%s: got wiretype %v, wanted %v", st, p.Name, wire, p.WireType)}
 			break
 		}
+		if p.isChecksum && !checksummed {
+			err = o.verify_checksum(st, p, o.buf[msg_start:start])
+			if err != nil {
+				err = &DecodeError{Offset: int(start), Field: p.Tag, Err: err}
+				break
+			}
+			checksummed = true
+		}
 		err = p.dec(o, p, base)
+		if err == nil && prop.maskSize != 0 {
+			prop.setPresenceBit(base, pidx)
+		}
+		if err != nil {
+			if _, ok := err.(*DecodeError); !ok {
+				err = &DecodeError{Offset: int(o.index), Field: p.Tag, Err: err}
+			} // else the error came from a nested message and is already annotated
+		}
+	}
+	if err == nil && prop.checksum && !checksummed {
+		p := &prop.props[len(prop.props)-1]
+		err = &DecodeError{Offset: int(o.index), Field: p.Tag, Err: fmt.Errorf("protobuf3: %s: missing checksum field %s", st, p.Name)}
 	}
+	o.depth--
 	return err
 }
 
+// unknown_field skips the field whose tag, which began at start, has just been decoded. The field is passed to
+// OnUnknown, and kept in the struct's unknown field, if there are either.
+func (o *Buffer) unknown_field(st reflect.Type, prop *StructProperties, base unsafe.Pointer, start uint, tag uint32, wire WireType) error {
+	var err error
+	if o.onUnknown != nil {
+		err = o.skipUnknown(st, tag, wire)
+	} else {
+		err = o.skip(st, wire)
+	}
+	if err != nil {
+		return &DecodeError{Offset: int(o.index), Field: tag, Err: err}
+	}
+	if prop.unknown {
+		// keep the whole field, tag and all, so it can be re-encoded
+		u := prop.unknownFields(base)
+		*u = append(*u, o.buf[start:o.index]...)
+	}
+	return nil
+}
+
+// verify_checksum checks that the CRC32 of msg matches the fixed32 checksum field p which is next in the buffer.
+func (o *Buffer) verify_checksum(st reflect.Type, p *Properties, msg []byte) error {
+	if o.index+4 > ulen(o.buf) {
+		return io.ErrUnexpectedEOF
+	}
+	b := o.buf[o.index : o.index+4]
+	x := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	if crc := crc32.ChecksumIEEE(msg); x != crc {
+		return fmt.Errorf("protobuf3: %s: checksum mismatch in field %s: got %08x, computed %08x", st, p.Name, x, crc)
+	}
+	return nil
+}
+
+// unmarshal_message unmarshals raw, which must be the bytes most recently returned by o.DecodeRawBytes(), into the struct at ptr.
+// Any DecodeError's Offset is adjusted to be relative to o.buf rather than raw.
+func (o *Buffer) unmarshal_message(st reflect.Type, prop *StructProperties, raw []byte, ptr unsafe.Pointer) error {
+	// swizzle around and reuse the buffer. less gc
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = raw, 0
+
+	err := o.unmarshal_struct(st, prop, ptr)
+
+	o.buf, o.index = obuf, oi
+
+	if de, ok := err.(*DecodeError); ok {
+		de.Offset += int(oi) - len(raw)
+	}
+	return err
+}
+
+// skipUnknown skips the value of unknown field tag, and passes the value to o.onUnknown
+func (o *Buffer) skipUnknown(t reflect.Type, tag uint32, wire WireType) error {
+	if wire == WireBytes {
+		raw, err := o.DecodeRawBytes()
+		if err != nil {
+			return err
+		}
+		o.onUnknown(tag, wire, raw)
+		return nil
+	}
+	start := o.index
+	err := o.skip(t, wire)
+	if err != nil {
+		return err
+	}
+	o.onUnknown(tag, wire, o.buf[start:o.index])
+	return nil
+}
+
 // Skip the next item in the buffer. Its wire type is decoded and presented as an argument.
 // t can be nil
 func (o *Buffer) skip(t reflect.Type, wire WireType) error {
@@ -592,6 +1148,9 @@ func (o *Buffer) get(t reflect.Type, wire WireType) ([]byte, error) {
 		var n uint64
 		n, err = o.DecodeVarint()
 		start = o.index // reset the starting index to where the byte payload starts
+		if err == nil && o.maxSize != 0 && n > uint64(o.maxSize) {
+			err = ErrMaxSize
+		}
 		if err == nil {
 			err = o.SkipFixed(n)
 		}
@@ -775,6 +1334,75 @@ func (o *Buffer) dec_slice_byte(p *Properties, base unsafe.Pointer) error {
 	return nil
 }
 
+// Decode a slice of bytes ([]byte) with the "base64" attribute from the base64 string encoding it
+func (o *Buffer) dec_slice_byte_base64(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	// note the decoded bytes are always a copy, so o.Immutable doesn't matter
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(raw)))
+	n, err := base64.StdEncoding.Decode(b, raw)
+	if err != nil {
+		return fmt.Errorf("protobuf3: base64 field %s: %v", p.Name, err)
+	}
+
+	*(*[]byte)(unsafe.Pointer(uintptr(base) + p.offset)) = b[:n]
+	return nil
+}
+
+// Decode a standard library type which encodes as a message (see stdMessageTypes)
+func (o *Buffer) dec_std_message(p *Properties, base unsafe.Pointer) error {
+	return o.dec_std_message_body(p, unsafe.Pointer(uintptr(base)+p.offset))
+}
+
+// Decode a pointer to a standard library type which encodes as a message. Like any pointer to a message, the value is
+// allocated if the pointer is nil.
+func (o *Buffer) dec_ptr_std_message(p *Properties, base unsafe.Pointer) error {
+	pptr := (*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if *pptr == nil {
+		*pptr = unsafe.Pointer(reflect.New(p.stype).Pointer())
+	}
+	return o.dec_std_message_body(p, *pptr)
+}
+
+// dec_std_message_body decodes the length and body of a message into the value at ptr
+func (o *Buffer) dec_std_message_body(p *Properties, ptr unsafe.Pointer) error {
+	buf, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	// swizzle buf (saves gc pressure from a new Buffer)
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = buf, 0
+
+	err = stdMessageTypes[p.stype].dec(o, ptr)
+
+	o.buf, o.index = obuf, oi
+
+	if err != nil {
+		return fmt.Errorf("protobuf3: %s field %s: %v", p.stype, p.Name, err)
+	}
+	return nil
+}
+
+// Decode a *bytes.Buffer. The bytes are appended to the Buffer, allocating it if it is nil.
+func (o *Buffer) dec_ptr_bytes_Buffer(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	ptr := (**bytes.Buffer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if *ptr == nil {
+		*ptr = new(bytes.Buffer)
+	}
+	(*ptr).Write(raw) // Write copies raw, so o.Immutable doesn't matter
+	return nil
+}
+
 // Decode an  array of bytes ([N]byte).
 func (o *Buffer) dec_array_byte(p *Properties, base unsafe.Pointer) error {
 	raw, err := o.DecodeRawBytes()
@@ -804,6 +1432,9 @@ func (o *Buffer) dec_slice_packed_bool(p *Properties, base unsafe.Pointer) error
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -837,6 +1468,9 @@ func (o *Buffer) dec_array_packed_bool(p *Properties, base unsafe.Pointer) error
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -862,6 +1496,9 @@ func (o *Buffer) dec_slice_packed_int8(p *Properties, base unsafe.Pointer) error
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded int8s
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 
 	fin := o.index + nb
 	if fin < o.index {
@@ -894,6 +1531,9 @@ func (o *Buffer) dec_array_packed_int8(p *Properties, base unsafe.Pointer) error
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -921,6 +1561,9 @@ func (o *Buffer) dec_slice_packed_int16(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded int16s
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 
 	fin := o.index + nb
 	if fin < o.index {
@@ -953,6 +1596,9 @@ func (o *Buffer) dec_array_packed_int16(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -980,6 +1626,9 @@ func (o *Buffer) dec_slice_packed_int32(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded int32s
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 
 	fin := o.index + nb
 	if fin < o.index {
@@ -1012,6 +1661,9 @@ func (o *Buffer) dec_array_packed_int32(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -1039,6 +1691,9 @@ func (o *Buffer) dec_slice_packed_int(p *Properties, base unsafe.Pointer) error
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded ints
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 
 	fin := o.index + nb
 	if fin < o.index {
@@ -1065,6 +1720,9 @@ func (o *Buffer) dec_slice_packed_int64(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded int64s
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 
 	fin := o.index + nb
 	if fin < o.index {
@@ -1097,6 +1755,9 @@ func (o *Buffer) dec_array_packed_int64(p *Properties, base unsafe.Pointer) erro
 		return err
 	}
 	nb := uint(nn) // number of bytes of encoded bools
+	if o.maxSize != 0 && nb > o.maxSize {
+		return ErrMaxSize
+	}
 	fin := o.index + nb
 	if fin < o.index {
 		return errOverflow
@@ -1234,14 +1895,7 @@ func (o *Buffer) dec_struct_message(p *Properties, base unsafe.Pointer) error {
 
 	ptr := unsafe.Pointer(uintptr(base) + p.offset)
 
-	// swizzle around and reuse the buffer. less gc
-	obuf, oi := o.buf, o.index
-	o.buf, o.index = raw, 0
-
-	err = o.unmarshal_struct(p.stype, p.sprop, ptr)
-
-	o.buf, o.index = obuf, oi
-	return err
+	return o.unmarshal_message(p.stype, p.sprop, raw, ptr)
 }
 
 // Decode a pointer to an embedded message.
@@ -1260,14 +1914,7 @@ func (o *Buffer) dec_ptr_struct_message(p *Properties, base unsafe.Pointer) erro
 		*pptr = ptr
 	} // else the value is already allocated and we merge into it
 
-	// swizzle around and reuse the buffer. less gc
-	obuf, oi := o.buf, o.index
-	o.buf, o.index = raw, 0
-
-	err = o.unmarshal_struct(p.stype, p.sprop, ptr)
-
-	o.buf, o.index = obuf, oi
-	return err
+	return o.unmarshal_message(p.stype, p.sprop, raw, ptr)
 }
 
 // Decode into a slice of messages ([]struct)
@@ -1299,12 +1946,7 @@ func (o *Buffer) dec_slice_struct_message(p *Properties, base unsafe.Pointer) er
 	pval := unsafe.Pointer(val.UnsafeAddr())
 
 	// unmarshal into pval
-	obuf, oi := o.buf, o.index
-	o.buf, o.index = raw, 0
-	err = o.unmarshal_struct(p.stype, p.sprop, pval)
-	o.buf, o.index = obuf, oi
-
-	return err
+	return o.unmarshal_message(p.stype, p.sprop, raw, pval)
 }
 
 // Decode into an array of messages ([N]struct)
@@ -1326,10 +1968,7 @@ func (o *Buffer) dec_array_struct_message(p *Properties, base unsafe.Pointer) er
 			err = reflect.NewAt(p.stype, ptr_elem).Interface().(unmarshaler).UnmarshalProtobuf3(raw)
 		} else {
 			// unmarshal into pval
-			obuf, oi := o.buf, o.index
-			o.buf, o.index = raw, 0
-			err = o.unmarshal_struct(p.stype, p.sprop, ptr_elem)
-			o.buf, o.index = obuf, oi
+			err = o.unmarshal_message(p.stype, p.sprop, raw, ptr_elem)
 		}
 
 		i++
@@ -1346,25 +1985,32 @@ func (o *Buffer) dec_slice_ptr_struct_message(p *Properties, base unsafe.Pointer
 		return err
 	}
 
-	// construct a new *struct
-	v := reflect.New(p.stype)
-	pv := unsafe.Pointer(v.Pointer())
+	pslice := (*[]unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
 
-	// unmarshal into the new struct
+	var v reflect.Value
+	var pv unsafe.Pointer
+	if s := *pslice; o.reuse && len(s) < cap(s) && s[:len(s)+1][len(s)] != nil {
+		// reuse the *struct in the spare capacity of the slice, zeroing it first
+		pv = s[:len(s)+1][len(s)]
+		v = reflect.NewAt(p.stype, pv)
+		v.Elem().Set(reflect.Zero(p.stype))
+	} else {
+		// construct a new *struct
+		v = reflect.New(p.stype)
+		pv = unsafe.Pointer(v.Pointer())
+	}
+
+	// unmarshal into the struct
 	if p.isAppender || p.isMarshaler {
 		err = v.Interface().(unmarshaler).UnmarshalProtobuf3(raw)
 	} else {
-		obuf, oi := o.buf, o.index
-		o.buf, o.index = raw, 0
-		err = o.unmarshal_struct(p.stype, p.sprop, pv)
-		o.buf, o.index = obuf, oi
+		err = o.unmarshal_message(p.stype, p.sprop, raw, pv)
 	}
 	if err != nil {
 		return err
 	}
 
 	// append pv to the slice []*struct
-	pslice := (*[]unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
 	*pslice = append(*pslice, pv)
 
 	return nil
@@ -1385,10 +2031,7 @@ func (o *Buffer) dec_array_ptr_struct_message(p *Properties, base unsafe.Pointer
 	if p.isAppender || p.isMarshaler {
 		err = v.Interface().(unmarshaler).UnmarshalProtobuf3(raw)
 	} else {
-		obuf, oi := o.buf, o.index
-		o.buf, o.index = raw, 0
-		err = o.unmarshal_struct(p.stype, p.sprop, pv)
-		o.buf, o.index = obuf, oi
+		err = o.unmarshal_message(p.stype, p.sprop, raw, pv)
 	}
 	if err != nil {
 		return err
@@ -1490,11 +2133,224 @@ func (o *Buffer) dec_nothing(p *Properties, base unsafe.Pointer) error {
 	return nil
 }
 
+// Decode a pointer to an array (*[n]T), allocating the array if the pointer is nil
+func (o *Buffer) dec_ptr_array(p *Properties, base unsafe.Pointer) error {
+	pptr := (*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if *pptr == nil {
+		*pptr = unsafe.Pointer(reflect.New(p.atype).Pointer())
+	}
+	return p.aprop.dec(o, p.aprop, *pptr)
+}
+
+// Decode one string of a map[string]string with the "flatmap" attribute. Each key is held until its value is decoded.
+// A key without a value (because it is the last string) is dropped.
+func (o *Buffer) dec_flatmap(p *Properties, base unsafe.Pointer) error {
+	s, err := o.DecodeStringBytes()
+	if err != nil {
+		return err
+	}
+
+	ptr := unsafe.Pointer(uintptr(base) + p.offset)
+	key, ok := o.flatmap_keys[ptr]
+	if !ok {
+		if o.flatmap_keys == nil {
+			o.flatmap_keys = make(map[unsafe.Pointer]string)
+		}
+		o.flatmap_keys[ptr] = s
+		return nil
+	}
+	delete(o.flatmap_keys, ptr)
+
+	v := reflect.NewAt(p.mtype, ptr).Elem()
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(p.mtype))
+	}
+	v.SetMapIndex(reflect.ValueOf(key).Convert(p.mtype.Key()), reflect.ValueOf(s).Convert(p.mtype.Elem()))
+	return nil
+}
+
+// Decode a slice of structs with the "record" attribute, appending the records to the slice.
+func (o *Buffer) dec_slice_record(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+	if uintptr(len(raw))%p.rsize != 0 {
+		return fmt.Errorf("protobuf3: %d bytes is not a whole number of %d byte %s records", len(raw), p.rsize, p.rtype)
+	}
+	n := uintptr(len(raw)) / p.rsize
+
+	v := reflect.NewAt(reflect.SliceOf(p.rtype), unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	l := v.Len()
+	v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), int(n), int(n))))
+
+	for i := uintptr(0); i < n; i++ {
+		elem := unsafe.Pointer(v.Index(l + int(i)).UnsafeAddr())
+		for _, f := range p.rfields {
+			b := ((*[8]byte)(unsafe.Pointer(uintptr(elem) + f.offset)))[:f.size:f.size]
+			if f.isBool {
+				// any byte other than 0 is true, as with a varint. storing it as is would make a bool which is neither true nor false
+				b[0] = 0
+				if raw[0] != 0 {
+					b[0] = 1
+				}
+			} else if host_little_endian {
+				copy(b, raw)
+			} else {
+				for j := range b {
+					b[len(b)-1-j] = raw[j]
+				}
+			}
+			raw = raw[f.size:]
+		}
+	}
+	return nil
+}
+
+// Decode a message into an interface field. The message is decoded into the pointer held in the field, or if there isn't one,
+// into a new message constructed by the factory registered for the field.
+func (o *Buffer) dec_interface_message(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	v := reflect.NewAt(p.itype, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	if v.IsNil() || (v.Elem().Kind() == reflect.Ptr && v.Elem().IsNil()) {
+		if p.ifactory == nil {
+			return fmt.Errorf("protobuf3: can't decode into nil interface field %s: no factory was registered with RegisterMessageFactory", p.Name)
+		}
+		m := p.ifactory()
+		mv := reflect.ValueOf(m)
+		if mv.Kind() != reflect.Ptr || mv.IsNil() || !mv.Type().AssignableTo(p.itype) {
+			return fmt.Errorf("protobuf3: the factory of interface field %s returned %T, which isn't a non-nil pointer assignable to %s", p.Name, m, p.itype)
+		}
+		v.Set(mv)
+	}
+
+	// swizzle around and reuse the buffer, like unmarshal_message
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = raw, 0
+
+	err = o.unmarshal(v.Interface())
+
+	o.buf, o.index = obuf, oi
+
+	if de, ok := err.(*DecodeError); ok {
+		de.Offset += int(oi) - len(raw)
+	}
+	return err
+}
+
+// Decode a google.protobuf.Any into an element of a slice of interfaces. The type of the element is found from the
+// type URL, and a pointer to a new message of that type is appended to the slice.
+func (o *Buffer) dec_slice_interface_any(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	// swizzle around and reuse the buffer, like unmarshal_message
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = raw, 0
+
+	var a Any
+	err = o.unmarshal(&a)
+	var m reflect.Value
+	if err == nil {
+		t := lookupTypeURL(a.TypeURL)
+		switch {
+		case t == nil:
+			err = fmt.Errorf("protobuf3: can't decode %s into %s: no type was registered with RegisterProtoName", a.TypeURL, p.Name)
+		case !reflect.PtrTo(t).AssignableTo(p.itype):
+			err = fmt.Errorf("protobuf3: can't decode %s into %s: *%s isn't assignable to %s", a.TypeURL, p.Name, t, p.itype)
+		default:
+			m = reflect.New(t)
+			o.buf, o.index = a.Value, 0
+			err = o.unmarshal(m.Interface())
+		}
+	}
+
+	o.buf, o.index = obuf, oi
+
+	if err != nil {
+		if de, ok := err.(*DecodeError); ok {
+			de.Offset += int(oi) - len(raw)
+		}
+		return err
+	}
+
+	s := reflect.NewAt(reflect.SliceOf(p.itype), unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	s.Set(reflect.Append(s, m))
+	return nil
+}
+
+// Decode an encrypted field. The bytes are decrypted, and the plaintext, which is the usual encoding of the field
+// (possibly several times over, in the case of repeated fields), is decoded.
+func (o *Buffer) dec_encrypted(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+	if o.cipher == nil {
+		return fmt.Errorf("protobuf3: field %s is encrypted, but there is no UnmarshalOptions.Cipher", p.Name)
+	}
+	plaintext, err := o.cipher.Decrypt(raw)
+	if err != nil {
+		return fmt.Errorf("protobuf3: can't decrypt field %s: %v", p.Name, err)
+	}
+
+	// swizzle around and reuse the buffer
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = plaintext, 0
+
+	for err == nil && o.index < ulen(o.buf) {
+		var tag uint64
+		tag, err = o.DecodeVarint()
+		if err != nil {
+			break
+		}
+		if uint32(tag>>3) != p.Tag {
+			// a ciphertext copied from another field
+			err = fmt.Errorf("protobuf3: decrypted field %s has tag %d; expected %d", p.Name, tag>>3, p.Tag)
+			break
+		}
+		if WireType(tag&7) != p.eprop.WireType {
+			err = fmt.Errorf("protobuf3: decrypted field %s has wiretype %s; expected %s", p.Name, WireType(tag&7), p.eprop.WireType)
+			break
+		}
+		err = p.eprop.dec(o, p.eprop, base)
+	}
+
+	o.buf, o.index = obuf, oi
+
+	if de, ok := err.(*DecodeError); ok {
+		// offsets within the plaintext don't correspond to anything in o.buf. the best we can do is point at the ciphertext
+		de.Offset = int(oi) - len(raw)
+	}
+	return err
+}
+
+// decoder which skips over the field's value. Used for fields which can't hold a decoded value, like func() T fields
+func (o *Buffer) dec_skip(p *Properties, base unsafe.Pointer) error {
+	return o.skip(nil, p.WireType)
+}
+
 // custom decoder for protobuf3 standard Timestamp, decoding it into the standard go time.Time
 func (o *Buffer) dec_time_Time(p *Properties, base unsafe.Pointer) error {
 	return o.decode_time_Time((*time.Time)(unsafe.Pointer(uintptr(base) + p.offset)))
 }
 
+// custom decoder for time.Time with the "trunc=" attribute, which truncates the decoded time (in case the encoder didn't)
+func (o *Buffer) dec_time_Time_trunc(p *Properties, base unsafe.Pointer) error {
+	t := (*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	err := o.decode_time_Time(t)
+	if err == nil {
+		*t = t.Truncate(p.trunc)
+	}
+	return err
+}
+
 // custom decoder for pointer to time.Time
 func (o *Buffer) dec_ptr_time_Time(p *Properties, base unsafe.Pointer) error {
 	pptr := (**time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
@@ -1555,6 +2411,144 @@ func (o *Buffer) DecodeTimestamp() (time.Time, error) {
 	return ts, nil
 }
 
+// custom decoder for an RFC 3339 string, decoding it into the standard go time.Time
+func (o *Buffer) dec_time_RFC3339(p *Properties, base unsafe.Pointer) error {
+	s, err := o.DecodeStringBytes()
+	if err != nil {
+		return err
+	}
+	var t time.Time
+	if s != "" {
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+	}
+	*(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset)) = t
+	return nil
+}
+
+// custom decoder for time.Time with the "fixed_nanos" attribute
+func (o *Buffer) dec_time_Time_fixed_nanos(p *Properties, base unsafe.Pointer) error {
+	x, err := p.valDec(o)
+	if err != nil {
+		return err
+	}
+	*(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset)) = time.Unix(0, int64(x)).UTC()
+	return nil
+}
+
+// Decode a []time.Time with the "delta" attribute, summing the differences to reconstruct the times, and appending them to the slice
+func (o *Buffer) dec_slice_time_Time_delta(p *Properties, base unsafe.Pointer) error {
+	raw, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+	s := (*[]time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	x := int64(0)
+	for len(raw) != 0 {
+		d, n := DecodeVarint(raw)
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		raw = raw[n:]
+		x += int64(d>>1) ^ -int64(d&1) // undo the zigzag
+		*s = append(*s, time.Unix(0, x).UTC())
+	}
+	return nil
+}
+
+// custom decoder for google.type.DateTime, decoding it into the standard go time.Time
+func (o *Buffer) dec_time_DateTime(p *Properties, base unsafe.Pointer) error {
+	buf, err := o.DecodeRawBytes()
+	if err != nil {
+		return err
+	}
+
+	// swizzle buf (saves gc pressure from a new Buffer)
+	obuf, oi := o.buf, o.index
+	o.buf, o.index = buf, 0
+
+	t, err := o.DecodeDateTime()
+
+	o.buf, o.index = obuf, oi
+
+	if err == nil {
+		*(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset)) = t
+	}
+	return err
+}
+
+// DecodeDateTime decodes a google.type.DateTime as a time.Time. See EncodeDateTime for the layout of a DateTime.
+// A utc_offset is decoded as a time.FixedZone (or time.UTC if the offset is 0), a time_zone as the named time.Location,
+// and a DateTime with neither is in time.Local.
+func (o *Buffer) DecodeDateTime() (time.Time, error) {
+	var fields [7]int // year, month, day, hours, minutes, seconds, nanos
+	loc := time.Local
+	for o.index < ulen(o.buf) {
+		tag, err := o.DecodeVarint()
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch {
+		case tag >= 1<<3|uint64(WireVarint) && tag <= 7<<3|uint64(WireVarint) && WireType(tag)&7 == WireVarint:
+			var x uint64
+			x, err = o.DecodeVarint()
+			fields[tag>>3-1] = int(int32(x))
+		case tag == 8<<3|uint64(WireBytes): // utc_offset
+			var d time.Duration
+			d, err = o.dec_Duration(nil)
+			if d == 0 {
+				loc = time.UTC
+			} else {
+				loc = time.FixedZone("", int(d/time.Second))
+			}
+		case tag == 9<<3|uint64(WireBytes): // time_zone
+			var tz []byte
+			tz, err = o.DecodeRawBytes()
+			if err == nil {
+				loc, err = decode_TimeZone(tz)
+			}
+		default:
+			// do the protobuf thing and ignore unknown tags
+			err = o.skip(nil, WireType(tag)&7)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], fields[6], loc), nil
+}
+
+// decode_TimeZone decodes a google.type.TimeZone, which is a pair of strings (id,version) tagged 1 and 2, and loads the time zone named by id
+func decode_TimeZone(buf []byte) (*time.Location, error) {
+	o := newBuffer(buf)
+	defer o.release()
+	var id string
+	for o.index < ulen(o.buf) {
+		tag, err := o.DecodeVarint()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 1<<3 | uint64(WireBytes): // id
+			id, err = o.DecodeStringBytes()
+		default:
+			// including the version, which time.LoadLocation has no use for
+			err = o.skip(nil, WireType(tag)&7)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	loc, err := time.LoadLocation(id)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf3: google.type.DateTime time_zone: %v", err)
+	}
+	return loc, nil
+}
+
 // DecodeNSecTimstamp decodes a google.protobuf.Timestamp as a int64 nanosecond unix time
 func (o *Buffer) DecodeNSecTimestamp() (int64, error) {
 	var secs, nanos uint64
@@ -1630,7 +2624,9 @@ func (o *Buffer) dec_Duration(p *Properties) (time.Duration, error) {
 
 	o.index = end
 
-	d := time.Duration(secs)*time.Second + time.Duration(nanos)*time.Nanosecond
+	// seconds and nanos have the same sign (or are 0), so a negative duration is negative in both.
+	// nanos is an int32, so sign-extend it from 32 bits in case the sender truncated its varint encoding
+	d := time.Duration(int64(secs))*time.Second + time.Duration(int32(nanos))*time.Nanosecond
 
 	return d, nil
 }
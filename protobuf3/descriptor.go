@@ -0,0 +1,268 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Generating the Go struct fields of messages described by google.protobuf.DescriptorProto, the reverse of AsProtobuf
+ */
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The types of a field, from the Type enum of google.protobuf.FieldDescriptorProto
+const (
+	FieldTypeDouble   int32 = 1
+	FieldTypeFloat    int32 = 2
+	FieldTypeInt64    int32 = 3
+	FieldTypeUint64   int32 = 4
+	FieldTypeInt32    int32 = 5
+	FieldTypeFixed64  int32 = 6
+	FieldTypeFixed32  int32 = 7
+	FieldTypeBool     int32 = 8
+	FieldTypeString   int32 = 9
+	FieldTypeGroup    int32 = 10
+	FieldTypeMessage  int32 = 11
+	FieldTypeBytes    int32 = 12
+	FieldTypeUint32   int32 = 13
+	FieldTypeEnum     int32 = 14
+	FieldTypeSfixed32 int32 = 15
+	FieldTypeSfixed64 int32 = 16
+	FieldTypeSint32   int32 = 17
+	FieldTypeSint64   int32 = 18
+)
+
+// The labels of a field, from the Label enum of google.protobuf.FieldDescriptorProto
+const (
+	FieldLabelOptional int32 = 1
+	FieldLabelRequired int32 = 2
+	FieldLabelRepeated int32 = 3
+)
+
+// FileDescriptorProto encodes as a google.protobuf.FileDescriptorProto, describing a .proto file.
+// Only the parts needed by StructTagsFromDescriptor are decoded; the rest are skipped.
+type FileDescriptorProto struct {
+	Name        string             `protobuf:"bytes,1"`
+	Package     string             `protobuf:"bytes,2"`
+	MessageType []*DescriptorProto `protobuf:"bytes,4"`
+	Syntax      string             `protobuf:"bytes,12"`
+}
+
+// DescriptorProto encodes as a google.protobuf.DescriptorProto, describing a message type.
+type DescriptorProto struct {
+	Name       string                  `protobuf:"bytes,1"`
+	Field      []*FieldDescriptorProto `protobuf:"bytes,2"`
+	NestedType []*DescriptorProto      `protobuf:"bytes,3"`
+	Options    *MessageOptions         `protobuf:"bytes,7"`
+}
+
+// MessageOptions encodes as a google.protobuf.MessageOptions. MapEntry is set on the nested types which protoc
+// synthesizes for the entries of map fields.
+type MessageOptions struct {
+	MapEntry bool `protobuf:"varint,7"`
+}
+
+// FieldDescriptorProto encodes as a google.protobuf.FieldDescriptorProto, describing a field of a message.
+type FieldDescriptorProto struct {
+	Name           string `protobuf:"bytes,1"`
+	Number         int32  `protobuf:"varint,3"`
+	Label          int32  `protobuf:"varint,4"` // one of the FieldLabel constants
+	Type           int32  `protobuf:"varint,5"` // one of the FieldType constants
+	TypeName       string `protobuf:"bytes,6"`  // the fully qualified name of the message or enum type, like ".pkg.Outer.Inner"
+	Proto3Optional bool   `protobuf:"varint,17"`
+}
+
+// the Go type and wiretype of each scalar protobuf type
+var descriptorScalarTypes = map[int32][2]string{
+	FieldTypeDouble:   {"float64", "fixed64"},
+	FieldTypeFloat:    {"float32", "fixed32"},
+	FieldTypeInt64:    {"int64", "varint"},
+	FieldTypeUint64:   {"uint64", "varint"},
+	FieldTypeInt32:    {"int32", "varint"},
+	FieldTypeFixed64:  {"uint64", "fixed64"},
+	FieldTypeFixed32:  {"uint32", "fixed32"},
+	FieldTypeBool:     {"bool", "varint"},
+	FieldTypeString:   {"string", "bytes"},
+	FieldTypeBytes:    {"[]byte", "bytes"},
+	FieldTypeUint32:   {"uint32", "varint"},
+	FieldTypeSfixed32: {"int32", "fixed32"},
+	FieldTypeSfixed64: {"int64", "fixed64"},
+	FieldTypeSint32:   {"int32", "zigzag32"},
+	FieldTypeSint64:   {"int64", "zigzag64"},
+}
+
+// StructTagsFromDescriptor returns the Go field declarations, with their protobuf struct tags, of a struct which
+// encodes like the message described by msg. It is the reverse of AsProtobuf, for those who start from a .proto.
+// Fields of message and enum types are given Go type names made from the nested names of the types, joined with '_'
+// (".pkg.Outer.Inner" becomes Outer_Inner); those types have to be declared separately (and enums registered with
+// RegisterEnum). Map fields become Go maps. Fields which are members of a oneof become ordinary fields, and fields of
+// the obsolete group type, which can't be encoded, become comments.
+func StructTagsFromDescriptor(msg *DescriptorProto) string {
+	type line struct{ name, typ, tags string }
+	var lines []line
+	for _, f := range msg.Field {
+		name := goFieldName(f.Name)
+		typ, tags, err := f.goTypeAndTags(msg)
+		if err != nil {
+			lines = append(lines, line{name: "// " + err.Error()})
+			continue
+		}
+		if MakeFieldName(name, nil) != f.Name {
+			// the name of the protobuf field can't be derived from the name of the Go field, so it has to be explicit
+			i := strings.IndexByte(tags[len(`protobuf:"`):], '"') + len(`protobuf:"`)
+			tags = tags[:i] + ",name=" + f.Name + tags[i:]
+		}
+		lines = append(lines, line{name, typ, tags})
+	}
+
+	// align the columns like gofmt would
+	var wname, wtyp int
+	for _, l := range lines {
+		if l.typ != "" {
+			if len(l.name) > wname {
+				wname = len(l.name)
+			}
+			if len(l.typ) > wtyp {
+				wtyp = len(l.typ)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, l := range lines {
+		if l.typ == "" {
+			fmt.Fprintf(&b, "\t%s\n", l.name)
+		} else {
+			fmt.Fprintf(&b, "\t%-*s %-*s `%s`\n", wname, l.name, wtyp, l.typ, l.tags)
+		}
+	}
+	return b.String()
+}
+
+// goTypeAndTags returns the Go type and struct tags of field f of message msg
+func (f *FieldDescriptorProto) goTypeAndTags(msg *DescriptorProto) (string, string, error) {
+	repeated := f.Label == FieldLabelRepeated
+
+	if repeated && f.Type == FieldTypeMessage {
+		if entry := msg.mapEntry(f.TypeName); entry != nil {
+			var key, val *FieldDescriptorProto
+			for _, ef := range entry.Field {
+				switch ef.Number {
+				case 1:
+					key = ef
+				case 2:
+					val = ef
+				}
+			}
+			if key == nil || val == nil {
+				return "", "", fmt.Errorf("field %s: map entry type %s lacks a key or a value", f.Name, f.TypeName)
+			}
+			ktyp, kwire, err := key.goTypeAndWire()
+			if err != nil {
+				return "", "", fmt.Errorf("field %s: %v", f.Name, err)
+			}
+			vtyp, vwire, err := val.goTypeAndWire()
+			if err != nil {
+				return "", "", fmt.Errorf("field %s: %v", f.Name, err)
+			}
+			return fmt.Sprintf("map[%s]%s", ktyp, vtyp),
+				fmt.Sprintf(`protobuf:"bytes,%d" protobuf_key:"%s,1" protobuf_val:"%s,2"`, f.Number, kwire, vwire), nil
+		}
+	}
+
+	typ, wire, err := f.goTypeAndWire()
+	if err != nil {
+		return "", "", fmt.Errorf("field %s: %v", f.Name, err)
+	}
+	opts := ""
+	switch {
+	case repeated:
+		typ = "[]" + typ // (repeated numeric fields are always packed, as proto3 expects)
+	case f.Proto3Optional:
+		if f.Type != FieldTypeMessage {
+			typ = "*" + typ
+		}
+		opts = ",optional"
+	}
+	return typ, fmt.Sprintf(`protobuf:"%s,%d%s"`, wire, f.Number, opts), nil
+}
+
+// goTypeAndWire returns the Go type and wiretype of a single value of field f
+func (f *FieldDescriptorProto) goTypeAndWire() (string, string, error) {
+	switch f.Type {
+	case FieldTypeMessage:
+		return "*" + goTypeName(f.TypeName), "bytes", nil
+	case FieldTypeEnum:
+		return goTypeName(f.TypeName), "varint", nil
+	}
+	if st, ok := descriptorScalarTypes[f.Type]; ok {
+		return st[0], st[1], nil
+	}
+	return "", "", fmt.Errorf("unsupported type %d", f.Type)
+}
+
+// mapEntry returns the nested map entry type of msg named by typeName, or nil if there isn't one
+func (msg *DescriptorProto) mapEntry(typeName string) *DescriptorProto {
+	name := typeName[strings.LastIndexByte(typeName, '.')+1:]
+	for _, nt := range msg.NestedType {
+		if nt.Name == name && nt.Options != nil && nt.Options.MapEntry {
+			return nt
+		}
+	}
+	return nil
+}
+
+// goFieldName returns the Go name of a protobuf field: "foo_bar" becomes FooBar
+func goFieldName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		r := []rune(part)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+	return b.String()
+}
+
+// goTypeName returns the Go name of a fully qualified protobuf type name: the components naming the (possibly nested)
+// type, which by convention are uppercase while those naming the package are lowercase, joined with '_'
+func goTypeName(typeName string) string {
+	parts := strings.Split(strings.TrimPrefix(typeName, "."), ".")
+	for i, part := range parts {
+		if part != "" && unicode.IsUpper([]rune(part)[0]) {
+			return strings.Join(parts[i:], "_")
+		}
+	}
+	return parts[len(parts)-1]
+}
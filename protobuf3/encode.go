@@ -40,9 +40,19 @@ package protobuf3
  */
 
 import (
+	"bytes"
+	"container/heap"
+	"container/list"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -152,6 +162,30 @@ func (p *WriteBuffer) EncodeFixed32(x uint64) {
 		uint8(x>>24))
 }
 
+// encodeFixed64BigEndian writes a 64-bit integer to the Buffer, in the big-endian byte order used by structs
+// implementing BigEndianer
+func (p *Buffer) encodeFixed64BigEndian(x uint64) {
+	p.buf = append(p.buf,
+		uint8(x>>56),
+		uint8(x>>48),
+		uint8(x>>40),
+		uint8(x>>32),
+		uint8(x>>24),
+		uint8(x>>16),
+		uint8(x>>8),
+		uint8(x))
+}
+
+// encodeFixed32BigEndian writes a 32-bit integer to the Buffer, in the big-endian byte order used by structs
+// implementing BigEndianer
+func (p *Buffer) encodeFixed32BigEndian(x uint64) {
+	p.buf = append(p.buf,
+		uint8(x>>24),
+		uint8(x>>16),
+		uint8(x>>8),
+		uint8(x))
+}
+
 // EncodeZigzag64 writes a zigzag-encoded 64-bit integer
 // to the Buffer.
 // This is the format used for the sint64 protocol buffer type.
@@ -175,6 +209,32 @@ func (p *WriteBuffer) EncodeBytes(tag uint32, b []byte) {
 	p.EncodeRawBytes(b)
 }
 
+// EncodeReader reads r until EOF and writes what it read as a bytes field with the given tag.
+// It returns the number of bytes read from r. If reading fails nothing is written to the Buffer.
+// Since reading has side effects there is no way to tag an io.Reader field of a struct; encoding
+// such a field must be done explicitly by calling EncodeReader.
+func (p *WriteBuffer) EncodeReader(tag uint32, r io.Reader) (int64, error) {
+	iTag := len(p.buf)
+	p.EncodeVarint(uint64(tag)<<3 + uint64(WireBytes))
+	iMsg := len(p.buf)
+	b := bytes.NewBuffer(p.buf)
+	n, err := b.ReadFrom(r)
+	p.buf = b.Bytes()
+	if err != nil {
+		p.buf = p.buf[:iTag]
+		return n, err
+	}
+	// move the contents right to make room for the length, and write the length in front of them
+	lLen := SizeVarint(uint64(n))
+	p.buf = append(p.buf, zeroes[:lLen]...)
+	copy(p.buf[iMsg+lLen:], p.buf[iMsg:iMsg+int(n)])
+	buf := p.buf
+	p.buf = p.buf[:iMsg]
+	p.EncodeVarint(uint64(n))
+	p.buf = buf
+	return n, nil
+}
+
 // EncodeRawBytes writes a count-delimited byte buffer to the Buffer.
 // This is the format used for the bytes protocol buffer
 // type and for embedded messages.
@@ -233,6 +293,465 @@ func Marshal(pb Message) ([]byte, error) {
 	return bytes, nil
 }
 
+// MarshalWithHint is like Marshal, but starts with an output buffer of sizeHint bytes capacity, rather than growing
+// the buffer as the message is encoded. When the hint is accurate (the result of Size, or the length of the previous
+// marshal of a similar message, for instance) the only allocation of the output is the initial one. A hint which is too
+// small merely means the buffer grows as it would have anyway, and one which is too large wastes the excess capacity.
+func MarshalWithHint(pb Message, sizeHint int) ([]byte, error) {
+	if sizeHint < 0 {
+		sizeHint = 0
+	}
+	buf := newBuffer(make([]byte, 0, sizeHint))
+	err := buf.Marshal(pb)
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// MarshalAppend is like Marshal, but appends the encoding of pb to buf and returns the extended slice, the way
+// Appender.AppendProtobuf3 does. Reusing one large buf across many calls avoids allocating a fresh output for each
+// message; the caller can slice each record out of the result. On error buf is returned unchanged (though the bytes
+// beyond its length, up to its capacity, may have been overwritten).
+func MarshalAppend(buf []byte, pb Message) ([]byte, error) {
+	o := newBuffer(buf)
+	err := o.Marshal(pb)
+	bytes := o.release()
+	if err != nil {
+		return buf, err
+	}
+	return bytes, nil
+}
+
+// MarshalBudget encodes as many of the fields of pb as fit in budget bytes. It returns the encoding of the fields up to
+// the first field which doesn't fit, and true if any fields were left out. The result is always a valid message, since
+// only whole fields are included, and it holds the fields in the order in which Marshal would encode them (which is
+// normally tag order), so the most important fields ought to have the lowest tags. (The elements of a repeated field
+// which isn't packed are separate fields, and so some of them can be included without the others.) If the type of pb
+// has a checksum field, room is left for it in the budget, and it is recomputed over the fields which were kept, so
+// the truncated message still verifies. This is useful for logging samples of large messages. NOTE WELL the whole
+// message is encoded before it is cut down to size. A negative budget, or one too small to hold the checksum, is an error.
+func MarshalBudget(pb Message, budget int) ([]byte, bool, error) {
+	if budget < 0 {
+		return nil, false, fmt.Errorf("protobuf3: MarshalBudget(%T, %d): negative budget", pb, budget)
+	}
+	buf := newBuffer(nil)
+	err := buf.Marshal(pb)
+	if err != nil {
+		buf.release()
+		return nil, false, err
+	}
+	if len(buf.buf) <= budget {
+		return buf.release(), false, nil
+	}
+
+	// if there is a checksum field, leave room for it
+	var checksum *Properties
+	if _, ok := pb.(Marshaler); !ok {
+		prop, err := GetProperties(reflect.TypeOf(pb)) // (Marshal has already checked pb is a pointer to a struct)
+		if err == nil && prop.checksum {
+			checksum = &prop.props[len(prop.props)-1]
+			budget -= len(checksum.tagcode) + 4
+		}
+	}
+
+	// find the end of the last whole field which fits in the budget
+	end := 0
+	for buf.index < ulen(buf.buf) {
+		x, err := buf.DecodeVarint()
+		if err != nil || buf.skip(nil, WireType(x&7)) != nil || int(buf.index) > budget {
+			break
+		}
+		end = int(buf.index)
+	}
+	buf.buf = buf.buf[:end]
+	if checksum != nil {
+		if budget < 0 {
+			buf.release()
+			return nil, true, fmt.Errorf("protobuf3: MarshalBudget(%T, %d): budget is too small to hold the checksum field", pb, budget+len(checksum.tagcode)+4)
+		}
+		crc := crc32.ChecksumIEEE(buf.buf)
+		buf.buf = append(buf.buf, checksum.tagcode...)
+		buf.EncodeFixed32(uint64(crc))
+	}
+	return buf.release(), true, nil
+}
+
+// MarshalTo encodes pb and writes it to w, returning the number of bytes written.
+// Writers which accept only part of the data without returning an error (which io.Writer forbids, but bounded
+// rings and some network writers do anyway) are called again with the remainder until all of it has been written,
+// so the stream isn't corrupted. A writer which makes no progress at all causes io.ErrShortWrite.
+func MarshalTo(w io.Writer, pb Message) (int, error) {
+	buf := newBuffer(nil)
+	err := buf.Marshal(pb)
+	if err != nil {
+		buf.release()
+		return 0, err
+	}
+
+	written, err := writeAll(w, buf.buf)
+	buf.release()
+	return written, err
+}
+
+// writeAll writes all of data to w, calling w again after partial writes
+func writeAll(w io.Writer, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		n, err := w.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// MarshalTrailerLength encodes pb and writes it to w followed by its length, so that a producer which streams its
+// output never needs to seek back to fill in a length. The frame is the encoded message followed by a 4 byte footer
+// holding the length of the message (not counting the footer) as a little-endian uint32. (A varint can't be used,
+// since it can't be parsed backwards from the end of the frame.) The frame is decoded by UnmarshalTrailerLength,
+// or ReadTrailerLength.
+func MarshalTrailerLength(w io.Writer, pb Message) error {
+	buf := newBuffer(nil)
+	err := buf.Marshal(pb)
+	if err == nil && uint64(len(buf.buf)) > math.MaxUint32 {
+		err = fmt.Errorf("protobuf3: %d byte message is too long for a trailer length", len(buf.buf))
+	}
+	if err == nil {
+		buf.EncodeFixed32(uint64(len(buf.buf)))
+		_, err = writeAll(w, buf.buf)
+	}
+	buf.release()
+	return err
+}
+
+// MarshalByteStream drains ch and returns the concatenation of the chunks it received, encoded as a single bytes
+// field with the given tag. This is equivalent to encoding a 'b []byte `protobuf:"bytes,tag"` field holding all the chunks,
+// so an empty stream encodes nothing at all. Since the length of the field precedes its contents, and the length isn't
+// known until ch is closed, the entire stream is held in memory before MarshalByteStream returns. Streams too large to
+// buffer must be split across several fields or messages by the caller.
+func MarshalByteStream(ch <-chan []byte, tag uint32) ([]byte, error) {
+	if tag == 0 || tag >= 1<<29 {
+		// drain ch anyway so the sender doesn't block forever
+		for range ch {
+		}
+		return nil, fmt.Errorf("protobuf3: out of range tag %d", tag)
+	}
+
+	// append the chunks directly after the tag and room for the length, so the stream isn't copied
+	o := newBuffer(nil)
+	o.EncodeVarint(uint64(tag)<<3 | uint64(WireBytes))
+	n := o.enc_len_reserved(4, func() {
+		for chunk := range ch {
+			o.buf = append(o.buf, chunk...)
+		}
+	})
+	if n == 0 {
+		o.buf = o.buf[:0]
+	}
+	return o.release(), nil
+}
+
+// MarshalOptions configures how messages are encoded. The zero value is the default behavior.
+type MarshalOptions struct {
+	// Parallelism is the maximum number of goroutines used to encode the elements of large repeated message fields.
+	// The output is identical to the serial encoding. 0 or 1 means encode serially.
+	Parallelism int
+
+	// Deterministic causes map fields to be encoded in order of their keys, so that equal messages encode to equal
+	// bytes. Individual map fields can override this with the "order=sorted" or "order=unsorted" tag attributes.
+	Deterministic bool
+
+	// Indent, if not empty, causes JSON to produce multi-line JSON indented with Indent.
+	// It has no effect on the protobuf encoding.
+	Indent string
+
+	// Cipher encrypts the fields tagged with the "encrypt" attribute. Marshaling a message containing such fields
+	// without a Cipher is an error.
+	Cipher Cipher
+
+	// NoElide causes fields holding zero values, which are normally omitted, to be encoded anyway. Scalars are
+	// encoded as 0, strings, bytes and empty packed repeated fields as zero-length bytes, and nil pointers to structs
+	// as empty messages. Repeated strings, bytes and messages, and maps, still encode nothing when they are empty, since
+	// there is no way to encode an empty one. This is useful for seeing which fields a message type contains.
+	NoElide bool
+
+	// SizeCache causes the length of each nested message to be computed before the message is encoded, so the length
+	// can be written directly rather than guessed and the message moved when the guess is wrong (see Buffer.SetSizeCache).
+	// It only pays off for large nested messages whose lengths vary. The output is identical.
+	SizeCache bool
+
+	// RenameTags, if not nil, is called with the Go name of each field of the message being marshaled, and when it
+	// returns true the field is encoded with the returned tag instead of its own, as if by MarshalRemapped. This lets
+	// an experiment rewire the tags of a schema migration per call. Like MarshalRemapped only the fields of the message
+	// itself are renumbered, and types which marshal themselves can't be.
+	RenameTags func(fieldName string) (newTag uint32, ok bool)
+}
+
+// renameTags returns the remap table which opts.RenameTags produces for the fields of sprop
+func (opts MarshalOptions) renameTags(sprop *StructProperties) map[uint32]uint32 {
+	remap := make(map[uint32]uint32)
+	for i := range sprop.props {
+		p := &sprop.props[i]
+		if tag, ok := opts.RenameTags(p.Name); ok {
+			remap[p.Tag] = tag
+		}
+	}
+	return remap
+}
+
+// Cipher encrypts and decrypts the encoding of fields tagged with the "encrypt" attribute. The encrypted field is
+// encoded as a bytes field holding the output of Encrypt. The Cipher is supplied by the caller in MarshalOptions and
+// UnmarshalOptions, and is responsible for any nonces, keys and authentication.
+type Cipher interface {
+	Encrypt(plaintext []byte) []byte
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// Marshal is like the package level Marshal, using the options.
+func (opts MarshalOptions) Marshal(pb Message) ([]byte, error) {
+	buf := newBuffer(nil)
+	buf.parallelism = opts.Parallelism
+	buf.deterministic = opts.Deterministic
+	buf.cipher = opts.Cipher
+	buf.noElide = opts.NoElide
+	buf.sizeCache = opts.SizeCache
+	var err error
+	if _, ok := pb.(Marshaler); opts.RenameTags != nil && !ok {
+		// (a message which marshals itself has no fields to rename)
+		err = buf.marshalRemapped(pb, "Marshal", opts.renameTags)
+	} else {
+		err = buf.Marshal(pb)
+	}
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// MarshalReflect is like Marshal, but marshals the struct or pointer to struct held in v. This is handy when the
+// message was built at runtime using package reflect (with reflect.StructOf, for instance).
+func MarshalReflect(v reflect.Value) ([]byte, error) {
+	switch {
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		if v.IsNil() {
+			return nil, ErrNil
+		}
+		// v might have been obtained through unexported fields, in which case v.Interface() would panic
+		v = reflect.NewAt(v.Type().Elem(), unsafe.Pointer(v.Pointer()))
+	case v.Kind() == reflect.Struct:
+		if v.CanAddr() {
+			v = reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr()))
+		} else {
+			// make an addressable copy
+			c := reflect.New(v.Type())
+			c.Elem().Set(v)
+			v = c
+		}
+	case !v.IsValid():
+		return nil, ErrNil
+	default:
+		return nil, fmt.Errorf("protobuf3: can't MarshalReflect(%s): not a struct or *struct", v.Type())
+	}
+	return Marshal(v.Interface())
+}
+
+// MarshalDelimited is like Marshal, but prefixes the message with its length as a varint, so that a stream of messages
+// can be split apart again by UnmarshalDelimited.
+func MarshalDelimited(pb Message) ([]byte, error) {
+	buf := newBuffer(nil)
+	var err error
+	buf.enc_len_thing(func() { err = buf.Marshal(pb) })
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// MarshalRemapped is like Marshal, but renumbers the tags of the fields of the message according to remap.
+// Fields whose tags aren't in remap keep their tags. This lets a producer emit a message using the field numbers of
+// another version of the schema without declaring another Go type. Only the fields of pb itself are renumbered,
+// not the fields of any messages nested inside it. Types which marshal themselves can't be remapped.
+func MarshalRemapped(pb Message, remap map[uint32]uint32) ([]byte, error) {
+	buf := newBuffer(nil)
+	err := buf.marshalRemapped(pb, "MarshalRemapped", func(*StructProperties) map[uint32]uint32 { return remap })
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// marshalRemapped encodes pb with the tags of its fields renumbered according to the table which remap returns, given
+// the properties of pb's struct type. what names the caller in errors.
+func (o *Buffer) marshalRemapped(pb Message, what string, remap func(*StructProperties) map[uint32]uint32) error {
+	if _, ok := pb.(Marshaler); ok {
+		return fmt.Errorf("protobuf3: can't %s(%T): it marshals itself", what, pb)
+	}
+	if pb == nil {
+		return ErrNil
+	}
+	v := reflect.ValueOf(pb)
+	t := v.Type()
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf3: can't %s(%s): not a *struct type", what, t)
+	}
+	base := unsafe.Pointer(v.Pointer())
+	if base == nil {
+		return ErrNil
+	}
+
+	prop, err := GetProperties(t.Elem())
+	if err != nil {
+		return err
+	}
+	if table := remap(prop); len(table) != 0 {
+		prop, err = prop.remapped(t.Elem(), table)
+		if err != nil {
+			return err
+		}
+	}
+
+	o.enc_struct(prop, base)
+	return o.err
+}
+
+// MarshalDelta encodes only those fields of updated which differ from the same fields of base, producing a patch
+// which can be applied to a copy of base by Unmarshal (which merges into the existing message).
+// base and updated must be pointers to the same struct type. Fields are compared by their encoding, so a field which
+// has been cleared to its zero value in updated can't be represented in the patch (zero values aren't encoded) and
+// it retains its old value when the patch is applied. Likewise repeated and map fields which differ are emitted in
+// full, and Unmarshal appends them to the existing elements rather than replacing them. Callers which need those
+// semantics should clear such fields in the target before applying the patch.
+func MarshalDelta(base, updated Message) ([]byte, error) {
+	if _, ok := updated.(Marshaler); ok {
+		return nil, fmt.Errorf("protobuf3: can't MarshalDelta(%T): it marshals itself", updated)
+	}
+	if base == nil || updated == nil {
+		return nil, ErrNil
+	}
+	bv := reflect.ValueOf(base)
+	uv := reflect.ValueOf(updated)
+	t := uv.Type()
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf3: can't MarshalDelta(%s): not a *struct type", t)
+	}
+	if bv.Type() != t {
+		return nil, fmt.Errorf("protobuf3: can't MarshalDelta(%s, %s): the types differ", bv.Type(), t)
+	}
+	bbase := unsafe.Pointer(bv.Pointer())
+	ubase := unsafe.Pointer(uv.Pointer())
+	if bbase == nil || ubase == nil {
+		return nil, ErrNil
+	}
+
+	prop, err := GetProperties(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	if prop.checksum {
+		return nil, fmt.Errorf("protobuf3: can't MarshalDelta(%s): a patch can't carry the checksum of the whole message", t)
+	}
+
+	buf := newBuffer(nil)
+	scratch := newBuffer(nil)
+	// encode maps in sorted order, so equal maps encode the same
+	buf.deterministic = true
+	scratch.deterministic = true
+	for i := range prop.props {
+		p := &prop.props[i]
+		// encode the field of base into scratch, and the field of updated into buf, and drop the latter if they match
+		scratch.buf = scratch.buf[:0]
+		p.enc(scratch, p, bbase)
+		n := len(buf.buf)
+		p.enc(buf, p, ubase)
+		if bytes.Equal(buf.buf[n:], scratch.buf) {
+			buf.buf = buf.buf[:n]
+		}
+	}
+	err = buf.err
+	if err == nil {
+		err = scratch.err
+	}
+	scratch.release()
+	patch := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// MarshalVersioned is like Marshal, but prefixes the message with a single version byte, so the format of the
+// message can evolve. UnmarshalVersioned strips the version byte before decoding the message.
+func MarshalVersioned(pb Message, version byte) ([]byte, error) {
+	buf := newBuffer(nil)
+	buf.buf = append(buf.buf, version)
+	err := buf.Marshal(pb)
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// MarshalSelfDescribing is like Marshal, but prefixes the message with the SchemaHash of its type, encoded as a
+// little-endian fixed64. UnmarshalSelfDescribing checks the hash before decoding, so that a consumer whose idea of
+// the schema has drifted from the producer's gets an error rather than garbage.
+func MarshalSelfDescribing(pb Message) ([]byte, error) {
+	hash, err := SchemaHash(reflect.TypeOf(pb))
+	if err != nil {
+		return nil, err
+	}
+	buf := newBuffer(nil)
+	buf.EncodeFixed64(hash)
+	err = buf.Marshal(pb)
+	bytes := buf.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// scratch_pool holds Buffers used by MarshalToBuffer. Unlike buffer_pool, the Buffers retain their []byte, so
+// once the pool has warmed up marshaling into them does not allocate.
+var scratch_pool = sync.Pool{
+	New: func() interface{} { return NewBuffer(nil) },
+}
+
+// don't hold on to scratch buffers larger than this; an occasional huge message shouldn't pin memory forever
+const max_scratch_cap = 1 << 20
+
+// MarshalToBuffer encodes pb into dst and returns the number of bytes written.
+// If dst is too small io.ErrShortBuffer is returned and dst is not modified.
+// Once warmed up, MarshalToBuffer does not allocate unless pb contains types which allocate while marshaling
+// themselves (Marshalers and maps, for instance).
+func MarshalToBuffer(dst []byte, pb Message) (int, error) {
+	o := scratch_pool.Get().(*Buffer)
+	o.Reset()
+	err := o.Marshal(pb)
+	n := len(o.buf)
+	if err == nil {
+		if n <= len(dst) {
+			copy(dst, o.buf)
+		} else {
+			n, err = 0, io.ErrShortBuffer
+		}
+	} else {
+		n = 0
+	}
+	if cap(o.buf) <= max_scratch_cap {
+		scratch_pool.Put(o)
+	}
+	return n, err
+}
+
 // Marshal takes the protocol buffer
 // and encodes it into the wire format, writing the result to the
 // Buffer.
@@ -269,6 +788,7 @@ func (o *Buffer) Marshal(pb Message) error {
 	}
 
 	o.enc_struct(prop, base)
+	o.clearMsgSizes() // the addresses of the messages are only meaningful during this Marshal
 	return o.err
 }
 
@@ -501,6 +1021,12 @@ func (o *Buffer) enc_string(p *Properties, base unsafe.Pointer) {
 	o.EncodeStringBytes(x)
 }
 
+// Encode a string field with the "typeurl" attribute. The type URL of the enclosing struct is encoded, whatever the field holds
+func (o *Buffer) enc_typeurl(p *Properties, base unsafe.Pointer) {
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeStringBytes(p.typeURL)
+}
+
 // Encode an message struct field which implements the Marshaler interface
 func (o *Buffer) enc_marshaler(p *Properties, base unsafe.Pointer) {
 	ptr := (unsafe.Pointer(uintptr(base) + p.offset))
@@ -691,7 +1217,68 @@ func (o *Buffer) enc_slice_byte(p *Properties, base unsafe.Pointer) {
 	o.EncodeRawBytes(s)
 }
 
+// Encode a slice of bytes ([]byte) with the "base64" attribute, as a string holding the base64 encoding of the bytes.
+func (o *Buffer) enc_slice_byte_base64(p *Properties, base unsafe.Pointer) {
+	s := *(*[]byte)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return
+	}
+	n := base64.StdEncoding.EncodedLen(len(s))
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeVarint(uint64(n))
+	i := len(o.buf)
+	o.buf = append(o.buf, make([]byte, n)...)
+	base64.StdEncoding.Encode(o.buf[i:], s)
+}
+
+// Encode the contents of a *bytes.Buffer. An empty or nil Buffer is elided, like an empty []byte.
+func (o *Buffer) enc_ptr_bytes_Buffer(p *Properties, base unsafe.Pointer) {
+	b := *(**bytes.Buffer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if b == nil || b.Len() == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeRawBytes(b.Bytes())
+}
+
+// Encode a standard library type which encodes as a message (see stdMessageTypes)
+func (o *Buffer) enc_std_message(p *Properties, base unsafe.Pointer) {
+	ptr := unsafe.Pointer(uintptr(base) + p.offset)
+
+	iTag := len(o.buf)
+	o.buf = append(o.buf, p.tagcode...)
+	iLen := len(o.buf)
+	o.enc_std_message_body(p, ptr)
+
+	// like any message, one which encoded to nothing (the zero value) is skipped entirely
+	if len(o.buf) == iLen+1 && o.buf[iLen] == 0 {
+		o.buf = o.buf[:iTag]
+	}
+}
+
+// Encode a pointer to a standard library type which encodes as a message
+func (o *Buffer) enc_ptr_std_message(p *Properties, base unsafe.Pointer) {
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if ptr == nil {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_std_message_body(p, ptr)
+}
+
+// enc_std_message_body encodes the value at ptr, preceded by its length
+func (o *Buffer) enc_std_message_body(p *Properties, ptr unsafe.Pointer) {
+	enc := stdMessageTypes[p.stype].enc
+	o.enc_len_thing(func() {
+		if err := enc(&o.WriteBuffer, ptr); err != nil {
+			o.noteError(fmt.Errorf("protobuf3: %s field %s: %v", p.stype, p.Name, err))
+		}
+	})
+}
+
 // Encode an array of bytes ([n]byte).
+// Note that unlike a []byte, an all-zero array is not elided. The protobuf default value of a bytes field is
+// the empty string of bytes, and an array of n zero bytes is not that. So n zero bytes are sent on the wire.
 func (o *Buffer) enc_array_byte(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen]byte)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
@@ -699,6 +1286,14 @@ func (o *Buffer) enc_array_byte(p *Properties, base unsafe.Pointer) {
 	o.EncodeRawBytes(s)
 }
 
+// Encode the tag of packed field p followed by the length-prefixed body written by enc. The body is encoded directly
+// into o.buf rather than into a scratch buffer. The space reserved for the length assumes each of the n elements
+// encodes in one byte, as small varints do, and the body is shifted over only when that guess is too small.
+func (o *Buffer) enc_packed(p *Properties, n int, enc func()) {
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_len_reserved(SizeVarint(uint64(n)), enc)
+}
+
 // Encode a slice of int ([]int) in packed format.
 func (o *Buffer) enc_slice_packed_int(p *Properties, base unsafe.Pointer) {
 	s := *(*[]int)(unsafe.Pointer(uintptr(base) + p.offset))
@@ -706,15 +1301,11 @@ func (o *Buffer) enc_slice_packed_int(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of uint ([]uint) in packed format.
@@ -724,15 +1315,11 @@ func (o *Buffer) enc_slice_packed_uint(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of int8s ([]int8) in packed format.
@@ -742,15 +1329,11 @@ func (o *Buffer) enc_slice_packed_int8(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of int16s ([]int16) in packed format.
@@ -760,15 +1343,11 @@ func (o *Buffer) enc_slice_packed_int16(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode an array of int8s ([length]int8) in packed format.
@@ -776,15 +1355,11 @@ func (o *Buffer) enc_array_packed_int8(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen]int8)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode an array of int16s ([length]int16) in packed format.
@@ -792,15 +1367,11 @@ func (o *Buffer) enc_array_packed_int16(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen / 2]int16)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of uint16s ([]uint16) in packed format.
@@ -810,15 +1381,11 @@ func (o *Buffer) enc_slice_packed_uint16(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode an array of uint16s ([length]uint16) in packed format.
@@ -826,15 +1393,11 @@ func (o *Buffer) enc_array_packed_uint16(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen / 2]uint16)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of int32s ([]int32) in packed format.
@@ -844,15 +1407,11 @@ func (o *Buffer) enc_slice_packed_int32(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode an array of int32s ([length]int32) in packed format.
@@ -860,15 +1419,11 @@ func (o *Buffer) enc_array_packed_int32(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen / 4]int32)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of uint32s ([]uint32) in packed format.
@@ -879,15 +1434,11 @@ func (o *Buffer) enc_slice_packed_uint32(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode an array of uint32s ([length]uint32) in packed format.
@@ -895,15 +1446,11 @@ func (o *Buffer) enc_array_packed_uint32(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen / 4]uint32)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, uint64(x))
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, uint64(x))
+		}
+	})
 }
 
 // Encode a slice of int64s or uint64s ([](u)int64) in packed format.
@@ -913,15 +1460,11 @@ func (o *Buffer) enc_slice_packed_int64(p *Properties, base unsafe.Pointer) {
 	if l == 0 {
 		return
 	}
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, x)
-	}
-
-	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.enc_packed(p, l, func() {
+		for _, x := range s {
+			p.valEnc(o, x)
+		}
+	})
 }
 
 // Encode an array of int64s ([n]int64) in packed format.
@@ -929,15 +1472,62 @@ func (o *Buffer) enc_array_packed_int64(p *Properties, base unsafe.Pointer) {
 	n := p.length
 	s := ((*[maxLen / 8]uint64)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]
 
-	buf := newBuffer(nil)
-	for _, x := range s {
-		p.valEnc(buf, x)
+	o.enc_packed(p, len(s), func() {
+		for _, x := range s {
+			p.valEnc(o, x)
+		}
+	})
+}
+
+// host_little_endian is true when the machine stores integers in little-endian byte order, which is the byte order of
+// protobuf's fixed32 and fixed64 encodings
+var host_little_endian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// Encode a slice of 4-byte values ([](u)int32 or []float32) as packed fixed32s.
+// Only used on little-endian machines, where the packed encoding is identical to the bytes of the slice in memory.
+func (o *Buffer) enc_slice_packed_fixed32(p *Properties, base unsafe.Pointer) {
+	s := *(*[]uint32)(unsafe.Pointer(uintptr(base) + p.offset))
+	n := 4 * len(s)
+	if n == 0 {
+		return
 	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeVarint(uint64(n))
+	o.buf = append(o.buf, ((*[maxLen]byte)(unsafe.Pointer(&s[0])))[0:n:n]...)
+}
 
+// Encode an array of 4-byte values ([n](u)int32 or [n]float32) as packed fixed32s.
+// Only used on little-endian machines, like enc_slice_packed_fixed32.
+func (o *Buffer) enc_array_packed_fixed32(p *Properties, base unsafe.Pointer) {
+	n := 4 * p.length
 	o.buf = append(o.buf, p.tagcode...)
-	o.EncodeVarint(uint64(len(buf.buf)))
-	o.buf = append(o.buf, buf.buf...)
-	buf.release()
+	o.EncodeVarint(uint64(n))
+	o.buf = append(o.buf, ((*[maxLen]byte)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]...)
+}
+
+// Encode a slice of 8-byte values ([](u)int64 or []float64) as packed fixed64s.
+// Only used on little-endian machines, like enc_slice_packed_fixed32.
+func (o *Buffer) enc_slice_packed_fixed64(p *Properties, base unsafe.Pointer) {
+	s := *(*[]uint64)(unsafe.Pointer(uintptr(base) + p.offset))
+	n := 8 * len(s)
+	if n == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeVarint(uint64(n))
+	o.buf = append(o.buf, ((*[maxLen]byte)(unsafe.Pointer(&s[0])))[0:n:n]...)
+}
+
+// Encode an array of 8-byte values ([n](u)int64 or [n]float64) as packed fixed64s.
+// Only used on little-endian machines, like enc_slice_packed_fixed32.
+func (o *Buffer) enc_array_packed_fixed64(p *Properties, base unsafe.Pointer) {
+	n := 8 * p.length
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeVarint(uint64(n))
+	o.buf = append(o.buf, ((*[maxLen]byte)(unsafe.Pointer(uintptr(base) + p.offset)))[0:n:n]...)
 }
 
 // Encode a slice of slice of bytes ([][]byte).
@@ -1011,6 +1601,11 @@ func (o *Buffer) enc_slice_ptr_struct_message(p *Properties, base unsafe.Pointer
 		return
 	}
 
+	if o.parallelism > 1 && len(s) >= min_parallel_elements {
+		o.enc_parallel_struct_messages(p, len(s), func(i int) unsafe.Pointer { return s[i] })
+		return
+	}
+
 	for _, structp := range s {
 		if structp == nil {
 			o.noteError(errRepeatedHasNil)
@@ -1023,6 +1618,59 @@ func (o *Buffer) enc_slice_ptr_struct_message(p *Properties, base unsafe.Pointer
 	}
 }
 
+// the minimum # of elements in a repeated message field before it is worth encoding them in parallel
+const min_parallel_elements = 1024
+
+// enc_parallel_struct_messages encodes n repeated messages, the i'th of which is at elem(i), using up to o.parallelism goroutines.
+// Each goroutine encodes a contiguous chunk of the elements into its own buffer, and the buffers are concatenated in order,
+// so the result is identical to encoding the elements serially.
+func (o *Buffer) enc_parallel_struct_messages(p *Properties, n int, elem func(i int) unsafe.Pointer) {
+	workers := o.parallelism
+	if workers > n {
+		workers = n
+	}
+	chunk := (n + workers - 1) / workers
+
+	bufs := make([]*Buffer, 0, workers)
+	var wg sync.WaitGroup
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		b := newBuffer(nil) // note b.parallelism is 0, so any nested repeated messages are encoded serially
+		b.deterministic = o.deterministic
+		b.cipher = o.cipher
+		b.noElide = o.noElide
+		b.sizeCache = o.sizeCache
+		bufs = append(bufs, b)
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				structp := elem(i)
+				if structp == nil {
+					b.noteError(errRepeatedHasNil)
+					return
+				}
+				b.buf = append(b.buf, p.tagcode...)
+				b.enc_len_struct(p.sprop, structp)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	for _, b := range bufs {
+		if b.err != nil {
+			o.noteError(b.err)
+		}
+		if o.err == nil {
+			o.buf = append(o.buf, b.buf...)
+		}
+		b.release()
+	}
+}
+
 // Encode an array of *message structs ([n]*struct).
 func (o *Buffer) enc_array_ptr_struct_message(p *Properties, base unsafe.Pointer) {
 	n := p.length
@@ -1190,6 +1838,11 @@ func enc_struct_messages(o *Buffer, p *Properties, base unsafe.Pointer, n uint)
 		return
 	}
 
+	if o.parallelism > 1 && n >= min_parallel_elements {
+		o.enc_parallel_struct_messages(p, int(n), func(i int) unsafe.Pointer { return unsafe.Pointer(uintptr(base) + uintptr(i)*sz) })
+		return
+	}
+
 	for i := uintptr(0); i < nb; i += sz {
 		structp := unsafe.Pointer(uintptr(base) + i)
 
@@ -1229,8 +1882,12 @@ func (o *Buffer) enc_new_map(p *Properties, base unsafe.Pointer) {
 		p.mvalprop.enc(o, p.mvalprop, valbase)
 	}
 
-	// Don't sort map keys. It is not required by the spec, and C++ doesn't do it.
-	for _, key := range v.MapKeys() {
+	// Don't sort map keys unless asked to. It is not required by the spec, and C++ doesn't do it.
+	keys := v.MapKeys()
+	if p.mapOrder == "sorted" || (p.mapOrder == "" && o.deterministic) {
+		sortMapKeys(keys)
+	}
+	for _, key := range keys {
 		val := v.MapIndex(key)
 
 		keycopy.Set(key)
@@ -1241,6 +1898,173 @@ func (o *Buffer) enc_new_map(p *Properties, base unsafe.Pointer) {
 	}
 }
 
+// sortMapKeys sorts keys, which are the keys of a map with a key type which is legal in protobuf (integers, bool or string).
+// Sorting a sort.Interface, rather than using sort.Slice, saves allocating a swapper and a closure on every call.
+func sortMapKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+	switch keys[0].Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sort.Sort(intMapKeys(keys))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		sort.Sort(uintMapKeys(keys))
+	case reflect.Bool:
+		sort.Sort(boolMapKeys(keys))
+	case reflect.String:
+		sort.Sort(stringMapKeys(keys))
+	default:
+		// not a legal protobuf map key type; leave the keys unsorted
+	}
+}
+
+// the map keys of each kind, sortable
+type intMapKeys []reflect.Value
+type uintMapKeys []reflect.Value
+type boolMapKeys []reflect.Value
+type stringMapKeys []reflect.Value
+
+func (k intMapKeys) Len() int              { return len(k) }
+func (k intMapKeys) Swap(i, j int)         { k[i], k[j] = k[j], k[i] }
+func (k intMapKeys) Less(i, j int) bool    { return k[i].Int() < k[j].Int() }
+func (k uintMapKeys) Len() int             { return len(k) }
+func (k uintMapKeys) Swap(i, j int)        { k[i], k[j] = k[j], k[i] }
+func (k uintMapKeys) Less(i, j int) bool   { return k[i].Uint() < k[j].Uint() }
+func (k boolMapKeys) Len() int             { return len(k) }
+func (k boolMapKeys) Swap(i, j int)        { k[i], k[j] = k[j], k[i] }
+func (k boolMapKeys) Less(i, j int) bool   { return !k[i].Bool() && k[j].Bool() }
+func (k stringMapKeys) Len() int           { return len(k) }
+func (k stringMapKeys) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k stringMapKeys) Less(i, j int) bool { return k[i].String() < k[j].String() }
+
+// MarshalSyncMap encodes the contents of a sync.Map as if it were a protobuf map field with id tag. Since a sync.Map
+// holds interface{} keys and values the caller must supply the Go types of the keys and values. The wiretypes of
+// the key and value are the natural ones for those types (varint for integers, fixed64 for float64, bytes for
+// strings and messages and so on). A key or value of some other type causes an error.
+// sync.Map.Range() doesn't take a snapshot of the map, so should the map be modified concurrently the result contains
+// some of the changes. It is always a valid encoding, since Range() visits each key at most once.
+func MarshalSyncMap(m *sync.Map, tag uint32, keyType, valType reflect.Type) ([]byte, error) {
+	keyprop, valprop, err := mapEntryProperties(keyType, valType)
+	if err != nil {
+		return nil, err
+	}
+
+	o := newBuffer(nil)
+
+	keycopy, valcopy, keybase, valbase := mapEncodeScratch(reflect.MapOf(keyType, valType))
+	enc := func() {
+		keyprop.enc(o, keyprop, keybase)
+		valprop.enc(o, valprop, valbase)
+	}
+
+	m.Range(func(k, v interface{}) bool {
+		key, val := reflect.ValueOf(k), reflect.ValueOf(v)
+		if !key.IsValid() || key.Type() != keyType {
+			err = fmt.Errorf("protobuf3: MarshalSyncMap: key %v is a %T, not a %s", k, k, keyType)
+			return false
+		}
+		if !val.IsValid() {
+			// a nil interface{} value. treat it as the zero value of valType
+			val = reflect.Zero(valType)
+		} else if val.Type() != valType {
+			err = fmt.Errorf("protobuf3: MarshalSyncMap: value of key %v is a %T, not a %s", k, v, valType)
+			return false
+		}
+
+		keycopy.Set(key)
+		valcopy.Set(val)
+
+		o.EncodeVarint(uint64(tag)<<3 | uint64(WireBytes))
+		o.enc_len_thing(enc)
+		return true
+	})
+
+	if err == nil {
+		err = o.err
+	}
+	bytes := o.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// MarshalList encodes the elements of l, which must all be of type elemType, as the repeated field with id tag. The wiretype
+// is the natural one for elemType, as with MarshalSyncMap. Encoding the list directly avoids copying it into a slice first.
+// Repeated scalars are encoded as a single packed run, the same as a slice would be.
+// An empty list encodes as nothing.
+func MarshalList(l *list.List, tag uint32, elemType reflect.Type) ([]byte, error) {
+	if l.Len() == 0 {
+		return nil, nil
+	}
+
+	prop, err := repeatedElemProperties(elemType, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	// an addressable [1]T in which to place each element for the encoder
+	scratch := reflect.New(reflect.ArrayOf(1, elemType)).Elem()
+	elem := scratch.Index(0)
+	base := unsafe.Pointer(scratch.UnsafeAddr())
+
+	// check the types of the elements first, so the encoders don't have to stop part way through
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value != nil && reflect.TypeOf(e.Value) != elemType {
+			return nil, fmt.Errorf("protobuf3: MarshalList: element %v is a %T, not a %s", e.Value, e.Value, elemType)
+		}
+	}
+	value := func(e *list.Element) reflect.Value {
+		if e.Value == nil {
+			// a nil interface{}. treat it as the zero value of elemType
+			return reflect.Zero(elemType)
+		}
+		return reflect.ValueOf(e.Value)
+	}
+
+	o := newBuffer(nil)
+	if prop.valEnc != nil {
+		// scalars, which are packed into one run like enc_slice_packed_* does
+		o.enc_packed(prop, l.Len(), func() {
+			for e := l.Front(); e != nil; e = e.Next() {
+				prop.valEnc(o, scalarBits(value(e)))
+			}
+		})
+	} else {
+		for e := l.Front(); e != nil; e = e.Next() {
+			elem.Set(value(e))
+			prop.enc(o, prop, base)
+		}
+	}
+
+	err = o.err
+	bytes := o.release()
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// scalarBits returns the bool or numeric value v as the uint64 a valueEncoder expects, the same way the
+// enc_slice_packed_* encoders convert the elements of their slices
+func scalarBits(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	case reflect.Float32:
+		return uint64(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		return math.Float64bits(v.Float())
+	default:
+		return v.Uint()
+	}
+}
+
 // mapEncodeScratch returns a new reflect.Value matching the map's value type,
 // and a unsafe.Pointer suitable for passing to an encoder or sizer.
 func mapEncodeScratch(mapType reflect.Type) (keycopy, valcopy reflect.Value, keybase, valbase unsafe.Pointer) {
@@ -1263,23 +2087,149 @@ func (o *Buffer) enc_struct(prop *StructProperties, base unsafe.Pointer) {
 	// Encode fields in tag order so that decoders may use optimizations
 	// that depend on the ordering.
 	// https://developers.google.com/protocol-buffers/docs/encoding#order
-	for i := range prop.props {
-		p := &prop.props[i]
-		p.enc(o, p, base)
+	start := len(o.buf)
+	if prop.maskSize != 0 || len(prop.oneofs) != 0 {
+		// the slow path, which keeps track of which fields were encoded
+		prop.clearPresenceMask(base)
+		var set []*Properties // the field of each oneof group which was encoded
+		if len(prop.oneofs) != 0 {
+			set = make([]*Properties, len(prop.oneofs))
+		}
+		for i := range prop.props {
+			p := &prop.props[i]
+			n := len(o.buf)
+			p.enc(o, p, base)
+			if len(o.buf) == n && o.noElide {
+				p.encZero(o)
+			}
+			if len(o.buf) != n {
+				prop.setPresenceBit(base, i)
+				if p.oneofGroup != 0 {
+					if q := set[p.oneofGroup-1]; q != nil {
+						o.noteError(fmt.Errorf("protobuf3: fields %s and %s of oneof %s are both set", q.Name, p.Name, p.oneof))
+					}
+					set[p.oneofGroup-1] = p
+				}
+			}
+		}
+	} else if o.noElide {
+		for i := range prop.props {
+			p := &prop.props[i]
+			n := len(o.buf)
+			p.enc(o, p, base)
+			if len(o.buf) == n {
+				p.encZero(o)
+			}
+		}
+	} else {
+		for i := range prop.props {
+			p := &prop.props[i]
+			p.enc(o, p, base)
+		}
+	}
+	if prop.unknown {
+		// the unknown fields follow the known ones (but precede the checksum, so it covers them too)
+		o.buf = append(o.buf, *prop.unknownFields(base)...)
+	}
+	if prop.checksum {
+		// the checksum field is always the last field, and is always encoded, even if it happens to be 0
+		p := &prop.props[len(prop.props)-1]
+		crc := crc32.ChecksumIEEE(o.buf[start:])
+		o.buf = append(o.buf, p.tagcode...)
+		o.EncodeFixed32(uint64(crc))
+		prop.setPresenceBit(base, len(prop.props)-1)
+	}
+}
+
+// encZero encodes the zero value of a field whose encoder elided it, for MarshalOptions.NoElide
+func (p *Properties) encZero(o *Buffer) {
+	if p.isChecksum || p.oneof != "" || p.eprop != nil || p.mtype != nil || p.itype != nil || p.fprop != nil || p.isFlatMap || p.isRecord {
+		// there is no zero value to encode, or it can't be encoded without side effects (or, for a oneof, without setting the oneof)
+		return
+	}
+	if _, typ := splitInline(p.asProtobuf); strings.HasPrefix(typ, "repeated ") && p.valEnc == nil {
+		// an unpacked repeated field has no encoding for an empty list
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	if p.WireType == WireBytes {
+		o.buf = append(o.buf, 0) // an empty string, bytes, packed list or message
+	} else {
+		p.valEnc(o, 0)
 	}
 }
 
 var zeroes [20]byte // longer than any conceivable SizeVarint
 
 // Encode a struct, preceded by its encoded length (as a varint).
+// The length of the previous message of the same type is remembered, and used to reserve space for the length. The hint
+// is per type rather than per message (see typeSizeHint). When the messages are all about the same size (as the elements
+// of a repeated field often are) this guess is right, and the message doesn't have to be moved once its actual length is known.
+// With SetSizeCache the length is computed instead of guessed (see enc_len_struct_sized).
 func (o *Buffer) enc_len_struct(prop *StructProperties, base unsafe.Pointer) {
-	o.enc_len_thing(func() { o.enc_struct(prop, base) })
+	if o.sizeCache && o.sizing == 0 {
+		// (a field which can only be sized by encoding it, and which contains messages, is encoded during the
+		// pre-pass, and its messages are encoded the usual way so that they don't disturb o.msgSizes)
+		o.enc_len_struct_sized(prop, base)
+		return
+	}
+
+	// o.sizes is a tiny cache of the last few types, so that nested messages of different types don't evict each other
+	key := uintptr(unsafe.Pointer(prop))
+	var h *typeSizeHint
+	reserve := 4
+	for i := range o.sizes {
+		if o.sizes[i].prop == key {
+			h = &o.sizes[i]
+			reserve = SizeVarint(uint64(h.n))
+			break
+		}
+	}
+	if h == nil {
+		// evict the oldest entry (the entries are replaced round-robin)
+		h = &o.sizes[o.sizes_next%uint(len(o.sizes))]
+		o.sizes_next++
+	}
+	n := o.enc_len_reserved(reserve, func() { o.enc_struct(prop, base) })
+	h.prop, h.n = key, n
+}
+
+// Encode a struct, preceded by its encoded length (as a varint), having first computed the length, so that exactly the
+// right amount of space is reserved for it and the message doesn't have to be moved. Sizing a message sizes the messages
+// nested within it too, and their lengths are recorded in o.msgSizes in the order they will be encoded, so that they
+// aren't sized again when they in turn are encoded. Each length is checked against the address and type of the message
+// it is used for. If they don't match (because a map was iterated in a different order, for example) the message is
+// sized again, and should its encoding still not match its size, enc_len_reserved moves it as usual.
+func (o *Buffer) enc_len_struct_sized(prop *StructProperties, base unsafe.Pointer) {
+	i := o.msgSizesNext
+	for i < len(o.msgSizes) && o.msgSizes[i].n == 0 && (o.msgSizes[i].base != base || o.msgSizes[i].prop != prop) {
+		i++ // skip an empty message which was elided rather than encoded
+	}
+	var n int
+	if i < len(o.msgSizes) && o.msgSizes[i].base == base && o.msgSizes[i].prop == prop {
+		n = o.msgSizes[i].n
+		o.msgSizesNext = i + 1
+	} else {
+		// size the message and everything within it
+		o.clearMsgSizes()
+		o.sizing++
+		n = o.size_struct(prop, base)
+		o.sizing--
+		o.msgSizesNext = 1 // skip the message's own entry
+	}
+	o.enc_len_reserved(SizeVarint(uint64(n)), func() { o.enc_struct(prop, base) })
 }
 
 // Encode something, preceded by its encoded length (as a varint).
 func (o *Buffer) enc_len_thing(enc func()) {
+	o.enc_len_reserved(4, enc)
+}
+
+// Encode something, preceded by its encoded length (as a varint), having first reserved the given number of bytes
+// for the length. Returns the length of the thing.
+func (o *Buffer) enc_len_reserved(reserve int, enc func()) int {
 	iLen := len(o.buf)
-	o.buf = append(o.buf, 0, 0, 0, 0) // reserve four bytes for length
+	o.buf = append(o.buf, zeroes[:reserve]...)
 	iMsg := len(o.buf)
 	enc()
 	lMsg := len(o.buf) - iMsg
@@ -1298,18 +2248,284 @@ func (o *Buffer) enc_len_thing(enc func()) {
 	o.buf = o.buf[:iLen]
 	o.EncodeVarint(uint64(lMsg))
 	o.buf = o.buf[:len(o.buf)+lMsg]
+	return lMsg
 }
 
 // dummy no-op encoder used for encoding 0-length array types
 func (o *Buffer) enc_nothing(p *Properties, base unsafe.Pointer) {
 }
 
+// Encode a pointer to an array (*[n]T) like the array itself. A nil pointer encodes nothing
+func (o *Buffer) enc_ptr_array(p *Properties, base unsafe.Pointer) {
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if ptr == nil {
+		return
+	}
+	p.aprop.enc(o, p.aprop, ptr)
+}
+
+// Encode a map[string]string with the "flatmap" attribute, as a repeated string of alternating keys and values.
+// Like other maps, the keys are sorted only if asked to.
+func (o *Buffer) enc_flatmap(p *Properties, base unsafe.Pointer) {
+	v := reflect.NewAt(p.mtype, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	if p.mapOrder == "sorted" || (p.mapOrder == "" && o.deterministic) {
+		keys := v.MapKeys()
+		sortMapKeys(keys)
+		for _, key := range keys {
+			o.enc_flatmap_entry(p, key.String(), v.MapIndex(key).String())
+		}
+		return
+	}
+	for it := v.MapRange(); it.Next(); {
+		o.enc_flatmap_entry(p, it.Key().String(), it.Value().String())
+	}
+}
+
+// Encode one key and value of a flatmap
+func (o *Buffer) enc_flatmap_entry(p *Properties, key, val string) {
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeStringBytes(key)
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeStringBytes(val)
+}
+
+// Encode a slice of structs with the "record" attribute, as one bytes field holding the fields of each element
+// in little-endian byte order, one after the other.
+func (o *Buffer) enc_slice_record(p *Properties, base unsafe.Pointer) {
+	v := reflect.NewAt(reflect.SliceOf(p.rtype), unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	n := v.Len()
+	if n == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeVarint(uint64(uintptr(n) * p.rsize))
+	data := unsafe.Pointer(v.Pointer())
+	esize := p.rtype.Size()
+	for i := 0; i < n; i++ {
+		for _, f := range p.rfields {
+			b := ((*[8]byte)(unsafe.Pointer(uintptr(data) + uintptr(i)*esize + f.offset)))[:f.size:f.size]
+			if host_little_endian {
+				o.buf = append(o.buf, b...)
+			} else {
+				for j := len(b) - 1; j >= 0; j-- {
+					o.buf = append(o.buf, b[j])
+				}
+			}
+		}
+	}
+}
+
+// encoder for func() T fields, which calls the function and encodes the value it returns. A nil function encodes nothing
+func (o *Buffer) enc_func(p *Properties, base unsafe.Pointer) {
+	fn := reflect.NewAt(p.ftype, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	if fn.IsNil() {
+		return
+	}
+	v := reflect.New(p.ftype.Out(0))
+	v.Elem().Set(fn.Call(nil)[0])
+	p.fprop.enc(o, p.fprop, unsafe.Pointer(v.Pointer()))
+}
+
+// Encode an interface field holding a message, as a submessage of the message's dynamic type.
+// A nil interface, or an interface holding a nil pointer, is elided.
+func (o *Buffer) enc_interface_message(p *Properties, base unsafe.Pointer) {
+	v := reflect.NewAt(p.itype, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	if v.IsNil() || (v.Elem().Kind() == reflect.Ptr && v.Elem().IsNil()) {
+		return
+	}
+
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_len_thing(func() {
+		err := o.Marshal(v.Interface())
+		if err != nil {
+			o.noteError(err)
+		}
+	})
+}
+
+// Encode a slice of interfaces ([]interface{}). Each element is encoded as a google.protobuf.Any holding the type URL
+// registered with RegisterProtoName for the element's dynamic type, and the element's encoding. Nil elements are an error.
+func (o *Buffer) enc_slice_interface_any(p *Properties, base unsafe.Pointer) {
+	s := reflect.NewAt(reflect.SliceOf(p.itype), unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	for i := 0; i < s.Len(); i++ {
+		e := s.Index(i)
+		if e.IsNil() || (e.Elem().Kind() == reflect.Ptr && e.Elem().IsNil()) {
+			o.noteError(errRepeatedHasNil)
+			return
+		}
+		m := e.Elem()
+		if m.Kind() != reflect.Ptr {
+			// Marshal needs a pointer to the message
+			v := reflect.New(m.Type())
+			v.Elem().Set(m)
+			m = v
+		}
+		url := TypeURL(m.Type().Elem())
+		if url == "" {
+			o.noteError(fmt.Errorf("protobuf3: element %d of %s is a %s, whose protobuf name hasn't been registered with RegisterProtoName", i, p.Name, m.Type().Elem()))
+			return
+		}
+
+		o.buf = append(o.buf, p.tagcode...)
+		o.enc_len_thing(func() {
+			o.EncodeVarint(1<<3 | uint64(WireBytes))
+			o.EncodeStringBytes(url)
+			start := len(o.buf)
+			o.EncodeVarint(2<<3 | uint64(WireBytes))
+			n := o.enc_len_reserved(1, func() {
+				err := o.Marshal(m.Interface())
+				if err != nil {
+					o.noteError(err)
+				}
+			})
+			if n == 0 {
+				// elide the empty value, like any empty bytes field
+				o.buf = o.buf[:start]
+			}
+		})
+	}
+}
+
+// Encode an encrypted field. The field is encoded as usual, and then the encoding (including its tag) is encrypted,
+// and the ciphertext encoded as a bytes field. Like any field, a zero value encodes to nothing.
+func (o *Buffer) enc_encrypted(p *Properties, base unsafe.Pointer) {
+	start := len(o.buf)
+	p.eprop.enc(o, p.eprop, base)
+	if len(o.buf) == start {
+		return
+	}
+	if o.cipher == nil {
+		o.buf = o.buf[:start]
+		o.noteError(fmt.Errorf("protobuf3: field %s is encrypted, but there is no MarshalOptions.Cipher", p.Name))
+		return
+	}
+	// copy the plaintext out of o.buf, since the Cipher might encrypt in place, or return a slice of its argument
+	plaintext := append([]byte(nil), o.buf[start:]...)
+	o.buf = o.buf[:start]
+	ciphertext := o.cipher.Encrypt(plaintext)
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeRawBytes(ciphertext)
+}
+
+// Encode a repeated field with the "sorted" attribute. A sorted copy of the field is encoded, so the message is unchanged.
+// Scalars are ordered by value, and messages by their encodings.
+func (o *Buffer) enc_sorted(p *Properties, base unsafe.Pointer) {
+	v := reflect.NewAt(p.otype, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	n := v.Len()
+	if n < 2 {
+		p.oprop.enc(o, p.oprop, unsafe.Pointer(v.UnsafeAddr()))
+		return
+	}
+
+	var less func(a, b reflect.Value) bool
+	switch p.otype.Elem().Kind() {
+	case reflect.Bool:
+		less = func(a, b reflect.Value) bool { return !a.Bool() && b.Bool() }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less = func(a, b reflect.Value) bool { return a.Int() < b.Int() }
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		less = func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(a, b reflect.Value) bool { return a.Float() < b.Float() }
+	case reflect.String:
+		less = func(a, b reflect.Value) bool { return a.String() < b.String() }
+	case reflect.Slice:
+		less = func(a, b reflect.Value) bool { return bytes.Compare(a.Bytes(), b.Bytes()) < 0 }
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	if less != nil {
+		sort.SliceStable(order, func(i, j int) bool { return less(v.Index(order[i]), v.Index(order[j])) })
+	} else {
+		// messages are ordered by their encodings
+		b := newBuffer(nil)
+		b.deterministic = true // so equal messages have equal keys, whatever the order of their map entries
+		b.noElide = o.noElide
+		b.cipher = o.cipher
+		ends := make([]int, n)
+		for i := 0; i < n; i++ {
+			e := v.Index(i)
+			if e.Kind() == reflect.Ptr {
+				if e.IsNil() {
+					b.noteError(errRepeatedHasNil)
+					break
+				}
+				b.enc_struct(p.sprop, unsafe.Pointer(e.Pointer()))
+			} else {
+				b.enc_struct(p.sprop, unsafe.Pointer(e.UnsafeAddr()))
+			}
+			ends[i] = len(b.buf)
+		}
+		if b.err != nil {
+			o.noteError(b.err)
+			b.release()
+			return
+		}
+		key := func(i int) []byte {
+			if i == 0 {
+				return b.buf[:ends[0]]
+			}
+			return b.buf[ends[i-1]:ends[i]]
+		}
+		sort.SliceStable(order, func(i, j int) bool { return bytes.Compare(key(order[i]), key(order[j])) < 0 })
+		b.release()
+	}
+
+	o.enc_permuted(p, v, order)
+}
+
+// Encode a copy of the repeated field v, whose elements are rearranged so that the i'th element is v[order[i]]
+func (o *Buffer) enc_permuted(p *Properties, v reflect.Value, order []int) {
+	n := len(order)
+	c := reflect.New(p.otype).Elem()
+	if p.otype.Kind() == reflect.Slice {
+		c.Set(reflect.MakeSlice(p.otype, n, n))
+	}
+	for i, j := range order {
+		c.Index(i).Set(v.Index(j))
+	}
+	p.oprop.enc(o, p.oprop, unsafe.Pointer(c.UnsafeAddr()))
+}
+
+// Encode a repeated field with the "heapsorted" attribute, whose type implements heap.Interface, in the order in which
+// the elements would be popped from the heap. Popping the elements from a copy of the heap would call its Swap and Pop
+// methods, which commonly update the elements (the index of each item, in the container/heap example), so instead the
+// elements are sorted using the heap's Less method, which has the same result and leaves the message unchanged.
+func (o *Buffer) enc_heapsorted(p *Properties, base unsafe.Pointer) {
+	ptr := reflect.NewAt(p.otype, unsafe.Pointer(uintptr(base)+p.offset))
+	v := ptr.Elem()
+	n := v.Len()
+	if n < 2 {
+		p.oprop.enc(o, p.oprop, unsafe.Pointer(v.UnsafeAddr()))
+		return
+	}
+
+	h := ptr.Interface().(heap.Interface)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return h.Less(order[i], order[j]) })
+	o.enc_permuted(p, v, order)
+}
+
 // custom encoder for time.Time, encoding it into the protobuf3 standard Timestamp
 func (o *WriteBuffer) enc_time_Time(p *Properties, base unsafe.Pointer) {
 	ts := *(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
 	o.EncodeTimestamp(ts)
 }
 
+// custom encoder for time.Time with the "trunc=" attribute, encoding it into the protobuf3 standard Timestamp after
+// truncating it. Like any time.Time, the zero value is encoded as well (it isn't the zero Timestamp)
+func (o *Buffer) enc_time_Time_trunc(p *Properties, base unsafe.Pointer) {
+	ts := (*(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))).Truncate(p.trunc)
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_len_thing(func() { o.EncodeTimestamp(ts) })
+}
+
 // EncodeTimestamp marshals a time.Time as a google.protobuf.Timestamp, which is a pair of varints (secs,nanos) tagged 1 and 2
 func (o *WriteBuffer) EncodeTimestamp(ts time.Time) {
 	// protobuf Timestamp uses its own encoding, different from time.Time
@@ -1336,6 +2552,108 @@ func (o *WriteBuffer) EncodeNSecTimestamp(ts int64) {
 	o.EncodeVarint(uint64(nanos))
 }
 
+// custom encoder for time.Time, encoding it as an RFC 3339 string (with nanoseconds, and the time zone offset of the time.Time)
+func (o *Buffer) enc_time_RFC3339(p *Properties, base unsafe.Pointer) {
+	t := (*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	if t.IsZero() {
+		return // like any string, the zero value isn't encoded
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.EncodeStringBytes(t.Format(time.RFC3339Nano))
+}
+
+// the range of times whose UnixNano() fits in an int64
+var (
+	minNanosTime = time.Unix(0, math.MinInt64)
+	maxNanosTime = time.Unix(0, math.MaxInt64)
+)
+
+// custom encoder for time.Time with the "fixed_nanos" attribute, encoding its UnixNano() as a fixed64
+func (o *Buffer) enc_time_Time_fixed_nanos(p *Properties, base unsafe.Pointer) {
+	t := (*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	if t.IsZero() {
+		return // the zero time.Time is long before 1678, and so can't be encoded in nanoseconds. it is elided like any zero value
+	}
+	if t.Before(minNanosTime) || t.After(maxNanosTime) {
+		o.noteError(fmt.Errorf("protobuf3: fixed_nanos field %s holds %s, which is out of range of int64 nanoseconds", p.Name, t))
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	p.valEnc(o, uint64(t.UnixNano()))
+}
+
+// Encode a []time.Time with the "delta" attribute as a bytes field holding the UnixNano() of the first time, followed by
+// the difference in nanoseconds between each time and the previous one, all as zigzag varints. A dense series of times
+// thus takes a byte or three per time. The arithmetic wraps around, so any times in range of int64 nanoseconds round trip.
+func (o *Buffer) enc_slice_time_Time_delta(p *Properties, base unsafe.Pointer) {
+	s := *(*[]time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_len_reserved(SizeVarint(uint64(len(s))), func() {
+		prev := int64(0)
+		for i := range s {
+			t := &s[i]
+			if t.Before(minNanosTime) || t.After(maxNanosTime) {
+				o.noteError(fmt.Errorf("protobuf3: delta field %s holds %s, which is out of range of int64 nanoseconds", p.Name, t))
+				return
+			}
+			x := t.UnixNano()
+			o.EncodeZigzag64(uint64(x - prev))
+			prev = x
+		}
+	})
+}
+
+// custom encoder for time.Time, encoding it into a google.type.DateTime
+func (o *Buffer) enc_time_DateTime(p *Properties, base unsafe.Pointer) {
+	t := *(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	if t.IsZero() {
+		return
+	}
+	o.buf = append(o.buf, p.tagcode...)
+	o.enc_len_thing(func() { o.EncodeDateTime(t) })
+}
+
+// EncodeDateTime marshals a time.Time as the fields of a google.type.DateTime
+//
+//	message DateTime {
+//	  int32 year = 1;
+//	  int32 month = 2;
+//	  int32 day = 3;
+//	  int32 hours = 4;
+//	  int32 minutes = 5;
+//	  int32 seconds = 6;
+//	  int32 nanos = 7;
+//	  oneof time_offset {
+//	    google.protobuf.Duration utc_offset = 8;
+//	    TimeZone time_zone = 9;
+//	  }
+//	}
+//
+// The time zone is always encoded as the utc_offset of t, since that is exact, while the IANA name of t's
+// Location might not be known to the receiver (and time.Local has no portable name at all).
+func (o *WriteBuffer) EncodeDateTime(t time.Time) {
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	_, offset := t.Zone()
+	for i, x := range [...]int{year, int(month), day, hour, min, sec, t.Nanosecond()} {
+		if x != 0 {
+			o.buf = append(o.buf, byte(i+1)<<3|byte(WireVarint))
+			o.EncodeVarint(uint64(int32(x)))
+		}
+	}
+	// the utc_offset is always sent, even when it is 0, so the receiver knows the time is not in some unspecified local time zone
+	o.buf = append(o.buf, 8<<3|byte(WireBytes), 0) // placeholder for the length; the body is at most 11 bytes
+	body_start := len(o.buf)
+	if offset != 0 {
+		o.buf = append(o.buf, 1<<3|byte(WireVarint))
+		o.EncodeVarint(uint64(offset))
+	}
+	o.buf[body_start-1] = uint8(len(o.buf) - body_start)
+}
+
 // custom encoder for time.Duration, encoding it into the protobuf3 standard Duration
 func (o *Buffer) enc_time_Duration(p *Properties, base unsafe.Pointer) {
 	d := *(*time.Duration)(unsafe.Pointer(uintptr(base) + p.offset))
@@ -0,0 +1,150 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Registry of Go integer types which are protobuf enums
+ */
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// EnumValue is one named value of an enum.
+type EnumValue struct {
+	Name  string
+	Value int32
+}
+
+var (
+	enumsMu sync.RWMutex
+	enums   = make(map[reflect.Type][]EnumValue)
+)
+
+// RegisterEnum registers the Go integer type t as a protobuf enum with the given named values. Fields of type t
+// are then declared as the enum by AsProtobuf, and AsProtobufFull generates the enum's definition.
+// Several names may have the same value (aliases). Since the properties of struct types are cached, enums must
+// be registered before the structs which use them are first marshaled or unmarshaled (typically in an init() func).
+func RegisterEnum(t reflect.Type, values ...EnumValue) error {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("protobuf3: enum %s must be an integer type", t)
+	}
+	if t.Name() == "" {
+		return fmt.Errorf("protobuf3: enum %s must be a named type", t)
+	}
+
+	// keep the values sorted, so the generated .proto is reproducible (and the zero value, which proto3 requires be first, usually is)
+	values = append([]EnumValue(nil), values...)
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Value < values[j].Value })
+
+	enumsMu.Lock()
+	enums[t] = values
+	enumsMu.Unlock()
+	return nil
+}
+
+// RegisterEnumNames is like RegisterEnum, with the named values given as a map from each value to its name, which is
+// convenient when the names are already in a table (as the names of the values of generated enums usually are).
+func RegisterEnumNames(t reflect.Type, names map[int32]string) error {
+	values := make([]EnumValue, 0, len(names))
+	for v, name := range names {
+		values = append(values, EnumValue{Name: name, Value: v})
+	}
+	// RegisterEnum sorts the values by value, which is unique, so the order of iteration over the map doesn't matter
+	return RegisterEnum(t, values...)
+}
+
+// lookupEnum returns the values of enum t, or nil if t isn't a registered enum
+func lookupEnum(t reflect.Type) []EnumValue {
+	enumsMu.RLock()
+	values := enums[t]
+	enumsMu.RUnlock()
+	return values
+}
+
+// enumAsProtobuf returns the definition of the registered enum t. proto3 requires that the first value of an enum be 0,
+// since that is the default value of a field, just as the zero value of t is the value of a Go field which wasn't set.
+// So the values are reordered to put 0 first, and if t has no value named 0 one named <ENUM>_UNSPECIFIED is added.
+func enumAsProtobuf(t reflect.Type) string {
+	name := MakeTypeName(t, "")
+	var values []EnumValue
+	for _, v := range lookupEnum(t) {
+		if v.Value == 0 {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		values = append(values, EnumValue{Name: enumUnspecifiedName(name), Value: 0})
+	}
+	for _, v := range lookupEnum(t) {
+		if v.Value != 0 {
+			values = append(values, v)
+		}
+	}
+
+	lines := []string{fmt.Sprintf("enum %s {", name)}
+	for i := 1; i < len(values); i++ {
+		if values[i].Value == values[i-1].Value {
+			// protoc rejects aliases unless they are explicitly allowed
+			lines = append(lines, "  option allow_alias = true;")
+			break
+		}
+	}
+	for _, v := range values {
+		lines = append(lines, fmt.Sprintf("  %s = %d;", v.Name, v.Value))
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+// enumUnspecifiedName returns the conventional name of the zero value of an enum named name: "LinkState" becomes
+// "LINK_STATE_UNSPECIFIED", and "HTTPCode" becomes "HTTP_CODE_UNSPECIFIED". Words are split where a capital follows
+// a lowercase letter, and before the last capital of an acronym which is followed by a lowercase letter.
+func enumUnspecifiedName(name string) string {
+	var b strings.Builder
+	rs := []rune(name)
+	for i, r := range rs {
+		if i != 0 && unicode.IsUpper(r) && (!unicode.IsUpper(rs[i-1]) || i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	b.WriteString("_UNSPECIFIED")
+	return b.String()
+}
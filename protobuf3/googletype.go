@@ -0,0 +1,217 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Go types which encode as the google.type messages from googleapis
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Money encodes as a google.type.Money, an amount of money in a currency. The amount is Units whole units plus Nanos
+// billionths of a unit. Nanos must be between -999,999,999 and +999,999,999, and must have the same sign as Units
+// (unless Units is 0, in which case Nanos carries the sign of the amount).
+type Money struct {
+	CurrencyCode string `protobuf:"bytes,1,name=currency_code"` // the three letter ISO 4217 code, such as "USD"
+	Units        int64  `protobuf:"varint,2"`
+	Nanos        int32  `protobuf:"varint,3"`
+}
+
+// money has the same fields as Money, without the methods, so it can be marshaled by reflection
+type money Money
+
+// ParseMoney returns the Money holding the decimal amount, such as "12.34" or "-0.5", in the given currency
+func ParseMoney(currencyCode, amount string) (Money, error) {
+	m := Money{CurrencyCode: currencyCode}
+	s := amount
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	whole, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		whole, frac = s[:dot], s[dot+1:]
+	}
+	if (whole == "" && frac == "") || len(frac) > 9 || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("protobuf3: %q is not a decimal amount of money", amount)
+	}
+	if whole != "" {
+		u, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return Money{}, fmt.Errorf("protobuf3: amount of money %q out of range", amount)
+		}
+		m.Units = u
+	}
+	if frac != "" {
+		n, _ := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 32)
+		m.Nanos = int32(n)
+	}
+	if neg {
+		// the nanos follow the sign of the units
+		m.Units, m.Nanos = -m.Units, -m.Nanos
+	}
+	return m, nil
+}
+
+// isDigits returns true if s consists of nothing but decimal digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Amount returns the amount of money as a decimal string, such as "12.34", without the currency code
+func (m *Money) Amount() string {
+	units, nanos := m.Units, m.Nanos
+	sign := ""
+	if units < 0 || nanos < 0 {
+		sign = "-"
+	}
+	if nanos < 0 {
+		nanos = -nanos
+	}
+	u := uint64(units)
+	if units < 0 {
+		u = uint64(-units) // NOTE this is correct even for math.MinInt64
+	}
+	s := strconv.FormatUint(u, 10)
+	if nanos != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", nanos), "0")
+	}
+	return sign + s
+}
+
+// validate checks that m's nanos are in range and follow the sign of its units
+func (m *Money) validate() error {
+	if m.Nanos <= -1e9 || m.Nanos >= 1e9 || (m.Units > 0 && m.Nanos < 0) || (m.Units < 0 && m.Nanos > 0) {
+		return fmt.Errorf("protobuf3: invalid google.type.Money: units %d and nanos %d", m.Units, m.Nanos)
+	}
+	return nil
+}
+
+// MarshalProtobuf3 encodes the Money as a google.type.Money
+func (m *Money) MarshalProtobuf3() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return Marshal((*money)(m))
+}
+
+// UnmarshalProtobuf3 decodes a google.type.Money
+func (m *Money) UnmarshalProtobuf3(data []byte) error {
+	if err := Unmarshal(data, (*money)(m)); err != nil {
+		return err
+	}
+	return m.validate()
+}
+
+// AsProtobuf3 returns the name of the type and the file which must be imported to use it
+func (*Money) AsProtobuf3() (string, string, []string) {
+	return "google.type.Money", "", []string{"google/type/money.proto"}
+}
+
+// TimeInterval encodes as a google.type.Interval, the span of time from Start (inclusive) to End (exclusive).
+// A zero Start or End is not encoded, and means the interval is unbounded at that end (an open interval).
+type TimeInterval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// timeInterval is how a TimeInterval is marshaled, with nil pointers for the unbounded ends
+type timeInterval struct {
+	Start *time.Time `protobuf:"bytes,1,name=start_time"`
+	End   *time.Time `protobuf:"bytes,2,name=end_time"`
+}
+
+// NewTimeInterval returns the interval from start to end. Pass the zero time.Time for an end which is unbounded.
+func NewTimeInterval(start, end time.Time) TimeInterval {
+	return TimeInterval{Start: start, End: end}
+}
+
+// IsOpen returns true if the interval is unbounded at either end
+func (ti *TimeInterval) IsOpen() bool {
+	return ti.Start.IsZero() || ti.End.IsZero()
+}
+
+// Contains returns true if t is within the interval
+func (ti *TimeInterval) Contains(t time.Time) bool {
+	return (ti.Start.IsZero() || !t.Before(ti.Start)) && (ti.End.IsZero() || t.Before(ti.End))
+}
+
+// Duration returns the length of the interval, or 0 if it is open
+func (ti *TimeInterval) Duration() time.Duration {
+	if ti.IsOpen() {
+		return 0
+	}
+	return ti.End.Sub(ti.Start)
+}
+
+// MarshalProtobuf3 encodes the TimeInterval as a google.type.Interval
+func (ti *TimeInterval) MarshalProtobuf3() ([]byte, error) {
+	var m timeInterval
+	if !ti.Start.IsZero() {
+		m.Start = &ti.Start
+	}
+	if !ti.End.IsZero() {
+		m.End = &ti.End
+	}
+	return Marshal(&m)
+}
+
+// UnmarshalProtobuf3 decodes a google.type.Interval
+func (ti *TimeInterval) UnmarshalProtobuf3(data []byte) error {
+	var m timeInterval
+	if err := Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*ti = TimeInterval{}
+	if m.Start != nil {
+		ti.Start = *m.Start
+	}
+	if m.End != nil {
+		ti.End = *m.End
+	}
+	return nil
+}
+
+// AsProtobuf3 returns the name of the type and the file which must be imported to use it
+func (*TimeInterval) AsProtobuf3() (string, string, []string) {
+	return "google.type.Interval", "", []string{"google/type/interval.proto"}
+}
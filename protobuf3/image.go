@@ -0,0 +1,116 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Image, a buffer of pixels along with its dimensions
+ */
+
+import (
+	"fmt"
+)
+
+// Image encodes a buffer of pixels along with its dimensions, as the message
+//
+//	message Image {
+//	  int32 width = 1;
+//	  int32 height = 2;
+//	  int32 stride = 3;
+//	  bytes pixels = 4;
+//	}
+//
+// Row y of the image starts at Pixels[y*Stride]. The Stride can be larger than the number of bytes of pixels in a row
+// (which is Width times the number of bytes per pixel, which only the application knows) when the rows are padded, as
+// they often are for alignment, or when the Image is a sub-image of a larger one. The padding is encoded along with the
+// pixels, except that the padding following the last row may be omitted, so that a sub-image needn't be copied. Use
+// Compact to strip the padding before encoding.
+type Image struct {
+	Width  int32  `protobuf:"varint,1"`
+	Height int32  `protobuf:"varint,2"`
+	Stride int32  `protobuf:"varint,3"`
+	Pixels []byte `protobuf:"bytes,4"`
+}
+
+// image has the same fields as Image, without the methods, so it can be marshaled by reflection
+type image Image
+
+// Row returns the bytes of row y of the image, including any padding
+func (img *Image) Row(y int) []byte {
+	start := y * int(img.Stride)
+	end := start + int(img.Stride)
+	if end > len(img.Pixels) {
+		end = len(img.Pixels) // the last row needn't be padded
+	}
+	return img.Pixels[start:end]
+}
+
+// Compact returns a copy of the image without any row padding, given the number of bytes per pixel
+func (img *Image) Compact(bytesPerPixel int) Image {
+	rowLen := int(img.Width) * bytesPerPixel
+	c := Image{Width: img.Width, Height: img.Height, Stride: int32(rowLen), Pixels: make([]byte, 0, rowLen*int(img.Height))}
+	for y := 0; y < int(img.Height); y++ {
+		c.Pixels = append(c.Pixels, img.Row(y)[:rowLen]...)
+	}
+	return c
+}
+
+// validate checks that the dimensions of the image are consistent with the length of its pixel buffer
+func (img *Image) validate() error {
+	if img.Width < 0 || img.Height < 0 || img.Stride < 0 {
+		return fmt.Errorf("protobuf3: invalid Image dimensions %dx%d, stride %d", img.Width, img.Height, img.Stride)
+	}
+	n := int64(len(img.Pixels))
+	if img.Height != 0 && (n <= int64(img.Stride)*int64(img.Height-1) || n > int64(img.Stride)*int64(img.Height)) {
+		return fmt.Errorf("protobuf3: Image of %d rows with stride %d can't have %d bytes of pixels", img.Height, img.Stride, n)
+	}
+	return nil
+}
+
+// MarshalProtobuf3 encodes the Image
+func (img *Image) MarshalProtobuf3() ([]byte, error) {
+	if err := img.validate(); err != nil {
+		return nil, err
+	}
+	return Marshal((*image)(img))
+}
+
+// UnmarshalProtobuf3 decodes an Image
+func (img *Image) UnmarshalProtobuf3(data []byte) error {
+	if err := Unmarshal(data, (*image)(img)); err != nil {
+		return err
+	}
+	return img.validate()
+}
+
+// AsProtobuf3 returns the name and definition of the Image message
+func (*Image) AsProtobuf3() (string, string, []string) {
+	return "Image", "message Image {\n  int32 width = 1;\n  int32 height = 2;\n  int32 stride = 3;\n  bytes pixels = 4;\n}", nil
+}
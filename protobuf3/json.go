@@ -0,0 +1,294 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Encoding messages as JSON, for debugging and config dumps
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MarshalJSON encodes the message pb as JSON. The JSON object members are named with the protobuf field names of the
+// fields (not the Go field names), and appear in tag order. Like proto3, fields holding the zero value are omitted.
+// time.Time is encoded as an RFC 3339 string and time.Duration as a string of seconds ("1.5s"), as in the proto3 JSON mapping.
+func MarshalJSON(pb Message) ([]byte, error) {
+	return MarshalOptions{}.JSON(pb)
+}
+
+// JSON is like the package level MarshalJSON, using the options. If opts.Indent is not empty the JSON is indented
+// the way json.MarshalIndent(pb, "", opts.Indent) would indent it. (This method isn't named MarshalJSON because
+// that would make MarshalOptions look like a json.Marshaler.)
+func (opts MarshalOptions) JSON(pb Message) ([]byte, error) {
+	v := reflect.ValueOf(pb)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protobuf3: can't MarshalJSON(%T): not a pointer to a struct", pb)
+	}
+	if v.IsNil() {
+		return nil, ErrNil
+	}
+
+	var buf bytes.Buffer
+	err := json_value(&buf, v.Elem())
+	if err != nil {
+		return nil, err
+	}
+	if opts.Indent == "" {
+		return buf.Bytes(), nil
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, buf.Bytes(), "", opts.Indent)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// json_value appends the JSON encoding of v to buf. v must be addressable.
+func json_value(buf *bytes.Buffer, v reflect.Value) error {
+	v = settable(v) // v might have been obtained through unexported fields
+
+	switch v.Type() {
+	case time_Time_type:
+		json_string(buf, v.Interface().(time.Time).UTC().Format(time.RFC3339Nano))
+		return nil
+	case time_Duration_type:
+		json_string(buf, strconv.FormatFloat(v.Interface().(time.Duration).Seconds(), 'f', -1, 64)+"s")
+		return nil
+	case bytes_Buffer_type:
+		return json_marshal(buf, v.Addr().Interface().(*bytes.Buffer).Bytes())
+	}
+	if _, ok := stdMessageTypes[v.Type()]; ok {
+		// net.TCPAddr and netip.AddrPort are written as strings, the way they print
+		json_string(buf, fmt.Sprint(v.Addr().Interface()))
+		return nil
+	}
+	if at, ok := atomicTypes[v.Type()]; ok {
+		// encode the value held by the atomic type
+		r := reflect.New(at.t).Elem()
+		r.Set(v.Addr().MethodByName("Load").Call(nil)[0])
+		return json_value(buf, r)
+	}
+	if _, ok := v.Addr().Interface().(json.Marshaler); ok {
+		return json_marshal(buf, v.Addr().Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return json_struct(buf, v)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return json_value(buf, v.Elem())
+
+	case reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		// copy the dynamic value so it is addressable
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		return json_value(buf, e)
+
+	case reflect.Func:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		r := reflect.New(v.Type().Out(0)).Elem()
+		r.Set(v.Call(nil)[0])
+		return json_value(buf, r)
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// bytes are base64 encoded, as encoding/json and proto3 JSON both do
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return json_marshal(buf, b)
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			err := json_value(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+
+	case reflect.Map:
+		// JSON object keys are strings. Sort them so the output is deterministic. Like jsonpb, numeric and bool keys
+		// are sorted by their values, not by their strings
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = json_map_key(k)
+		}
+		order := make([]int, len(keys))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return json_map_key_less(keys[order[i]], keys[order[j]], names[order[i]], names[order[j]])
+		})
+
+		buf.WriteByte('{')
+		for n, i := range order {
+			if n != 0 {
+				buf.WriteByte(',')
+			}
+			json_string(buf, names[i])
+			buf.WriteByte(':')
+			// map values aren't addressable, so copy them
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(keys[i]))
+			err := json_value(buf, e)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+
+	default:
+		return json_marshal(buf, v.Interface())
+	}
+}
+
+// json_map_key returns the proto3 JSON string form of map key k. Integer keys are formatted in decimal and bool keys
+// as "true" or "false", regardless of any String() method of their Go type
+func json_map_key(k reflect.Value) string {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String()
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10)
+	default:
+		return fmt.Sprint(k.Interface())
+	}
+}
+
+// json_map_key_less orders map keys a and b, whose JSON strings are sa and sb
+func json_map_key_less(a, b reflect.Value, sa, sb string) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	default:
+		return sa < sb
+	}
+}
+
+// json_struct appends the JSON object encoding the fields of struct v to buf
+func json_struct(buf *bytes.Buffer, v reflect.Value) error {
+	t := v.Type()
+	prop, err := GetProperties(t)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for i := range prop.props {
+		p := &prop.props[i]
+		if p.isChecksum {
+			continue // the checksum only exists on the wire
+		}
+		var fv reflect.Value
+		if p.wtype != nil {
+			// the field of a oneof held in an interface is present, even when zero, if the interface holds its wrapper
+			w := v.FieldByName(p.wfield).Elem()
+			if !w.IsValid() || w.Type() != p.wtype || w.IsNil() {
+				continue
+			}
+			fv = w.Elem().FieldByName(p.Name)
+		} else {
+			f, ok := t.FieldByName(p.Name)
+			if !ok {
+				continue
+			}
+			fv = v.FieldByIndex(f.Index)
+			if fv.IsZero() {
+				continue
+			}
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		json_string(buf, p.protobufFieldName(t))
+		buf.WriteByte(':')
+		err := json_value(buf, fv)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// json_string appends s to buf as a JSON string. (strconv.Quote isn't used because its \x escapes aren't valid JSON)
+func json_string(buf *bytes.Buffer, s string) {
+	j, _ := json.Marshal(s) // encoding a string can't fail
+	buf.Write(j)
+}
+
+// json_marshal appends the encoding/json encoding of x to buf
+func json_marshal(buf *bytes.Buffer, x interface{}) error {
+	j, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	buf.Write(j)
+	return nil
+}
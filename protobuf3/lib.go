@@ -67,10 +67,30 @@ type Message interface {
 // rather than being expensive copies.
 type Buffer struct {
 	WriteBuffer
-	err           error                   // nil, or the first error which happened during operation
-	index         uint                    // read position in .buf[]
-	Immutable     bool                    // true if we the caller promises the contents of buf[] are immutable, and thus we can retain references to it for types which decode into []byte
-	array_indexes map[unsafe.Pointer]uint // map of base address of array -> index of next unfilled slot (or nil if never used)
+	err           error                     // nil, or the first error which happened during operation
+	index         uint                      // read position in .buf[]
+	Immutable     bool                      // true if we the caller promises the contents of buf[] are immutable, and thus we can retain references to it for types which decode into []byte
+	array_indexes map[unsafe.Pointer]uint   // map of base address of array -> index of next unfilled slot (or nil if never used)
+	flatmap_keys  map[unsafe.Pointer]string // map of address of flatmap field -> key decoded but still waiting for its value (or nil if never used)
+	lenient       bool                      // true if fields with mismatched wiretypes are skipped rather than being an error
+	reuse         bool                      // true if repeated message fields decode into the messages left in the slice's spare capacity
+	cipher        Cipher                    // encrypts and decrypts fields with the "encrypt" attribute, or nil
+	deterministic bool                      // true if map fields are encoded in key order (unless the field's tag says otherwise)
+	noElide       bool                      // true if fields holding zero values are encoded rather than omitted
+	sizes         [4]typeSizeHint           // per-type hints: the encoded lengths of the last messages of the last few types encoded, used to guess how much space to reserve for the length of the next message of the same type
+	sizes_next    uint                      // index (mod len(sizes)) of the next entry of sizes to replace
+	sizeCache     bool                      // true if the length of each nested message is computed before it is encoded (see SetSizeCache)
+	msgSizes      []msgSize                 // when sizeCache is set, the lengths of the messages sized by the last size pre-pass, in the order they are encoded
+	msgSizesNext  int                       // index in msgSizes of the next message expected to be encoded
+	sizing        int                       // > 0 while a size pre-pass is running
+	parallelism   int                       // max # of goroutines to use when encoding large repeated message fields (0 or 1 means encode serially)
+	skipValidate  bool                      // true if messages which implement Validator aren't validated after they are decoded
+	depth         int                       // nesting depth of the message being decoded
+	maxDepth      int                       // max nesting depth of decoded messages, or 0 for DefaultMaxDepth
+	maxSize       uint                      // max length of a decoded message or length-delimited field, or 0 for no limit
+	seen          map[uint32]bool           // if not nil, the tags of the fields of the next message decoded are recorded here (but not those of the messages nested within it)
+
+	onUnknown func(tag uint32, wire WireType, value []byte) // if not nil, called with each unknown field decoded
 }
 
 // WriteBuffer is just enough wrapper around a byte slice that it can
@@ -98,6 +118,77 @@ func (p *Buffer) Reset() {
 	p.index = 0 // for reading
 	p.err = nil
 	p.array_indexes = nil
+	p.flatmap_keys = nil
+	p.sizes = [len(p.sizes)]typeSizeHint{}
+	p.sizes_next = 0
+	p.clearMsgSizes()
+}
+
+// SetDeterministic sets whether map fields are encoded in order of their keys by Marshal, so that equal messages encode
+// to equal bytes (which content-addressed storage and golden files need). Integer keys are sorted numerically, and
+// string keys lexically. The default is to encode the entries in map iteration order, which is faster. Map fields with
+// the "order=sorted" or "order=unsorted" tag attributes ignore this setting. Reset does not change it.
+func (p *Buffer) SetDeterministic(deterministic bool) {
+	p.deterministic = deterministic
+}
+
+// SetSizeCache sets whether Marshal computes the length of each nested message before encoding it, so that the length
+// can be written directly ahead of the message. Otherwise space for the length is reserved using the length of the
+// previous message of the same type, and the message is moved once it is encoded if the guess was wrong. The lengths
+// of the messages nested within a message are cached, by address, when the outer message is sized, so each message
+// is sized only once however deeply it is nested. Sizing costs a pass over the message, which is more than the moves
+// it saves unless the guesses are often wrong and the messages large (see BenchmarkMarshalAlternatingSizeMessages).
+// The output is identical either way. Reset does not change it.
+func (p *Buffer) SetSizeCache(sizeCache bool) {
+	p.sizeCache = sizeCache
+}
+
+// SetMaxDepth sets the maximum nesting depth of the messages Unmarshal decodes. The message passed to Unmarshal is at
+// depth 1, the messages in its fields at depth 2, and so on. Input nested more deeply is rejected with ErrMaxDepth
+// rather than recursing until the stack is exhausted. n <= 0 restores DefaultMaxDepth. Reset does not change it.
+func (p *Buffer) SetMaxDepth(n int) {
+	p.maxDepth = n
+}
+
+// SetMaxSize sets the maximum length of the messages Unmarshal decodes, and of the length-delimited fields (strings,
+// bytes, nested messages and packed repeated fields) within them. A longer message or field is rejected with
+// ErrMaxSize, before anything is allocated to hold it. (A length which exceeds the rest of the input is always rejected,
+// with io.ErrUnexpectedEOF, so a truncated buffer can't cause a huge allocation either.) n <= 0 removes the limit, which
+// is the default. Reset does not change it.
+func (p *Buffer) SetMaxSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	p.maxSize = uint(n)
+}
+
+// typeSizeHint is the encoded length of the last message of a type. It is a per-type hint, not a per-message one:
+// the type is identified by the address of its StructProperties, and every message of the type shares the hint. A
+// message whose length needs a different number of bytes than the previous one of its type costs a move, and then
+// becomes the hint for the next. The address is held as a uintptr so that updating the hint doesn't need a GC write
+// barrier. (In the unlikely case the StructProperties are evicted from the cache and the address reused, all that
+// happens is the guess is wrong.)
+type typeSizeHint struct {
+	prop uintptr
+	n    int
+}
+
+// msgSize is the length of the message at base, of the type described by prop. The type is part of the key because
+// a struct and the struct embedded at its start have the same address.
+type msgSize struct {
+	base unsafe.Pointer
+	prop *StructProperties
+	n    int
+}
+
+// clearMsgSizes forgets the lengths of the messages sized by the previous Marshal (and the pointers to them), keeping
+// the slice for the next one
+func (p *Buffer) clearMsgSizes() {
+	for i := range p.msgSizes {
+		p.msgSizes[i] = msgSize{}
+	}
+	p.msgSizes = p.msgSizes[:0]
+	p.msgSizesNext = 0
 }
 
 // Reset resets the WriteBuffer while hold on to the capacity
@@ -124,6 +215,24 @@ func (p *Buffer) release() []byte {
 	p.Immutable = false
 	p.err = nil
 	p.array_indexes = nil
+	p.flatmap_keys = nil
+	p.lenient = false
+	p.reuse = false
+	p.deterministic = false
+	p.noElide = false
+	p.cipher = nil
+	p.parallelism = 0
+	p.seen = nil
+	p.onUnknown = nil
+	p.skipValidate = false
+	p.depth = 0
+	p.maxDepth = 0
+	p.maxSize = 0
+	p.sizes = [len(p.sizes)]typeSizeHint{}
+	p.sizes_next = 0
+	p.sizeCache = false
+	p.clearMsgSizes()
+	p.sizing = 0
 	buffer_pool.Put(p)
 	return bytes
 }
@@ -292,6 +401,104 @@ func (p *Buffer) FindBytes(id uint, sorted bool) (position int, full []byte, val
 // error returned by (*Buffer).Find when the id is not present in the buffer
 var ErrNotFound = errors.New("ID not found in protobuf buffer")
 
+// GetField scans the top level fields of the protobuf message in buf and returns the value of the first field with id tag,
+// without decoding the rest of the message. The value is the raw encoded bytes: the varint or fixed bytes for those
+// wiretypes, and the bytes without the length prefix for WireBytes. value points into buf.
+// If the field isn't present found is false and err is nil.
+func GetField(buf []byte, tag uint32) (wire WireType, value []byte, found bool, err error) {
+	p := newBuffer(buf)
+	_, _, value, wire, err = p.Find(uint(tag), false)
+	p.release()
+	if err == ErrNotFound {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return wire, value, true, nil
+}
+
+// UnmarshalStream calls handler for each top level field of the protobuf message in buf, in the order they are encoded.
+// The value is the raw encoded bytes, as with GetField, and points into buf. This lets very large messages be processed
+// without decoding them into a struct; the handler is free to decode any nested messages itself.
+// The first error returned by handler stops the decoding and is returned by UnmarshalStream.
+func UnmarshalStream(buf []byte, handler func(tag uint32, wire WireType, value []byte) error) error {
+	p := newBuffer(buf)
+	defer p.release()
+	for !p.EOF() {
+		start := p.index
+		id, _, val, wt, err := p.Next()
+		if err != nil {
+			return &DecodeError{Offset: int(start), Field: uint32(id), Err: err}
+		}
+		if id <= 0 {
+			return &DecodeError{Offset: int(start), Err: fmt.Errorf("protobuf3: illegal tag %d (wiretype %v)", id, wt)}
+		}
+		err = handler(uint32(id), wt, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresentTags returns the distinct tags of the top level fields of the protobuf message in buf, in the order in which
+// they first appear. The values of the fields are skipped over, not decoded, so this is much cheaper than decoding the
+// message when all that is needed is which fields it contains (to route the message, for instance).
+func PresentTags(buf []byte) ([]uint32, error) {
+	p := newBuffer(buf)
+	defer p.release()
+	var tags []uint32
+	for !p.EOF() {
+		start := p.index
+		u, err := p.DecodeVarint()
+		if err != nil {
+			return nil, &DecodeError{Offset: int(start), Err: err}
+		}
+		tag, wire := uint32(u>>3), WireType(u&7)
+		if tag == 0 || u>>3 > 1<<29-1 {
+			return nil, &DecodeError{Offset: int(start), Err: fmt.Errorf("protobuf3: illegal tag %d (wiretype %v)", u>>3, wire)}
+		}
+		err = p.skip(nil, wire)
+		if err != nil {
+			return nil, &DecodeError{Offset: int(start), Field: tag, Err: err}
+		}
+		seen := false
+		for _, t := range tags {
+			if t == tag {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// GetFields is like GetField, but returns the values of all the top level fields with id tag, as is needed for repeated
+// fields. (Packed repeated fields are a single WireBytes value, and must be unpacked by the caller.)
+// All the occurrences of the field must have the same wiretype. If the field isn't present values is nil and err is nil.
+func GetFields(buf []byte, tag uint32) (wire WireType, values [][]byte, err error) {
+	p := newBuffer(buf)
+	defer p.release()
+	for {
+		_, _, val, wt, err := p.Find(uint(tag), false)
+		if err == ErrNotFound {
+			return wire, values, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(values) != 0 && wt != wire {
+			return 0, nil, fmt.Errorf("protobuf3: field %d has wiretype %v and %v", tag, wire, wt)
+		}
+		wire = wt
+		values = append(values, val)
+	}
+}
+
 // DebugPrint dumps the encoded data in b in a debugging format with a header
 // including the string s. Used in testing but made available for general debugging.
 func DebugPrint(b []byte) string {
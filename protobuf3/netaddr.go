@@ -0,0 +1,134 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Encoding net.TCPAddr as a message
+ */
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"unsafe"
+)
+
+func init() {
+	stdMessageTypes[reflect.TypeOf(net.TCPAddr{})] = stdMessageType{
+		name: "TCPAddr",
+		definition: `message TCPAddr {
+  bytes ip = 1; // 4 bytes for an IPv4 address, 16 for IPv6
+  uint32 port = 2;
+  string zone = 3; // the IPv6 scoped addressing zone
+}`,
+		enc: encodeTCPAddr,
+		dec: decodeTCPAddr,
+	}
+}
+
+// encodeTCPAddr encodes the net.TCPAddr at ptr. IPv4 addresses are always encoded in 4 bytes, even when the net.IP holds
+// them in their 16 byte IPv4-in-IPv6 form, so they decode into 4 byte net.IPs
+func encodeTCPAddr(o *WriteBuffer, ptr unsafe.Pointer) error {
+	a := (*net.TCPAddr)(ptr)
+	ip := a.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) != 0 && len(ip) != net.IPv6len {
+		return fmt.Errorf("invalid IP address of length %d", len(ip))
+	}
+	if a.Port < 0 || a.Port > 0xffff {
+		return fmt.Errorf("port %d out of range", a.Port)
+	}
+
+	if len(ip) != 0 {
+		o.EncodeBytes(1, ip)
+	}
+	if a.Port != 0 {
+		o.buf = append(o.buf, 2<<3|byte(WireVarint))
+		o.EncodeVarint(uint64(a.Port))
+	}
+	if a.Zone != "" {
+		o.buf = append(o.buf, 3<<3|byte(WireBytes))
+		o.EncodeStringBytes(a.Zone)
+	}
+	return nil
+}
+
+// decodeTCPAddr decodes a TCPAddr message into the net.TCPAddr at ptr
+func decodeTCPAddr(o *Buffer, ptr unsafe.Pointer) error {
+	var a net.TCPAddr
+	for o.index < ulen(o.buf) {
+		tag, err := o.DecodeVarint()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case 1<<3 | uint64(WireBytes): // ip
+			var ip []byte
+			ip, err = o.DecodeRawBytes()
+			if err == nil {
+				a.IP, err = decodeIP(ip)
+			}
+		case 2<<3 | uint64(WireVarint): // port
+			var port uint64
+			port, err = o.DecodeVarint()
+			if err == nil {
+				a.Port, err = decodePort(port)
+			}
+		case 3<<3 | uint64(WireBytes): // zone
+			a.Zone, err = o.DecodeStringBytes()
+		default:
+			// do the protobuf thing and ignore unknown tags
+			err = o.skip(nil, WireType(tag)&7)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	*(*net.TCPAddr)(ptr) = a
+	return nil
+}
+
+// decodeIP returns a copy of the 4 or 16 byte IP address in b
+func decodeIP(b []byte) (net.IP, error) {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, fmt.Errorf("invalid IP address of length %d", len(b))
+	}
+	return append(net.IP(nil), b...), nil
+}
+
+// decodePort checks that port is a legal port number
+func decodePort(port uint64) (int, error) {
+	if port > 0xffff {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return int(port), nil
+}
@@ -0,0 +1,123 @@
+//go:build go1.18
+// +build go1.18
+
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Encoding netip.AddrPort as a message
+ */
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"unsafe"
+)
+
+func init() {
+	stdMessageTypes[reflect.TypeOf(netip.AddrPort{})] = stdMessageType{
+		name: "AddrPort",
+		definition: `message AddrPort {
+  bytes addr = 1; // 4 bytes for an IPv4 address, 16 for IPv6
+  uint32 port = 2;
+  string zone = 3; // the IPv6 scoped addressing zone
+}`,
+		enc: encodeAddrPort,
+		dec: decodeAddrPort,
+	}
+}
+
+// encodeAddrPort encodes the netip.AddrPort at ptr. The zero AddrPort (whose Addr is invalid) encodes to nothing
+func encodeAddrPort(o *WriteBuffer, ptr unsafe.Pointer) error {
+	ap := *(*netip.AddrPort)(ptr)
+	addr := ap.Addr()
+	if addr.IsValid() {
+		o.EncodeBytes(1, addr.AsSlice()) // AsSlice returns 4 bytes for an IPv4 address, and 16 for IPv6
+	}
+	if port := ap.Port(); port != 0 {
+		o.buf = append(o.buf, 2<<3|byte(WireVarint))
+		o.EncodeVarint(uint64(port))
+	}
+	if zone := addr.Zone(); zone != "" {
+		o.buf = append(o.buf, 3<<3|byte(WireBytes))
+		o.EncodeStringBytes(zone)
+	}
+	return nil
+}
+
+// decodeAddrPort decodes an AddrPort message into the netip.AddrPort at ptr
+func decodeAddrPort(o *Buffer, ptr unsafe.Pointer) error {
+	var addr netip.Addr
+	var port int
+	var zone string
+	for o.index < ulen(o.buf) {
+		tag, err := o.DecodeVarint()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case 1<<3 | uint64(WireBytes): // addr
+			var b []byte
+			b, err = o.DecodeRawBytes()
+			if err == nil {
+				var ok bool
+				addr, ok = netip.AddrFromSlice(b)
+				if !ok {
+					err = fmt.Errorf("invalid IP address of length %d", len(b))
+				}
+			}
+		case 2<<3 | uint64(WireVarint): // port
+			var x uint64
+			x, err = o.DecodeVarint()
+			if err == nil {
+				port, err = decodePort(x)
+			}
+		case 3<<3 | uint64(WireBytes): // zone
+			zone, err = o.DecodeStringBytes()
+		default:
+			// do the protobuf thing and ignore unknown tags
+			err = o.skip(nil, WireType(tag)&7)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if zone != "" {
+		if !addr.Is6() {
+			return fmt.Errorf("zone %q of an address which isn't IPv6", zone)
+		}
+		addr = addr.WithZone(zone)
+	}
+	*(*netip.AddrPort)(ptr) = netip.AddrPortFrom(addr, uint16(port))
+	return nil
+}
@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3_test
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mistsys/protobuf3/protobuf3"
+)
+
+type NetAddrMsg struct {
+	AddrPort  netip.AddrPort  `protobuf:"bytes,1"`
+	PAddrPort *netip.AddrPort `protobuf:"bytes,2"`
+	TCPAddr   net.TCPAddr     `protobuf:"bytes,3"`
+	PTCPAddr  *net.TCPAddr    `protobuf:"bytes,4"`
+}
+
+func TestNetAddr(t *testing.T) {
+	ap4 := netip.MustParseAddrPort("192.0.2.1:443")
+	ap6 := netip.MustParseAddrPort("[fe80::1%eth0]:8080")
+	for _, m := range []NetAddrMsg{
+		{},
+		{AddrPort: ap4, PAddrPort: &ap6},
+		{AddrPort: ap6, TCPAddr: net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}},
+		{PTCPAddr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 8080, Zone: "eth0"}},
+	} {
+		pb := mustMarshal(t, &m)
+		var u NetAddrMsg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		if u.AddrPort != m.AddrPort || (m.PAddrPort != nil) != (u.PAddrPort != nil) || (m.PAddrPort != nil && *u.PAddrPort != *m.PAddrPort) {
+			t.Errorf("AddrPorts %v %v decoded as %v %v", m.AddrPort, m.PAddrPort, u.AddrPort, u.PAddrPort)
+		}
+		if !tcpAddrEqual(&u.TCPAddr, &m.TCPAddr) || (m.PTCPAddr != nil) != (u.PTCPAddr != nil) || (m.PTCPAddr != nil && !tcpAddrEqual(u.PTCPAddr, m.PTCPAddr)) {
+			t.Errorf("TCPAddrs %v %v decoded as %v %v", m.TCPAddr, m.PTCPAddr, u.TCPAddr, u.PTCPAddr)
+		}
+		if n, err := protobuf3.Size(&m); err != nil || n != len(pb) {
+			t.Errorf("Size = %d, %v; expected %d", n, err, len(pb))
+		}
+	}
+
+	// IPv4 addresses are encoded in 4 bytes, however the net.IP holds them
+	pb := mustMarshal(t, &NetAddrMsg{TCPAddr: net.TCPAddr{IP: net.ParseIP("192.0.2.1")}})
+	if len(pb) != 2+2+4 {
+		t.Errorf("IPv4 TCPAddr encoded as % x; expected a 4 byte address", pb)
+	}
+
+	if _, err := protobuf3.Marshal(&NetAddrMsg{TCPAddr: net.TCPAddr{Port: 70000}}); err == nil {
+		t.Error("Marshal of an out of range port succeeded")
+	}
+
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(NetAddrMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{"AddrPort addr_port = 1;", "TCPAddr ptcpaddr = 4;", "message AddrPort {", "message TCPAddr {"} {
+		if !strings.Contains(s, x) {
+			t.Errorf("AsProtobufFull lacks %q:\n%s", x, s)
+		}
+	}
+}
+
+func tcpAddrEqual(a, b *net.TCPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
@@ -0,0 +1,168 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * oneof unions held in an interface field, the way golang/protobuf generates them
+ */
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+var (
+	oneofsMu sync.RWMutex
+	oneofs   = make(map[reflect.Type][]reflect.Type) // interface type -> wrapper struct types
+)
+
+// RegisterOneof registers the wrapper types which interface type iface can hold, so that a struct field of type iface
+// tagged `protobuf_oneof:"name"` encodes as a oneof. Each wrapper is a struct type W (or *W) with exactly one protobuf
+// field, and *W must implement iface. This matches the code golang/protobuf generates for a oneof:
+//
+//	type Msg struct {
+//		Choice isMsg_Choice `protobuf_oneof:"choice"`
+//	}
+//	type isMsg_Choice interface{ isMsg_Choice() }
+//	type Msg_Name struct {
+//		Name string `protobuf:"bytes,1"`
+//	}
+//	type Msg_ID struct {
+//		ID int64 `protobuf:"varint,2"`
+//	}
+//	func (*Msg_Name) isMsg_Choice() {}
+//	func (*Msg_ID) isMsg_Choice()   {}
+//
+//	protobuf3.RegisterOneof(reflect.TypeOf((*isMsg_Choice)(nil)).Elem(), reflect.TypeOf(Msg_Name{}), reflect.TypeOf(Msg_ID{}))
+//
+// The field of each wrapper is a field of the oneof, and is encoded (even when it is the zero value) when the interface
+// holds a *W. Decoding it stores a *W in the interface. Like enums, oneofs must be registered before the structs which
+// use them are first marshaled or unmarshaled.
+func RegisterOneof(iface reflect.Type, wrappers ...reflect.Type) error {
+	if iface.Kind() != reflect.Interface {
+		return fmt.Errorf("protobuf3: oneof %s must be an interface type", iface)
+	}
+	ws := make([]reflect.Type, len(wrappers))
+	for i, w := range wrappers {
+		if w.Kind() == reflect.Ptr {
+			w = w.Elem()
+		}
+		if w.Kind() != reflect.Struct {
+			return fmt.Errorf("protobuf3: oneof %s wrapper %s must be a struct type", iface, w)
+		}
+		if !reflect.PtrTo(w).Implements(iface) {
+			return fmt.Errorf("protobuf3: oneof %s wrapper *%s doesn't implement the interface", iface, w)
+		}
+		ws[i] = w
+	}
+
+	oneofsMu.Lock()
+	oneofs[iface] = ws
+	oneofsMu.Unlock()
+	return nil
+}
+
+// lookupOneof returns the wrapper types registered for interface type iface, or nil
+func lookupOneof(iface reflect.Type) []reflect.Type {
+	oneofsMu.RLock()
+	ws := oneofs[iface]
+	oneofsMu.RUnlock()
+	return ws
+}
+
+// oneofProperties returns the properties of the fields of the oneof held in interface field f of struct type t, one for
+// the field of each registered wrapper, all located at the interface field
+func oneofProperties(t reflect.Type, f *reflect.StructField, oneof, tagkey string) ([]Properties, error) {
+	if f.Type.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("%s_oneof field must be an interface, not %s", tagkey, f.Type)
+	}
+	wrappers := lookupOneof(f.Type)
+	if len(wrappers) == 0 {
+		return nil, fmt.Errorf("no wrapper types of %s have been registered with RegisterOneof", f.Type)
+	}
+
+	props := make([]Properties, 0, len(wrappers))
+	for _, w := range wrappers {
+		wsprop, err := getPropertiesLocked(w, tagkey)
+		if err != nil {
+			return nil, err
+		}
+		if len(wsprop.props) != 1 {
+			return nil, fmt.Errorf("oneof wrapper %s must have exactly one protobuf field, not %d", w, len(wsprop.props))
+		}
+		wp := &wsprop.props[0]
+		if wp.oneof != "" || wp.presence != "" || wp.isEmptyOK || wp.isChecksum {
+			return nil, fmt.Errorf("oneof wrapper %s field %s can't have the oneof, presence, emptyok or checksum attributes", w, wp.Name)
+		}
+
+		p := *wp
+		p.origin = t
+		p.offset = f.Offset
+		p.oneof = oneof
+		p.oneofType = f.Type
+		p.wtype = reflect.PtrTo(w)
+		p.wprop = wp
+		p.wfield = f.Name
+		p.enc = (*Buffer).enc_oneof
+		p.size = nil
+		p.dec = (*Buffer).dec_oneof
+		props = append(props, p)
+	}
+	return props, nil
+}
+
+// Encode the field of a oneof held in an interface field, if the interface holds a pointer to the field's wrapper.
+// Since it's the presence of the wrapper which selects the field of the oneof, a zero value is encoded too.
+func (o *Buffer) enc_oneof(p *Properties, base unsafe.Pointer) {
+	w := reflect.NewAt(p.oneofType, unsafe.Pointer(uintptr(base)+p.offset)).Elem().Elem()
+	if !w.IsValid() || w.Type() != p.wtype || w.IsNil() {
+		return
+	}
+	n := len(o.buf)
+	p.wprop.enc(o, p.wprop, unsafe.Pointer(w.Pointer()))
+	if len(o.buf) == n {
+		p.wprop.encZero(o)
+	}
+}
+
+// Decode the field of a oneof held in an interface field. When the interface already holds the field's wrapper the
+// field is decoded into it (so a message merges, as usual). Otherwise a new wrapper replaces whatever the interface held.
+func (o *Buffer) dec_oneof(p *Properties, base unsafe.Pointer) error {
+	v := reflect.NewAt(p.oneofType, unsafe.Pointer(uintptr(base)+p.offset)).Elem()
+	w := v.Elem()
+	if !w.IsValid() || w.Type() != p.wtype || w.IsNil() {
+		w = reflect.New(p.wtype.Elem())
+		v.Set(w)
+	}
+	return p.wprop.dec(o, p.wprop, unsafe.Pointer(w.Pointer()))
+}
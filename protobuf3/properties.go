@@ -40,13 +40,18 @@ package protobuf3
  */
 
 import (
+	"bytes"
+	"container/heap"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -60,6 +65,12 @@ const debug bool = false
 // This isn't needed unless you are dealing with old protobuf v2 generated types like some unit tests do
 var XXXHack = false
 
+// TagKey is the key of the struct field tags which hold the protobuf encoding information. The map key and value
+// tags use the same key with "_key" and "_val" appended. The default of "protobuf" matches golang/protobuf. Change it
+// if your structs' "protobuf" tags are already used by another encoder (the canonical golang/protobuf, for instance),
+// and you want a parallel set of tags for this package. Properties are cached separately for each TagKey.
+var TagKey = "protobuf"
+
 // MakeFieldName is a pointer to a function which returns what should be the name of field f in the protobuf definition of type t.
 // You can replace this with your own function before calling AsProtobuf[Full]() to control the field names yourself.
 var MakeFieldName func(f string, t reflect.Type) string = MakeLowercaseFieldName
@@ -120,6 +131,13 @@ type encoder func(p *Buffer, prop *Properties, base unsafe.Pointer)
 // A valueEncoder encodes a single integer in a particular encoding.
 type valueEncoder func(o *Buffer, x uint64)
 
+// Sizers are defined in size.go
+// A sizer returns the length of what the field's encoder would output.
+type sizer func(p *Buffer, prop *Properties, base unsafe.Pointer) int
+
+// A valueSizer returns the length of what the matching valueEncoder would output.
+type valueSizer func(x uint64) int
+
 // Decoders are defined in decode.go
 // A decoder creates a value from its wire representation.
 // Unrecognized subelements are saved in unrec.
@@ -130,8 +148,60 @@ type valueDecoder func(o *Buffer) (x uint64, err error)
 
 // StructProperties represents properties for all the fields of a struct.
 type StructProperties struct {
+	lastUsed uint64       // value of propertiesClock when this was last returned by GetProperties. Only maintained when the cache is bounded. Must be first to be 64-bit aligned for sync/atomic
 	props    []Properties // properties for each field encoded in protobuf, ordered by tag id
 	reserved []uint32     // all the reserved tags
+	checksum bool         // true if the last field in props is marked "checksum" and holds a CRC32 of the preceding fields
+
+	maskOffset uintptr // byte offset of the XXX_PresenceMask field, if the struct has one
+	maskSize   uintptr // size of the XXX_PresenceMask field (1, 2, 4 or 8 bytes), or 0 if the struct has none
+
+	oneofs []string // names of the oneof groups of the fields, in the order of the first field of each group
+
+	unknown       bool    // true if the struct has a []byte field tagged `protobuf:"unknown"`
+	unknownOffset uintptr // byte offset of the unknown field, if the struct has one
+}
+
+// unknownFields returns a pointer to the []byte field of the struct at base in which unknown fields are kept. The struct must have one.
+func (sp *StructProperties) unknownFields(base unsafe.Pointer) *[]byte {
+	return (*[]byte)(unsafe.Pointer(uintptr(base) + sp.unknownOffset))
+}
+
+// PresenceMaskField is the name of the optional field of a struct in which the presence of the struct's other fields
+// is recorded. It must be an unsigned integer with an explicit size. Bit i of the mask corresponds to the i'th field
+// in tag order (that is, the i'th field in the .proto generated by AsProtobuf). Marshal sets the bits of the fields it
+// emits and clears the others, so NOTE WELL marshaling a struct with a presence mask writes to the struct. Unmarshal
+// sets the bits of the fields it decodes. The mask field itself is not encoded.
+const PresenceMaskField = "XXX_PresenceMask"
+
+// clearPresenceMask zeros the presence mask of the struct at base, if it has one
+func (sp *StructProperties) clearPresenceMask(base unsafe.Pointer) {
+	ptr := unsafe.Pointer(uintptr(base) + sp.maskOffset)
+	switch sp.maskSize {
+	case 1:
+		*(*uint8)(ptr) = 0
+	case 2:
+		*(*uint16)(ptr) = 0
+	case 4:
+		*(*uint32)(ptr) = 0
+	case 8:
+		*(*uint64)(ptr) = 0
+	}
+}
+
+// setPresenceBit sets the bit of field sp.props[i] in the presence mask of the struct at base, if it has one
+func (sp *StructProperties) setPresenceBit(base unsafe.Pointer, i int) {
+	ptr := unsafe.Pointer(uintptr(base) + sp.maskOffset)
+	switch sp.maskSize {
+	case 1:
+		*(*uint8)(ptr) |= 1 << uint(i)
+	case 2:
+		*(*uint16)(ptr) |= 1 << uint(i)
+	case 4:
+		*(*uint32)(ptr) |= 1 << uint(i)
+	case 8:
+		*(*uint64)(ptr) |= 1 << uint(i)
+	}
 }
 
 // Implement the sorting interface so we can sort the fields in tag order, as recommended by the spec.
@@ -147,11 +217,31 @@ func (sp *StructProperties) asProtobuf(t reflect.Type, tname string) string {
 	lines := []string{fmt.Sprintf("message %s {", tname)}
 	for i := range sp.props {
 		pp := &sp.props[i]
-		if pp.Wire != "-" {
-			lines = append(lines, fmt.Sprintf("  %s%s %s = %d;", pp.optional(), pp.asProtobuf, pp.protobufFieldName(t), pp.Tag))
+		if pp.Wire != "-" && pp.oneofGroup == 0 {
+			def, typ := splitInline(pp.asProtobuf)
+			lines = append(lines, fmt.Sprintf("  %s%s%s %s = %d%s;", def, pp.optional(), typ, pp.protobufFieldName(t), pp.Tag, pp.fieldOptions()))
 		}
 	}
-	if len(sp.reserved) != 0 {
+	for g, name := range sp.oneofs {
+		// the fields of the oneof are declared inside a oneof block, and any inline type definitions in front of it
+		var defs, fields []string
+		for i := range sp.props {
+			pp := &sp.props[i]
+			if pp.oneofGroup == g+1 {
+				def, typ := splitInline(pp.asProtobuf)
+				if def != "" {
+					defs = append(defs, "  "+def[:strings.LastIndexByte(def, '\n')])
+				}
+				fields = append(fields, fmt.Sprintf("    %s %s = %d%s;", typ, pp.protobufFieldName(t), pp.Tag, pp.fieldOptions()))
+			}
+		}
+		lines = append(lines, defs...)
+		lines = append(lines, fmt.Sprintf("  oneof %s {", name))
+		lines = append(lines, fields...)
+		lines = append(lines, "  }")
+	}
+	ranges, names := lookupReservedTags(t)
+	if len(sp.reserved) != 0 || len(ranges) != 0 {
 		var b strings.Builder
 		b.WriteString("  reserved ")
 		sep := ""
@@ -159,6 +249,23 @@ func (sp *StructProperties) asProtobuf(t reflect.Type, tname string) string {
 			fmt.Fprintf(&b, "%s%d", sep, r)
 			sep = ", "
 		}
+		for _, r := range ranges {
+			b.WriteString(sep)
+			b.WriteString(r.String())
+			sep = ", "
+		}
+		b.WriteByte(';')
+		lines = append(lines, b.String())
+	}
+	if len(names) != 0 {
+		var b strings.Builder
+		b.WriteString("  reserved ")
+		for i, n := range names {
+			if i != 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%q", n)
+		}
 		b.WriteByte(';')
 		lines = append(lines, b.String())
 	}
@@ -174,6 +281,62 @@ type Reserved [0]byte
 
 var reservedType = reflect.TypeOf((*Reserved)(nil)).Elem()
 
+// TagRange is an inclusive range of protobuf IDs. A single ID has From == To.
+type TagRange struct {
+	From, To uint32
+}
+
+// String formats the range the way it is written in a `reserved` statement in a .proto file
+func (r TagRange) String() string {
+	if r.From == r.To {
+		return strconv.FormatUint(uint64(r.From), 10)
+	}
+	return fmt.Sprintf("%d to %d", r.From, r.To)
+}
+
+// Contains returns true if tag is within the range
+func (r TagRange) Contains(tag uint32) bool {
+	return r.From <= tag && tag <= r.To
+}
+
+type reservedTags struct {
+	ranges []TagRange
+	names  []string
+}
+
+var (
+	reservedTagsMu sync.RWMutex
+	reservedTagsOf = make(map[reflect.Type]reservedTags)
+)
+
+// ReserveTags registers ranges of protobuf IDs and field names of struct type t which are retired and must not be reused.
+// AsProtobuf emits them as `reserved` statements, and using a reserved ID in t is an error, just as with a Reserved field.
+// Like the Reserved field, this lets the IDs and names of deleted fields be remembered, but without changing the
+// struct (which might not be yours to change). Since the properties of struct types are cached, the tags must be
+// reserved before t is first marshaled or unmarshaled (typically in an init() func).
+func ReserveTags(t reflect.Type, ranges []TagRange, names []string) error {
+	for _, r := range ranges {
+		if r.From == 0 || r.To < r.From {
+			return fmt.Errorf("protobuf3: invalid reserved tag range %d to %d", r.From, r.To)
+		}
+	}
+	reservedTagsMu.Lock()
+	reservedTagsOf[t] = reservedTags{
+		ranges: append([]TagRange(nil), ranges...),
+		names:  append([]string(nil), names...),
+	}
+	reservedTagsMu.Unlock()
+	return nil
+}
+
+// lookupReservedTags returns the ranges and names registered for t by ReserveTags
+func lookupReservedTags(t reflect.Type) ([]TagRange, []string) {
+	reservedTagsMu.RLock()
+	r := reservedTagsOf[t]
+	reservedTagsMu.RUnlock()
+	return r.ranges, r.names
+}
+
 // parse the protobuf tag of a Reserved field
 func (sp *StructProperties) parseReserved(tag string) error {
 	for _, s := range strings.Split(tag, ",") {
@@ -206,12 +369,21 @@ func (p *Properties) optional() string {
 	// NOTE: we allow "optional" to be applied to all field types, even those for which, in the Go struct definition, there is no good way to tell the difference
 	// between the default value and absence of the value. (an int32 for example, or pretty much nothing but pointers and maps (which are pointers underneath))
 	// What isOptional does is apply
-	if p.isOptional {
+	// Fields with a presence bit or an emptyok companion field do have explicit presence, so they are always optional.
+	if p.isOptional || p.presence != "" || p.isEmptyOK {
 		return "optional "
 	}
 	return ""
 }
 
+// fieldOptions returns the options of the field in the .proto, including the leading space, or "" if there are none
+func (p *Properties) fieldOptions() string {
+	if p.deprecated {
+		return " [deprecated = true]"
+	}
+	return ""
+}
+
 // MakeLowercaseFieldName returns a reasonable lowercase field name
 func MakeLowercaseFieldName(f string, t reflect.Type) string {
 	// To make people who use other languages happy it would be nice if our field names were like most and were lowercase.
@@ -333,7 +505,23 @@ func AsProtobufFull2(t reflect.Type, extra_package_headers []string, more ...ref
 			}
 			for i := range p.props {
 				pp := &p.props[i]
+				if pp.etype != nil {
+					// the enum needs to be defined, but has no fields to explore
+					discovered[pp.etype] = struct{}{}
+				}
+				if pp.isDateTime {
+					// the DateTime type gets defined by an import of datetime.proto
+					imported["google/type/datetime.proto"] = struct{}{}
+				}
+				if pp.itype != nil && pp.asProtobuf == "repeated google.protobuf.Any" {
+					// the Any type gets defined by an import of any.proto
+					imported["google/protobuf/any.proto"] = struct{}{}
+				}
 				tt := pp.Subtype()
+				if tt == nil && pp.mvalprop != nil {
+					// the map's values are messages
+					tt = pp.mvalprop.Subtype()
+				}
 				if tt != nil {
 					if _, ok := discovered[tt]; !ok {
 						// it's a new type of field
@@ -345,10 +533,13 @@ func AsProtobufFull2(t reflect.Type, extra_package_headers []string, more ...ref
 							// this type has a custom protobuf definition. it presumably encodes its own types
 							discovered[tt] = struct{}{}
 						case tt.Kind() == reflect.Struct:
-							switch tt {
-							case time_Time_type:
+							switch _, std := stdMessageTypes[tt]; {
+							case tt == time_Time_type:
 								// the timestamp type get defined by an import of timestamp.proto
 								discovered[tt] = struct{}{}
+							case std:
+								// the message is defined by us, and has no fields to explore
+								discovered[tt] = struct{}{}
 							default:
 								// put this new type in the todo table if it isn't already there
 								// (the duplicate insert when it is already present is a no-op)
@@ -387,6 +578,9 @@ func AsProtobufFull2(t reflect.Type, extra_package_headers []string, more ...ref
 		var imports []string
 		var external bool
 		switch {
+		case lookupEnum(t) != nil:
+			definition = enumAsProtobuf(t)
+
 		case t == time_Time_type:
 			// the timestamp type gets defined by an import
 			imports = []string{"google/protobuf/timestamp.proto"}
@@ -397,6 +591,9 @@ func AsProtobufFull2(t reflect.Type, extra_package_headers []string, more ...ref
 			imports = []string{"google/protobuf/duration.proto"}
 			external = true
 
+		case stdMessageTypes[t].definition != "":
+			definition = stdMessageTypes[t].definition
+
 		case isAppender(ptr_t) || isMarshaler(ptr_t):
 			// we can't define a custom type automatically. see if it can tell us, and otherwise remind the human to do it.
 			switch {
@@ -471,20 +668,76 @@ type Properties struct {
 
 	enc         encoder
 	valEnc      valueEncoder      // set for bool and numeric types only
+	size        sizer             // computes the length of enc's output, or nil if the field must be encoded to find it
+	valSize     valueSizer        // set whenever valEnc is
 	offset      uintptr           // byte offset of this field within the struct
+	origin      reflect.Type      // the struct type which declared this field (which differs from the enclosing struct for fields promoted from embedded structs)
 	tagcode     string            // encoding of EncodeVarint((Tag<<3)|WireType), stored in a string for efficiency
 	stype       reflect.Type      // set for struct types and time.Duration only
 	sprop       *StructProperties // set for struct types only
 	isMarshaler bool              // true if the type implements Marshaler and marshals/unmarshals itself
 	isAppender  bool              // true if the type implements Appender and helps marshal itself into a *Buffer
+	isChecksum  bool              // true if the "checksum" attribute was specified in the protobuf: tag. The field's value is computed when encoding as the CRC32 of the previous fields of the message, and verified when decoding
+	isDateTime  bool              // true if the "datetime" attribute was specified in the protobuf: tag. The time.Time field is encoded as a google.type.DateTime rather than a google.protobuf.Timestamp
+	isRFC3339   bool              // true if the "rfc3339" attribute was specified in the protobuf: tag. The time.Time field is encoded as an RFC 3339 string rather than a google.protobuf.Timestamp
+	isBase64    bool              // true if the "base64" attribute was specified in the protobuf: tag. The []byte field is encoded as a string holding its standard (padded) base64 encoding rather than as bytes
+	trunc       time.Duration     // set if the "trunc=" attribute was specified in the protobuf: tag. The time.Time field is truncated to a multiple of this duration when encoded and decoded, which shrinks the nanoseconds of the Timestamp
+	heapSorted  bool              // true if the "heapsorted" attribute was specified in the protobuf: tag. The repeated field, whose type implements heap.Interface, is encoded in the order its elements would be popped from the heap
+	isSorted    bool              // true if the "sorted" attribute was specified in the protobuf: tag. The elements of the repeated field are sorted (scalars by value, messages by their encoding) before they are encoded
+	fixedNanos  bool              // true if the "fixed_nanos" attribute was specified in the protobuf: tag. The time.Time field is encoded as its UnixNano() in a fixed64 rather than as a google.protobuf.Timestamp
+	isDelta     bool              // true if the "delta" attribute was specified in the protobuf: tag. The []time.Time field is encoded as one bytes field holding the UnixNano() of the first time and the differences between each successive time, as zigzag varints
+	isNanos     bool              // true if the "nanos" attribute was specified in the protobuf: tag. The time.Duration field is encoded as an integer count of nanoseconds rather than as a google.protobuf.Duration
+	isTypeURL   bool              // true if the "typeurl" attribute was specified in the protobuf: tag. The string field is encoded with the type URL registered for the enclosing struct with RegisterProtoName rather than with its value
+	typeURL     string            // set for typeurl fields only: the type URL of the enclosing struct
+	isEncrypted bool              // true if the "encrypt" attribute was specified in the protobuf: tag. The encoding of the field is encrypted with the Cipher of the Marshal/UnmarshalOptions, and is encoded as a bytes field
+	isRecord    bool              // true if the "record" attribute was specified in the protobuf: tag. The slice of structs is encoded as one bytes field holding the concatenated fixed-width fields of the elements
+	isFlatMap   bool              // true if the "flatmap" attribute was specified in the protobuf: tag. The map[string]string field is encoded as a repeated string of alternating keys and values, rather than as map entries
+	stringList  bool              // true if the "stringlist" attribute was specified in the protobuf: tag. The []string values of the map field are encoded as StringList messages, rather than as repeated strings within the map entries
+	presence    string            // "bitmapField:bitIndex" if the "presence=" attribute was specified in the protobuf: tag. The field is encoded if and only if the bit is set in the bitmap field, and decoding the field sets the bit
+	isEmptyOK   bool              // true if the "emptyok" attribute was specified in the protobuf: tag. The string or []byte field is encoded even when empty if its companion bool field <Name>Present is true, and decoding the field sets the companion field
+	oneof       string            // the group name if the "oneof=" attribute was specified in the protobuf: tag. At most one field of the group may be set when encoding, and decoding a field of the group zeros the others
+	oneofGroup  int               // set for oneof fields only: 1 + the index of the field's group in StructProperties.oneofs
+	oneofType   reflect.Type      // set for oneof fields only: the type of the field, so it can be zeroed
+	deprecated  bool              // true if the "deprecated" attribute was specified in the protobuf: tag. The field is marked deprecated in the generated .proto, and OnDeprecatedField is called when the field is encoded or decoded
 	isOptional  bool              // true if the "optional" attribute was specified in the protobuf: tag. This code (for the obvious reason that it doesn't generate the structs we unmarshal into) largely ignores "optional", but it is copied into the generated .proto, and protoc or some other protobuf code generator will obey it
 
+	etype reflect.Type // set for registered enum types only
+
+	bigEndian bool // true if the enclosing struct's ProtoBigEndian() returns true. fixed32 and fixed64 values are encoded big-endian
+
+	presenceOffset uintptr // set for fields with a presence bit only: byte offset of the presence bitmap field within the struct
+	presenceSize   uintptr // size of the presence bitmap field (1, 2, 4 or 8 bytes)
+	presenceBit    uint    // index of this field's bit in the presence bitmap
+
 	mtype    reflect.Type // set for map types only
 	mkeyprop *Properties  // set for map types only
 	mvalprop *Properties  // set for map types only
+	mapOrder string       // "sorted" or "unsorted" if the "order=" attribute was specified in the protobuf: tag. Otherwise the order of the map entries is chosen by MarshalOptions.Deterministic
 
 	length uint // set for array types only
 
+	rtype   reflect.Type  // set for "record" slices only: the type of the elements
+	rfields []recordField // set for "record" slices only: the layout of the elements' fields
+	rsize   uintptr       // set for "record" slices only: the encoded size of one element
+
+	atype reflect.Type // set for pointer to array types only
+	aprop *Properties  // set for pointer to array types only: the properties of the array
+
+	ftype reflect.Type // set for func types only
+	fprop *Properties  // set for func types only: the properties of the value returned by the function
+
+	eprop *Properties // set for encrypted fields only: the properties of the field before it was encrypted
+
+	otype reflect.Type // set for "sorted" fields only: the slice or array type of the field
+	oprop *Properties  // set for "sorted" fields only: the properties of the field before it was sorted, at offset 0 so they can encode a sorted copy of the field
+
+	wtype  reflect.Type // set for the fields of a oneof held in an interface only: the pointer to wrapper struct type the interface holds when the field is set
+	wprop  *Properties  // set for the fields of a oneof held in an interface only: the properties of the wrapper's field
+	wfield string       // set for the fields of a oneof held in an interface only: the name of the interface field
+
+	itype    reflect.Type   // set for interface types and slices of interface types only
+	ifactory func() Message // set for interface types only, if a factory was registered with RegisterMessageFactory
+
 	dec    decoder
 	valDec valueDecoder // set for bool and numeric types only
 }
@@ -536,26 +789,31 @@ func (p *Properties) Parse(s string) (IntEncoder, bool, error) {
 	switch fields[0] {
 	case "varint":
 		p.valEnc = (*Buffer).EncodeVarint
+		p.valSize = SizeVarint
 		p.valDec = (*Buffer).DecodeVarint
 		p.WireType = WireVarint
 		enc = VarintEncoder
 	case "fixed32":
 		p.valEnc = (*Buffer).EncodeFixed32
+		p.valSize = sizeFixed32
 		p.valDec = (*Buffer).DecodeFixed32
 		p.WireType = WireFixed32
 		enc = Fixed32Encoder
 	case "fixed64":
 		p.valEnc = (*Buffer).EncodeFixed64
+		p.valSize = sizeFixed64
 		p.valDec = (*Buffer).DecodeFixed64
 		p.WireType = WireFixed64
 		enc = Fixed64Encoder
 	case "zigzag32":
 		p.valEnc = (*Buffer).EncodeZigzag32
+		p.valSize = sizeZigzag32
 		p.valDec = (*Buffer).DecodeZigzag32
 		p.WireType = WireVarint
 		enc = Zigzag32Encoder
 	case "zigzag64":
 		p.valEnc = (*Buffer).EncodeZigzag64
+		p.valSize = sizeZigzag64
 		p.valDec = (*Buffer).DecodeZigzag64
 		p.WireType = WireVarint
 		enc = Zigzag64Encoder
@@ -577,20 +835,107 @@ func (p *Properties) Parse(s string) (IntEncoder, bool, error) {
 
 	for _, field := range fields[2:] {
 		switch field {
+		case "checksum":
+			p.isChecksum = true
+		case "datetime":
+			p.isDateTime = true
+		case "rfc3339":
+			p.isRFC3339 = true
+		case "base64":
+			p.isBase64 = true
+		case "flatmap":
+			p.isFlatMap = true
+		case "stringlist":
+			p.stringList = true
+		case "record":
+			p.isRecord = true
+		case "encrypt":
+			p.isEncrypted = true
+		case "nanos":
+			p.isNanos = true
+		case "fixed_nanos":
+			p.fixedNanos = true
+		case "delta":
+			p.isDelta = true
+		case "sorted":
+			p.isSorted = true
+		case "heapsorted":
+			p.heapSorted = true
+		case "emptyok":
+			p.isEmptyOK = true
+		case "deprecated":
+			p.deprecated = true
+		case "typeurl":
+			p.isTypeURL = true
 		case "optional":
 			p.isOptional = true
 			// and we don't care about any other fields
 			// (if you don't mark slices/arrays/maps with ",rep" that's your own problem; this encoder always repeats those types)
+		case "order=sorted", "order=unsorted":
+			p.mapOrder = field[6:]
+		case "trunc=us":
+			p.trunc = time.Microsecond
+		case "trunc=ms":
+			p.trunc = time.Millisecond
+		case "trunc=s":
+			p.trunc = time.Second
+		default:
+			if strings.HasPrefix(field, "presence=") {
+				p.presence = field[9:]
+			} else if strings.HasPrefix(field, "codec=") {
+				if err := p.setCodec(field[6:]); err != nil {
+					return 0, false, err
+				}
+			} else if strings.HasPrefix(field, "oneof=") {
+				p.oneof = field[6:]
+				if p.oneof == "" {
+					return 0, false, fmt.Errorf("protobuf3: tag of %q has an empty oneof group name", p.Name)
+				}
+			} else if strings.HasPrefix(field, "order=") {
+				return 0, false, fmt.Errorf("protobuf3: tag of %q has unknown map order %q (expected sorted or unsorted)", p.Name, field[6:])
+			} else if strings.HasPrefix(field, "trunc=") {
+				return 0, false, fmt.Errorf("protobuf3: tag of %q has unknown truncation %q (expected us, ms or s)", p.Name, field[6:])
+			}
 		}
 	}
 
+	if p.fixedNanos && p.WireType == WireBytes {
+		// the whole point of fixed_nanos is a constant size
+		p.valEnc = (*Buffer).EncodeFixed64
+		p.valSize = sizeFixed64
+		p.valDec = (*Buffer).DecodeFixed64
+		p.WireType = WireFixed64
+		enc = Fixed64Encoder
+	}
+	if p.bigEndian && !p.isChecksum {
+		switch p.WireType {
+		case WireFixed32:
+			p.valEnc = (*Buffer).encodeFixed32BigEndian
+			p.valSize = sizeFixed32
+			p.valDec = (*Buffer).decodeFixed32BigEndian
+		case WireFixed64:
+			p.valEnc = (*Buffer).encodeFixed64BigEndian
+			p.valSize = sizeFixed64
+			p.valDec = (*Buffer).decodeFixed64BigEndian
+		}
+	}
+	if p.isNanos && p.WireType == WireBytes {
+		// durations are as often negative as not, so unless the tag specified another integer encoding the nanoseconds are zigzag encoded
+		p.valEnc = (*Buffer).EncodeZigzag64
+		p.valSize = sizeZigzag64
+		p.valDec = (*Buffer).DecodeZigzag64
+		p.WireType = WireVarint
+		enc = Zigzag64Encoder
+	}
+
 	return enc, false, nil
 }
 
 // Initialize the fields for encoding and decoding.
-func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name string, int_encoder IntEncoder) error {
+func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name string, int_encoder IntEncoder, tagkey string) error {
 	var err error
 	p.enc = nil
+	p.size = nil
 	p.dec = nil
 	wire := p.WireType
 
@@ -614,6 +959,17 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 	case Zigzag64Encoder:
 		int64_encoder_txt = "sint64"
 	}
+	// native int and uint are declared as the protobuf types which hold what the encoder actually encodes.
+	// varint encodes all the bits of the int, so on platforms where int is 64 bits the 64-bit protobuf types are
+	// the correct ones (declaring them int32 would cause other decoders to truncate large values). fixed64 and zigzag64
+	// encode 64 bits on any platform. Conversely zigzag32 and fixed32 encode only the low 32 bits of a native int.
+	int_encoder_txt, uint_encoder_txt := int32_encoder_txt, uint32_encoder_txt
+	if int_encoder_txt == "" || (int_encoder == VarintEncoder && strconv.IntSize == 64) {
+		int_encoder_txt = int64_encoder_txt
+	}
+	if uint_encoder_txt == "" || (int_encoder == VarintEncoder && strconv.IntSize == 64) {
+		uint_encoder_txt = uint64_encoder_txt
+	}
 
 	// can t1 marshal itself?
 	ptr_t1 := reflect.PtrTo(t1)
@@ -638,66 +994,75 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 
 		case reflect.Bool:
 			p.enc = (*Buffer).enc_bool
+			p.size = (*Buffer).size_bool
 			p.dec = (*Buffer).dec_bool
 			p.asProtobuf = "bool"
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Int:
 			p.enc = (*Buffer).enc_int
+			p.size = (*Buffer).size_int
 			p.dec = (*Buffer).dec_int
-			p.asProtobuf = int32_encoder_txt
+			p.asProtobuf = int_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Uint:
 			p.enc = (*Buffer).enc_uint
+			p.size = (*Buffer).size_uint
 			p.dec = (*Buffer).dec_int // signness doesn't matter when decoding. either the top bit is set or it isn't
-			p.asProtobuf = uint32_encoder_txt
+			p.asProtobuf = uint_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Int8:
 			p.enc = (*Buffer).enc_int8
+			p.size = (*Buffer).size_int8
 			p.dec = (*Buffer).dec_int8
 			p.asProtobuf = int32_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Uint8:
 			p.enc = (*Buffer).enc_uint8
+			p.size = (*Buffer).size_uint8
 			p.dec = (*Buffer).dec_int8
 			p.asProtobuf = uint32_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Int16:
 			p.enc = (*Buffer).enc_int16
+			p.size = (*Buffer).size_int16
 			p.dec = (*Buffer).dec_int16
 			p.asProtobuf = int32_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Uint16:
 			p.enc = (*Buffer).enc_uint16
+			p.size = (*Buffer).size_uint16
 			p.dec = (*Buffer).dec_int16
 			p.asProtobuf = uint32_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Int32:
 			p.enc = (*Buffer).enc_int32
+			p.size = (*Buffer).size_int32
 			p.dec = (*Buffer).dec_int32
 			p.asProtobuf = int32_encoder_txt
 			if p.valEnc == nil { // note it is safe, though peculiar, for an int32 to have a wiretype of fixed64
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Uint32:
 			p.enc = (*Buffer).enc_uint32
+			p.size = (*Buffer).size_uint32
 			p.dec = (*Buffer).dec_int32
 			p.asProtobuf = uint32_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Int64:
 			// this might be a time.Duration, or it might be an ordinary int64
@@ -706,62 +1071,118 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 			if p.WireType == WireBytes && t1 == time_Duration_type {
 				p.stype = time_Duration_type
 				p.enc = (*Buffer).enc_time_Duration
+				p.size = (*Buffer).size_time_Duration
 				p.dec = (*Buffer).dec_time_Duration
 				p.asProtobuf = "google.protobuf.Duration"
 			} else {
 				p.enc = (*Buffer).enc_int64
+				p.size = (*Buffer).size_int64
 				p.dec = (*Buffer).dec_int64
 				p.asProtobuf = int64_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			}
 		case reflect.Uint64:
 			p.enc = (*Buffer).enc_int64
+			p.size = (*Buffer).size_int64
 			p.dec = (*Buffer).dec_int64
 			p.asProtobuf = uint64_encoder_txt
 			if p.valEnc == nil {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Float32:
 			p.enc = (*Buffer).enc_uint32 // can just treat them as bits
+			p.size = (*Buffer).size_uint32
 			p.dec = (*Buffer).dec_int32
 			p.asProtobuf = "float"
 			if p.valEnc == nil || wire != WireFixed32 { // the way we encode and decode float32 at the moment means we can only support fixed32
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.Float64:
 			p.enc = (*Buffer).enc_int64 // can just treat them as bits
+			p.size = (*Buffer).size_int64
 			p.dec = (*Buffer).dec_int64
 			p.asProtobuf = "double"
 			if p.valEnc == nil || wire != WireFixed64 { // the way we encode and decode float64 at the moment means we can only support fixed64
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 		case reflect.String:
 			p.enc = (*Buffer).enc_string
+			p.size = (*Buffer).size_string
 			p.dec = (*Buffer).dec_string
 			p.asProtobuf = "string"
 			if wire != WireBytes {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 
 		case reflect.Struct:
+			if at, ok := atomicTypes[t1]; ok {
+				// the field is encoded like the value the atomic type holds, using the atomic type's Load and Store methods
+				err := p.setEncAndDec(at.t, f, name, int_encoder, tagkey)
+				if err != nil {
+					return err
+				}
+				p.enc = at.enc
+				p.size = nil
+				p.dec = at.dec
+				break
+			}
+			if mt, ok := stdMessageTypes[t1]; ok {
+				p.stype = t1
+				p.enc = (*Buffer).enc_std_message
+				p.dec = (*Buffer).dec_std_message
+				p.asProtobuf = mt.name
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				break
+			}
+			if t1 == time_Time_type && p.fixedNanos {
+				// time.Time encodes as an integer, not as a message
+				p.asProtobuf = "sfixed64"
+				p.enc = (*Buffer).enc_time_Time_fixed_nanos
+				p.dec = (*Buffer).dec_time_Time_fixed_nanos
+				if wire != WireFixed64 {
+					return wiretypeError(name, t1, wire)
+				}
+				break
+			}
 			p.stype = t1
-			p.sprop, err = getPropertiesLocked(t1)
+			p.sprop, err = getPropertiesLocked(t1, tagkey)
 			if err != nil {
 				return err
 			}
 			p.asProtobuf = p.stypeAsProtobuf()
-			switch t1 {
-			case time_Time_type:
+			switch {
+			case t1 == time_Time_type && p.isDateTime:
+				// time.Time encodes as a google.type.DateTime, which has nothing in common with time_Time_sprop
+				p.stype = nil
+				p.sprop = nil
+				p.asProtobuf = "google.type.DateTime"
+				p.enc = (*Buffer).enc_time_DateTime
+				p.dec = (*Buffer).dec_time_DateTime
+			case t1 == time_Time_type && p.isRFC3339:
+				// time.Time encodes as a string
+				p.stype = nil
+				p.sprop = nil
+				p.asProtobuf = "string"
+				p.enc = (*Buffer).enc_time_RFC3339
+				p.dec = (*Buffer).dec_time_RFC3339
+			case t1 == time_Time_type && p.trunc != 0:
+				p.enc = (*Buffer).enc_time_Time_trunc
+				p.dec = (*Buffer).dec_time_Time_trunc
+			case t1 == time_Time_type:
 				p.enc = (*Buffer).enc_struct_message // time.Time encodes as a struct with 1 (made up) field
 				p.dec = (*Buffer).dec_time_Time      // but it decodes with a custom function
+				p.size = (*Buffer).size_struct_message
 			default:
 				p.enc = (*Buffer).enc_struct_message
+				p.size = (*Buffer).size_struct_message
 				p.dec = (*Buffer).dec_struct_message
 			}
 			if wire != WireBytes {
-				return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+				return wiretypeError(name, t1, wire)
 			}
 
 		case reflect.Ptr:
@@ -786,124 +1207,177 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 			if isAsProtobuf3er(t1) || isAsV1Protobuf3er(t1) {
 				p.stype = t2
 			}
+			if t2 == bytes_Buffer_type {
+				// a *bytes.Buffer encodes its current contents, without draining them
+				p.enc = (*Buffer).enc_ptr_bytes_Buffer
+				p.dec = (*Buffer).dec_ptr_bytes_Buffer
+				p.asProtobuf = "bytes"
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				break
+			}
+			if mt, ok := stdMessageTypes[t2]; ok {
+				p.stype = t2
+				p.enc = (*Buffer).enc_ptr_std_message
+				p.dec = (*Buffer).dec_ptr_std_message
+				p.asProtobuf = mt.name
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				break
+			}
 
 			switch t2.Kind() {
 			default:
 				return fmt.Errorf("protobuf3: no encoder function for %s -> %s", t1, t2.Name())
 
+			case reflect.Array:
+				// a *[N]T is encoded like a [N]T, unless it is nil, in which case it is elided
+				p.atype = t2
+				p.aprop = &Properties{}
+				*p.aprop = *p
+				p.aprop.offset = 0 // the array is reached through the pointer
+				err := p.aprop.setEncAndDec(t2, f, name, int_encoder, tagkey)
+				if err != nil {
+					return err
+				}
+				p.enc = (*Buffer).enc_ptr_array
+				p.dec = (*Buffer).dec_ptr_array
+				p.asProtobuf = p.aprop.asProtobuf
+				p.stype = p.aprop.stype
+				p.sprop = p.aprop.sprop
+				wire = p.aprop.WireType
+
 			case reflect.Bool:
 				p.enc = (*Buffer).enc_ptr_bool
+				p.size = (*Buffer).size_ptr_bool
 				p.dec = (*Buffer).dec_ptr_bool
 				p.asProtobuf = "bool"
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int:
 				p.enc = (*Buffer).enc_ptr_int
+				p.size = (*Buffer).size_ptr_int
 				p.dec = (*Buffer).dec_ptr_int
-				p.asProtobuf = int32_encoder_txt
+				p.asProtobuf = int_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint:
 				p.enc = (*Buffer).enc_ptr_uint
+				p.size = (*Buffer).size_ptr_uint
 				p.dec = (*Buffer).dec_ptr_int // signness doesn't matter when decoding. either the top bit is set or it isn't
-				p.asProtobuf = uint32_encoder_txt
+				p.asProtobuf = uint_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int8:
 				p.enc = (*Buffer).enc_ptr_int8
+				p.size = (*Buffer).size_ptr_int8
 				p.dec = (*Buffer).dec_ptr_int8
 				p.asProtobuf = int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint8:
 				p.enc = (*Buffer).enc_ptr_uint8
+				p.size = (*Buffer).size_ptr_uint8
 				p.dec = (*Buffer).dec_ptr_int8
 				p.asProtobuf = uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int16:
 				p.enc = (*Buffer).enc_ptr_int16
+				p.size = (*Buffer).size_ptr_int16
 				p.dec = (*Buffer).dec_ptr_int16
 				p.asProtobuf = int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint16:
 				p.enc = (*Buffer).enc_ptr_uint16
+				p.size = (*Buffer).size_ptr_uint16
 				p.dec = (*Buffer).dec_ptr_int16
 				p.asProtobuf = uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int32:
 				p.enc = (*Buffer).enc_ptr_int32
+				p.size = (*Buffer).size_ptr_int32
 				p.dec = (*Buffer).dec_ptr_int32
 				p.asProtobuf = int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint32:
 				p.enc = (*Buffer).enc_ptr_uint32
+				p.size = (*Buffer).size_ptr_uint32
 				p.dec = (*Buffer).dec_ptr_int32
 				p.asProtobuf = uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int64:
 				if p.WireType == WireBytes && t2 == time_Duration_type {
 					p.stype = time_Duration_type
 					p.enc = (*Buffer).enc_ptr_time_Duration
+					p.size = (*Buffer).size_ptr_time_Duration
 					p.dec = (*Buffer).dec_ptr_time_Duration
 					p.asProtobuf = "google.protobuf.Duration"
 				} else {
 					p.enc = (*Buffer).enc_ptr_int64
+					p.size = (*Buffer).size_ptr_int64
 					p.dec = (*Buffer).dec_ptr_int64
 					p.asProtobuf = int64_encoder_txt
 					if p.valEnc == nil {
-						return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+						return wiretypeError(name, t1, wire)
 					}
 				}
 			case reflect.Uint64:
 				p.enc = (*Buffer).enc_ptr_int64
+				p.size = (*Buffer).size_ptr_int64
 				p.dec = (*Buffer).dec_ptr_int64
 				p.asProtobuf = uint64_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Float32:
 				p.enc = (*Buffer).enc_ptr_uint32 // can just treat them as bits
+				p.size = (*Buffer).size_ptr_uint32
 				p.dec = (*Buffer).dec_ptr_int32
 				p.asProtobuf = "float"
 				if p.valEnc == nil || wire != WireFixed32 { // the way we encode and decode float32 at the moment means we can only support fixed32
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Float64:
 				p.enc = (*Buffer).enc_ptr_int64 // can just treat them as bits
+				p.size = (*Buffer).size_ptr_int64
 				p.dec = (*Buffer).dec_ptr_int64
 				p.asProtobuf = "double"
 				if p.valEnc == nil || wire != WireFixed64 { // the way we encode and decode float64 at the moment means we can only support fixed64
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.String:
 				p.enc = (*Buffer).enc_ptr_string
+				p.size = (*Buffer).size_ptr_string
 				p.dec = (*Buffer).dec_ptr_string
 				p.asProtobuf = "string"
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Struct:
 				p.stype = t2
-				p.sprop, err = getPropertiesLocked(t2)
+				p.sprop, err = getPropertiesLocked(t2, tagkey)
 				if err != nil {
 					return err
 				}
 				p.asProtobuf = p.stypeAsProtobuf()
 				p.enc = (*Buffer).enc_ptr_struct_message
+				p.size = (*Buffer).size_ptr_struct_message
 				switch {
 				case t2 == time_Time_type:
 					p.dec = (*Buffer).dec_ptr_time_Time
@@ -911,21 +1385,47 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 					p.dec = (*Buffer).dec_ptr_struct_message
 				}
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 
 				// what about *Slice and *Array types? Fill them in when we need them.
 			}
 
 		case reflect.Slice:
-			// can elements of the slice marshal themselves?
 			t2 := t1.Elem()
+			if p.isRecord {
+				// NOTE WELL this is not a standard protobuf encoding. Both ends must agree to use it
+				err := p.setRecordLayout(t2)
+				if err != nil {
+					return fmt.Errorf("protobuf3: record field %q: %v", name, err)
+				}
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				p.enc = (*Buffer).enc_slice_record
+				p.dec = (*Buffer).dec_slice_record
+				p.asProtobuf = "bytes"
+				break
+			}
+			if p.isDelta && t2 == time_Time_type {
+				// NOTE WELL this is not a standard protobuf encoding. Both ends must agree to use it
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				p.enc = (*Buffer).enc_slice_time_Time_delta
+				p.size = (*Buffer).size_slice_time_Time_delta
+				p.dec = (*Buffer).dec_slice_time_Time_delta
+				p.asProtobuf = "bytes"
+				break
+			}
+
+			// can elements of the slice marshal themselves?
 			if isAppender(reflect.PtrTo(t2)) {
 				p.isAppender = true
 				p.stype = t2
 				p.enc = (*Buffer).enc_slice_appender
 				p.dec = (*Buffer).dec_slice_unmarshaler
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				break
 			}
 			if isMarshaler(reflect.PtrTo(t2)) {
@@ -933,7 +1433,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				p.stype = t2
 				p.enc = (*Buffer).enc_slice_marshaler
 				p.dec = (*Buffer).dec_slice_unmarshaler
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				break
 			}
 
@@ -947,23 +1447,23 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true is implied in protobuf v3
 				p.asProtobuf = "repeated bool"
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int:
 				p.enc = (*Buffer).enc_slice_packed_int
 				p.dec = (*Buffer).dec_slice_packed_int
 				wire = WireBytes // packed=true...
-				p.asProtobuf = "repeated " + int32_encoder_txt
+				p.asProtobuf = "repeated " + int_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint:
 				p.enc = (*Buffer).enc_slice_packed_uint
 				p.dec = (*Buffer).dec_slice_packed_int
 				wire = WireBytes // packed=true...
-				p.asProtobuf = "repeated " + uint32_encoder_txt
+				p.asProtobuf = "repeated " + uint_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int8:
 				p.enc = (*Buffer).enc_slice_packed_int8
@@ -971,10 +1471,11 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint8:
 				p.enc = (*Buffer).enc_slice_byte
+				p.size = (*Buffer).size_slice_byte
 				p.dec = (*Buffer).dec_slice_byte
 				wire = WireBytes // packed=true... even for integers
 				p.asProtobuf = "bytes"
@@ -984,7 +1485,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint16:
 				p.enc = (*Buffer).enc_slice_packed_uint16
@@ -992,85 +1493,118 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int32:
 				p.enc = (*Buffer).enc_slice_packed_int32
+				p.size = (*Buffer).size_slice_packed_int32
 				p.dec = (*Buffer).dec_slice_packed_int32
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed32 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed32
+					p.size = (*Buffer).size_slice_packed_fixed32
 				}
 			case reflect.Uint32:
 				p.enc = (*Buffer).enc_slice_packed_uint32
+				p.size = (*Buffer).size_slice_packed_uint32
 				p.dec = (*Buffer).dec_slice_packed_int32
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed32 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed32
+					p.size = (*Buffer).size_slice_packed_fixed32
 				}
 			case reflect.Int64:
 				if p.WireType == WireBytes && t2 == time_Duration_type {
 					p.stype = time_Duration_type
 					p.enc = (*Buffer).enc_slice_time_Duration
+					p.size = (*Buffer).size_slice_time_Duration
 					p.dec = (*Buffer).dec_slice_time_Duration
 					p.asProtobuf = "repeated google.protobuf.Duration"
 				} else {
 					p.enc = (*Buffer).enc_slice_packed_int64
+					p.size = (*Buffer).size_slice_packed_int64
 					p.dec = (*Buffer).dec_slice_packed_int64
 					wire = WireBytes // packed=true...
 					p.asProtobuf = "repeated " + int64_encoder_txt
 					if p.valEnc == nil {
-						return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+						return wiretypeError(name, t1, wire)
 					}
 				}
+				if p.WireType == WireFixed64 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed64
+					p.size = (*Buffer).size_slice_packed_fixed64
+				}
 			case reflect.Uint64:
 				p.enc = (*Buffer).enc_slice_packed_int64
+				p.size = (*Buffer).size_slice_packed_int64
 				p.dec = (*Buffer).dec_slice_packed_int64
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int64_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed64 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed64
+					p.size = (*Buffer).size_slice_packed_fixed64
 				}
 			case reflect.Float32:
 				// can just treat them as bits
 				p.enc = (*Buffer).enc_slice_packed_uint32
+				p.size = (*Buffer).size_slice_packed_uint32
 				p.dec = (*Buffer).dec_slice_packed_int32
 				p.asProtobuf = "repeated float"
 				if p.valEnc == nil || wire != WireFixed32 { // the way we encode and decode float32 at the moment means we can only support fixed32
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 				wire = WireBytes // packed=true...
+				if host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed32
+					p.size = (*Buffer).size_slice_packed_fixed32
+				}
 			case reflect.Float64:
 				// can just treat them as bits
 				p.enc = (*Buffer).enc_slice_packed_int64
+				p.size = (*Buffer).size_slice_packed_int64
 				p.dec = (*Buffer).dec_slice_packed_int64
 				p.asProtobuf = "repeated double"
 				if p.valEnc == nil || wire != WireFixed64 { // the way we encode and decode float64 at the moment means we can only support fixed64
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 				wire = WireBytes // packed=true...
+				if host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_slice_packed_fixed64
+					p.size = (*Buffer).size_slice_packed_fixed64
+				}
 			case reflect.String:
 				p.enc = (*Buffer).enc_slice_string
+				p.size = (*Buffer).size_slice_string
 				p.dec = (*Buffer).dec_slice_string
 				p.asProtobuf = "repeated string"
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Struct:
 				p.stype = t2
-				p.sprop, err = getPropertiesLocked(t2)
+				p.sprop, err = getPropertiesLocked(t2, tagkey)
 				if err != nil {
 					return err
 				}
 				p.isAppender = isAppender(reflect.PtrTo(t2))
 				p.isMarshaler = isMarshaler(reflect.PtrTo(t2))
 				p.enc = (*Buffer).enc_slice_struct_message
+				p.size = (*Buffer).size_slice_struct_message
 				p.dec = (*Buffer).dec_slice_struct_message
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Ptr:
 				switch t3 := t2.Elem(); t3.Kind() {
@@ -1079,19 +1613,29 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 
 				case reflect.Struct:
 					p.stype = t3
-					p.sprop, err = getPropertiesLocked(t3)
+					p.sprop, err = getPropertiesLocked(t3, tagkey)
 					if err != nil {
 						return err
 					}
 					p.isAppender = isAppender(t2)
 					p.isMarshaler = isMarshaler(t2)
 					p.enc = (*Buffer).enc_slice_ptr_struct_message
+					p.size = (*Buffer).size_slice_ptr_struct_message
 					p.dec = (*Buffer).dec_slice_ptr_struct_message
-					p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+					p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 					if wire != WireBytes {
-						return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+						return wiretypeError(name, t1, wire)
 					}
 				}
+			case reflect.Interface:
+				// each element is encoded as a google.protobuf.Any, using the type URL registered for its dynamic type
+				p.itype = t2
+				p.enc = (*Buffer).enc_slice_interface_any
+				p.dec = (*Buffer).dec_slice_interface_any
+				p.asProtobuf = "repeated google.protobuf.Any"
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
 			case reflect.Slice:
 				switch t2.Elem().Kind() {
 				default:
@@ -1099,8 +1643,12 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 
 				case reflect.Uint8:
 					p.enc = (*Buffer).enc_slice_slice_byte
+					p.size = (*Buffer).size_slice_slice_byte
 					p.dec = (*Buffer).dec_slice_slice_byte
 					p.asProtobuf = "repeated bytes"
+					if wire != WireBytes {
+						return wiretypeError(name, t1, wire)
+					}
 				}
 			}
 
@@ -1122,7 +1670,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				p.stype = t2
 				p.enc = (*Buffer).enc_array_appender
 				p.dec = (*Buffer).dec_array_unmarshaler
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				break
 			}
 			if isMarshaler(reflect.PtrTo(t2)) {
@@ -1131,7 +1679,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				p.stype = t2
 				p.enc = (*Buffer).enc_array_marshaler
 				p.dec = (*Buffer).dec_array_unmarshaler
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				break
 			}
 
@@ -1145,7 +1693,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true is implied in protobuf v3
 				p.asProtobuf = "repeated bool"
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int8:
 				p.enc = (*Buffer).enc_array_packed_int8
@@ -1153,7 +1701,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint8:
 				// arrays of uint8 have a special type in protobuf: "bytes"
@@ -1166,7 +1714,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Uint16:
 				p.enc = (*Buffer).enc_array_packed_uint16
@@ -1174,7 +1722,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Int32:
 				p.enc = (*Buffer).enc_array_packed_int32
@@ -1182,7 +1730,10 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + int32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed32 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed32
 				}
 			case reflect.Uint32:
 				p.enc = (*Buffer).enc_array_packed_uint32
@@ -1190,7 +1741,10 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + uint32_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed32 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed32
 				}
 			case reflect.Int64:
 				if p.WireType == WireBytes && t2 == time_Duration_type {
@@ -1204,16 +1758,22 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 					wire = WireBytes // packed=true...
 					p.asProtobuf = "repeated " + int64_encoder_txt
 					if p.valEnc == nil {
-						return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+						return wiretypeError(name, t1, wire)
 					}
 				}
+				if p.WireType == WireFixed64 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed64
+				}
 			case reflect.Uint64:
 				p.enc = (*Buffer).enc_array_packed_int64
 				p.dec = (*Buffer).dec_array_packed_int64
 				wire = WireBytes // packed=true...
 				p.asProtobuf = "repeated " + uint64_encoder_txt
 				if p.valEnc == nil {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
+				}
+				if p.WireType == WireFixed64 && host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed64
 				}
 			case reflect.Float32:
 				// can just treat them as bits
@@ -1221,36 +1781,42 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 				p.dec = (*Buffer).dec_array_packed_int32
 				p.asProtobuf = "repeated float"
 				if p.valEnc == nil || wire != WireFixed32 { // the way we encode and decode float32 at the moment means we can only support fixed32
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 				wire = WireBytes // packed=true...
+				if host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed32
+				}
 			case reflect.Float64:
 				// can just treat them as bits
 				p.enc = (*Buffer).enc_array_packed_int64
 				p.dec = (*Buffer).dec_array_packed_int64
 				p.asProtobuf = "repeated double"
 				if p.valEnc == nil || wire != WireFixed64 { // the way we encode and decode float64 at the moment means we can only support fixed64
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 				wire = WireBytes // packed=true...
+				if host_little_endian && !p.bigEndian {
+					p.enc = (*Buffer).enc_array_packed_fixed64
+				}
 			case reflect.String:
 				p.enc = (*Buffer).enc_array_string
 				p.dec = (*Buffer).dec_array_string
 				p.asProtobuf = "repeated string"
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Struct:
 				p.stype = t2
-				p.sprop, err = getPropertiesLocked(t2)
+				p.sprop, err = getPropertiesLocked(t2, tagkey)
 				if err != nil {
 					return err
 				}
 				p.enc = (*Buffer).enc_array_struct_message
 				p.dec = (*Buffer).dec_array_struct_message
-				p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+				p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 				if wire != WireBytes {
-					return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+					return wiretypeError(name, t1, wire)
 				}
 			case reflect.Ptr:
 				switch t3 := t2.Elem(); t3.Kind() {
@@ -1259,7 +1825,7 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 
 				case reflect.Struct:
 					p.stype = t3
-					p.sprop, err = getPropertiesLocked(t3)
+					p.sprop, err = getPropertiesLocked(t3, tagkey)
 					if err != nil {
 						return err
 					}
@@ -1267,15 +1833,31 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 					p.isMarshaler = isMarshaler(t2)
 					p.enc = (*Buffer).enc_array_ptr_struct_message
 					p.dec = (*Buffer).dec_array_ptr_struct_message
-					p.asProtobuf = "repeated " + p.stypeAsProtobuf()
+					p.asProtobuf = repeatedAsProtobuf(p.stypeAsProtobuf())
 					if wire != WireBytes {
-						return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s", name, t1, wire)
+						return wiretypeError(name, t1, wire)
 					}
 				}
 			}
 
 		case reflect.Map:
+			if p.isFlatMap {
+				// NOTE WELL this is not a standard protobuf encoding. Both ends must agree to use it
+				if t1.Key().Kind() != reflect.String || t1.Elem().Kind() != reflect.String {
+					return fmt.Errorf("protobuf3: flatmap field %q must be a map[string]string, not %s", name, t1)
+				}
+				if wire != WireBytes {
+					return wiretypeError(name, t1, wire)
+				}
+				p.mtype = t1
+				p.enc = (*Buffer).enc_flatmap
+				p.dec = (*Buffer).dec_flatmap
+				p.asProtobuf = "repeated string"
+				break
+			}
+
 			p.enc = (*Buffer).enc_new_map
+			p.size = (*Buffer).size_new_map
 			p.dec = (*Buffer).dec_new_map
 
 			if p.WireType != WireBytes {
@@ -1285,53 +1867,109 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 			}
 
 			p.mtype = t1
-			p.mkeyprop = &Properties{}
-			key_tag := f.Tag.Get("protobuf_key")
+			p.mkeyprop = &Properties{bigEndian: p.bigEndian}
+			key_tag := f.Tag.Get(tagkey + "_key")
 			if key_tag == "" {
-				err := fmt.Errorf("protobuf3: %s.%s lacks a protobuf_key tag", t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s lacks a %s_key tag", t1.String(), name, tagkey)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
-			skip, err := p.mkeyprop.init(p.mtype.Key(), "Key", key_tag, nil)
+			skip, err := p.mkeyprop.init(p.mtype.Key(), "Key", key_tag, nil, tagkey)
 			if err != nil {
 				return fmt.Errorf("protobuf3: while parsing the proto_key tag (%s) of %s.%s: %v", key_tag, t1.String(), name, err)
 			}
 			if skip {
-				err := fmt.Errorf("protobuf3: %s.%s protobuf_key tag cannot be \"-\"", t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s %s_key tag cannot be \"-\"", t1.String(), name, tagkey)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				return err
+			}
+			if !isLegalMapKey(p.mkeyprop.asProtobuf) {
+				// protoc rejects floating point, bytes, enum and message map keys, so we do too
+				err := fmt.Errorf("protobuf3: %s.%s map key type %s (%s) is not a legal protobuf map key; keys must be integers, bool or string", t1.String(), name, p.mtype.Key(), p.mkeyprop.asProtobuf)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
 			if p.mkeyprop.Tag != 1 {
 				// treat non-traditional map tags as an error since they won't be compatible with other protobuf marshalers
-				err := fmt.Errorf("protobuf3: %s.%s protobuf_key tag (%s) doesn't use id 1", key_tag, t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s %s_key tag (%s) doesn't use id 1", t1.String(), name, tagkey, key_tag)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
 
-			p.mvalprop = &Properties{}
-			val_tag := f.Tag.Get("protobuf_val")
+			p.mvalprop = &Properties{bigEndian: p.bigEndian}
+			val_tag := f.Tag.Get(tagkey + "_val")
 			if val_tag == "" {
-				err := fmt.Errorf("protobuf3: %s.%s lacks a protobuf_val tag", t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s lacks a %s_val tag", t1.String(), name, tagkey)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
-			skip, err = p.mvalprop.init(p.mtype.Elem(), "Value", val_tag, nil)
+			// the value's name is used to name any anonymous struct type of the values, so make it unique within the enclosing message
+			skip, err = p.mvalprop.init(p.mtype.Elem(), name+"Value", val_tag, nil, tagkey)
 			if err != nil {
 				return fmt.Errorf("protobuf3: while parsing the proto_val tag (%s) of %s.%s: %v", val_tag, t1.String(), name, err)
 			}
 			if skip {
-				err := fmt.Errorf("protobuf3: %s.%s protobuf_val tag cannot be \"-\"", t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s %s_val tag cannot be \"-\"", t1.String(), name, tagkey)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
+			if p.stringList {
+				// protobuf map values can't be repeated, so each []string (of a url.Values or http.Header, for instance) is
+				// encoded as a StringList message, whose memory layout is the same as the []string's
+				if t2 := p.mtype.Elem(); t2.Kind() != reflect.Slice || t2.Elem().Kind() != reflect.String || p.mvalprop.WireType != WireBytes {
+					return fmt.Errorf("protobuf3: stringlist field %q must be a map with []string values encoded as bytes, not %s", name, t1)
+				}
+				p.mvalprop.stype = stringListType
+				p.mvalprop.sprop, err = getPropertiesLocked(stringListType, tagkey)
+				if err != nil {
+					return err
+				}
+				p.mvalprop.enc = (*Buffer).enc_struct_message
+				p.mvalprop.size = (*Buffer).size_struct_message
+				p.mvalprop.dec = (*Buffer).dec_struct_message
+				p.mvalprop.asProtobuf = p.mvalprop.stypeAsProtobuf()
+			}
 			if p.mvalprop.Tag != 2 {
 				// treat non-traditional map tags as an error since they won't be compatible with other protobuf marshalers
-				err := fmt.Errorf("protobuf3: %s.%s protobuf_val tag (%s) doesn't use id 2", val_tag, t1.String(), name)
+				err := fmt.Errorf("protobuf3: %s.%s %s_val tag (%s) doesn't use id 2", t1.String(), name, tagkey, val_tag)
 				fmt.Fprintln(os.Stderr, err) // print the error too
 				return err
 			}
 
-			p.asProtobuf = fmt.Sprintf("map<%s, %s>", p.mkeyprop.asProtobuf, p.mvalprop.asProtobuf)
+			def, typ := splitInline(p.mvalprop.asProtobuf)
+			p.asProtobuf = fmt.Sprintf("%smap<%s, %s>", def, p.mkeyprop.asProtobuf, typ)
+
+		case reflect.Func:
+			// a func() T field is called when encoding to compute the value of the field
+			if t1.NumIn() != 0 || t1.NumOut() != 1 {
+				return fmt.Errorf("protobuf3: %s.%s function type %s must take no arguments and return one value", t1.String(), name, t1)
+			}
+			p.ftype = t1
+			p.fprop = &Properties{}
+			*p.fprop = *p
+			p.fprop.offset = 0 // the returned value is encoded from a temporary
+			err := p.fprop.setEncAndDec(t1.Out(0), f, name, int_encoder, tagkey)
+			if err != nil {
+				return err
+			}
+			p.enc = (*Buffer).enc_func
+			// the value can't be stored in the function, so when decoding the field is ignored
+			p.dec = (*Buffer).dec_skip
+			p.asProtobuf = p.fprop.asProtobuf
+			p.stype = p.fprop.stype
+			p.sprop = p.fprop.sprop
+			wire = p.fprop.WireType
+
+		case reflect.Interface:
+			// an interface field holding a message encodes as a submessage of the message's dynamic type.
+			// since the dynamic type isn't on the wire, it is declared as bytes
+			p.itype = t1
+			p.enc = (*Buffer).enc_interface_message
+			p.dec = (*Buffer).dec_interface_message
+			p.asProtobuf = "bytes"
+			if wire != WireBytes {
+				return wiretypeError(name, t1, wire)
+			}
 		}
 
 		// if the type overrides the protobuf definition, use that instead
@@ -1350,9 +1988,111 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 	}
 
 	p.WireType = wire
+	p.setTagcode()
 
-	// precalculate tag code
-	x := p.Tag<<3 | uint32(wire)
+	return nil
+}
+
+// SchemaHash returns a hash of the wire format of the message type t (a struct or pointer to struct).
+// Two types have the same hash if they encode the same fields with the same tags, wiretypes and protobuf types,
+// recursively through any nested messages. Names of fields and types don't affect the hash, since they don't
+// appear on the wire, and registered enums hash as the int32s they are encoded as. The exceptions are the well-known
+// protobuf messages (google.protobuf.Timestamp and so on) and types which marshal themselves, whose structure can't
+// be seen and so which hash by their protobuf type name. The hash is meant to detect schema drift between the
+// producer and consumer of a message.
+func SchemaHash(t reflect.Type) (uint64, error) {
+	sprop, err := GetProperties(t)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	sprop.hashSchema(h, make(map[*StructProperties]int))
+	return h.Sum64(), nil
+}
+
+// hashSchema writes a description of the wire format of sprop to w. seen holds the messages already described,
+// so that recursive types terminate.
+func (sprop *StructProperties) hashSchema(w io.Writer, seen map[*StructProperties]int) {
+	if n, ok := seen[sprop]; ok {
+		fmt.Fprintf(w, "@%d;", n)
+		return
+	}
+	seen[sprop] = len(seen)
+
+	fmt.Fprint(w, "{")
+	for i := range sprop.props {
+		p := &sprop.props[i]
+		fmt.Fprintf(w, "%d,%d,", p.Tag, p.WireType)
+		switch {
+		case p.sprop != nil && p.sprop != time_Time_sprop:
+			// describe the message rather than name it
+			if _, typ := splitInline(p.asProtobuf); strings.HasPrefix(typ, "repeated ") {
+				fmt.Fprint(w, "repeated ")
+			}
+			p.sprop.hashSchema(w, seen)
+		case p.mvalprop != nil && p.mvalprop.sprop != nil && p.mvalprop.sprop != time_Time_sprop:
+			fmt.Fprintf(w, "map<%s,", p.mkeyprop.wireAsProtobuf())
+			p.mvalprop.sprop.hashSchema(w, seen)
+			fmt.Fprint(w, ">")
+		default:
+			fmt.Fprint(w, p.wireAsProtobuf())
+		}
+		fmt.Fprint(w, ";")
+	}
+	fmt.Fprint(w, "}")
+}
+
+// wireAsProtobuf returns p.asProtobuf with any registered enum type declared as the int32 it is encoded as
+func (p *Properties) wireAsProtobuf() string {
+	switch {
+	case p.etype != nil:
+		if strings.HasPrefix(p.asProtobuf, "repeated ") {
+			return "repeated int32"
+		}
+		return "int32"
+	case p.mvalprop != nil && (p.mkeyprop.etype != nil || p.mvalprop.etype != nil):
+		return fmt.Sprintf("map<%s, %s>", p.mkeyprop.wireAsProtobuf(), p.mvalprop.wireAsProtobuf())
+	}
+	return p.asProtobuf
+}
+
+// recordField is the location and size of one field of a struct encoded by the "record" attribute
+type recordField struct {
+	offset uintptr
+	size   uintptr
+	isBool bool // true if the field is a bool, which must be decoded as 0 or 1
+}
+
+// setRecordLayout works out the layout of the fields of struct type t when encoded as a "record":
+// the fixed-width fields in the order they are declared, each in little-endian byte order, without tags or padding.
+func (p *Properties) setRecordLayout(t reflect.Type) error {
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("elements must be structs, not %s", t)
+	}
+	p.rtype = t
+	p.rfields = nil
+	p.rsize = 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16,
+			reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+			// fixed-width scalar (note that int and uint aren't, since their width depends on the platform)
+		default:
+			return fmt.Errorf("field %s.%s of type %s is not a fixed-width scalar", t, f.Name, f.Type)
+		}
+		p.rfields = append(p.rfields, recordField{offset: f.Offset, size: f.Type.Size(), isBool: f.Type.Kind() == reflect.Bool})
+		p.rsize += f.Type.Size()
+	}
+	if p.rsize == 0 {
+		return fmt.Errorf("%s has no fields", t)
+	}
+	return nil
+}
+
+// setTagcode precalculates the tag code from p.Tag and p.WireType
+func (p *Properties) setTagcode() {
+	x := p.Tag<<3 | uint32(p.WireType)
 	i := 0
 	var tagbuf [8]byte
 	for i = 0; x > 127; i++ {
@@ -1361,10 +2101,355 @@ func (p *Properties) setEncAndDec(t1 reflect.Type, f *reflect.StructField, name
 	}
 	tagbuf[i] = uint8(x)
 	p.tagcode = string(tagbuf[0 : i+1])
+}
+
+// setTag changes the tag of the field, including in the properties of any value the field indirects to.
+// The indirect properties are copied, since they might be shared.
+func (p *Properties) setTag(tag uint32) {
+	p.Tag = tag
+	p.setTagcode()
+	if p.aprop != nil {
+		aprop := *p.aprop
+		aprop.setTag(tag)
+		p.aprop = &aprop
+	}
+	if p.fprop != nil {
+		fprop := *p.fprop
+		fprop.setTag(tag)
+		p.fprop = &fprop
+	}
+	if p.eprop != nil {
+		eprop := *p.eprop
+		eprop.setTag(tag)
+		p.eprop = &eprop
+	}
+	if p.oprop != nil {
+		oprop := *p.oprop
+		oprop.setTag(tag)
+		p.oprop = &oprop
+	}
+}
+
+// remapped returns a copy of sprop (the properties of struct type t) in which the fields' tags have been renumbered
+// according to remap. Tags which are not in remap are unchanged.
+func (sprop *StructProperties) remapped(t reflect.Type, remap map[uint32]uint32) (*StructProperties, error) {
+	rp := &StructProperties{
+		props:    make([]Properties, len(sprop.props)),
+		reserved: sprop.reserved,
+		checksum: sprop.checksum,
+
+		unknown:       sprop.unknown,
+		unknownOffset: sprop.unknownOffset,
+	}
+	copy(rp.props, sprop.props)
+
+	seen := make(map[uint32]string, len(rp.props))
+	for i := range rp.props {
+		p := &rp.props[i]
+		if tag, ok := remap[p.Tag]; ok {
+			if tag == 0 || tag >= 1<<29 {
+				return nil, fmt.Errorf("protobuf3: tag %d of %s.%s remapped to out of range tag %d", p.Tag, t, p.Name, tag)
+			}
+			p.setTag(tag)
+		}
+		if other, ok := seen[p.Tag]; ok {
+			return nil, fmt.Errorf("protobuf3: remapping %s gives %s and %s the same tag %d", t, other, p.Name, p.Tag)
+		}
+		seen[p.Tag] = p.Name
+	}
+
+	// keep the fields in tag order. a checksum field stays last no matter its tag, since it covers the fields before it
+	n := len(rp.props)
+	if rp.checksum {
+		n--
+	}
+	sort.Slice(rp.props[:n], func(i, j int) bool { return rp.props[i].Tag < rp.props[j].Tag })
+
+	return rp, nil
+}
+
+// resolvePresence finds the presence bitmap field named by p.presence in struct type t, and wraps p's encoder and decoder
+// so that the field is encoded if and only if its bit is set, and decoding the field sets the bit.
+func (p *Properties) resolvePresence(t reflect.Type) error {
+	colon := strings.IndexByte(p.presence, ':')
+	if colon < 0 {
+		return fmt.Errorf("protobuf3: presence=%s of %q is not of the form presence=bitmapField:bitIndex", p.presence, p.Name)
+	}
+	bitmap, ok := t.FieldByName(p.presence[:colon])
+	if !ok || len(bitmap.Index) != 1 {
+		return fmt.Errorf("protobuf3: presence bitmap field %q of %q is not a field of %s", p.presence[:colon], p.Name, t)
+	}
+	switch bitmap.Type.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("protobuf3: presence bitmap field %q of %q must be an unsigned integer with an explicit size, not %s", bitmap.Name, p.Name, bitmap.Type)
+	}
+	bit, err := strconv.ParseUint(p.presence[colon+1:], 10, 8)
+	if err != nil || bit >= uint64(8*bitmap.Type.Size()) {
+		return fmt.Errorf("protobuf3: presence bit index %q of %q out of range for %s", p.presence[colon+1:], p.Name, bitmap.Type)
+	}
+	if (p.valEnc == nil && p.asProtobuf != "string" && p.asProtobuf != "bytes") || strings.HasPrefix(p.asProtobuf, "repeated ") {
+		// zero values of other types (messages, repeated fields) can't be distinguished on the wire from their absence
+		return fmt.Errorf("protobuf3: presence bits are only supported on scalar fields, not %q (%s)", p.Name, p.asProtobuf)
+	}
+
+	p.presenceOffset = bitmap.Offset
+	p.presenceSize = bitmap.Type.Size()
+	p.presenceBit = uint(bit)
+
+	p.size = nil // the encoder's output no longer depends only on the field
+	enc := p.enc
+	p.enc = func(o *Buffer, p *Properties, base unsafe.Pointer) {
+		if !p.isPresent(base) {
+			return
+		}
+		n := len(o.buf)
+		enc(o, p, base)
+		if len(o.buf) == n {
+			// the encoder elided the zero value, but the field is present, so encode the zero value explicitly
+			o.buf = append(o.buf, p.tagcode...)
+			if p.WireType == WireBytes {
+				o.buf = append(o.buf, 0) // zero length string or bytes
+			} else {
+				p.valEnc(o, 0)
+			}
+		}
+	}
+
+	dec := p.dec
+	p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+		err := dec(o, p, base)
+		if err == nil {
+			p.setPresent(base)
+		}
+		return err
+	}
 
 	return nil
 }
 
+// resolveEmptyOK finds the companion bool field of emptyok field p in struct type t, and wraps p's encoder and decoder so
+// that an empty value is encoded when the companion field is true, and decoding the field sets the companion field.
+// The companion field is named after p with the suffix "Present", and (since it isn't encoded itself) is normally
+// tagged `protobuf:"-"`. Non-empty values are encoded whatever the companion field holds.
+func (p *Properties) resolveEmptyOK(t reflect.Type) error {
+	companion := p.Name + "Present"
+	f, ok := t.FieldByName(companion)
+	if !ok || len(f.Index) != 1 || f.Type.Kind() != reflect.Bool {
+		return fmt.Errorf("protobuf3: emptyok field %q needs a companion bool field %s in %s", p.Name, companion, t)
+	}
+
+	// a bool is a 1-byte presence bitmap using bit 0
+	p.presenceOffset = f.Offset
+	p.presenceSize = 1
+	p.presenceBit = 0
+
+	p.size = nil
+	enc := p.enc
+	p.enc = func(o *Buffer, p *Properties, base unsafe.Pointer) {
+		n := len(o.buf)
+		enc(o, p, base)
+		if len(o.buf) == n && p.isPresent(base) {
+			// the value is empty, but present
+			o.buf = append(o.buf, p.tagcode...)
+			o.buf = append(o.buf, 0)
+		}
+	}
+
+	dec := p.dec
+	p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+		err := dec(o, p, base)
+		if err == nil {
+			p.setPresent(base)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// OnDeprecatedField, if not nil, is called with the name of the struct type and the name of the field whenever a field
+// whose tag has the "deprecated" attribute is encoded (which happens when it holds a non-zero value) or decoded. This lets
+// teams find the code which still uses deprecated fields before the fields are removed. It is called while encoding or
+// decoding, so it should be quick (count or sample, rather than log every call), and must be safe to call concurrently.
+var OnDeprecatedField func(msgType, fieldName string)
+
+// wrapDeprecated wraps the encoder and decoder of deprecated field p of struct type t so they call OnDeprecatedField.
+// Sizing the field doesn't call it.
+func (p *Properties) wrapDeprecated(t reflect.Type) {
+	msgType := t.String()
+
+	enc := p.enc
+	if p.size == nil {
+		// size the field with the unwrapped encoder, so Size doesn't report the deprecated field
+		p.size = func(o *Buffer, p *Properties, base unsafe.Pointer) int {
+			n := len(o.buf)
+			enc(o, p, base)
+			l := len(o.buf) - n
+			o.buf = o.buf[:n]
+			return l
+		}
+	} // else the field's own sizer never calls OnDeprecatedField
+	p.enc = func(o *Buffer, p *Properties, base unsafe.Pointer) {
+		n := len(o.buf)
+		enc(o, p, base)
+		if fn := OnDeprecatedField; fn != nil && len(o.buf) != n {
+			fn(msgType, p.Name)
+		}
+	}
+
+	dec := p.dec
+	p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+		if fn := OnDeprecatedField; fn != nil {
+			fn(msgType, p.Name)
+		}
+		return dec(o, p, base)
+	}
+}
+
+// isPresent returns true if p's presence bit is set in the struct at base
+func (p *Properties) isPresent(base unsafe.Pointer) bool {
+	ptr := unsafe.Pointer(uintptr(base) + p.presenceOffset)
+	var x uint64
+	switch p.presenceSize {
+	case 1:
+		x = uint64(*(*uint8)(ptr))
+	case 2:
+		x = uint64(*(*uint16)(ptr))
+	case 4:
+		x = uint64(*(*uint32)(ptr))
+	case 8:
+		x = *(*uint64)(ptr)
+	}
+	return x&(1<<p.presenceBit) != 0
+}
+
+// setPresent sets p's presence bit in the struct at base
+func (p *Properties) setPresent(base unsafe.Pointer) {
+	ptr := unsafe.Pointer(uintptr(base) + p.presenceOffset)
+	switch p.presenceSize {
+	case 1:
+		*(*uint8)(ptr) |= 1 << p.presenceBit
+	case 2:
+		*(*uint16)(ptr) |= 1 << p.presenceBit
+	case 4:
+		*(*uint32)(ptr) |= 1 << p.presenceBit
+	case 8:
+		*(*uint64)(ptr) |= 1 << p.presenceBit
+	}
+}
+
+// BigEndianer is implemented by structs whose fixed32 and fixed64 fields (sfixed32, sfixed64, float and double too) are
+// encoded big-endian rather than little-endian, when ProtoBigEndian returns true. This is useful for protocols which
+// interleave protobuf with big-endian binary headers. NOTE WELL this is not a standard protobuf encoding, and the .proto
+// generated by AsProtobuf can't express it, so both ends must agree to use it. It applies to the struct's own fields
+// (including repeated fields and maps), not to the fields of any messages nested inside it, which have their own
+// ProtoBigEndian, nor to a checksum field. Like other properties of a struct type, ProtoBigEndian is called once, on
+// a zero value of the struct, and its result is cached.
+type BigEndianer interface {
+	ProtoBigEndian() bool
+}
+
+var bigEndianerType = reflect.TypeOf((*BigEndianer)(nil)).Elem()
+
+// isBigEndian returns true if struct type t's fixed fields are encoded big-endian
+func isBigEndian(t reflect.Type) bool {
+	if !reflect.PtrTo(t).Implements(bigEndianerType) {
+		return false
+	}
+	return reflect.New(t).Interface().(BigEndianer).ProtoBigEndian()
+}
+
+// sortable returns true if field p of type t is a slice or array whose elements the "sorted" attribute can sort
+func sortable(t reflect.Type, p *Properties) bool {
+	if (t.Kind() != reflect.Slice && t.Kind() != reflect.Array) || p.isRecord {
+		return false
+	}
+	switch t.Elem().Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Uint8:
+		return false // []byte isn't a repeated field
+	case reflect.Slice:
+		return t.Elem().Elem().Kind() == reflect.Uint8 // [][]byte
+	case reflect.Struct, reflect.Ptr:
+		return p.sprop != nil && !p.isMarshaler && !p.isAppender // messages
+	}
+	return false
+}
+
+// wiretypeError returns the error for a field of type t tagged with a wiretype which cannot be used with t
+func wiretypeError(name string, t reflect.Type, wire WireType) error {
+	return fmt.Errorf("protobuf3: %q %s cannot have wiretype %s (try %s)", name, t, wire, DefaultWireType(t))
+}
+
+// DefaultWireType returns the natural protobuf wiretype of a field of type t, in the form used in protobuf tags
+// ("varint", "fixed32", "fixed64" or "bytes"). Integers can also use the fixed and zigzag wiretypes.
+func DefaultWireType(t reflect.Type) string {
+	if t == time_Duration_type {
+		return "bytes" // encode as a google.protobuf.Duration
+	}
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "varint"
+	case reflect.Float32:
+		return "fixed32"
+	case reflect.Float64:
+		return "fixed64"
+	case reflect.Ptr:
+		return DefaultWireType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return DefaultWireType(t.Elem())
+	default:
+		// strings, structs and anything else
+		return "bytes"
+	}
+}
+
+// mapEntryProperties returns the properties of the key and value of a map entry with the given types, using the natural wiretypes of the types.
+func mapEntryProperties(keyType, valType reflect.Type) (keyprop, valprop *Properties, err error) {
+	tagkey := TagKey
+
+	propertiesMu.Lock()
+	defer propertiesMu.Unlock()
+
+	keyprop = &Properties{}
+	_, err = keyprop.init(keyType, "Key", DefaultWireType(keyType)+",1", nil, tagkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	valprop = &Properties{}
+	_, err = valprop.init(valType, "Value", DefaultWireType(valType)+",2", nil, tagkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyprop, valprop, nil
+}
+
+// repeatedElemProperties returns the properties of a [1]T field with id tag, using the natural wiretype of T. Encoding a [1]T
+// encodes one element of a repeated field of T, without eliding zero values.
+func repeatedElemProperties(elemType reflect.Type, tag uint32) (*Properties, error) {
+	tagkey := TagKey
+
+	propertiesMu.Lock()
+	defer propertiesMu.Unlock()
+
+	prop := &Properties{}
+	_, err := prop.init(reflect.ArrayOf(1, elemType), "Elem", fmt.Sprintf("%s,%d", DefaultWireType(elemType), tag), nil, tagkey)
+	if err != nil {
+		return nil, err
+	}
+	return prop, nil
+}
+
 // using p.Name, p.stype and p.sprop, figure out the right name for the type of field p.
 // if the name of the type is known, use that. Otherwise build a nested type and use it.
 func (p *Properties) stypeAsProtobuf() string {
@@ -1411,6 +2496,27 @@ func (p *Properties) stypeAsProtobuf() string {
 	return name
 }
 
+// splitInline splits the asProtobuf of a field into the definition of any anonymous type which is defined inline
+// (see stypeAsProtobuf), including the indentation of the final line, and the type of the field itself, so that
+// qualifiers like "repeated" can be placed in front of the type rather than in front of the definition.
+func splitInline(s string) (def, typ string) {
+	i := strings.LastIndexByte(s, '\n')
+	if i < 0 {
+		return "", s
+	}
+	i++
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// repeatedAsProtobuf returns the asProtobuf of a repeated field of type s
+func repeatedAsProtobuf(s string) string {
+	def, typ := splitInline(s)
+	return def + "repeated " + typ
+}
+
 // MakeUppercaseTypeName makes an uppercase message type name for type t, which is the type of a field named f.
 // Since the field is visible to us it is public, and thus it is uppercase. And since the type is similarly visible
 // it is almost certainly uppercased too. So there isn't much to do except pick whichever is appropriate.
@@ -1438,6 +2544,7 @@ var (
 	appenderType         = reflect.TypeOf((*Appender)(nil)).Elem()
 	asprotobuffer3Type   = reflect.TypeOf((*AsProtobuf3er)(nil)).Elem()
 	asv1protobuffer3Type = reflect.TypeOf((*AsV1Protobuf3er)(nil)).Elem()
+	heapInterfaceType    = reflect.TypeOf((*heap.Interface)(nil)).Elem()
 )
 
 // isMarshaler reports whether type t implements Marshaler.
@@ -1457,9 +2564,20 @@ func isAsV1Protobuf3er(t reflect.Type) bool {
 	return t.Implements(asv1protobuffer3Type)
 }
 
+// isLegalMapKey returns true if the protobuf type can be the key of a protobuf map
+func isLegalMapKey(typ string) bool {
+	switch typ {
+	case "int32", "int64", "uint32", "uint64", "sint32", "sint64",
+		"fixed32", "fixed64", "sfixed32", "sfixed64", "bool", "string":
+		return true
+	}
+	return false
+}
+
 // Init populates the properties from a protocol buffer struct tag.
+// tagkey is the struct tag key which was used to look up tag (and which is used to look up any map key and value tags).
 // returns (skip, error)
-func (p *Properties) init(typ reflect.Type, name, tag string, f *reflect.StructField) (bool, error) {
+func (p *Properties) init(typ reflect.Type, name, tag string, f *reflect.StructField, tagkey string) (bool, error) {
 	// fields without a protobuf tag are an error
 	if tag == "" {
 		// backwards compatibility HACK. canonical golang.org/protobuf ignores errors on fields with names that start with XXX_
@@ -1467,7 +2585,7 @@ func (p *Properties) init(typ reflect.Type, name, tag string, f *reflect.StructF
 		if XXXHack && strings.HasPrefix(name, "XXX_") {
 			return true, nil
 		}
-		err := fmt.Errorf("protobuf3: %s (%s) lacks a protobuf tag. Tag it, or mark it with `protobuf:\"-\"` if it isn't intended to be marshaled to/from protobuf", name, typ.String())
+		err := fmt.Errorf("protobuf3: %s (%s) lacks a %s tag. Tag it, or mark it with `%s:\"-\"` if it isn't intended to be marshaled to/from protobuf", name, typ.String(), tagkey, tagkey)
 		fmt.Fprintln(os.Stderr, err) // print the error too
 		return true, err
 	}
@@ -1482,14 +2600,237 @@ func (p *Properties) init(typ reflect.Type, name, tag string, f *reflect.StructF
 		return skip, err
 	}
 
-	return false, p.setEncAndDec(typ, f, name, intencoder)
+	err = p.setEncAndDec(typ, f, name, intencoder, tagkey)
+	if err == nil && intencoder == VarintEncoder {
+		et := typ
+		if et.Kind() == reflect.Ptr || et.Kind() == reflect.Slice || et.Kind() == reflect.Array {
+			et = et.Elem() // a pointer to, or repeated, enum
+		}
+		if lookupEnum(et) != nil {
+			// declare the field using the enum's type rather than an integer type
+			p.etype = et
+			p.asProtobuf = MakeTypeName(et, name)
+			if et != typ && typ.Kind() != reflect.Ptr {
+				p.asProtobuf = "repeated " + p.asProtobuf
+			}
+		}
+	}
+	if err == nil && p.isDateTime && typ != time_Time_type {
+		return false, fmt.Errorf("protobuf3: datetime field %q must be a time.Time, not %s", name, typ)
+	}
+	if err == nil && p.isRFC3339 && (typ != time_Time_type || p.isDateTime) {
+		return false, fmt.Errorf("protobuf3: rfc3339 field %q must be a time.Time without the datetime attribute, not %s", name, typ)
+	}
+	if err == nil && p.trunc != 0 && (typ != time_Time_type || p.isDateTime || p.isRFC3339) {
+		return false, fmt.Errorf("protobuf3: trunc field %q must be a time.Time encoded as a google.protobuf.Timestamp, not %s", name, typ)
+	}
+	if err == nil && p.fixedNanos && (typ != time_Time_type || p.isDateTime || p.isRFC3339 || p.trunc != 0) {
+		return false, fmt.Errorf("protobuf3: fixed_nanos field %q must be a time.Time without the datetime, rfc3339 or trunc attributes, not %s", name, typ)
+	}
+	if err == nil && p.isDelta && (typ != reflect.SliceOf(time_Time_type) || p.isDateTime || p.isRFC3339 || p.trunc != 0 || p.fixedNanos) {
+		return false, fmt.Errorf("protobuf3: delta field %q must be a []time.Time without the datetime, rfc3339, trunc or fixed_nanos attributes, not %s", name, typ)
+	}
+	if err == nil && p.isNanos {
+		t := typ
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t != time_Duration_type {
+			return false, fmt.Errorf("protobuf3: nanos field %q must be a time.Duration, not %s", name, typ)
+		}
+	}
+	if err == nil && p.isTypeURL {
+		if typ.Kind() != reflect.String || p.isEncrypted || p.presence != "" {
+			return false, fmt.Errorf("protobuf3: typeurl field %q must be a string without the encrypt or presence attributes, not %s", name, typ)
+		}
+		p.enc = (*Buffer).enc_typeurl
+		p.size = nil
+	}
+	if err == nil && p.isBase64 {
+		if typ.Kind() != reflect.Slice || typ.Elem().Kind() != reflect.Uint8 {
+			return false, fmt.Errorf("protobuf3: base64 field %q must be a []byte, not %s", name, typ)
+		}
+		// the bytes are encoded as a string, for peers which carry binary data in string fields
+		p.enc = (*Buffer).enc_slice_byte_base64
+		p.size = (*Buffer).size_slice_byte_base64
+		p.dec = (*Buffer).dec_slice_byte_base64
+		p.asProtobuf = "string"
+	}
+	if err == nil && p.isEmptyOK {
+		if !(typ.Kind() == reflect.String || (typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8)) || p.presence != "" {
+			return false, fmt.Errorf("protobuf3: emptyok field %q must be a string or []byte without the presence attribute, not %s", name, typ)
+		}
+	}
+	if err == nil && p.oneof != "" {
+		if _, t := splitInline(p.asProtobuf); strings.HasPrefix(t, "repeated ") || strings.HasPrefix(t, "map<") || p.isChecksum || p.presence != "" || p.isEmptyOK || p.isOptional {
+			return false, fmt.Errorf("protobuf3: oneof field %q must be a singular field without the checksum, presence, emptyok or optional attributes, not %s", name, p.asProtobuf)
+		}
+		p.oneofType = typ
+	}
+	if err == nil && p.heapSorted {
+		if typ.Kind() != reflect.Slice || !reflect.PtrTo(typ).Implements(heapInterfaceType) || p.isSorted || !sortable(typ, p) {
+			return false, fmt.Errorf("protobuf3: heapsorted field %q must be a repeated scalar or message whose type implements heap.Interface, without the sorted attribute, not %s", name, typ)
+		}
+		oprop := *p
+		oprop.offset = 0
+		p.oprop = &oprop
+		p.otype = typ
+		p.enc = (*Buffer).enc_heapsorted
+		p.size = nil
+	}
+	if err == nil && p.isSorted {
+		if !sortable(typ, p) {
+			return false, fmt.Errorf("protobuf3: sorted field %q must be a repeated scalar or message, not %s (maps use the order= attribute)", name, typ)
+		}
+		oprop := *p
+		oprop.offset = 0
+		p.oprop = &oprop
+		p.otype = typ
+		p.enc = (*Buffer).enc_sorted
+		p.size = nil
+	}
+	if err == nil && p.isChecksum {
+		if typ.Kind() != reflect.Uint32 || p.WireType != WireFixed32 {
+			return false, fmt.Errorf("protobuf3: checksum field %q must be a uint32 with wiretype fixed32, not %s %s", name, typ, p.WireType)
+		}
+		// enc_struct encodes the checksum after all the other fields
+		p.enc = (*Buffer).enc_nothing
+		p.size = nil
+	}
+	if err == nil && p.isEncrypted {
+		if p.isChecksum || p.presence != "" {
+			return false, fmt.Errorf("protobuf3: encrypted field %q can't also be a checksum or have a presence bit", name)
+		}
+		// the field is encoded as usual, and then the encoding is encrypted and encoded as a bytes field
+		eprop := *p
+		p.eprop = &eprop
+		p.WireType = WireBytes
+		p.setTagcode()
+		p.enc = (*Buffer).enc_encrypted
+		p.size = nil
+		p.dec = (*Buffer).dec_encrypted
+		p.asProtobuf = "bytes"
+	}
+	return false, err
 }
 
 var (
 	propertiesMu  sync.RWMutex
-	propertiesMap = make(map[reflect.Type]*StructProperties)
+	propertiesMap = make(map[propertiesKey]*StructProperties)
+
+	propertiesMaxLen int            // maximum number of entries in propertiesMap, or 0 if unbounded. protected by propertiesMu
+	propertiesClock  uint64         // incremented each time a cached StructProperties is used, when propertiesMaxLen != 0. Accessed atomically
+	propertiesLRU    propertiesHeap // the entries of propertiesMap ordered by lastUsed, when propertiesMaxLen != 0. protected by propertiesMu
 )
 
+// SetPropertiesCacheSize bounds the number of struct types whose properties are cached. When the cache is full,
+// resolving a new type evicts the least recently used types, which are rebuilt if they are used again.
+// This bounds the memory used by servers which create many struct types at runtime (with reflect.StructOf, for
+// instance). n == 0, the default, means the cache is unbounded. The properties of time.Time are built in and are never
+// evicted. The previous size is returned.
+func SetPropertiesCacheSize(n int) int {
+	if n < 0 {
+		n = 0
+	}
+	propertiesMu.Lock()
+	prev := propertiesMaxLen
+	propertiesMaxLen = n
+	rebuildPropertiesLRULocked()
+	evictPropertiesLocked()
+	propertiesMu.Unlock()
+	return prev
+}
+
+// PropertiesCacheLen returns the number of struct types whose properties are cached.
+func PropertiesCacheLen() int {
+	propertiesMu.RLock()
+	n := len(propertiesMap)
+	propertiesMu.RUnlock()
+	return n
+}
+
+// touch marks sprop as recently used
+func (sprop *StructProperties) touch() {
+	atomic.StoreUint64(&sprop.lastUsed, atomic.AddUint64(&propertiesClock, 1))
+}
+
+// propertiesHeap is a min-heap of the entries of propertiesMap, ordered by the lastUsed of each entry at the time it
+// was pushed or last fixed. Since touch() only takes the read lock it can't reorder the heap, so the order goes stale,
+// and evictPropertiesLocked refreshes the top entry before evicting it. Entries which are no longer in propertiesMap
+// are dropped when they reach the top.
+type propertiesHeap []propertiesHeapEntry
+
+type propertiesHeapEntry struct {
+	used  uint64 // sprop.lastUsed when the entry was pushed or last fixed
+	key   propertiesKey
+	sprop *StructProperties
+}
+
+func (h propertiesHeap) Len() int            { return len(h) }
+func (h propertiesHeap) Less(i, j int) bool  { return h[i].used < h[j].used }
+func (h propertiesHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *propertiesHeap) Push(x interface{}) { *h = append(*h, x.(propertiesHeapEntry)) }
+func (h *propertiesHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// pushPropertiesLocked adds a new entry of propertiesMap to propertiesLRU. It requires that propertiesMu is held for writing.
+func pushPropertiesLocked(key propertiesKey, sprop *StructProperties) {
+	if len(propertiesLRU) > 2*len(propertiesMap)+16 {
+		// too many of the entries are for types which failed to build. start afresh
+		rebuildPropertiesLRULocked()
+	}
+	heap.Push(&propertiesLRU, propertiesHeapEntry{atomic.LoadUint64(&sprop.lastUsed), key, sprop})
+}
+
+// rebuildPropertiesLRULocked rebuilds propertiesLRU from propertiesMap. It requires that propertiesMu is held for writing.
+func rebuildPropertiesLRULocked() {
+	propertiesLRU = propertiesLRU[:0]
+	if propertiesMaxLen == 0 {
+		propertiesLRU = nil
+		return
+	}
+	for k, sprop := range propertiesMap {
+		propertiesLRU = append(propertiesLRU, propertiesHeapEntry{atomic.LoadUint64(&sprop.lastUsed), k, sprop})
+	}
+	heap.Init(&propertiesLRU)
+}
+
+// evictPropertiesLocked removes the least recently used entries from propertiesMap until it is no larger than
+// propertiesMaxLen. It requires that propertiesMu is held for writing. Evicted StructProperties remain valid; they
+// are still referenced by the properties of any cached types which contain them, and they are rebuilt if looked up again.
+func evictPropertiesLocked() {
+	if propertiesMaxLen == 0 {
+		return
+	}
+	for len(propertiesMap) > propertiesMaxLen && len(propertiesLRU) != 0 {
+		e := &propertiesLRU[0]
+		if propertiesMap[e.key] != e.sprop {
+			// the entry was removed already (the type failed to build)
+			heap.Pop(&propertiesLRU)
+			continue
+		}
+		if used := atomic.LoadUint64(&e.sprop.lastUsed); used != e.used {
+			// the entry has been used since it was placed in the heap. move it to where it belongs now
+			e.used = used
+			heap.Fix(&propertiesLRU, 0)
+			continue
+		}
+		delete(propertiesMap, e.key)
+		heap.Pop(&propertiesLRU)
+	}
+}
+
+// propertiesKey is the key of propertiesMap. The same type parsed using different struct tag keys
+// has different properties, so the tag key is part of the key.
+type propertiesKey struct {
+	t      reflect.Type
+	tagkey string
+}
+
 // synthesize a StructProperties for time.Time which will encode it
 // to the same as the standard protobuf3 Timestamp type.
 var time_Time_type = reflect.TypeOf(time.Time{})
@@ -1500,6 +2841,7 @@ var time_Time_sprop = &StructProperties{
 			Name:     "time.Time",
 			WireType: WireBytes,
 			enc:      (*Buffer).enc_time_Time,
+			size:     (*Buffer).size_time_Time,
 			// note: .dec isn't used
 		},
 	},
@@ -1509,10 +2851,32 @@ var time_Time_sprop = &StructProperties{
 // go time.Duration isn't a struct (it's a int64) there isn't a time_Duration_sprop at all.
 var time_Duration_type = reflect.TypeOf(time.Duration(0))
 
-func init() {
-	propertiesMap[time_Time_type] = time_Time_sprop
+// atomicTypes maps the sync/atomic value types (atomic.Int64 and friends) to the type of the value they hold, and to
+// the encoder and decoder of fields of the atomic type. It is filled in by atomic.go, since the types need go1.19
+var atomicTypes = make(map[reflect.Type]atomicType)
+
+type atomicType struct {
+	t   reflect.Type // the type of the value held
+	enc encoder
+	dec decoder
+}
+
+// stdMessageTypes maps the standard library types which encode as messages of our own definition (net.TCPAddr and
+// netip.AddrPort) to their message encodings. It is filled in by the files defining the encodings, since netip needs go1.18
+var stdMessageTypes = make(map[reflect.Type]stdMessageType)
+
+type stdMessageType struct {
+	name       string                                         // the name of the protobuf message
+	definition string                                         // the protobuf definition of the message
+	enc        func(o *WriteBuffer, ptr unsafe.Pointer) error // appends the fields of the value at ptr
+	dec        func(o *Buffer, ptr unsafe.Pointer) error      // decodes the fields in o into the value at ptr
 }
 
+// a *bytes.Buffer encodes its contents as a bytes field
+var bytes_Buffer_type = reflect.TypeOf(bytes.Buffer{})
+
+var stringListType = reflect.TypeOf(StringList{})
+
 // GetProperties returns the list of properties for the type represented by t.
 // t must represent a generated struct type of a protocol message.
 func GetProperties(t reflect.Type) (*StructProperties, error) {
@@ -1526,35 +2890,76 @@ func GetProperties(t reflect.Type) (*StructProperties, error) {
 		panic("protobuf3: type must have kind struct")
 	}
 
+	// sample TagKey once, so that all the fields of t and its inner types are parsed with the same key
+	tagkey := TagKey
+
 	// Most calls to GetProperties in a long-running program will be
 	// retrieving details for types we have seen before.
 	propertiesMu.RLock()
-	sprop, ok := propertiesMap[t]
+	sprop, ok := propertiesMap[propertiesKey{t, tagkey}]
+	bounded := propertiesMaxLen != 0
 	propertiesMu.RUnlock()
 	if ok {
+		if bounded {
+			sprop.touch()
+		}
 		return sprop, nil
 	}
 
 	propertiesMu.Lock()
-	sprop, err := getPropertiesLocked(t)
+	sprop, err := getPropertiesLocked(t, tagkey)
+	if err == nil && propertiesMaxLen != 0 && sprop != time_Time_sprop {
+		// note that the recursive types being built were inserted in propertiesMap by getPropertiesLocked, and are
+		// complete by now, so it is safe to evict anything
+		sprop.touch()
+		evictPropertiesLocked()
+	}
 	propertiesMu.Unlock()
 	return sprop, err
 }
 
 // getPropertiesLocked requires that propertiesMu is held.
-func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
-	if prop, ok := propertiesMap[t]; ok {
+func getPropertiesLocked(t reflect.Type, tagkey string) (*StructProperties, error) {
+	if t == time_Time_type {
+		// time.Time is the same no matter what tag key is in use
+		return time_Time_sprop, nil
+	}
+
+	key := propertiesKey{t, tagkey}
+	if prop, ok := propertiesMap[key]; ok {
 		return prop, nil
 	}
 
 	prop := new(StructProperties)
 
 	// in case of recursion, add ourselves to propertiesMap now. we'll remove ourselves if we error
-	propertiesMap[t] = prop
+	propertiesMap[key] = prop
+	if propertiesMaxLen != 0 {
+		prop.touch()
+		pushPropertiesLocked(key, prop)
+	}
 
 	// build properties
 	nf := t.NumField()
 	prop.props = make([]Properties, 0, nf)
+	type field struct {
+		origin reflect.Type
+		name   string
+	}
+	bigEndian := isBigEndian(t)
+	seen := make(map[uint32]field) // tag -> the 1st field with that tag, so collisions between fields from different embedded structs can be reported clearly
+
+	// check for a collision between p's tag and an earlier field's
+	checkTag := func(p *Properties) error {
+		if q, ok := seen[p.Tag]; ok {
+			if q.origin != p.origin {
+				return fmt.Errorf("protobuf3: error duplicate tag id %d assigned to %s.%s and %s.%s in %s", p.Tag, q.origin, q.name, p.origin, p.Name, t)
+			}
+			return fmt.Errorf("protobuf3: error duplicate tag id %d assigned to %s.%s and %s", p.Tag, t, q.name, p.Name)
+		}
+		seen[p.Tag] = field{p.origin, p.Name}
+		return nil
+	}
 
 	for i := 0; i < nf; i++ {
 		f := t.Field(i)
@@ -1572,15 +2977,15 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 			name = "<unnamed field>"
 		}
 
-		tag := f.Tag.Get("protobuf")
+		tag := f.Tag.Get(tagkey)
 
 		if tag == "embedded" && f.Anonymous {
 			// field f is embedded in type t and has the special `protobuf:"embedded"` tag. Get f's fields and then merge them into t's
-			fprop, err := getPropertiesLocked(f.Type)
+			fprop, err := getPropertiesLocked(f.Type, tagkey)
 			if err != nil {
 				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: %v", name, t.Name(), err)
 				fmt.Fprintln(os.Stderr, err) // print the error too
-				delete(propertiesMap, t)
+				delete(propertiesMap, key)
 				return nil, err
 			}
 
@@ -1588,6 +2993,13 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 			for ii, p := range fprop.props {
 				// fixup the field property as we copy them
 				p.offset += f.Offset
+				p.presenceOffset += f.Offset
+
+				if err := checkTag(&p); err != nil {
+					fmt.Fprintln(os.Stderr, err) // print the error too
+					delete(propertiesMap, key)
+					return nil, err
+				}
 
 				prop.props = append(prop.props, p)
 
@@ -1603,6 +3015,33 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 			continue
 		}
 
+		if name == PresenceMaskField {
+			switch f.Type.Kind() {
+			case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			default:
+				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: the presence mask must be an unsigned integer with an explicit size, not %s", name, t.Name(), f.Type)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+			prop.maskOffset = f.Offset
+			prop.maskSize = f.Type.Size()
+			continue
+		}
+
+		if tag == "unknown" {
+			// field f holds the encoding of any fields which t doesn't have, so they survive being decoded and re-encoded
+			if f.Type.Kind() != reflect.Slice || f.Type.Elem().Kind() != reflect.Uint8 || prop.unknown {
+				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: the unknown field must be the only one, and must be a []byte, not %s", name, t.Name(), f.Type)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+			prop.unknown = true
+			prop.unknownOffset = f.Offset
+			continue
+		}
+
 		if f.Type == reservedType {
 			err := prop.parseReserved(tag)
 			if err != nil {
@@ -1613,14 +3052,34 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 			continue
 		}
 
-		prop.props = append(prop.props, Properties{})
+		if oneof := f.Tag.Get(tagkey + "_oneof"); tag == "" && oneof != "" {
+			// field f is an interface holding one of the registered wrapper types of a oneof. Each wrapper's field is a field of t
+			oprops, err := oneofProperties(t, &f, oneof, tagkey)
+			if err != nil {
+				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: %v", name, t.Name(), err)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+			for i := range oprops {
+				if err := checkTag(&oprops[i]); err != nil {
+					fmt.Fprintln(os.Stderr, err) // print the error too
+					delete(propertiesMap, key)
+					return nil, err
+				}
+			}
+			prop.props = append(prop.props, oprops...)
+			continue
+		}
+
+		prop.props = append(prop.props, Properties{origin: t, bigEndian: bigEndian})
 		p := &prop.props[len(prop.props)-1]
 
-		skip, err := p.init(f.Type, name, tag, &f)
+		skip, err := p.init(f.Type, name, tag, &f, tagkey)
 		if err != nil {
 			err := fmt.Errorf("protobuf3: error preparing field %q of type %q: %v", name, t.Name(), err)
 			fmt.Fprintln(os.Stderr, err) // print the error too
-			delete(propertiesMap, t)
+			delete(propertiesMap, key)
 			return nil, err
 		}
 		if skip {
@@ -1644,9 +3103,51 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 			}
 			err := fmt.Errorf("protobuf3: error no encoder or decoder for field %q.%q of type %q", tname, name, f.Type.Name())
 			fmt.Fprintln(os.Stderr, err) // print the error too
-			delete(propertiesMap, t)
+			delete(propertiesMap, key)
 			return nil, err
 		}
+
+		if err := checkTag(p); err != nil {
+			fmt.Fprintln(os.Stderr, err) // print the error too
+			delete(propertiesMap, key)
+			return nil, err
+		}
+
+		if p.presence != "" {
+			if err := p.resolvePresence(t); err != nil {
+				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: %v", name, t.Name(), err)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+		}
+		if p.isEmptyOK {
+			if err := p.resolveEmptyOK(t); err != nil {
+				err := fmt.Errorf("protobuf3: error preparing field %q of type %q: %v", name, t.Name(), err)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+		}
+
+		if p.itype != nil {
+			p.ifactory = lookupMessageFactory(t, f.Name)
+		}
+		if p.isTypeURL {
+			// only now do we know the enclosing struct
+			p.typeURL = TypeURL(t)
+			if p.typeURL == "" {
+				err := fmt.Errorf("protobuf3: error preparing typeurl field %q of type %q: the protobuf name of %s hasn't been registered with RegisterProtoName", name, t.Name(), t)
+				fmt.Fprintln(os.Stderr, err) // print the error too
+				delete(propertiesMap, key)
+				return nil, err
+			}
+		}
+		p.wrapMerger(&f)
+		p.wrapDecodeTransform(t, &f)
+		if p.deprecated {
+			p.wrapDeprecated(t)
+		}
 	}
 
 	// sort and de-dup the reserved IDs
@@ -1676,22 +3177,88 @@ func getPropertiesLocked(t reflect.Type) (*StructProperties, error) {
 	}
 
 	// now that they are sorted, sanity check for duplicate or reserved tags, since some of us are hand editing the tags
+	reserved_ranges, _ := lookupReservedTags(t)
 	prev_tag := uint32(0)
 	var err error
+	if prop.maskSize != 0 && uintptr(len(prop.props)) > 8*prop.maskSize {
+		err = fmt.Errorf("protobuf3: error %s has %d fields, too many for its %d bit %s", t.String(), len(prop.props), 8*prop.maskSize, PresenceMaskField)
+		fmt.Fprintln(os.Stderr, err) // print the error too
+		delete(propertiesMap, key)
+		return nil, err
+	}
 	for i := range prop.props {
 		p := &prop.props[i]
 		if prev_tag == p.Tag {
 			err = fmt.Errorf("protobuf3: error duplicate tag id %d assigned to %s.%s", p.Tag, t.String(), p.Name)
 		} else if _, ok := reserved[p.Tag]; ok {
 			err = fmt.Errorf("protobuf3: error reserved tag id %d assigned to %s.%s", p.Tag, t.String(), p.Name)
+		} else if p.isChecksum {
+			// the checksum covers all the preceding fields, so it must be the last field encoded
+			if i != len(prop.props)-1 {
+				err = fmt.Errorf("protobuf3: error checksum field %s.%s must have the highest tag id", t.String(), p.Name)
+			}
+			prop.checksum = true
+		}
+		for _, r := range reserved_ranges {
+			if err == nil && r.Contains(p.Tag) {
+				err = fmt.Errorf("protobuf3: error reserved tag id %d (reserved range %s) assigned to %s.%s", p.Tag, r, t.String(), p.Name)
+			}
 		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err) // print the error too
-			delete(propertiesMap, t)
+			delete(propertiesMap, key)
 			return nil, err
 		}
 		prev_tag = p.Tag
 	}
 
+	prop.resolveOneofs()
+
 	return prop, nil
 }
+
+// resolveOneofs numbers the oneof groups of the fields, and wraps the decoder of each field of a group so that decoding
+// it zeros the other fields of the group. (enc_struct checks that at most one field of each group is set.)
+func (sp *StructProperties) resolveOneofs() {
+	type peer struct {
+		offset uintptr
+		typ    reflect.Type
+	}
+	groups := make(map[string][]peer)
+	for i := range sp.props {
+		p := &sp.props[i]
+		if p.oneof == "" {
+			continue
+		}
+		if _, ok := groups[p.oneof]; !ok {
+			sp.oneofs = append(sp.oneofs, p.oneof)
+		}
+		groups[p.oneof] = append(groups[p.oneof], peer{p.offset, p.oneofType})
+		for g, name := range sp.oneofs {
+			if name == p.oneof {
+				p.oneofGroup = g + 1
+			}
+		}
+	}
+
+	for i := range sp.props {
+		p := &sp.props[i]
+		if p.oneof == "" {
+			continue
+		}
+		var others []peer
+		for _, q := range groups[p.oneof] {
+			if q.offset != p.offset {
+				others = append(others, q)
+			}
+		}
+		dec := p.dec
+		p.dec = func(o *Buffer, p *Properties, base unsafe.Pointer) error {
+			for _, q := range others {
+				v := reflect.NewAt(q.typ, unsafe.Pointer(uintptr(base)+q.offset)).Elem()
+				v.Set(reflect.Zero(q.typ))
+			}
+			return dec(o, p, base)
+		}
+	}
+}
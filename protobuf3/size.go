@@ -0,0 +1,601 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Routines for computing the length of the wire format of protocol buffers without encoding them.
+ */
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"time"
+	"unsafe"
+)
+
+// Size returns the number of bytes Marshal(pb) would produce, without encoding pb. Callers can use it to allocate
+// an output buffer of exactly the right size, or to decide whether a message fits somewhere before marshaling it.
+// The common field types are measured directly. The others (Marshalers and Appenders, and fields with attributes such
+// as "encrypt" or "sorted", whose encoding can't be predicted) are encoded into a scratch buffer and the result is
+// measured, so Size is always exact, but it is only cheaper than Marshal for messages made of the common types.
+func Size(pb Message) (int, error) {
+	// Can it marshal itself?
+	if m, ok := pb.(Marshaler); ok {
+		data, err := m.MarshalProtobuf3()
+		if err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	// unpack the interface and sanity check
+	if pb == nil {
+		return 0, ErrNil
+	}
+	v := reflect.ValueOf(pb)
+	t := v.Type()
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return 0, fmt.Errorf("protobuf3: can't Size(%s): not a *struct type", t)
+	}
+	base := unsafe.Pointer(v.Pointer())
+	if base == nil {
+		return 0, ErrNil
+	}
+
+	prop, err := GetProperties(t.Elem())
+	if err != nil {
+		return 0, err
+	}
+
+	o := newBuffer(nil)
+	n := o.size_struct(prop, base)
+	err = o.err
+	o.release()
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// sizeOf returns the length of the encoding of field p of the struct at base.
+func (p *Properties) sizeOf(o *Buffer, base unsafe.Pointer) int {
+	if p.size != nil {
+		return p.size(o, p, base)
+	}
+	return p.encodedSize(o, base)
+}
+
+// encodedSize is the fallback for fields without a sizer. The field is encoded into o, which is then truncated back to
+// its original length.
+func (p *Properties) encodedSize(o *Buffer, base unsafe.Pointer) int {
+	n := len(o.buf)
+	p.enc(o, p, base)
+	l := len(o.buf) - n
+	o.buf = o.buf[:n]
+	return l
+}
+
+// sizeLen returns the length of l bytes preceded by their length (as a varint)
+func sizeLen(l int) int {
+	return SizeVarint(uint64(l)) + l
+}
+
+// The sizes of the fundamental encodings. These are the valueSizers matching the valueEncoders.
+
+func sizeFixed32(x uint64) int { return 4 }
+func sizeFixed64(x uint64) int { return 8 }
+
+func sizeZigzag32(x uint64) int {
+	return SizeVarint(uint64((uint32(x) << 1) ^ uint32((int32(x) >> 31))))
+}
+
+func sizeZigzag64(x uint64) int {
+	return SizeVarint(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+
+// Size a struct. This parallels enc_struct.
+func (o *Buffer) size_struct(prop *StructProperties, base unsafe.Pointer) int {
+	idx := -1
+	if o.sizing != 0 {
+		// record the length of this message, and so of every message nested within it, in the order they are encoded
+		idx = len(o.msgSizes)
+		o.msgSizes = append(o.msgSizes, msgSize{base: base, prop: prop})
+	}
+	n := 0
+	var set []*Properties // the field of each oneof group which would be encoded
+	if len(prop.oneofs) != 0 {
+		set = make([]*Properties, len(prop.oneofs))
+	}
+	for i := range prop.props {
+		p := &prop.props[i]
+		l := p.sizeOf(o, base)
+		if l != 0 && p.oneofGroup != 0 {
+			if q := set[p.oneofGroup-1]; q != nil {
+				o.noteError(fmt.Errorf("protobuf3: fields %s and %s of oneof %s are both set", q.Name, p.Name, p.oneof))
+			}
+			set[p.oneofGroup-1] = p
+		}
+		n += l
+	}
+	if prop.unknown {
+		n += len(*prop.unknownFields(base))
+	}
+	if prop.checksum {
+		// the checksum field is always encoded, as a fixed32
+		n += len(prop.props[len(prop.props)-1].tagcode) + 4
+	}
+	if idx >= 0 {
+		o.msgSizes[idx].n = n
+	}
+	return n
+}
+
+// Individual type sizers. Each returns the length of what the matching encoder would append.
+
+// Size a *bool.
+func (o *Buffer) size_ptr_bool(p *Properties, base unsafe.Pointer) int {
+	v := *(**bool)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	x := 0
+	if *v {
+		x = 1
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size a bool.
+func (o *Buffer) size_bool(p *Properties, base unsafe.Pointer) int {
+	v := *(*bool)(unsafe.Pointer(uintptr(base) + p.offset))
+	if !v {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(1)
+}
+
+// Size an *int.
+func (o *Buffer) size_ptr_int(p *Properties, base unsafe.Pointer) int {
+	v := *(**int)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size an int.
+func (o *Buffer) size_int(p *Properties, base unsafe.Pointer) int {
+	x := *(*int)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size a *uint.
+func (o *Buffer) size_ptr_uint(p *Properties, base unsafe.Pointer) int {
+	v := *(**uint)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size a uint.
+func (o *Buffer) size_uint(p *Properties, base unsafe.Pointer) int {
+	x := *(*uint)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size an *int8.
+func (o *Buffer) size_ptr_int8(p *Properties, base unsafe.Pointer) int {
+	v := *(**int8)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size an int8.
+func (o *Buffer) size_int8(p *Properties, base unsafe.Pointer) int {
+	x := *(*int8)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size a *uint8.
+func (o *Buffer) size_ptr_uint8(p *Properties, base unsafe.Pointer) int {
+	v := *(**uint8)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size a uint8.
+func (o *Buffer) size_uint8(p *Properties, base unsafe.Pointer) int {
+	x := *(*uint8)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size an *int16.
+func (o *Buffer) size_ptr_int16(p *Properties, base unsafe.Pointer) int {
+	v := *(**int16)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size an int16.
+func (o *Buffer) size_int16(p *Properties, base unsafe.Pointer) int {
+	x := *(*int16)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size a *uint16.
+func (o *Buffer) size_ptr_uint16(p *Properties, base unsafe.Pointer) int {
+	v := *(**uint16)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size a uint16.
+func (o *Buffer) size_uint16(p *Properties, base unsafe.Pointer) int {
+	x := *(*uint16)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size an *int32.
+func (o *Buffer) size_ptr_int32(p *Properties, base unsafe.Pointer) int {
+	v := *(**int32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size an int32.
+func (o *Buffer) size_int32(p *Properties, base unsafe.Pointer) int {
+	x := *(*int32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size a *uint32.
+func (o *Buffer) size_ptr_uint32(p *Properties, base unsafe.Pointer) int {
+	v := *(**uint32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(*v))
+}
+
+// Size a uint32.
+func (o *Buffer) size_uint32(p *Properties, base unsafe.Pointer) int {
+	x := *(*uint32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(uint64(x))
+}
+
+// Size an *int64.
+func (o *Buffer) size_ptr_int64(p *Properties, base unsafe.Pointer) int {
+	v := *(**uint64)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(*v)
+}
+
+// Size an int64.
+func (o *Buffer) size_int64(p *Properties, base unsafe.Pointer) int {
+	x := *(*uint64)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == 0 {
+		return 0
+	}
+	return len(p.tagcode) + p.valSize(x)
+}
+
+// Size a *string.
+func (o *Buffer) size_ptr_string(p *Properties, base unsafe.Pointer) int {
+	v := *(**string)(unsafe.Pointer(uintptr(base) + p.offset))
+	if v == nil {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(len(*v))
+}
+
+// Size a string.
+func (o *Buffer) size_string(p *Properties, base unsafe.Pointer) int {
+	x := *(*string)(unsafe.Pointer(uintptr(base) + p.offset))
+	if x == "" {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(len(x))
+}
+
+// Size a slice of bytes ([]byte).
+func (o *Buffer) size_slice_byte(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]byte)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(len(s))
+}
+
+// Size a slice of bytes ([]byte) with the "base64" attribute.
+func (o *Buffer) size_slice_byte_base64(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]byte)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(base64.StdEncoding.EncodedLen(len(s)))
+}
+
+// Size a slice of int32s ([]int32) in packed format.
+func (o *Buffer) size_slice_packed_int32(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]int32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	n := 0
+	for _, x := range s {
+		n += p.valSize(uint64(x))
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
+
+// Size a slice of uint32s ([]uint32) in packed format.
+func (o *Buffer) size_slice_packed_uint32(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]uint32)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	n := 0
+	for _, x := range s {
+		n += p.valSize(uint64(x))
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
+
+// Size a slice of int64s or uint64s ([]int64, []uint64) in packed format.
+func (o *Buffer) size_slice_packed_int64(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]uint64)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	n := 0
+	for _, x := range s {
+		n += p.valSize(x)
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
+
+// Size a slice of 32-bit values in packed fixed32 format.
+func (o *Buffer) size_slice_packed_fixed32(p *Properties, base unsafe.Pointer) int {
+	n := 4 * len(*(*[]uint32)(unsafe.Pointer(uintptr(base) + p.offset)))
+	if n == 0 {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
+
+// Size a slice of 64-bit values in packed fixed64 format.
+func (o *Buffer) size_slice_packed_fixed64(p *Properties, base unsafe.Pointer) int {
+	n := 8 * len(*(*[]uint64)(unsafe.Pointer(uintptr(base) + p.offset)))
+	if n == 0 {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
+
+// Size a slice of slice of bytes ([][]byte).
+func (o *Buffer) size_slice_slice_byte(p *Properties, base unsafe.Pointer) int {
+	ss := *(*[][]byte)(unsafe.Pointer(uintptr(base) + p.offset))
+	n := 0
+	for _, s := range ss {
+		n += len(p.tagcode) + sizeLen(len(s))
+	}
+	return n
+}
+
+// Size a slice of strings ([]string).
+func (o *Buffer) size_slice_string(p *Properties, base unsafe.Pointer) int {
+	ss := *(*[]string)(unsafe.Pointer(uintptr(base) + p.offset))
+	n := 0
+	for _, s := range ss {
+		n += len(p.tagcode) + sizeLen(len(s))
+	}
+	return n
+}
+
+// Size a message struct.
+func (o *Buffer) size_struct_message(p *Properties, base unsafe.Pointer) int {
+	l := o.size_struct(p.sprop, unsafe.Pointer(uintptr(base)+p.offset))
+	if l == 0 {
+		// like enc_struct_message, an empty message is elided
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(l)
+}
+
+// Size a *struct.
+func (o *Buffer) size_ptr_struct_message(p *Properties, base unsafe.Pointer) int {
+	structp := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	if structp == nil {
+		return 0
+	}
+	return len(p.tagcode) + sizeLen(o.size_struct(p.sprop, structp))
+}
+
+// Size a slice of message structs ([]struct).
+func (o *Buffer) size_slice_struct_message(p *Properties, base unsafe.Pointer) int {
+	if p.isAppender || p.isMarshaler {
+		// the elements have to be marshaled to find out
+		return p.encodedSize(o, base)
+	}
+	s := *(*[]byte)(unsafe.Pointer(uintptr(base) + p.offset)) // see enc_slice_struct_message
+	n := ulen(s)
+	if n == 0 {
+		return 0
+	}
+	sz := p.stype.Size()
+	l := 0
+	for i := uintptr(0); i < uintptr(n)*sz; i += sz {
+		l += len(p.tagcode) + sizeLen(o.size_struct(p.sprop, unsafe.Pointer(uintptr(unsafe.Pointer(&s[0]))+i)))
+	}
+	return l
+}
+
+// Size a slice of pointers to message structs ([]*struct).
+func (o *Buffer) size_slice_ptr_struct_message(p *Properties, base unsafe.Pointer) int {
+	if p.isAppender || p.isMarshaler {
+		return p.encodedSize(o, base)
+	}
+	s := *(*[]unsafe.Pointer)(unsafe.Pointer(uintptr(base) + p.offset))
+	l := 0
+	for _, structp := range s {
+		if structp == nil {
+			o.noteError(errRepeatedHasNil)
+			return 0
+		}
+		l += len(p.tagcode) + sizeLen(o.size_struct(p.sprop, structp))
+	}
+	return l
+}
+
+// Size a map field.
+func (o *Buffer) size_new_map(p *Properties, base unsafe.Pointer) int {
+	v := reflect.NewAt(p.mtype, unsafe.Pointer(uintptr(base)+p.offset)).Elem() // map[K]V
+	if v.Len() == 0 {
+		return 0
+	}
+
+	keycopy, valcopy, keybase, valbase := mapEncodeScratch(p.mtype)
+
+	// the order of the entries doesn't change their total size, so there's no need to sort them
+	l := 0
+	for it := v.MapRange(); it.Next(); {
+		keycopy.Set(it.Key())
+		valcopy.Set(it.Value())
+		l += len(p.tagcode) + sizeLen(p.mkeyprop.sizeOf(o, keybase)+p.mvalprop.sizeOf(o, valbase))
+	}
+	return l
+}
+
+// Size the made-up field of time_Time_sprop.
+func (o *Buffer) size_time_Time(p *Properties, base unsafe.Pointer) int {
+	ts := *(*time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	secs := ts.Unix()
+	nanos := int32(ts.Sub(time.Unix(secs, 0)))
+	return 1 + SizeVarint(uint64(secs)) + 1 + SizeVarint(uint64(nanos))
+}
+
+// Size a time.Duration.
+func (o *Buffer) size_time_Duration(p *Properties, base unsafe.Pointer) int {
+	d := *(*time.Duration)(unsafe.Pointer(uintptr(base) + p.offset))
+	if d == 0 {
+		return 0
+	}
+	return sizeDuration(p, d)
+}
+
+// Size a *time.Duration.
+func (o *Buffer) size_ptr_time_Duration(p *Properties, base unsafe.Pointer) int {
+	d := *(**time.Duration)(unsafe.Pointer(uintptr(base) + p.offset))
+	if d == nil || *d == 0 {
+		return 0
+	}
+	return sizeDuration(p, *d)
+}
+
+// Size a []time.Duration.
+func (o *Buffer) size_slice_time_Duration(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]time.Duration)(unsafe.Pointer(uintptr(base) + p.offset))
+	n := 0
+	for _, d := range s {
+		n += sizeDuration(p, d)
+	}
+	return n
+}
+
+// sizeDuration returns the length of what enc_Duration appends
+func sizeDuration(p *Properties, d time.Duration) int {
+	nanos := d.Nanoseconds()
+	secs := nanos / 1000_000_000
+	nanos -= secs * 1000_000_000
+
+	n := len(p.tagcode) + 1 // the length always fits in 1 byte
+	if secs != 0 {
+		n += 1 + SizeVarint(uint64(secs))
+	}
+	if nanos != 0 {
+		n += 1 + SizeVarint(uint64(nanos))
+	}
+	return n
+}
+
+// Size a []time.Time with the "delta" attribute
+func (o *Buffer) size_slice_time_Time_delta(p *Properties, base unsafe.Pointer) int {
+	s := *(*[]time.Time)(unsafe.Pointer(uintptr(base) + p.offset))
+	if len(s) == 0 {
+		return 0
+	}
+	n := 0
+	prev := int64(0)
+	for i := range s {
+		x := s[i].UnixNano()
+		n += sizeZigzag64(uint64(x - prev))
+		prev = x
+	}
+	return len(p.tagcode) + sizeLen(n)
+}
@@ -0,0 +1,125 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * google.rpc.Status, the rich error model used by gRPC
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Status codes of a google.rpc.Status. These are the canonical gRPC codes from google/rpc/code.proto.
+const (
+	StatusOK                 int32 = 0
+	StatusCancelled          int32 = 1
+	StatusUnknown            int32 = 2
+	StatusInvalidArgument    int32 = 3
+	StatusDeadlineExceeded   int32 = 4
+	StatusNotFound           int32 = 5
+	StatusAlreadyExists      int32 = 6
+	StatusPermissionDenied   int32 = 7
+	StatusResourceExhausted  int32 = 8
+	StatusFailedPrecondition int32 = 9
+	StatusAborted            int32 = 10
+	StatusOutOfRange         int32 = 11
+	StatusUnimplemented      int32 = 12
+	StatusInternal           int32 = 13
+	StatusUnavailable        int32 = 14
+	StatusDataLoss           int32 = 15
+	StatusUnauthenticated    int32 = 16
+)
+
+// Status encodes as a google.rpc.Status, an error code, a developer facing message, and any number of
+// messages holding details of the error. A *Status is also an error, so it can be returned as one.
+type Status struct {
+	Code    int32  `protobuf:"varint,1"`
+	Message string `protobuf:"bytes,2"`
+	Details []Any  `protobuf:"bytes,3"`
+}
+
+// status has the same fields as Status, without the methods, so it can be marshaled by reflection
+type status Status
+
+// StatusFromError returns a Status describing err. If err is, or wraps, a *Status then that Status is returned.
+// Otherwise the code is chosen from the standard errors err wraps (context.DeadlineExceeded is StatusDeadlineExceeded,
+// os.ErrNotExist is StatusNotFound, and so on), and the message is err.Error(). A nil err is StatusOK.
+func StatusFromError(err error) *Status {
+	if err == nil {
+		return &Status{Code: StatusOK}
+	}
+	var s *Status
+	if errors.As(err, &s) {
+		return s
+	}
+
+	code := StatusUnknown
+	var de *DecodeError
+	switch {
+	case errors.Is(err, context.Canceled):
+		code = StatusCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = StatusDeadlineExceeded
+	case errors.Is(err, os.ErrNotExist):
+		code = StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		code = StatusAlreadyExists
+	case errors.Is(err, os.ErrPermission):
+		code = StatusPermissionDenied
+	case errors.As(err, &de):
+		code = StatusInvalidArgument
+	}
+	return &Status{Code: code, Message: err.Error()}
+}
+
+// Error returns a description of the status
+func (s *Status) Error() string {
+	return fmt.Sprintf("protobuf3: status code %d: %s", s.Code, s.Message)
+}
+
+// MarshalProtobuf3 encodes the Status as a google.rpc.Status
+func (s *Status) MarshalProtobuf3() ([]byte, error) {
+	return Marshal((*status)(s))
+}
+
+// UnmarshalProtobuf3 decodes a google.rpc.Status
+func (s *Status) UnmarshalProtobuf3(data []byte) error {
+	return Unmarshal(data, (*status)(s))
+}
+
+// AsProtobuf3 returns the name of the type and the file which must be imported to use it
+func (*Status) AsProtobuf3() (string, string, []string) {
+	return "google.rpc.Status", "", []string{"google/rpc/status.proto"}
+}
@@ -0,0 +1,98 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Registry of the protobuf names of Go struct types, used to generate type URLs
+ */
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// TypeURLPrefix is the conventional prefix of type URLs, which is followed by the fully qualified protobuf name of the message
+const TypeURLPrefix = "type.googleapis.com/"
+
+var (
+	protoNamesMu sync.RWMutex
+	protoNames   = make(map[reflect.Type]string)
+	protoTypes   = make(map[string]reflect.Type) // the reverse of protoNames
+)
+
+// RegisterProtoName registers the fully qualified protobuf name (for example "mist.Event") of the Go struct type t.
+// A string field of t with the "typeurl" attribute is then encoded with the type URL TypeURLPrefix+name, no matter
+// what value the field holds, so the message identifies itself. Since the properties of struct types are cached,
+// names must be registered before the structs which use them are first marshaled or unmarshaled (typically in an init() func).
+// The elements of []interface{} fields are encoded as google.protobuf.Any holding the type URLs of the elements' types,
+// and when such a field is decoded the type URL is used to find the type of the element to decode.
+func RegisterProtoName(t reflect.Type, name string) error {
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf3: %s must be a struct type", t)
+	}
+	if name == "" {
+		return fmt.Errorf("protobuf3: %s can't be registered with an empty name", t)
+	}
+
+	protoNamesMu.Lock()
+	protoNames[t] = name
+	protoTypes[name] = t
+	protoNamesMu.Unlock()
+	return nil
+}
+
+// lookupProtoName returns the registered protobuf name of struct type t, or "" if t isn't registered
+func lookupProtoName(t reflect.Type) string {
+	protoNamesMu.RLock()
+	name := protoNames[t]
+	protoNamesMu.RUnlock()
+	return name
+}
+
+// TypeURL returns the type URL of struct type t, or "" if t's protobuf name hasn't been registered with RegisterProtoName
+func TypeURL(t reflect.Type) string {
+	name := lookupProtoName(t)
+	if name == "" {
+		return ""
+	}
+	return TypeURLPrefix + name
+}
+
+// lookupTypeURL returns the struct type whose protobuf name is the last path element of typeURL, or nil if there isn't one
+func lookupTypeURL(typeURL string) reflect.Type {
+	name := typeURL[strings.LastIndexByte(typeURL, '/')+1:]
+	protoNamesMu.RLock()
+	t := protoTypes[name]
+	protoNamesMu.RUnlock()
+	return t
+}
@@ -37,13 +37,26 @@ package protobuf3_test
 
 import (
 	"bytes"
+	"container/heap"
+	"container/list"
+	"context"
 	"encoding/binary"
 	ehex "encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -687,6 +700,101 @@ func TestRecursiveTypeMsg(t *testing.T) {
 	eq("mb", m, mb, t)
 }
 
+func TestRecursiveTypeMsgAsProtobufFull(t *testing.T) {
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(RecursiveTypeMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(s)
+	if n := strings.Count(s, "message RecursiveTypeMsg {"); n != 1 {
+		t.Errorf("RecursiveTypeMsg is defined %d times; expected once", n)
+	}
+	if !strings.Contains(s, "RecursiveTypeMsg self = 1;") {
+		t.Error("RecursiveTypeMsg.self isn't a RecursiveTypeMsg")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	// a chain of 150 nested messages
+	m := &RecursiveTypeMsg{b: true}
+	for i := 1; i < 150; i++ {
+		m = &RecursiveTypeMsg{self: m}
+	}
+	pb := mustMarshal(t, m)
+
+	var u RecursiveTypeMsg
+	err := protobuf3.Unmarshal(pb, &u)
+	if !errors.Is(err, protobuf3.ErrMaxDepth) {
+		t.Errorf("Unmarshal(150 deep) = %v; expected ErrMaxDepth", err)
+	}
+
+	buf := protobuf3.NewBuffer(pb)
+	buf.SetMaxDepth(150)
+	u = RecursiveTypeMsg{}
+	if err := buf.Unmarshal(&u); err != nil {
+		t.Fatalf("Unmarshal(150 deep) with max depth 150 = %v", err)
+	}
+	eq("deep", *m, u, t)
+
+	buf = protobuf3.NewBuffer(pb)
+	buf.SetMaxDepth(149)
+	u = RecursiveTypeMsg{}
+	if err := buf.Unmarshal(&u); !errors.Is(err, protobuf3.ErrMaxDepth) {
+		t.Errorf("Unmarshal(150 deep) with max depth 149 = %v; expected ErrMaxDepth", err)
+	}
+}
+
+type MaxSizeMsg struct {
+	S string  `protobuf:"bytes,1"`
+	P []int32 `protobuf:"varint,2"`
+}
+
+func TestMaxSize(t *testing.T) {
+	// a truncated buffer claiming a 2GB string is rejected without allocating it
+	var b protobuf3.Buffer
+	b.EncodeVarint(1<<3 | uint64(protobuf3.WireBytes))
+	b.EncodeVarint(2 << 30)
+	truncated := append(b.Bytes(), "abc"...)
+	var u MaxSizeMsg
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := protobuf3.Unmarshal(truncated, &u); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Unmarshal(truncated) = %v; expected io.ErrUnexpectedEOF", err)
+		}
+	})
+	if allocs > 2 {
+		t.Errorf("Unmarshal(truncated) did %v allocations", allocs)
+	}
+
+	unmarshal := func(pb []byte, max int) error {
+		buf := protobuf3.NewBuffer(pb)
+		buf.SetMaxSize(max)
+		var u MaxSizeMsg
+		return buf.Unmarshal(&u)
+	}
+
+	// a string or packed field longer than the max size is rejected, even when the input holds it
+	long := mustMarshal(t, &MaxSizeMsg{S: "0123456789a"})
+	if err := unmarshal(long, 12); !errors.Is(err, protobuf3.ErrMaxSize) {
+		t.Errorf("Unmarshal(long string) = %v; expected ErrMaxSize", err)
+	}
+	packed := mustMarshal(t, &MaxSizeMsg{P: []int32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}})
+	if err := unmarshal(packed, 12); !errors.Is(err, protobuf3.ErrMaxSize) {
+		t.Errorf("Unmarshal(long packed field) = %v; expected ErrMaxSize", err)
+	}
+
+	// as is a message longer than the max size
+	if err := unmarshal(append(mustMarshal(t, &MaxSizeMsg{S: "a"}), packed...), 12); !errors.Is(err, protobuf3.ErrMaxSize) {
+		t.Errorf("Unmarshal(long message) = %v; expected ErrMaxSize", err)
+	}
+
+	// and within the limit (or with no limit) all is well
+	for _, max := range []int{13, 0} {
+		if err := unmarshal(long, max); err != nil {
+			t.Errorf("Unmarshal(long string, max %d) = %v", max, err)
+		}
+	}
+}
+
 type MapMsg struct {
 	m map[string]int32   `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
 	n map[int32][]byte   `protobuf:"bytes,4" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
@@ -2627,6 +2735,66 @@ func TestTimestampAndDuration(t *testing.T) {
 	}
 }
 
+type AnonStructMsgA struct {
+	X struct {
+		V int32 `protobuf:"varint,1"`
+	} `protobuf:"bytes,1"`
+	Y []struct {
+		V int32 `protobuf:"varint,1"`
+	} `protobuf:"bytes,2"`
+	M map[string]struct {
+		V int32 `protobuf:"varint,1"`
+	} `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	N map[string]struct {
+		V int32 `protobuf:"varint,1"`
+	} `protobuf:"bytes,4" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+}
+
+type AnonStructMsgB struct {
+	X *struct {
+		V int32 `protobuf:"varint,1"`
+	} `protobuf:"bytes,1,optional"`
+}
+
+func TestAnonymousStructsAsProtobuf(t *testing.T) {
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(AnonStructMsgA{}), reflect.TypeOf(AnonStructMsgB{}))
+	if err != nil {
+		t.Error(err)
+	}
+	t.Log(s)
+
+	// each anonymous type is defined once, nested inside the message which uses it, ahead of the field
+	expected := `
+message AnonStructMsgA {
+  message X {
+    int32 v = 1;
+  }
+  X x = 1;
+  message Y {
+    int32 v = 1;
+  }
+  repeated Y y = 2;
+  message MValue {
+    int32 v = 1;
+  }
+  map<string, MValue> m = 3;
+  message NValue {
+    int32 v = 1;
+  }
+  map<string, NValue> n = 4;
+}
+
+message AnonStructMsgB {
+  message X {
+    int32 v = 1;
+  }
+  optional X x = 1;
+}`
+	if !strings.HasSuffix(s, expected) {
+		t.Errorf("AsProtobufFull =\n%s\nexpected it to end with%s", s, expected)
+	}
+}
+
 type MsgWithUint8Slice struct {
 	S []percentage `protobuf:"varint,1"`
 	B []int8       `protobuf:"varint,10"`
@@ -2822,7 +2990,5125 @@ func TestPackedMsg(t *testing.T) {
 	err = protobuf3.Unmarshal(pb2, &m3)
 	if err == nil {
 		t.Errorf("Unmarshal(unpacked) should have failed")
-	} else if err.Error() != "protobuf3: bad wiretype for field protobuf3_test.PackedMsg.F: got wiretype varint, wanted bytes" {
+	} else if err.Error() != "protobuf3: bad wiretype for field protobuf3_test.PackedMsg.F: got wiretype varint, wanted bytes (field 1 at offset 0)" {
 		t.Errorf("Unmarshal() failed: %v", err)
 	}
 }
+
+type TagKeyMsg struct {
+	X int32            `protobuf:"varint,1" pb3:"varint,2"`
+	S string           `protobuf:"bytes,2" pb3:"bytes,3"`
+	M map[string]int32 `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2" pb3:"bytes,4" pb3_key:"bytes,1" pb3_val:"zigzag32,2"`
+	N int32            `protobuf:"-" pb3:"varint,5"`
+}
+
+func TestTagKey(t *testing.T) {
+	m := TagKeyMsg{
+		X: 1,
+		S: "s",
+		M: map[string]int32{"m": -1},
+		N: 5,
+	}
+
+	// first marshal using the default tag key, so that the properties are cached
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := protobuf3.NewBuffer(nil)
+	buf.EncodeVarint(1<<3 | uint64(protobuf3.WireVarint))
+	buf.EncodeVarint(1)
+	buf.EncodeVarint(2<<3 | uint64(protobuf3.WireBytes))
+	buf.EncodeStringBytes("s")
+	buf.EncodeBytes(3, []byte{1<<3 | byte(protobuf3.WireBytes), 1, 'm', 2<<3 | byte(protobuf3.WireVarint), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	if !bytes.Equal(pb, buf.Bytes()) {
+		t.Errorf("Marshal with default TagKey = % x; expected % x", pb, buf.Bytes())
+	}
+
+	// then marshal with the pb3 tag key
+	protobuf3.TagKey = "pb3"
+	defer func() { protobuf3.TagKey = "protobuf" }()
+
+	pb, err = protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = protobuf3.NewBuffer(nil)
+	buf.EncodeVarint(2<<3 | uint64(protobuf3.WireVarint))
+	buf.EncodeVarint(1)
+	buf.EncodeVarint(3<<3 | uint64(protobuf3.WireBytes))
+	buf.EncodeStringBytes("s")
+	buf.EncodeBytes(4, []byte{1<<3 | byte(protobuf3.WireBytes), 1, 'm', 2<<3 | byte(protobuf3.WireVarint), 1})
+	buf.EncodeVarint(5<<3 | uint64(protobuf3.WireVarint))
+	buf.EncodeVarint(5)
+	if !bytes.Equal(pb, buf.Bytes()) {
+		t.Errorf("Marshal with TagKey pb3 = % x; expected % x", pb, buf.Bytes())
+	}
+
+	var m2 TagKeyMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Error(err)
+	}
+	eq("TagKeyMsg", m, m2, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Error(err)
+	}
+	t.Log(s)
+	if !strings.Contains(s, "map<string, sint32> m = 4;") {
+		t.Errorf("AsProtobuf with TagKey pb3 didn't use the pb3 tags:\n%s", s)
+	}
+}
+
+type DecodeErrorMsg struct {
+	X     uint32                `protobuf:"varint,1"`
+	Inner DecodeErrorInnerMsg   `protobuf:"bytes,2"`
+	S     []DecodeErrorInnerMsg `protobuf:"bytes,3"`
+}
+
+type DecodeErrorInnerMsg struct {
+	A string `protobuf:"bytes,1"`
+	B uint64 `protobuf:"varint,2"`
+}
+
+func TestDecodeError(t *testing.T) {
+	m := DecodeErrorMsg{
+		X:     1,
+		Inner: DecodeErrorInnerMsg{A: "abc", B: 1 << 20},
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(protobuf3.DebugPrint(pb))
+	// pb is:
+	//  0: 08 01              X
+	//  2: 12 09              Inner, 9 bytes long
+	//  4:   0a 03 61 62 63   Inner.A
+	//  9:   10 80 80 40      Inner.B
+
+	// truncating anywhere inside Inner is detected when Inner's byte length (at offset 3, just after Inner's tag) overruns the buffer
+	for n := 4; n < len(pb); n++ {
+		var m2 DecodeErrorMsg
+		err = protobuf3.Unmarshal(pb[:n], &m2)
+		de, ok := err.(*protobuf3.DecodeError)
+		if !ok {
+			t.Errorf("Unmarshal(pb[:%d]) returned %T %v; expected a *DecodeError", n, err, err)
+			continue
+		}
+		t.Log(de)
+		if de.Offset != 3 || de.Field != 2 {
+			t.Errorf("Unmarshal(pb[:%d]) reported offset %d, field %d; expected offset 3, field 2", n, de.Offset, de.Field)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Unmarshal(pb[:%d]) returned %v; expected it to wrap io.ErrUnexpectedEOF", n, err)
+		}
+	}
+
+	// truncating the top level message just after a tag reports the offset of the missing value
+	var m2 DecodeErrorMsg
+	err = protobuf3.Unmarshal(pb[:1], &m2)
+	if de, ok := err.(*protobuf3.DecodeError); !ok || de.Offset != 1 || de.Field != 1 {
+		t.Errorf("Unmarshal(pb[:1]) returned %v; expected offset 1, field 1", err)
+	}
+
+	// corrupt Inner.B by making it an overlong varint, so the error is found inside the nested message
+	// the offset of the problem must be relative to the start of the outer buffer
+	pb2 := append([]byte{}, pb[:3]...)
+	pb2 = append(pb2, 5+11) // Inner's new byte length
+	pb2 = append(pb2, pb[4:9]...)
+	pb2 = append(pb2, 0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	t.Log(protobuf3.DebugPrint(pb2))
+	var m3 DecodeErrorMsg
+	err = protobuf3.Unmarshal(pb2, &m3)
+	if de, ok := err.(*protobuf3.DecodeError); !ok || de.Offset != 10 || de.Field != 2 {
+		t.Errorf("Unmarshal(corrupt inner message) returned %v; expected offset 10, field 2", err)
+	}
+
+	// and the same inside a repeated message at a different position
+	pb4 := []byte{0x08, 0x01, 0x1a, 0x03, 0x0a, 0x05, 0x61}
+	var m4 DecodeErrorMsg
+	err = protobuf3.Unmarshal(pb4, &m4)
+	if de, ok := err.(*protobuf3.DecodeError); !ok || de.Offset != 5 || de.Field != 1 {
+		t.Errorf("Unmarshal(corrupt repeated message) returned %v; expected offset 5, field 1", err)
+	}
+}
+
+type UUID [16]byte
+
+type UUIDMsg struct {
+	ID   UUID `protobuf:"bytes,1"`
+	Zero UUID `protobuf:"bytes,3"`
+}
+
+func TestNamedByteArray(t *testing.T) {
+	m := UUIDMsg{
+		ID: UUID{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0},
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(s)
+	if !strings.Contains(s, "  bytes id = 1;\n") || !strings.Contains(s, "  bytes zero = 3;\n") {
+		t.Errorf("AsProtobuf of a named [16]byte isn't bytes:\n%s", s)
+	}
+
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(protobuf3.DebugPrint(pb))
+
+	// the all-zero UUID is not the protobuf default value (which is zero bytes), and so it is not elided
+	buf := protobuf3.NewBuffer(nil)
+	buf.EncodeBytes(1, m.ID[:])
+	buf.EncodeBytes(3, make([]byte, 16))
+	if !bytes.Equal(pb, buf.Bytes()) {
+		t.Errorf("Marshal(UUIDMsg) = % x; expected % x", pb, buf.Bytes())
+	}
+
+	var m2 UUIDMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Error(err)
+	}
+	eq("UUIDMsg", m, m2, t)
+
+	// and a message lacking the zero UUID decodes to the zero UUID
+	var m3 UUIDMsg
+	m3.Zero[0] = 1 // Unmarshal merges, so it must not touch m3.Zero
+	err = protobuf3.Unmarshal(pb[:2+16], &m3)
+	if err != nil {
+		t.Error(err)
+	}
+	if m3.ID != m.ID || m3.Zero != (UUID{1}) {
+		t.Errorf("Unmarshal(UUIDMsg without Zero) = %+v", m3)
+	}
+}
+
+type FieldMaskMsg struct {
+	Mask protobuf3.FieldMask `protobuf:"bytes,1"`
+}
+
+type PatchMsg struct {
+	Name    string         `protobuf:"bytes,1"`
+	Count   int32          `protobuf:"varint,2"`
+	Address *PatchInnerMsg `protobuf:"bytes,3"`
+	Inner   PatchInnerMsg  `protobuf:"bytes,4"`
+	Tags    []string       `protobuf:"bytes,5"`
+}
+
+type PatchInnerMsg struct {
+	Street string `protobuf:"bytes,1"`
+	Zip    string `protobuf:"bytes,2,name=postal_code"`
+}
+
+func TestFieldMask(t *testing.T) {
+	m := FieldMaskMsg{
+		Mask: protobuf3.NewFieldMask("name", "address.street", "inner.postal_code"),
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(protobuf3.DebugPrint(pb))
+
+	// the field mask is a message containing repeated strings in field 1
+	var inner protobuf3.Buffer
+	for _, path := range m.Mask {
+		inner.EncodeBytes(1, []byte(path))
+	}
+	var outer protobuf3.Buffer
+	outer.EncodeBytes(1, inner.Bytes())
+	if !bytes.Equal(pb, outer.Bytes()) {
+		t.Errorf("Marshal(FieldMask) = % x; expected % x", pb, outer.Bytes())
+	}
+
+	var m2 FieldMaskMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Error(err)
+	}
+	eq("FieldMaskMsg", m, m2, t)
+
+	// an empty mask encodes as nothing
+	pb, err = protobuf3.Marshal(&FieldMaskMsg{})
+	if err != nil || len(pb) != 0 {
+		t.Errorf("Marshal(empty FieldMask) = % x, %v", pb, err)
+	}
+
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(m))
+	if err != nil {
+		t.Error(err)
+	}
+	t.Log(s)
+	if !strings.Contains(s, "google.protobuf.FieldMask mask = 1;") || !strings.Contains(s, `import "google/protobuf/field_mask.proto";`) {
+		t.Errorf("AsProtobufFull(FieldMaskMsg) doesn't use the well-known FieldMask:\n%s", s)
+	}
+
+	if !m.Mask.Contains("address.street") || !m.Mask.Contains("name") || m.Mask.Contains("address") || m.Mask.Contains("count") {
+		t.Error("FieldMask.Contains is wrong")
+	}
+	if !protobuf3.NewFieldMask("address").Contains("address.street") || protobuf3.NewFieldMask("address").Contains("addresses") {
+		t.Error("FieldMask.Contains of a parent path is wrong")
+	}
+
+	// apply the mask
+	dst := PatchMsg{
+		Name:  "old",
+		Count: 1,
+		Inner: PatchInnerMsg{Street: "old street", Zip: "12345"},
+	}
+	src := PatchMsg{
+		Name:    "new",
+		Count:   2,
+		Address: &PatchInnerMsg{Street: "new street", Zip: "67890"},
+		Inner:   PatchInnerMsg{Street: "new street", Zip: "67890"},
+	}
+	err = m.Mask.Apply(&dst, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PatchMsg{
+		Name:    "new",
+		Count:   1,
+		Address: &PatchInnerMsg{Street: "new street"},
+		Inner:   PatchInnerMsg{Street: "old street", Zip: "67890"},
+	}
+	eq("FieldMask.Apply", dst, expected, t)
+
+	// the fields copied don't share memory with src
+	src.Tags = []string{"a", "b"}
+	err = protobuf3.NewFieldMask("address", "tags").Apply(&dst, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Address.Street = "changed"
+	src.Tags[0] = "changed"
+	if dst.Address == src.Address || dst.Address.Street != "new street" || dst.Tags[0] != "a" {
+		t.Errorf("FieldMask.Apply aliased src: %+v %v", *dst.Address, dst.Tags)
+	}
+
+	err = protobuf3.NewFieldMask("nonesuch").Apply(&dst, &src)
+	t.Log(err)
+	if err == nil {
+		t.Error("FieldMask.Apply with an unknown path should have failed")
+	}
+}
+
+type SyncMapMsg struct {
+	M map[string]int32 `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+func TestMarshalSyncMap(t *testing.T) {
+	var sm sync.Map
+	expected := SyncMapMsg{M: make(map[string]int32)}
+	for i := int32(-2); i < 100; i++ {
+		k := fmt.Sprintf("key%d", i)
+		sm.Store(k, i)
+		expected.M[k] = i
+	}
+
+	pb, err := protobuf3.MarshalSyncMap(&sm, 3, reflect.TypeOf(""), reflect.TypeOf(int32(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m SyncMapMsg
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("SyncMapMsg", m, expected, t)
+
+	// an empty sync.Map encodes as nothing
+	var empty sync.Map
+	pb, err = protobuf3.MarshalSyncMap(&empty, 3, reflect.TypeOf(""), reflect.TypeOf(int32(0)))
+	if err != nil || len(pb) != 0 {
+		t.Errorf("MarshalSyncMap(empty) = % x, %v", pb, err)
+	}
+
+	// values of the wrong type are an error
+	sm.Store("wrong", "type")
+	_, err = protobuf3.MarshalSyncMap(&sm, 3, reflect.TypeOf(""), reflect.TypeOf(int32(0)))
+	t.Log(err)
+	if err == nil {
+		t.Error("MarshalSyncMap with a value of the wrong type should have failed")
+	}
+}
+
+type GetFieldMsg struct {
+	Payload []byte   `protobuf:"bytes,1"`
+	Tenant  uint64   `protobuf:"varint,7"`
+	Tags    []string `protobuf:"bytes,9"`
+	Ratio   float64  `protobuf:"fixed64,10"`
+}
+
+func TestGetField(t *testing.T) {
+	m := GetFieldMsg{
+		Payload: bytes.Repeat([]byte{0xff}, 300),
+		Tenant:  12345,
+		Tags:    []string{"a", "bb", "ccc"},
+		Ratio:   0.5,
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wt, val, found, err := protobuf3.GetField(pb, 7)
+	if err != nil || !found || wt != protobuf3.WireVarint {
+		t.Fatalf("GetField(7) = %v, % x, %v, %v", wt, val, found, err)
+	}
+	if x, n := protobuf3.DecodeVarint(val); x != m.Tenant || n != len(val) {
+		t.Errorf("GetField(7) = % x; expected varint %d", val, m.Tenant)
+	}
+
+	wt, val, found, err = protobuf3.GetField(pb, 10)
+	if err != nil || !found || wt != protobuf3.WireFixed64 || !bytes.Equal(val, []byte{0, 0, 0, 0, 0, 0, 0xe0, 0x3f}) {
+		t.Errorf("GetField(10) = %v, % x, %v, %v", wt, val, found, err)
+	}
+
+	wt, val, found, err = protobuf3.GetField(pb, 9)
+	if err != nil || !found || wt != protobuf3.WireBytes || string(val) != "a" {
+		t.Errorf("GetField(9) = %v, % x, %v, %v", wt, val, found, err)
+	}
+
+	_, _, found, err = protobuf3.GetField(pb, 8)
+	if err != nil || found {
+		t.Errorf("GetField(8) found %v, %v; expected not found", found, err)
+	}
+
+	wt, vals, err := protobuf3.GetFields(pb, 9)
+	if err != nil || wt != protobuf3.WireBytes || len(vals) != len(m.Tags) {
+		t.Fatalf("GetFields(9) = %v, %q, %v", wt, vals, err)
+	}
+	for i := range vals {
+		if string(vals[i]) != m.Tags[i] {
+			t.Errorf("GetFields(9)[%d] = %q; expected %q", i, vals[i], m.Tags[i])
+		}
+	}
+
+	_, vals, err = protobuf3.GetFields(pb, 8)
+	if err != nil || vals != nil {
+		t.Errorf("GetFields(8) = %q, %v; expected nothing", vals, err)
+	}
+
+	// a truncated message is an error
+	_, _, _, err = protobuf3.GetField(pb[:len(pb)-3], 10)
+	if err == nil {
+		t.Error("GetField(truncated message) should have failed")
+	}
+}
+
+type ChecksumMsg struct {
+	Seq      uint64       `protobuf:"varint,1"`
+	Payload  string       `protobuf:"bytes,2"`
+	Inner    *ChecksumMsg `protobuf:"bytes,3"`
+	Checksum uint32       `protobuf:"fixed32,15,checksum"`
+}
+
+type BadChecksumMsg struct {
+	Checksum uint32 `protobuf:"fixed32,1,checksum"`
+	Payload  string `protobuf:"bytes,2"`
+}
+
+func TestChecksum(t *testing.T) {
+	m := ChecksumMsg{
+		Seq:     7,
+		Payload: "hello",
+		Inner: &ChecksumMsg{
+			Payload: "world",
+		},
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the outer checksum is the last 5 bytes, and covers everything before it
+	n := len(pb) - 5
+	if pb[n] != 15<<3|byte(protobuf3.WireFixed32) {
+		t.Fatalf("checksum field not last in % x", pb)
+	}
+	if crc := binary.LittleEndian.Uint32(pb[n+1:]); crc != crc32.ChecksumIEEE(pb[:n]) {
+		t.Errorf("checksum %08x; expected %08x", crc, crc32.ChecksumIEEE(pb[:n]))
+	}
+
+	var m2 ChecksumMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Seq != m.Seq || m2.Payload != m.Payload || m2.Inner == nil || m2.Inner.Payload != m.Inner.Payload {
+		t.Errorf("m2 = %+v; expected %+v", m2, m)
+	}
+	if m2.Checksum != crc32.ChecksumIEEE(pb[:n]) || m2.Inner.Checksum == 0 {
+		t.Errorf("m2 checksums %08x, %08x", m2.Checksum, m2.Inner.Checksum)
+	}
+
+	// corrupt a byte of the payload
+	bad := append([]byte(nil), pb...)
+	bad[bytes.Index(bad, []byte("hello"))] ^= 0x20
+	err = protobuf3.Unmarshal(bad, &m2)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Unmarshal(corrupt) = %v; expected a checksum mismatch", err)
+	}
+
+	// corrupt a byte of the inner message. both checksums are wrong; the inner one is detected first
+	bad = append([]byte(nil), pb...)
+	bad[bytes.Index(bad, []byte("world"))] ^= 0x20
+	err = protobuf3.Unmarshal(bad, &m2)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Unmarshal(corrupt inner) = %v; expected a checksum mismatch", err)
+	}
+
+	// a missing checksum is an error too
+	err = protobuf3.Unmarshal(pb[:n], &m2)
+	if err == nil || !strings.Contains(err.Error(), "missing checksum") {
+		t.Errorf("Unmarshal(no checksum) = %v; expected missing checksum", err)
+	}
+
+	// the checksum field must be the last field
+	_, err = protobuf3.Marshal(&BadChecksumMsg{})
+	if err == nil {
+		t.Error("Marshal(BadChecksumMsg) should have failed")
+	}
+}
+
+// a message wrapped with transport bookkeeping fields which aren't part of the protobuf encoding
+type BookkeepingMsg struct {
+	ID      uint64     `protobuf:"varint,1"`
+	mu      sync.Mutex `protobuf:"-"`
+	retries int        `protobuf:"-"`
+	Name    string     `protobuf:"bytes,2"`
+	sent    time.Time  `protobuf:"-"`
+	Values  []int32    `protobuf:"varint,3"`
+}
+
+func TestSkippedFieldOffsets(t *testing.T) {
+	m := BookkeepingMsg{
+		ID:      1234,
+		retries: 3,
+		Name:    "frame",
+		sent:    time.Now(),
+		Values:  []int32{-1, 0, 1},
+	}
+	m.mu.Lock()
+	pb, err := protobuf3.Marshal(&m)
+	m.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m2 BookkeepingMsg
+	m2.retries = 5
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.ID != m.ID || m2.Name != m.Name || !reflect.DeepEqual(m2.Values, m.Values) {
+		t.Errorf("m2 = %d %q %v; expected %d %q %v", m2.ID, m2.Name, m2.Values, m.ID, m.Name, m.Values)
+	}
+	// the skipped fields are untouched
+	if m2.retries != 5 || !m2.sent.IsZero() {
+		t.Errorf("m2 bookkeeping fields were modified: %d %v", m2.retries, m2.sent)
+	}
+	m2.mu.Lock() // and the mutex is still usable
+	m2.mu.Unlock()
+}
+
+type DateTimeMsg struct {
+	When  time.Time `protobuf:"bytes,1,datetime"`
+	Stamp time.Time `protobuf:"bytes,2"`
+}
+
+func TestDateTime(t *testing.T) {
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("", -(7*3600 + 30*60)), time.FixedZone("IST", 5*3600+30*60)} {
+		when := time.Date(2021, time.March, 14, 1, 59, 26, 535897932, loc)
+		m := DateTimeMsg{When: when, Stamp: when}
+		pb, err := protobuf3.Marshal(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var m2 DateTimeMsg
+		err = protobuf3.Unmarshal(pb, &m2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m2.When.Equal(when) {
+			t.Errorf("When = %v; expected %v", m2.When, when)
+		}
+		// unlike a Timestamp, the DateTime keeps the civil time and its utc offset
+		if y, mo, d := m2.When.Date(); y != 2021 || mo != time.March || d != 14 || m2.When.Hour() != 1 {
+			t.Errorf("When = %v; expected civil time 2021-03-14 01:59", m2.When)
+		}
+		_, off1 := m2.When.Zone()
+		_, off2 := when.Zone()
+		if off1 != off2 {
+			t.Errorf("When offset = %d; expected %d", off1, off2)
+		}
+		if !m2.Stamp.Equal(when) || m2.Stamp.Location() != time.UTC {
+			t.Errorf("Stamp = %v; expected %v in UTC", m2.Stamp, when)
+		}
+	}
+
+	// the .proto imports the DateTime definition
+	def, err := protobuf3.AsProtobufFull(reflect.TypeOf(DateTimeMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(def, `import "google/type/datetime.proto";`) || !strings.Contains(def, "google.type.DateTime when = 1;") {
+		t.Errorf("AsProtobufFull(DateTimeMsg) = %s", def)
+	}
+
+	// a DateTime with a named time_zone rather than a utc_offset decodes in that time zone
+	if _, err := time.LoadLocation("Etc/GMT+5"); err != nil {
+		t.Skipf("skipping time_zone test: %v", err)
+	}
+	pb := []byte{0x0a, 0x14, 0x08, 0xe5, 0x0f, 0x10, 0x07, 0x18, 0x04, 0x4a, 0x0b, 0x0a, 0x09, 'E', 't', 'c', '/', 'G', 'M', 'T', '+', '5'}
+	var m DateTimeMsg
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.When.Location().String() != "Etc/GMT+5" || !m.When.Equal(time.Date(2021, time.July, 4, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("When = %v; expected 2021-07-04 00:00 in Etc/GMT+5", m.When)
+	}
+}
+
+func TestMarshalToBuffer(t *testing.T) {
+	m := GetFieldMsg{
+		Payload: []byte("payload"),
+		Tenant:  99,
+		Tags:    []string{"x", "y"},
+		Ratio:   1.5,
+	}
+	expected, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an exactly sized buffer
+	dst := make([]byte, len(expected))
+	n, err := protobuf3.MarshalToBuffer(dst, &m)
+	if err != nil || n != len(expected) || !bytes.Equal(dst, expected) {
+		t.Errorf("MarshalToBuffer = %d, %v, % x; expected % x", n, err, dst, expected)
+	}
+
+	// an undersized buffer is untouched
+	short := make([]byte, len(expected)-1)
+	n, err = protobuf3.MarshalToBuffer(short, &m)
+	if err != io.ErrShortBuffer || n != 0 {
+		t.Errorf("MarshalToBuffer(short) = %d, %v; expected io.ErrShortBuffer", n, err)
+	}
+	if !bytes.Equal(short, make([]byte, len(short))) {
+		t.Errorf("MarshalToBuffer(short) modified dst: % x", short)
+	}
+
+	// and once warmed up it doesn't allocate
+	if raceEnabled {
+		return
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		protobuf3.MarshalToBuffer(dst, &m)
+	})
+	if allocs != 0 {
+		t.Errorf("MarshalToBuffer did %v allocations; expected none", allocs)
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	m := GetFieldMsg{
+		Payload: []byte("payload"),
+		Tenant:  99,
+		Tags:    []string{"x", "y"},
+		Ratio:   1.5,
+	}
+	expected, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// append two records after a prefix, and slice them back out
+	buf := make([]byte, 0, 256)
+	buf = append(buf, "prefix"...)
+	buf, err = protobuf3.MarshalAppend(buf, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid := len(buf)
+	buf, err = protobuf3.MarshalAppend(buf, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:6]) != "prefix" || !bytes.Equal(buf[6:mid], expected) || !bytes.Equal(buf[mid:], expected) {
+		t.Errorf("MarshalAppend = % x; expected prefix and two copies of % x", buf, expected)
+	}
+
+	var m2 GetFieldMsg
+	err = protobuf3.Unmarshal(buf[mid:], &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("round trip = %+v; expected %+v", m2, m)
+	}
+
+	// on error the input is returned as it was
+	buf2, err := protobuf3.MarshalAppend(buf, (*GetFieldMsg)(nil))
+	if err == nil || len(buf2) != len(buf) {
+		t.Errorf("MarshalAppend(nil) = %d bytes, %v; expected %d bytes and an error", len(buf2), err, len(buf))
+	}
+
+	// with enough capacity it doesn't allocate the output
+	allocs := testing.AllocsPerRun(100, func() {
+		protobuf3.MarshalAppend(buf[:0], &m)
+	})
+	if allocs != 0 {
+		t.Errorf("MarshalAppend did %v allocations; expected none", allocs)
+	}
+}
+
+type BitsetMsg struct {
+	Flags protobuf3.Bitset `protobuf:"bytes,1"`
+	Bools []bool           `protobuf:"varint,2"`
+}
+
+func TestBitset(t *testing.T) {
+	var m BitsetMsg
+	scattered := []int{0, 7, 8, 63, 64, 65, 127, 500, 777, 999}
+	for _, i := range scattered {
+		m.Flags.Set(i, true)
+	}
+	m.Flags.Set(500, false)
+	m.Flags.Set(5000, false) // clearing a flag past the end doesn't grow the set
+	if m.Flags.Count() != len(scattered)-1 || len(m.Flags) != 16 {
+		t.Errorf("Count = %d, len = %d; expected %d, 16", m.Flags.Count(), len(m.Flags), len(scattered)-1)
+	}
+
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1000 bits are 125 bytes, plus a byte each of tag and length
+	if len(pb) != 127 {
+		t.Errorf("Bitset encoded to %d bytes; expected 127", len(pb))
+	}
+	if n, err := protobuf3.Size(&m); err != nil || n != len(pb) {
+		t.Errorf("Size = %d, %v; expected %d", n, err, len(pb))
+	}
+
+	var m2 BitsetMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i++ {
+		if m2.Flags.Get(i) != m.Flags.Get(i) {
+			t.Errorf("flag %d = %v; expected %v", i, m2.Flags.Get(i), m.Flags.Get(i))
+		}
+	}
+
+	// the same flags as a []bool take 8x the space
+	m3 := BitsetMsg{Bools: make([]bool, 1000)}
+	for _, i := range scattered {
+		m3.Bools[i] = true
+	}
+	pb3, err := protobuf3.Marshal(&m3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pb3) < 8*125 {
+		t.Errorf("[]bool encoded to %d bytes; expected more than %d", len(pb3), 8*125)
+	}
+
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(s)
+	if !strings.Contains(s, "bytes flags = 1;") || strings.Contains(s, "message Bitset {") {
+		t.Error("Bitset isn't declared as bytes")
+	}
+}
+
+type LinkState int32
+
+const (
+	LinkUnknown LinkState = iota
+	LinkUp
+	LinkDown
+)
+
+type LinkMsg struct {
+	State LinkState `protobuf:"varint,1"`
+	Speed int32     `protobuf:"varint,2"`
+}
+
+func TestEnumAlias(t *testing.T) {
+	err := protobuf3.RegisterEnum(reflect.TypeOf(LinkUnknown),
+		protobuf3.EnumValue{Name: "LINK_UNKNOWN", Value: int32(LinkUnknown)},
+		protobuf3.EnumValue{Name: "LINK_UP", Value: int32(LinkUp)},
+		protobuf3.EnumValue{Name: "LINK_DOWN", Value: int32(LinkDown)},
+		protobuf3.EnumValue{Name: "LINK_RUNNING", Value: int32(LinkUp)}, // an alias of LINK_UP
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := protobuf3.AsProtobufFull(reflect.TypeOf(LinkMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const enum = `enum LinkState {
+  option allow_alias = true;
+  LINK_UNKNOWN = 0;
+  LINK_UP = 1;
+  LINK_RUNNING = 1;
+  LINK_DOWN = 2;
+}`
+	if !strings.Contains(def, enum) || !strings.Contains(def, "  LinkState state = 1;") {
+		t.Errorf("AsProtobufFull(LinkMsg) = %s", def)
+	}
+
+	// enums without aliases don't have the option
+	err = protobuf3.RegisterEnum(reflect.TypeOf(LinkUnknown),
+		protobuf3.EnumValue{Name: "LINK_UNKNOWN", Value: int32(LinkUnknown)},
+		protobuf3.EnumValue{Name: "LINK_UP", Value: int32(LinkUp)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, _ = protobuf3.AsProtobufFull(reflect.TypeOf(LinkMsg{}))
+	if strings.Contains(def, "allow_alias") {
+		t.Errorf("AsProtobufFull(LinkMsg) = %s; expected no allow_alias", def)
+	}
+
+	// the encoding is unchanged
+	pb, err := protobuf3.Marshal(&LinkMsg{State: LinkDown})
+	if err != nil || !bytes.Equal(pb, []byte{0x08, 0x02}) {
+		t.Errorf("Marshal(LinkMsg) = % x, %v", pb, err)
+	}
+
+	if protobuf3.RegisterEnum(reflect.TypeOf(""), protobuf3.EnumValue{Name: "X"}) == nil {
+		t.Error("RegisterEnum(string) should have failed")
+	}
+}
+
+type Color int32
+
+const (
+	ColorBlack Color = -1
+	ColorRed   Color = 1
+	ColorGreen Color = 2
+)
+
+type PaletteMsg struct {
+	Default Color   `protobuf:"varint,1"`
+	Colors  []Color `protobuf:"varint,2"`
+}
+
+func TestEnumNames(t *testing.T) {
+	err := protobuf3.RegisterEnumNames(reflect.TypeOf(ColorRed), map[int32]string{
+		int32(ColorBlack): "BLACK",
+		int32(ColorRed):   "RED",
+		int32(ColorGreen): "GREEN",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := protobuf3.AsProtobufFull(reflect.TypeOf(PaletteMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the zero value comes first, as proto3 requires, and since Color has no name for 0 one is made up
+	const enum = `enum Color {
+  COLOR_UNSPECIFIED = 0;
+  BLACK = -1;
+  RED = 1;
+  GREEN = 2;
+}`
+	if !strings.Contains(def, enum) || !strings.Contains(def, "  Color default = 1;") || !strings.Contains(def, "  repeated Color colors = 2;") {
+		t.Errorf("AsProtobufFull(PaletteMsg) = %s", def)
+	}
+
+	m := PaletteMsg{Default: ColorBlack, Colors: []Color{ColorRed, ColorGreen}}
+	pb := mustMarshal(t, &m)
+	var u PaletteMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("palette", m, u, t)
+}
+
+type HTTPCode int32
+
+type HTTPResponseMsg struct {
+	Code HTTPCode `protobuf:"varint,1"`
+}
+
+func TestEnumUnspecifiedAcronym(t *testing.T) {
+	err := protobuf3.RegisterEnumNames(reflect.TypeOf(HTTPCode(0)), map[int32]string{200: "OK", 404: "NOT_FOUND"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := protobuf3.AsProtobufFull(reflect.TypeOf(HTTPResponseMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the acronym is kept as one word
+	if !strings.Contains(def, "  HTTP_CODE_UNSPECIFIED = 0;") {
+		t.Errorf("AsProtobufFull(HTTPResponseMsg) = %s", def)
+	}
+}
+
+type CollidingEmbeddedA struct {
+	X int32 `protobuf:"varint,1"`
+	Y int32 `protobuf:"varint,3"`
+}
+
+type CollidingEmbeddedB struct {
+	Z int32 `protobuf:"varint,3"`
+}
+
+type CollidingEmbeddedMsg struct {
+	CollidingEmbeddedA `protobuf:"embedded"`
+	W                  int32 `protobuf:"varint,2"`
+	CollidingEmbeddedB `protobuf:"embedded"`
+}
+
+func TestEmbeddedTagCollision(t *testing.T) {
+	_, err := protobuf3.GetProperties(reflect.TypeOf(CollidingEmbeddedMsg{}))
+	if err == nil {
+		t.Fatal("GetProperties(CollidingEmbeddedMsg) should have failed")
+	}
+	const expected = "protobuf3: error duplicate tag id 3 assigned to protobuf3_test.CollidingEmbeddedA.Y and protobuf3_test.CollidingEmbeddedB.Z in protobuf3_test.CollidingEmbeddedMsg"
+	if err.Error() != expected {
+		t.Errorf("GetProperties(CollidingEmbeddedMsg) error %q; expected %q", err, expected)
+	}
+
+	_, err = protobuf3.Marshal(&CollidingEmbeddedMsg{})
+	if err == nil {
+		t.Error("Marshal(CollidingEmbeddedMsg) should have failed")
+	}
+}
+
+type StreamMsg struct {
+	Name    string            `protobuf:"bytes,1"`
+	Samples []int64           `protobuf:"varint,2"`
+	Inner   *InnerEmbeddedMsg `protobuf:"bytes,3"`
+}
+
+func TestUnmarshalStream(t *testing.T) {
+	m := StreamMsg{
+		Name:    "sensor",
+		Samples: []int64{1, 2, 3, 4, 1000},
+		Inner:   &InnerEmbeddedMsg{S: "inner"},
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sum the packed Samples while streaming
+	var sum int64
+	var tags []uint32
+	err = protobuf3.UnmarshalStream(pb, func(tag uint32, wire protobuf3.WireType, value []byte) error {
+		tags = append(tags, tag)
+		if tag == 2 {
+			if wire != protobuf3.WireBytes {
+				return fmt.Errorf("field 2 has wiretype %v", wire)
+			}
+			for len(value) != 0 {
+				x, n := protobuf3.DecodeVarint(value)
+				if n == 0 {
+					return errors.New("bad varint")
+				}
+				sum += int64(x)
+				value = value[n:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 1010 {
+		t.Errorf("sum = %d; expected 1010", sum)
+	}
+	if !reflect.DeepEqual(tags, []uint32{1, 2, 3}) {
+		t.Errorf("tags = %v; expected [1 2 3]", tags)
+	}
+
+	// an error from the handler stops the stream
+	stop := errors.New("stop")
+	n := 0
+	err = protobuf3.UnmarshalStream(pb, func(tag uint32, wire protobuf3.WireType, value []byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("UnmarshalStream = %v after %d calls; expected stop after 1 call", err, n)
+	}
+
+	// a truncated message is an error
+	err = protobuf3.UnmarshalStream(pb[:len(pb)-1], func(uint32, protobuf3.WireType, []byte) error { return nil })
+	if err == nil {
+		t.Error("UnmarshalStream(truncated) should have failed")
+	}
+}
+
+type MarshalerMapMsg struct {
+	M map[string]TestMarshaler  `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	P map[string]*TestMarshaler `protobuf:"bytes,2" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+}
+
+type EquivMarshalerMapMsg struct {
+	M map[string][]byte `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	P map[string][]byte `protobuf:"bytes,2" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+}
+
+func TestMarshalerMapValues(t *testing.T) {
+	m := MarshalerMapMsg{
+		M: map[string]TestMarshaler{"a": {1, 2, 3, 4}, "b": {5, 6, 7, 8}},
+		P: map[string]*TestMarshaler{"c": {9, 10, 11, 12}},
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values must be length prefixed like any other bytes
+	var e EquivMarshalerMapMsg
+	err = protobuf3.Unmarshal(pb, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("e", EquivMarshalerMapMsg{
+		M: map[string][]byte{"a": {1, 2, 3, 4}, "b": {5, 6, 7, 8}},
+		P: map[string][]byte{"c": {9, 10, 11, 12}},
+	}, e, t)
+
+	var m2 MarshalerMapMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+}
+
+type RetiredFieldsMsg struct {
+	protobuf3.Reserved `protobuf:"1"`
+	X                  uint32 `protobuf:"varint,3"`
+	Y                  uint32 `protobuf:"varint,12"`
+}
+
+type ReusedRetiredFieldMsg struct {
+	X uint32 `protobuf:"varint,3"`
+	Z uint32 `protobuf:"varint,10"`
+}
+
+func TestReserveTags(t *testing.T) {
+	err := protobuf3.ReserveTags(reflect.TypeOf(RetiredFieldsMsg{}),
+		[]protobuf3.TagRange{{From: 2, To: 2}, {From: 15, To: 15}, {From: 9, To: 11}},
+		[]string{"foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(RetiredFieldsMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `message RetiredFieldsMsg {
+  uint32 x = 3;
+  uint32 y = 12;
+  reserved 1, 2, 15, 9 to 11;
+  reserved "foo", "bar";
+}` {
+		t.Errorf("unexpected AsProtobuf result with reserved tags:\n%s\n", s)
+	}
+
+	// reusing a reserved tag is an error
+	err = protobuf3.ReserveTags(reflect.TypeOf(ReusedRetiredFieldMsg{}), []protobuf3.TagRange{{From: 9, To: 11}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = protobuf3.Marshal(&ReusedRetiredFieldMsg{})
+	if err == nil || !strings.Contains(err.Error(), "reserved range 9 to 11") {
+		t.Errorf("Marshal(ReusedRetiredFieldMsg) = %v; expected a reserved tag error", err)
+	}
+
+	if protobuf3.ReserveTags(reflect.TypeOf(RetiredFieldsMsg{}), []protobuf3.TagRange{{From: 5, To: 4}}, nil) == nil {
+		t.Error("ReserveTags(5 to 4) should have failed")
+	}
+}
+
+type RepeatedStringMsg struct {
+	S []string `protobuf:"bytes,1"`
+}
+
+type RepeatedBytesMsg struct {
+	B [][]byte `protobuf:"bytes,1"`
+}
+
+func TestRepeatedStringOrBytes(t *testing.T) {
+	for _, pb := range [][]byte{
+		mustMarshal(t, &RepeatedStringMsg{S: []string{"one", "", "three"}}),
+		mustMarshal(t, &RepeatedBytesMsg{B: [][]byte{[]byte("one"), nil, []byte("three")}}),
+	} {
+		var s RepeatedStringMsg
+		if err := protobuf3.Unmarshal(pb, &s); err != nil {
+			t.Fatal(err)
+		}
+		var b RepeatedBytesMsg
+		if err := protobuf3.Unmarshal(pb, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.S) != 3 || len(b.B) != 3 {
+			t.Fatalf("decoded %q and %q; expected 3 elements each", s.S, b.B)
+		}
+		for i := range s.S {
+			if s.S[i] != string(b.B[i]) {
+				t.Errorf("element %d: %q != %q", i, s.S[i], b.B[i])
+			}
+		}
+
+		// the []byte are copies, not references into pb
+		for i := range pb {
+			pb[i] = 'X'
+		}
+		if string(b.B[0]) != "one" || string(b.B[2]) != "three" {
+			t.Errorf("[][]byte refers to the input buffer: %q", b.B)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, pb protobuf3.Message) []byte {
+	b, err := protobuf3.Marshal(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnmarshalDelimitedTrailing(t *testing.T) {
+	m := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	pb, err := protobuf3.MarshalDelimited(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := mustMarshal(t, &m)
+	if int(pb[0]) != len(body) || !bytes.Equal(pb[1:], body) {
+		t.Fatalf("MarshalDelimited = % x; expected length prefixed % x", pb, body)
+	}
+
+	// a framed message followed by trailing bytes (which happen to be another valid field)
+	trailing := append(append([]byte(nil), pb...), 7<<3|byte(protobuf3.WireVarint), 9)
+
+	var m2 GetFieldMsg
+	n, err := protobuf3.UnmarshalDelimited(trailing, &m2)
+	if err != nil || n != len(pb) || m2.Tenant != 3 {
+		t.Errorf("UnmarshalDelimited = %d, %v, %+v; expected %d bytes and Tenant 3", n, err, m2, len(pb))
+	}
+
+	var m3 GetFieldMsg
+	opts := protobuf3.UnmarshalOptions{RejectTrailing: true}
+	_, err = opts.UnmarshalDelimited(trailing, &m3)
+	if err == nil || !strings.Contains(err.Error(), "2 trailing bytes") {
+		t.Errorf("UnmarshalDelimited(RejectTrailing) = %v; expected a trailing bytes error", err)
+	}
+	n, err = opts.UnmarshalDelimited(pb, &m3)
+	if err != nil || n != len(pb) {
+		t.Errorf("UnmarshalDelimited(RejectTrailing, exact) = %d, %v", n, err)
+	}
+
+	// a top level Unmarshal consumes everything, decoding the trailing bytes as more fields
+	var m4 GetFieldMsg
+	err = opts.Unmarshal(append(body, 7<<3|byte(protobuf3.WireVarint), 9), &m4)
+	if err != nil || m4.Tenant != 9 {
+		t.Errorf("Unmarshal(trailing) = %v, %+v; expected Tenant 9", err, m4)
+	}
+
+	// a truncated delimited message is an error
+	_, err = protobuf3.UnmarshalDelimited(pb[:len(pb)-1], &m4)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalDelimited(truncated) = %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMarshalReflect(t *testing.T) {
+	// build a message type at runtime
+	typ := reflect.StructOf([]reflect.StructField{
+		{Name: "Id", Type: reflect.TypeOf(uint64(0)), Tag: `protobuf:"varint,7"`},
+		{Name: "Tags", Type: reflect.TypeOf([]string(nil)), Tag: `protobuf:"bytes,9"`},
+	})
+	v := reflect.New(typ).Elem()
+	v.Field(0).SetUint(12345)
+	v.Field(1).Set(reflect.ValueOf([]string{"a", "bb"}))
+
+	expected := mustMarshal(t, &GetFieldMsg{Tenant: 12345, Tags: []string{"a", "bb"}})
+
+	for _, x := range []reflect.Value{v, v.Addr(), reflect.ValueOf(v.Interface())} { // addressable struct, pointer, and unaddressable struct
+		pb, err := protobuf3.MarshalReflect(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pb, expected) {
+			t.Errorf("MarshalReflect(%v) = % x; expected % x", x.Type(), pb, expected)
+		}
+	}
+
+	if _, err := protobuf3.MarshalReflect(reflect.ValueOf(7)); err == nil {
+		t.Error("MarshalReflect(int) should have failed")
+	}
+	if _, err := protobuf3.MarshalReflect(reflect.Value{}); err != protobuf3.ErrNil {
+		t.Errorf("MarshalReflect(invalid) = %v; expected ErrNil", err)
+	}
+}
+
+type ParallelElem struct {
+	ID    uint64            `protobuf:"varint,1"`
+	Name  string            `protobuf:"bytes,2"`
+	Inner *InnerEmbeddedMsg `protobuf:"bytes,3"`
+}
+
+type ParallelMsg struct {
+	Elems []ParallelElem     `protobuf:"bytes,1"`
+	Ptrs  []*ParallelElem    `protobuf:"bytes,2"`
+	Array [1500]ParallelElem `protobuf:"bytes,3"`
+}
+
+func makeParallelMsg(n int) *ParallelMsg {
+	m := &ParallelMsg{
+		Elems: make([]ParallelElem, n),
+		Ptrs:  make([]*ParallelElem, n),
+	}
+	for i := range m.Elems {
+		m.Elems[i] = ParallelElem{ID: uint64(i * i), Name: strconv.Itoa(i)}
+		if i%3 == 0 {
+			m.Elems[i].Inner = &InnerEmbeddedMsg{S: "inner"}
+		}
+		m.Ptrs[i] = &m.Elems[i]
+	}
+	for i := range m.Array {
+		m.Array[i].ID = uint64(i)
+	}
+	return m
+}
+
+func TestParallelMarshal(t *testing.T) {
+	for _, n := range []int{0, 10, 1024, 5003} {
+		m := makeParallelMsg(n)
+		serial := mustMarshal(t, m)
+		for _, workers := range []int{2, 3, 8, 10000} {
+			parallel, err := protobuf3.MarshalOptions{Parallelism: workers}.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(serial, parallel) {
+				t.Errorf("%d elements with %d workers: parallel encoding differs from serial", n, workers)
+			}
+		}
+	}
+
+	// errors in the workers are reported
+	m := makeParallelMsg(2000)
+	m.Ptrs[1500] = nil
+	_, err := protobuf3.MarshalOptions{Parallelism: 4}.Marshal(m)
+	if err == nil {
+		t.Error("Marshal of a nil repeated message should have failed")
+	}
+}
+
+type NativeZigzagMsg struct {
+	I  int   `protobuf:"zigzag64,1"`
+	P  *int  `protobuf:"zigzag64,2"`
+	S  []int `protobuf:"zigzag64,3"`
+	I2 int   `protobuf:"zigzag32,4"`
+}
+
+func TestNativeIntZigzag64(t *testing.T) {
+	if unsafe.Sizeof(int(0)) != 8 {
+		t.Skip("int is not 64 bits")
+	}
+	big := -1 << 40
+	m := NativeZigzagMsg{I: big, P: &big, S: []int{big, 1}, I2: -5}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b protobuf3.Buffer
+	b.EncodeVarint(1<<3 | uint64(protobuf3.WireVarint))
+	b.EncodeZigzag64(uint64(big))
+	b.EncodeVarint(2<<3 | uint64(protobuf3.WireVarint))
+	b.EncodeZigzag64(uint64(big))
+	var packed protobuf3.Buffer
+	packed.EncodeZigzag64(uint64(big))
+	packed.EncodeZigzag64(1)
+	b.EncodeBytes(3, packed.Bytes())
+	b.EncodeVarint(4<<3 | uint64(protobuf3.WireVarint))
+	minus5 := -5
+	b.EncodeZigzag32(uint64(minus5))
+	if !bytes.Equal(pb, b.Bytes()) {
+		t.Errorf("Marshal = % x; expected % x", pb, b.Bytes())
+	}
+
+	var m2 NativeZigzagMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.I != big || m2.P == nil || *m2.P != big || !reflect.DeepEqual(m2.S, m.S) || m2.I2 != -5 {
+		t.Errorf("m2 = %v %v %v %v; expected %v", m2.I, m2.P, m2.S, m2.I2, m)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `message NativeZigzagMsg {
+  sint64 i = 1;
+  sint64 p = 2;
+  repeated sint64 s = 3;
+  sint32 i2 = 4;
+}` {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+type MyInt32 int32
+type MyFloat64 float64
+
+type NamedScalarArrayMsg struct {
+	I [3]MyInt32   `protobuf:"varint,1"`
+	F [2]MyFloat64 `protobuf:"fixed64,2"`
+	Z [3]MyInt32   `protobuf:"zigzag32,3"`
+}
+
+type EquivNamedScalarArrayMsg struct {
+	I []int32   `protobuf:"varint,1"`
+	F []float64 `protobuf:"fixed64,2"`
+	Z []int32   `protobuf:"zigzag32,3"`
+}
+
+func TestNamedScalarArrays(t *testing.T) {
+	m := NamedScalarArrayMsg{
+		I: [3]MyInt32{-1, 0, 1 << 20},
+		F: [2]MyFloat64{3.5, -0.25},
+		Z: [3]MyInt32{-2, 2, 0},
+	}
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustMarshal(t, &EquivNamedScalarArrayMsg{
+		I: []int32{-1, 0, 1 << 20},
+		F: []float64{3.5, -0.25},
+		Z: []int32{-2, 2, 0},
+	})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var m2 NamedScalarArrayMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// the .proto types reflect the encoding, not the Go type names
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `message NamedScalarArrayMsg {
+  repeated int32 i = 1;
+  repeated double f = 2;
+  repeated sint32 z = 3;
+}` {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+type LegacyTimeoutMsg struct {
+	Timeout int32   `protobuf:"varint,1"` // used to be in seconds; now in milliseconds
+	Retries []int32 `protobuf:"varint,2"`
+	Name    string  `protobuf:"bytes,3"`
+}
+
+func TestDecodeTransform(t *testing.T) {
+	typ := reflect.TypeOf(LegacyTimeoutMsg{})
+	protobuf3.RegisterDecodeTransform(typ, "Timeout", func(v reflect.Value) {
+		v.SetInt(v.Int() * 2)
+	})
+	protobuf3.RegisterDecodeTransform(typ, "Retries", func(v reflect.Value) {
+		v.SetInt(v.Int() * 2)
+	})
+
+	m := LegacyTimeoutMsg{Timeout: 30, Retries: []int32{1, 2, 3}, Name: "x"}
+	pb := mustMarshal(t, &m)
+
+	var m2 LegacyTimeoutMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Timeout != 60 || !reflect.DeepEqual(m2.Retries, []int32{2, 4, 6}) || m2.Name != "x" {
+		t.Errorf("m2 = %+v; expected the transformed values", m2)
+	}
+
+	// encoding is unaffected
+	if !bytes.Equal(mustMarshal(t, &m), pb) {
+		t.Error("the transform changed the encoding")
+	}
+}
+
+type InnerMsgList struct {
+	L []*InnerEmbeddedMsg `protobuf:"bytes,4"`
+	N []uint32            `protobuf:"varint,5"`
+	F []float32           `protobuf:"fixed32,6"`
+}
+
+func TestMarshalList(t *testing.T) {
+	l := list.New()
+	for _, s := range []string{"a", "", "c"} {
+		l.PushBack(&InnerEmbeddedMsg{S: s})
+	}
+	pb, err := protobuf3.MarshalList(l, 4, reflect.TypeOf(&InnerEmbeddedMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it encodes the same as a slice
+	expected := mustMarshal(t, &InnerMsgList{L: []*InnerEmbeddedMsg{{S: "a"}, {S: ""}, {S: "c"}}})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("MarshalList = % x; expected % x", pb, expected)
+	}
+
+	var m InnerMsgList
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m", InnerMsgList{L: []*InnerEmbeddedMsg{{S: "a"}, {S: ""}, {S: "c"}}}, m, t)
+
+	// scalars, including zero values
+	l = list.New()
+	for _, x := range []uint32{7, 0, 300} {
+		l.PushBack(x)
+	}
+	pb, err = protobuf3.MarshalList(l, 5, reflect.TypeOf(uint32(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = InnerMsgList{}
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m.N", []uint32{7, 0, 300}, m.N, t)
+	// in a single packed run, the same as a slice
+	expected = mustMarshal(t, &InnerMsgList{N: []uint32{7, 0, 300}})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("MarshalList = % x; expected % x", pb, expected)
+	}
+	l = list.New()
+	for _, x := range []float32{1.5, -2} {
+		l.PushBack(x)
+	}
+	pb, err = protobuf3.MarshalList(l, 6, reflect.TypeOf(float32(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = InnerMsgList{}
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m.F", []float32{1.5, -2}, m.F, t)
+
+	// an empty list is nothing
+	pb, err = protobuf3.MarshalList(list.New(), 4, reflect.TypeOf(&InnerEmbeddedMsg{}))
+	if err != nil || len(pb) != 0 {
+		t.Errorf("MarshalList(empty) = % x, %v", pb, err)
+	}
+
+	// elements of the wrong type are an error
+	l.PushBack("x")
+	_, err = protobuf3.MarshalList(l, 5, reflect.TypeOf(uint32(0)))
+	if err == nil {
+		t.Error("MarshalList(mixed types) should have failed")
+	}
+}
+
+func TestWiretypeMismatch(t *testing.T) {
+	type StringAsVarint struct {
+		S string `protobuf:"varint,1"`
+	}
+	type IntAsBytes struct {
+		I int64 `protobuf:"bytes,1"`
+	}
+	type SliceOfBytesAsVarint struct {
+		B [][]byte `protobuf:"varint,1"`
+	}
+
+	for _, c := range []struct {
+		m        protobuf3.Message
+		expected string
+	}{
+		{&StringAsVarint{S: "x"}, `"S" string cannot have wiretype varint (try bytes)`},
+		{&IntAsBytes{I: 1}, `"I" int64 cannot have wiretype bytes (try varint)`},
+		{&SliceOfBytesAsVarint{B: [][]byte{{1}}}, `"B" [][]uint8 cannot have wiretype varint (try bytes)`},
+	} {
+		_, err := protobuf3.Marshal(c.m)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Marshal(%T) = %v; expected error containing %q", c.m, err, c.expected)
+		}
+	}
+
+	for typ, wire := range map[reflect.Type]string{
+		reflect.TypeOf(""):                    "bytes",
+		reflect.TypeOf(int32(0)):              "varint",
+		reflect.TypeOf([]float32(nil)):        "fixed32",
+		reflect.TypeOf((*float64)(nil)):       "fixed64",
+		reflect.TypeOf([4]byte{}):             "bytes",
+		reflect.TypeOf(time.Duration(0)):      "bytes",
+		reflect.TypeOf([]*InnerEmbeddedMsg{}): "bytes",
+	} {
+		if w := protobuf3.DefaultWireType(typ); w != wire {
+			t.Errorf("DefaultWireType(%s) = %q; expected %q", typ, w, wire)
+		}
+	}
+}
+
+// trickleWriter accepts at most n bytes per call to Write, without returning an error, as some bounded writers do
+type trickleWriter struct {
+	n     int
+	calls int
+	bytes.Buffer
+}
+
+func (w *trickleWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestMarshalTo(t *testing.T) {
+	m := GetFieldMsg{
+		Payload: bytes.Repeat([]byte{0x55}, 50),
+		Tenant:  42,
+		Tags:    []string{"alpha", "beta"},
+	}
+	expected := mustMarshal(t, &m)
+
+	w := &trickleWriter{n: 3}
+	n, err := protobuf3.MarshalTo(w, &m)
+	if err != nil || n != len(expected) || !bytes.Equal(w.Bytes(), expected) {
+		t.Errorf("MarshalTo = %d, %v, % x; expected % x", n, err, w.Bytes(), expected)
+	}
+	if w.calls < len(expected)/3 {
+		t.Errorf("trickleWriter was called %d times; expected at least %d", w.calls, len(expected)/3)
+	}
+
+	// a writer which makes no progress is an error, rather than an infinite loop
+	n, err = protobuf3.MarshalTo(&trickleWriter{n: 0}, &m)
+	if err != io.ErrShortWrite || n != 0 {
+		t.Errorf("MarshalTo(stuck writer) = %d, %v; expected io.ErrShortWrite", n, err)
+	}
+}
+
+type PresenceMsg struct {
+	Present uint16 `protobuf:"-"`
+	A       int32  `protobuf:"varint,1,presence=Present:0"`
+	B       string `protobuf:"bytes,2,presence=Present:1"`
+	C       int32  `protobuf:"zigzag32,3,presence=Present:9"`
+	D       bool   `protobuf:"varint,4"`
+}
+
+type BadPresenceMsg struct {
+	Present uint8   `protobuf:"-"`
+	S       []int32 `protobuf:"varint,1,presence=Present:0"`
+}
+
+func TestPresenceBitmap(t *testing.T) {
+	// A and B are zero but present, C is non-zero but absent
+	m := PresenceMsg{Present: 1<<0 | 1<<1, C: 5}
+	pb := mustMarshal(t, &m)
+	expected := []byte{1<<3 | byte(protobuf3.WireVarint), 0, 2<<3 | byte(protobuf3.WireBytes), 0}
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	// decoding sets the presence bits of the fields which were present
+	var m2 PresenceMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Present != 1<<0|1<<1 || m2.A != 0 || m2.B != "" || m2.C != 0 {
+		t.Errorf("m2 = %+v; expected only A and B present", m2)
+	}
+
+	m = PresenceMsg{Present: 1 << 9, A: 3, C: -1, D: true}
+	pb = mustMarshal(t, &m)
+	m2 = PresenceMsg{}
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", PresenceMsg{Present: 1 << 9, C: -1, D: true}, m2, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `message PresenceMsg {
+  optional int32 a = 1;
+  optional string b = 2;
+  optional sint32 c = 3;
+  bool d = 4;
+}` {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	_, err = protobuf3.Marshal(&BadPresenceMsg{})
+	if err == nil {
+		t.Error("presence bit on a repeated field should have failed")
+	}
+}
+
+type DurationMsg struct {
+	D time.Duration `protobuf:"bytes,1"`
+}
+
+type OldDurationMsg struct {
+	D *duration.Duration `protobuf:"bytes,1"`
+}
+
+func (*OldDurationMsg) ProtoMessage()    {}
+func (m *OldDurationMsg) String() string { return fmt.Sprintf("%+v", *m) }
+func (m *OldDurationMsg) Reset()         { *m = OldDurationMsg{} }
+
+func TestTimestampDurationRoundTrip(t *testing.T) {
+	durations := []time.Duration{
+		-time.Nanosecond,
+		-time.Second,
+		-(time.Second + time.Nanosecond),
+		-(90*time.Minute + 999999999*time.Nanosecond),
+		time.Duration(-1 << 63),
+		time.Duration(1<<63 - 1),
+		time.Second + 1,
+	}
+	times := []time.Time{
+		time.Unix(-1, 0).UTC(),
+		time.Unix(-1, 999999999).UTC(),
+		time.Date(1066, 10, 14, 9, 0, 0, 123, time.UTC),
+		time.Date(2038, 1, 19, 3, 14, 8, 0, time.UTC),
+	}
+
+	for _, d := range durations {
+		for _, tm := range times {
+			m := MsgWithTimestampAndDuration{T: tm, D: d}
+			pb := mustMarshal(t, &m)
+			var m2 MsgWithTimestampAndDuration
+			err := protobuf3.Unmarshal(pb, &m2)
+			if err != nil {
+				t.Fatalf("Unmarshal(%v, %v): %v", tm, d, err)
+			}
+			if !m2.T.Equal(m.T) || m2.D != m.D {
+				t.Errorf("round trip of %v, %v = %v, %v", m.T, m.D, m2.T, m2.D)
+			}
+		}
+
+		// and the encoding of the duration must agree with the golang protobuf Duration
+		o := OldDurationMsg{D: &duration.Duration{Seconds: int64(d / time.Second), Nanos: int32(d % time.Second)}}
+		check(&DurationMsg{D: d}, &o, t)
+	}
+
+	// a Duration of -1.000000005 seconds, with the int32 nanos truncated to a 5 byte varint, as some encoders do
+	pb := []byte{2<<3 | byte(protobuf3.WireBytes), 13,
+		1<<3 | byte(protobuf3.WireVarint), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		2<<3 | byte(protobuf3.WireVarint), 0xfb, 0xff, 0xff, 0xff, 0x0f,
+	}
+	pb[1] = byte(len(pb) - 2)
+	var m MsgWithTimestampAndDuration
+	err := protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.D != -(time.Second + 5*time.Nanosecond) {
+		t.Errorf("D = %v; expected -1.000000005s", m.D)
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	m := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	pb, err := protobuf3.MarshalVersioned(&m, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := mustMarshal(t, &m)
+	if pb[0] != 2 || !bytes.Equal(pb[1:], body) {
+		t.Fatalf("MarshalVersioned = % x; expected 02 % x", pb, body)
+	}
+
+	var m2 GetFieldMsg
+	v, err := protobuf3.UnmarshalVersioned(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Errorf("version = %d; expected 2", v)
+	}
+	eq("m2", m, m2, t)
+
+	// an empty message is just the version byte
+	pb, err = protobuf3.MarshalVersioned(&GetFieldMsg{}, 0xff)
+	if err != nil || !bytes.Equal(pb, []byte{0xff}) {
+		t.Errorf("MarshalVersioned(empty) = % x, %v", pb, err)
+	}
+	v, err = protobuf3.UnmarshalVersioned(pb, &m2)
+	if err != nil || v != 0xff {
+		t.Errorf("UnmarshalVersioned(empty) = %d, %v", v, err)
+	}
+
+	_, err = protobuf3.UnmarshalVersioned(nil, &m2)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalVersioned(nil) = %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+type FloatKeyMapMsg struct {
+	M map[float64]int32 `protobuf:"bytes,1" protobuf_key:"fixed64,1" protobuf_val:"varint,2"`
+}
+
+type BytesKeyMapMsg struct {
+	M map[[4]byte]int32 `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+func TestIllegalMapKey(t *testing.T) {
+	_, err := protobuf3.AsProtobuf(reflect.TypeOf(FloatKeyMapMsg{}))
+	if err == nil || !strings.Contains(err.Error(), "map key type float64 (double) is not a legal protobuf map key") {
+		t.Errorf("AsProtobuf(map[float64]int32) = %v; expected an illegal map key error", err)
+	}
+	_, err = protobuf3.Marshal(&FloatKeyMapMsg{M: map[float64]int32{1.5: 1}})
+	if err == nil {
+		t.Error("Marshal(map[float64]int32) should have failed")
+	}
+	_, err = protobuf3.AsProtobuf(reflect.TypeOf(BytesKeyMapMsg{}))
+	if err == nil || !strings.Contains(err.Error(), "not a legal protobuf map key") {
+		t.Errorf("AsProtobuf(map[[4]byte]int32) = %v; expected an illegal map key error", err)
+	}
+}
+
+type LazyMsg struct {
+	A int32          `protobuf:"varint,1"`
+	S func() string  `protobuf:"bytes,2"`
+	N func() int64   `protobuf:"zigzag64,3"`
+	M func() *InnerL `protobuf:"bytes,4"`
+}
+
+type InnerL struct {
+	X uint32 `protobuf:"varint,1"`
+}
+
+type EagerMsg struct {
+	A int32   `protobuf:"varint,1"`
+	S string  `protobuf:"bytes,2"`
+	N int64   `protobuf:"zigzag64,3"`
+	M *InnerL `protobuf:"bytes,4"`
+}
+
+func TestLazyFuncFields(t *testing.T) {
+	calls := 0
+	m := LazyMsg{
+		A: 1,
+		S: func() string { calls++; return "lazy" },
+		N: func() int64 { return -7 },
+		M: func() *InnerL { return &InnerL{X: 3} },
+	}
+	pb := mustMarshal(t, &m)
+	if calls != 1 {
+		t.Errorf("S was called %d times; expected once", calls)
+	}
+	expected := mustMarshal(t, &EagerMsg{A: 1, S: "lazy", N: -7, M: &InnerL{X: 3}})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	// nil functions are elided
+	pb = mustMarshal(t, &LazyMsg{A: 1})
+	expected = mustMarshal(t, &EagerMsg{A: 1})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal(nil funcs) = % x; expected % x", pb, expected)
+	}
+
+	// decoding ignores the computed fields
+	var m2 LazyMsg
+	err := protobuf3.Unmarshal(mustMarshal(t, &m), &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.A != 1 || m2.S != nil {
+		t.Errorf("m2 = %+v", m2)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "string s = 2;") || !strings.Contains(s, "sint64 n = 3;") || !strings.Contains(s, "InnerL m = 4;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+func TestMarshalJSONIndent(t *testing.T) {
+	m := NestedStructMsg{
+		first: InnerMsg{0x11},
+		many:  []InnerMsg{InnerMsg{0x33}, InnerMsg{}},
+		some:  [1]*InnerMsg{&InnerMsg{0x77}},
+	}
+
+	j, err := protobuf3.MarshalJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"first":{"i":17},"many":[{"i":51},{}],"some":[{"i":119}]}`
+	if string(j) != expected {
+		t.Errorf("MarshalJSON = %s; expected %s", j, expected)
+	}
+
+	j, err = protobuf3.MarshalOptions{Indent: "  "}.JSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{
+  "first": {
+    "i": 17
+  },
+  "many": [
+    {
+      "i": 51
+    },
+    {}
+  ],
+  "some": [
+    {
+      "i": 119
+    }
+  ]
+}`
+	if string(j) != expected {
+		t.Errorf("MarshalJSON(Indent) =\n%s\nexpected\n%s", j, expected)
+	}
+
+	// the indented JSON is still the same JSON
+	var x, y interface{}
+	if json.Unmarshal(j, &x) != nil || json.Unmarshal([]byte(`{"first":{"i":17},"many":[{"i":51},{}],"some":[{"i":119}]}`), &y) != nil || !reflect.DeepEqual(x, y) {
+		t.Error("indented JSON differs from compact JSON")
+	}
+
+	j, err = protobuf3.MarshalOptions{Indent: "\t"}.JSON(&MsgWithTimestampAndDuration{T: time.Unix(1, 5).UTC(), D: -1500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != "{\n\t\"t\": \"1970-01-01T00:00:01.000000005Z\",\n\t\"d\": \"-1.5s\"\n}" {
+		t.Errorf("MarshalJSON(time) = %s", j)
+	}
+
+	// strings which need escaping are escaped the JSON way, so they can be indented
+	j, err = protobuf3.MarshalOptions{Indent: " "}.JSON(&SyncMapMsg{M: map[string]int32{"\x01": 1, "k\x7f\xff": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]map[string]int32
+	err = json.Unmarshal(j, &keys)
+	if err != nil || !reflect.DeepEqual(keys, map[string]map[string]int32{"m": {"\x01": 1, "k\x7f\ufffd": 2}}) {
+		t.Errorf("MarshalJSON(control characters and invalid UTF-8) = %s, %v", j, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	d1, err := protobuf3.NewAny("type.googleapis.com/test.InnerMsg", &InnerMsg{i: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := protobuf3.NewAny("type.googleapis.com/test.GetFieldMsg", &GetFieldMsg{Tenant: 3, Tags: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := protobuf3.Status{Code: protobuf3.StatusNotFound, Message: "no such widget", Details: []protobuf3.Any{d1, d2}}
+
+	pb := mustMarshal(t, &s)
+	if !bytes.HasPrefix(pb, []byte{1<<3 | byte(protobuf3.WireVarint), 5, 2<<3 | byte(protobuf3.WireBytes), 14}) {
+		t.Errorf("Marshal(Status) = % x", pb)
+	}
+
+	var s2 protobuf3.Status
+	err = protobuf3.Unmarshal(pb, &s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("s2", s, s2, t)
+
+	var m1 InnerMsg
+	var m2 GetFieldMsg
+	if s2.Details[0].UnmarshalTo(&m1) != nil || m1.i != 5 || s2.Details[1].UnmarshalTo(&m2) != nil || m2.Tenant != 3 {
+		t.Errorf("details = %+v, %+v", m1, m2)
+	}
+
+	// Status nested in another message
+	type StatusMsg struct {
+		S *protobuf3.Status `protobuf:"bytes,1"`
+	}
+	str, err := protobuf3.AsProtobufFull(reflect.TypeOf(StatusMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(str, "google.rpc.Status s = 1;") || !strings.Contains(str, `import "google/rpc/status.proto";`) {
+		t.Errorf("unexpected AsProtobufFull result:\n%s", str)
+	}
+
+	for _, c := range []struct {
+		err  error
+		code int32
+	}{
+		{nil, protobuf3.StatusOK},
+		{context.DeadlineExceeded, protobuf3.StatusDeadlineExceeded},
+		{fmt.Errorf("opening config: %w", os.ErrNotExist), protobuf3.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", &s), protobuf3.StatusNotFound},
+		{errors.New("mystery"), protobuf3.StatusUnknown},
+	} {
+		st := protobuf3.StatusFromError(c.err)
+		if st.Code != c.code {
+			t.Errorf("StatusFromError(%v).Code = %d; expected %d", c.err, st.Code, c.code)
+		}
+	}
+}
+
+type FixedSlicesMsg struct {
+	I32 []int32    `protobuf:"fixed32,1"`
+	U32 []uint32   `protobuf:"fixed32,2"`
+	F32 []float32  `protobuf:"fixed32,3"`
+	I64 []int64    `protobuf:"fixed64,4"`
+	U64 []uint64   `protobuf:"fixed64,5"`
+	F64 []float64  `protobuf:"fixed64,6"`
+	A32 [3]int32   `protobuf:"fixed32,7"`
+	A64 [2]float64 `protobuf:"fixed64,8"`
+	V32 []uint32   `protobuf:"varint,9"` // not fixed, so not bulk copied
+}
+
+func TestFixedSlices(t *testing.T) {
+	m := FixedSlicesMsg{
+		I32: []int32{-1, 2, 1 << 30},
+		U32: []uint32{0xdeadbeef},
+		F32: []float32{1.5, -0.25},
+		I64: []int64{-2, 1 << 40},
+		U64: []uint64{0x0123456789abcdef},
+		F64: []float64{3.25},
+		A32: [3]int32{7, -8, 9},
+		A64: [2]float64{-1, 0.5},
+		V32: []uint32{300},
+	}
+	pb := mustMarshal(t, &m)
+
+	// build the expected encoding one element at a time
+	var expected []byte
+	fixed32s := func(tag byte, xs ...uint32) {
+		expected = append(expected, tag<<3|byte(protobuf3.WireBytes), byte(4*len(xs)))
+		for _, x := range xs {
+			expected = append(expected, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(expected[len(expected)-4:], x)
+		}
+	}
+	fixed64s := func(tag byte, xs ...uint64) {
+		expected = append(expected, tag<<3|byte(protobuf3.WireBytes), byte(8*len(xs)))
+		for _, x := range xs {
+			expected = append(expected, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(expected[len(expected)-8:], x)
+		}
+	}
+	i32 := func(x int32) uint32 { return uint32(x) }
+	i64 := func(x int64) uint64 { return uint64(x) }
+	fixed32s(1, i32(-1), 2, 1<<30)
+	fixed32s(2, 0xdeadbeef)
+	fixed32s(3, math.Float32bits(1.5), math.Float32bits(-0.25))
+	fixed64s(4, i64(-2), 1<<40)
+	fixed64s(5, 0x0123456789abcdef)
+	fixed64s(6, math.Float64bits(3.25))
+	fixed32s(7, 7, i32(-8), 9)
+	fixed64s(8, math.Float64bits(-1), math.Float64bits(0.5))
+	expected = append(expected, 9<<3|byte(protobuf3.WireBytes), 2, 0xac, 0x02)
+
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x\nexpected % x", pb, expected)
+	}
+
+	var m2 FixedSlicesMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// empty slices encode as nothing
+	pb = mustMarshal(t, &FixedSlicesMsg{I32: []int32{}, A32: [3]int32{}})
+	if len(pb) != 2+12+2+16 { // the arrays are always encoded
+		t.Errorf("Marshal(empty) = % x", pb)
+	}
+}
+
+type PtrScalarPresenceMsg struct {
+	I *int32   `protobuf:"varint,1"`
+	S *string  `protobuf:"bytes,2"`
+	B *bool    `protobuf:"varint,3"`
+	F *float64 `protobuf:"fixed64,4"`
+	U *uint64  `protobuf:"zigzag64,5"`
+}
+
+func TestPtrScalarPresence(t *testing.T) {
+	// a present zero int32 and string; the rest are absent
+	var zi int32
+	var zs string
+	m := PtrScalarPresenceMsg{I: &zi, S: &zs}
+	pb := mustMarshal(t, &m)
+	expected := []byte{1<<3 | byte(protobuf3.WireVarint), 0, 2<<3 | byte(protobuf3.WireBytes), 0}
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var m2 PtrScalarPresenceMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.I == nil || *m2.I != 0 {
+		t.Errorf("I = %v; expected a pointer to 0", m2.I)
+	}
+	if m2.S == nil || *m2.S != "" {
+		t.Errorf("S = %v; expected a pointer to \"\"", m2.S)
+	}
+	if m2.B != nil || m2.F != nil || m2.U != nil {
+		t.Errorf("absent fields were set: %+v", m2)
+	}
+
+	// a present zero of every type round trips, as does absence of every type
+	var zb bool
+	var zf float64
+	var zu uint64
+	m = PtrScalarPresenceMsg{I: &zi, S: &zs, B: &zb, F: &zf, U: &zu}
+	m2 = PtrScalarPresenceMsg{}
+	err = protobuf3.Unmarshal(mustMarshal(t, &m), &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	m2 = PtrScalarPresenceMsg{}
+	err = protobuf3.Unmarshal(mustMarshal(t, &PtrScalarPresenceMsg{}), &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", PtrScalarPresenceMsg{}, m2, t)
+}
+
+type PtrArrayMsg struct {
+	A *[4]int32    `protobuf:"varint,1"`
+	B *[2]string   `protobuf:"bytes,2"`
+	C *[2]InnerMsg `protobuf:"bytes,3"`
+	D *[3]byte     `protobuf:"bytes,4"`
+}
+
+type ArrayMsg struct {
+	A [4]int32    `protobuf:"varint,1"`
+	B [2]string   `protobuf:"bytes,2"`
+	C [2]InnerMsg `protobuf:"bytes,3"`
+	D [3]byte     `protobuf:"bytes,4"`
+}
+
+func TestPtrArray(t *testing.T) {
+	// nil pointers are elided
+	pb := mustMarshal(t, &PtrArrayMsg{})
+	if len(pb) != 0 {
+		t.Errorf("Marshal(nil arrays) = % x; expected nothing", pb)
+	}
+	var m PtrArrayMsg
+	err := protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.A != nil || m.B != nil || m.C != nil || m.D != nil {
+		t.Errorf("m = %+v; expected nil arrays", m)
+	}
+
+	// non-nil pointers encode like the arrays themselves
+	a := ArrayMsg{
+		A: [4]int32{1, -2, 0, 4},
+		B: [2]string{"x", "yz"},
+		C: [2]InnerMsg{{i: 5}, {i: 6}},
+		D: [3]byte{7, 8, 9},
+	}
+	m = PtrArrayMsg{A: &a.A, B: &a.B, C: &a.C, D: &a.D}
+	pb = mustMarshal(t, &m)
+	expected := mustMarshal(t, &a)
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var m2 PtrArrayMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.A == nil || *m2.A != a.A || m2.B == nil || *m2.B != a.B || m2.C == nil || *m2.C != a.C || m2.D == nil || *m2.D != a.D {
+		t.Errorf("m2 = %+v; expected %+v", m2, a)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "repeated int32 a = 1;") || !strings.Contains(s, "repeated InnerMsg c = 3;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+func TestPropertiesCacheSize(t *testing.T) {
+	// start with a cache holding only the types we're about to use
+	prev := protobuf3.SetPropertiesCacheSize(4)
+	defer protobuf3.SetPropertiesCacheSize(prev)
+
+	// make more types than fit in the cache
+	var types []reflect.Type
+	for i := 0; i < 10; i++ {
+		types = append(types, reflect.StructOf([]reflect.StructField{
+			{Name: "X", Type: reflect.TypeOf(int32(0)), Tag: reflect.StructTag(fmt.Sprintf(`protobuf:"varint,%d"`, i+1))},
+			{Name: "Inner", Type: reflect.TypeOf(&InnerMsg{}), Tag: `protobuf:"bytes,20"`},
+		}))
+	}
+
+	first, err := protobuf3.GetProperties(types[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range types[1:] {
+		_, err := protobuf3.GetProperties(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := protobuf3.PropertiesCacheLen(); n > 4 {
+			t.Fatalf("PropertiesCacheLen() = %d; expected at most 4", n)
+		}
+	}
+
+	// using a type moves it to the back of the line for eviction
+	used, _ := protobuf3.GetProperties(types[7])
+	protobuf3.GetProperties(types[1])
+	protobuf3.GetProperties(types[2])
+	if again, _ := protobuf3.GetProperties(types[7]); again != used {
+		t.Error("recently used types[7] was evicted")
+	}
+
+	// types[0] has been evicted, and is rebuilt when used again
+	again, err := protobuf3.GetProperties(types[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == first {
+		t.Error("types[0] was not evicted")
+	}
+	// and the most recently used type is still cached
+	last, _ := protobuf3.GetProperties(types[9])
+	last2, _ := protobuf3.GetProperties(types[9])
+	if last != last2 {
+		t.Error("types[9] was evicted")
+	}
+
+	// the rebuilt properties encode correctly
+	for i, typ := range types {
+		v := reflect.New(typ)
+		v.Elem().Field(0).SetInt(int64(i + 100))
+		v.Elem().Field(1).Set(reflect.ValueOf(&InnerMsg{i: 3}))
+		pb, err := protobuf3.MarshalReflect(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []byte{byte(i+1) << 3, byte(i + 100), 0xa2, 0x01, 2, 2<<3 | byte(protobuf3.WireVarint), 3} // 0xa2, 0x01 is tag 20, WireBytes
+		if !bytes.Equal(pb, expected) {
+			t.Errorf("Marshal(types[%d]) = % x; expected % x", i, pb, expected)
+		}
+	}
+
+	// time.Time is never evicted
+	protobuf3.SetPropertiesCacheSize(1)
+	pb := mustMarshal(t, &MsgWithTimestampAndDuration{T: time.Unix(3, 0)})
+	var m MsgWithTimestampAndDuration
+	if err := protobuf3.Unmarshal(pb, &m); err != nil || !m.T.Equal(time.Unix(3, 0)) {
+		t.Errorf("Unmarshal(time) = %v, %v", m.T, err)
+	}
+}
+
+type RemapV1 struct {
+	A int32   `protobuf:"varint,1"`
+	B string  `protobuf:"bytes,2"`
+	C []int64 `protobuf:"varint,3"`
+}
+
+type RemapV2 struct {
+	A int32   `protobuf:"varint,1"`
+	C []int64 `protobuf:"varint,13"` // was 3 in v1
+	B string  `protobuf:"bytes,12"`  // was 2 in v1
+	D bool    `protobuf:"varint,14"` // new in v2
+}
+
+func TestMarshalRemapped(t *testing.T) {
+	m := RemapV2{A: 1, B: "b", C: []int64{-1, 2}, D: true}
+	pb, err := protobuf3.MarshalRemapped(&m, map[uint32]uint32{12: 2, 13: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustMarshal(t, &RemapV1{A: 1, B: "b", C: []int64{-1, 2}})
+	expected = append(expected, 14<<3|byte(protobuf3.WireVarint), 1)
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("MarshalRemapped = % x; expected % x", pb, expected)
+	}
+
+	var m1 RemapV1
+	err = protobuf3.Unmarshal(pb, &m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m1", RemapV1{A: 1, B: "b", C: []int64{-1, 2}}, m1, t)
+
+	// the cached properties of RemapV2 are untouched
+	pb = mustMarshal(t, &m)
+	var m2 RemapV2
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	_, err = protobuf3.MarshalRemapped(&m, map[uint32]uint32{12: 1})
+	if err == nil || !strings.Contains(err.Error(), "the same tag 1") {
+		t.Errorf("MarshalRemapped(collision) = %v; expected an error", err)
+	}
+}
+
+func TestMarshalOptionsRenameTags(t *testing.T) {
+	m := RemapV2{A: 1, B: "b", C: []int64{-1, 2}, D: true}
+	rename := func(fieldName string) (uint32, bool) {
+		if fieldName == "B" {
+			return 2, true
+		}
+		return 0, false
+	}
+	pb, err := protobuf3.MarshalOptions{RenameTags: rename}.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := protobuf3.MarshalRemapped(&m, map[uint32]uint32{12: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("RenameTags = % x; expected % x", pb, expected)
+	}
+
+	// B decodes from its new tag, and C, which wasn't renamed, doesn't decode as v1
+	var m1 RemapV1
+	err = protobuf3.Unmarshal(pb, &m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m1", RemapV1{A: 1, B: "b"}, m1, t)
+
+	_, err = protobuf3.MarshalOptions{RenameTags: func(string) (uint32, bool) { return 1, true }}.Marshal(&m)
+	if err == nil || !strings.Contains(err.Error(), "the same tag 1") {
+		t.Errorf("RenameTags(collision) = %v; expected an error", err)
+	}
+
+	// renaming nothing is the same as not renaming
+	pb, err = protobuf3.MarshalOptions{RenameTags: func(string) (uint32, bool) { return 0, false }}.Marshal(&m)
+	if err != nil || !bytes.Equal(pb, mustMarshal(t, &m)) {
+		t.Errorf("RenameTags(nothing) = % x, %v", pb, err)
+	}
+	// and a message which marshals itself has no fields to rename
+	cm := CustomMarshalerSlice{{1, 2}, {3}}
+	pb, err = protobuf3.MarshalOptions{RenameTags: rename}.Marshal(&cm)
+	if err != nil || !bytes.Equal(pb, mustMarshal(t, &cm)) {
+		t.Errorf("RenameTags(Marshaler) = % x, %v", pb, err)
+	}
+}
+
+func TestMarshalDelta(t *testing.T) {
+	f32 := float32(-4.5)
+	base := FixedMsg{i32: -1, u64: 2, f64: 3.25, pf32: &f32, si64: []int64{5, -6}}
+	updated := base
+	updated.u64 = 7
+
+	pb, err := protobuf3.MarshalDelta(&base, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mustMarshal(t, &FixedMsg{u64: 7})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("MarshalDelta = % x; expected % x", pb, expected)
+	}
+
+	// apply the patch to a copy of base
+	var m FixedMsg
+	err = protobuf3.Unmarshal(mustMarshal(t, &base), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("patched", updated, m, t)
+
+	// no differences produce an empty patch
+	pb, err = protobuf3.MarshalDelta(&updated, &updated)
+	if err != nil || len(pb) != 0 {
+		t.Errorf("MarshalDelta(same) = % x, %v; expected nothing", pb, err)
+	}
+
+	// equal maps are unchanged, whatever order they iterate in
+	mb, mu := SyncMapMsg{M: map[string]int32{}}, SyncMapMsg{M: map[string]int32{}}
+	for i := 0; i < 20; i++ {
+		mb.M[strconv.Itoa(i)] = int32(i)
+		mu.M[strconv.Itoa(i)] = int32(i)
+	}
+	pb, err = protobuf3.MarshalDelta(&mb, &mu)
+	if err != nil || len(pb) != 0 {
+		t.Errorf("MarshalDelta(equal maps) = % x, %v; expected nothing", pb, err)
+	}
+
+	_, err = protobuf3.MarshalDelta(&base, &InnerMsg{})
+	if err == nil {
+		t.Error("MarshalDelta(different types) succeeded")
+	}
+}
+
+type SelfDescribingMsg struct {
+	A int32              `protobuf:"varint,1"`
+	I *InnerMsg          `protobuf:"bytes,2"`
+	R *SelfDescribingMsg `protobuf:"bytes,3"`
+}
+
+// same wire format as SelfDescribingMsg, with different names
+type SelfDescribingMsgRenamed struct {
+	X     int32                     `protobuf:"varint,1"`
+	Inner *InnerMsg                 `protobuf:"bytes,2"`
+	Next  *SelfDescribingMsgRenamed `protobuf:"bytes,3"`
+}
+
+// different wire format: A is a sint32
+type SelfDescribingMsgDrifted struct {
+	A int32                     `protobuf:"zigzag32,1"`
+	I *InnerMsg                 `protobuf:"bytes,2"`
+	R *SelfDescribingMsgDrifted `protobuf:"bytes,3"`
+}
+
+func TestSelfDescribing(t *testing.T) {
+	m := SelfDescribingMsg{A: -3, I: &InnerMsg{i: 4}, R: &SelfDescribingMsg{A: 5}}
+	pb, err := protobuf3.MarshalSelfDescribing(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := protobuf3.SchemaHash(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint64(pb) != hash || !bytes.Equal(pb[8:], mustMarshal(t, &m)) {
+		t.Errorf("MarshalSelfDescribing = % x", pb)
+	}
+
+	var m2 SelfDescribingMsg
+	err = protobuf3.UnmarshalSelfDescribing(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// names don't matter
+	var m3 SelfDescribingMsgRenamed
+	err = protobuf3.UnmarshalSelfDescribing(pb, &m3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m3.X != -3 || m3.Inner == nil || m3.Next == nil || m3.Next.X != 5 {
+		t.Errorf("m3 = %+v", m3)
+	}
+
+	// but the wire format does
+	var m4 SelfDescribingMsgDrifted
+	err = protobuf3.UnmarshalSelfDescribing(pb, &m4)
+	if err == nil || !strings.Contains(err.Error(), "schema hash") {
+		t.Errorf("UnmarshalSelfDescribing(drifted) = %v; expected a schema hash mismatch", err)
+	}
+	if m4.A != 0 || m4.I != nil {
+		t.Errorf("m4 was modified: %+v", m4)
+	}
+
+	err = protobuf3.UnmarshalSelfDescribing(pb[:7], &m2)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalSelfDescribing(short) = %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+type SchemaEnumA int32
+type SchemaEnumB int32
+
+type SchemaEnumMsgA struct {
+	E  SchemaEnumA            `protobuf:"varint,1"`
+	Es []SchemaEnumA          `protobuf:"varint,2"`
+	M  map[string]SchemaEnumA `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+// same wire format as SchemaEnumMsgA, with a differently named enum
+type SchemaEnumMsgB struct {
+	E  SchemaEnumB            `protobuf:"varint,1"`
+	Es []SchemaEnumB          `protobuf:"varint,2"`
+	M  map[string]SchemaEnumB `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+// same wire format again, with int32s
+type SchemaEnumMsgInt struct {
+	E  int32            `protobuf:"varint,1"`
+	Es []int32          `protobuf:"varint,2"`
+	M  map[string]int32 `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+func TestSchemaHashEnum(t *testing.T) {
+	if err := protobuf3.RegisterEnumNames(reflect.TypeOf(SchemaEnumA(0)), map[int32]string{0: "A_ZERO"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protobuf3.RegisterEnumNames(reflect.TypeOf(SchemaEnumB(0)), map[int32]string{0: "B_ZERO"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []uint64
+	for _, m := range []interface{}{SchemaEnumMsgA{}, SchemaEnumMsgB{}, SchemaEnumMsgInt{}} {
+		hash, err := protobuf3.SchemaHash(reflect.TypeOf(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if hashes[0] != hashes[1] || hashes[0] != hashes[2] {
+		t.Errorf("SchemaHash = %x; expected the names of the enums not to matter", hashes)
+	}
+}
+
+type RFC3339Msg struct {
+	T time.Time `protobuf:"bytes,1,rfc3339"`
+	N int32     `protobuf:"varint,2"`
+}
+
+func TestRFC3339(t *testing.T) {
+	for _, tm := range []time.Time{
+		time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC),
+		time.Date(1999, 12, 31, 23, 59, 59, 500000000, time.FixedZone("", -(5*3600+30*60))),
+	} {
+		m := RFC3339Msg{T: tm, N: 1}
+		pb := mustMarshal(t, &m)
+		s := tm.Format(time.RFC3339Nano)
+		expected := append([]byte{1<<3 | byte(protobuf3.WireBytes), byte(len(s))}, s...)
+		expected = append(expected, 2<<3|byte(protobuf3.WireVarint), 1)
+		if !bytes.Equal(pb, expected) {
+			t.Errorf("Marshal(%v) = %q; expected %q", tm, pb, expected)
+		}
+
+		var m2 RFC3339Msg
+		err := protobuf3.Unmarshal(pb, &m2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, offset := m2.T.Zone()
+		_, expected_offset := tm.Zone()
+		if !m2.T.Equal(tm) || offset != expected_offset {
+			t.Errorf("Unmarshal = %v; expected %v", m2.T, tm)
+		}
+	}
+
+	// the zero time is elided
+	pb := mustMarshal(t, &RFC3339Msg{})
+	if len(pb) != 0 {
+		t.Errorf("Marshal(zero) = % x", pb)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(RFC3339Msg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "string t = 1;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	// a malformed time is an error
+	var m RFC3339Msg
+	err = protobuf3.Unmarshal([]byte{1<<3 | byte(protobuf3.WireBytes), 3, 'x', 'y', 'z'}, &m)
+	if err == nil {
+		t.Error("Unmarshal(malformed) should have failed")
+	}
+}
+
+type FlatMapMsg struct {
+	H map[string]string `protobuf:"bytes,1,flatmap"`
+	N int32             `protobuf:"varint,2"`
+}
+
+func TestFlatMap(t *testing.T) {
+	m := FlatMapMsg{
+		H: map[string]string{"Content-Type": "text/plain", "X-Empty": "", "Accept": "*/*"},
+		N: 7,
+	}
+	pb := mustMarshal(t, &m)
+
+	// the encoding is a repeated string of alternating keys and values (in some order)
+	var strs []string
+	err := protobuf3.UnmarshalStream(pb, func(tag uint32, wire protobuf3.WireType, value []byte) error {
+		if tag == 1 {
+			strs = append(strs, string(value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 6 {
+		t.Fatalf("flatmap encoded %q; expected 3 keys and 3 values", strs)
+	}
+	for i := 0; i < len(strs); i += 2 {
+		if v, ok := m.H[strs[i]]; !ok || v != strs[i+1] {
+			t.Errorf("flatmap encoded key %q, value %q", strs[i], strs[i+1])
+		}
+	}
+
+	var m2 FlatMapMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "repeated string h = 1;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	// deterministic encoding sorts the keys
+	pb, err = protobuf3.MarshalOptions{Deterministic: true}.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs = strs[:0]
+	protobuf3.UnmarshalStream(pb, func(tag uint32, wire protobuf3.WireType, value []byte) error {
+		if tag == 1 {
+			strs = append(strs, string(value))
+		}
+		return nil
+	})
+	eq("deterministic flatmap", []string{"Accept", "*/*", "Content-Type", "text/plain", "X-Empty", ""}, strs, t)
+
+	// and the error for a map of the wrong type names the field
+	type BadFlatMap struct {
+		H map[string]int32 `protobuf:"bytes,1,flatmap"`
+	}
+	_, err = protobuf3.Marshal(&BadFlatMap{})
+	if err == nil || !strings.Contains(err.Error(), `flatmap field "H" must be a map[string]string, not map[string]int32`) {
+		t.Errorf("Marshal(BadFlatMap) = %v", err)
+	}
+}
+
+type WireMismatchMsg struct {
+	V   int32    `protobuf:"varint,1"`
+	S   string   `protobuf:"bytes,2"`
+	F32 uint32   `protobuf:"fixed32,3"`
+	F64 float64  `protobuf:"fixed64,4"`
+	M   InnerMsg `protobuf:"bytes,5"`
+	R   []int32  `protobuf:"varint,6"` // packed, so WireBytes
+	Z   int32    `protobuf:"varint,7"`
+}
+
+func TestDecodeWiretypeMismatch(t *testing.T) {
+	z := []byte{7<<3 | byte(protobuf3.WireVarint), 9} // a valid field after the mismatched one
+	for _, c := range []struct {
+		name string
+		pb   []byte
+	}{
+		{"bytes for varint", []byte{1<<3 | byte(protobuf3.WireBytes), 1, 0}},
+		{"fixed64 for varint", []byte{1<<3 | byte(protobuf3.WireFixed64), 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"varint for string", []byte{2<<3 | byte(protobuf3.WireVarint), 1}},
+		{"fixed64 for fixed32", []byte{3<<3 | byte(protobuf3.WireFixed64), 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"fixed32 for fixed64", []byte{4<<3 | byte(protobuf3.WireFixed32), 1, 2, 3, 4}},
+		{"varint for message", []byte{5<<3 | byte(protobuf3.WireVarint), 0x96, 0x01}},
+		{"unpacked varint for packed repeated", []byte{6<<3 | byte(protobuf3.WireVarint), 3}},
+	} {
+		pb := append(append([]byte(nil), c.pb...), z...)
+
+		var m WireMismatchMsg
+		err := protobuf3.Unmarshal(pb, &m)
+		if err == nil || !strings.Contains(err.Error(), "bad wiretype") {
+			t.Errorf("%s: Unmarshal = %v; expected a bad wiretype error", c.name, err)
+		}
+
+		m = WireMismatchMsg{}
+		err = protobuf3.UnmarshalOptions{Lenient: true}.Unmarshal(pb, &m)
+		if err != nil {
+			t.Errorf("%s: Unmarshal(Lenient) = %v", c.name, err)
+		}
+		eq(c.name, WireMismatchMsg{Z: 9}, m, t)
+	}
+
+	// Lenient applies inside nested messages too
+	type Outer struct {
+		W WireMismatchMsg `protobuf:"bytes,1"`
+	}
+	pb := []byte{1<<3 | byte(protobuf3.WireBytes), 4, 2<<3 | byte(protobuf3.WireVarint), 1, 7 << 3, 9}
+	var o Outer
+	if err := protobuf3.Unmarshal(pb, &o); err == nil {
+		t.Error("Unmarshal(nested mismatch) should have failed")
+	}
+	o = Outer{}
+	if err := (protobuf3.UnmarshalOptions{Lenient: true}).Unmarshal(pb, &o); err != nil || o.W.Z != 9 {
+		t.Errorf("Unmarshal(nested, Lenient) = %v, %+v", err, o)
+	}
+
+	// the skipped fields are treated as unknown fields, so they are passed to OnUnknown, and kept and re-encoded
+	type LenientUnknownMsg struct {
+		V       int32  `protobuf:"varint,1"`
+		Unknown []byte `protobuf:"unknown"`
+	}
+	pb = []byte{1<<3 | byte(protobuf3.WireBytes), 1, 0}
+	var u LenientUnknownMsg
+	var unknown []uint32
+	err := protobuf3.UnmarshalOptions{Lenient: true, OnUnknown: func(tag uint32, wire protobuf3.WireType, value []byte) {
+		if wire == protobuf3.WireBytes && bytes.Equal(value, []byte{0}) {
+			unknown = append(unknown, tag)
+		}
+	}}.Unmarshal(pb, &u)
+	if err != nil || !bytes.Equal(u.Unknown, pb) || !reflect.DeepEqual(unknown, []uint32{1}) {
+		t.Errorf("Unmarshal(Lenient, OnUnknown) = %v, %+v, %v", err, u, unknown)
+	}
+	if pb2 := mustMarshal(t, &u); !bytes.Equal(pb2, pb) {
+		t.Errorf("Marshal(lenient unknown) = % x; expected % x", pb2, pb)
+	}
+}
+
+type Record struct {
+	A int32
+	B float64
+}
+
+type RecordMsg struct {
+	R []Record `protobuf:"bytes,1,record"`
+	N int32    `protobuf:"varint,2"`
+}
+
+type BadRecordMsg struct {
+	R []struct {
+		S string
+	} `protobuf:"bytes,1,record"`
+}
+
+func TestRecord(t *testing.T) {
+	m := RecordMsg{N: 3}
+	for i := 0; i < 100; i++ {
+		m.R = append(m.R, Record{A: int32(i) - 50, B: float64(i) / 4})
+	}
+	pb := mustMarshal(t, &m)
+	// tag, 2 byte length, N*12 bytes, then the tag and value of N
+	if len(pb) != 1+2+100*12+2 {
+		t.Errorf("len(Marshal) = %d; expected %d", len(pb), 1+2+100*12+2)
+	}
+	// the first record is A=-50 then B=0, little-endian
+	if !bytes.Equal(pb[3:3+12], []byte{0xce, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("first record = % x", pb[3:3+12])
+	}
+
+	var m2 RecordMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// records append to the slice, like any repeated field
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.R) != 200 || m2.R[150] != m.R[50] {
+		t.Errorf("len(m2.R) = %d after decoding twice", len(m2.R))
+	}
+
+	// a partial record is an error
+	if err := protobuf3.Unmarshal([]byte{1<<3 | byte(protobuf3.WireBytes), 5, 1, 2, 3, 4, 5}, &m2); err == nil {
+		t.Error("Unmarshal(partial record) should have failed")
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "bytes r = 1;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	_, err = protobuf3.Marshal(&BadRecordMsg{})
+	if err == nil || !strings.Contains(err.Error(), "not a fixed-width scalar") {
+		t.Errorf("Marshal(BadRecordMsg) = %v; expected an error", err)
+	}
+
+	// a bool which isn't 0 or 1 on the wire decodes as true
+	type BoolRecord struct {
+		B bool
+	}
+	var bm struct {
+		R []BoolRecord `protobuf:"bytes,1,record"`
+	}
+	err = protobuf3.Unmarshal([]byte{1<<3 | byte(protobuf3.WireBytes), 2, 7, 0}, &bm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bm.R) != 2 || bm.R[0].B != true || bm.R[1].B != false || *(*byte)(unsafe.Pointer(&bm.R[0].B)) != 1 {
+		t.Errorf("Unmarshal(bool records) = %+v", bm.R)
+	}
+}
+
+type NativeVarintMsg struct {
+	I  int    `protobuf:"varint,1"`
+	U  uint   `protobuf:"varint,2"`
+	S  []int  `protobuf:"varint,3"`
+	P  *uint  `protobuf:"varint,4"`
+	F  int    `protobuf:"fixed32,5"` // only the low 32 bits are encoded, so it stays 32-bit
+	I3 int32  `protobuf:"varint,7"`
+	U3 uint32 `protobuf:"varint,8"`
+}
+
+func TestNativeIntVarintAsProtobuf(t *testing.T) {
+	if unsafe.Sizeof(int(0)) != 8 {
+		t.Skip("int is not 64 bits")
+	}
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(NativeVarintMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `message NativeVarintMsg {
+  int64 i = 1;
+  uint64 u = 2;
+  repeated int64 s = 3;
+  uint64 p = 4;
+  sfixed32 f = 5;
+  int32 i3 = 7;
+  uint32 u3 = 8;
+}` {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	// and the values which need 64 bits are encoded with 64 bits
+	m := NativeVarintMsg{I: 1 << 40, U: 1<<64 - 1}
+	var m2 NativeVarintMsg
+	err = protobuf3.Unmarshal(mustMarshal(t, &m), &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+}
+
+func TestPresentTags(t *testing.T) {
+	var i32 int32 = 7
+	m := FixedMsg{u32: 1, i64: -2, f64: 3.5, pi32: &i32}
+	pb := mustMarshal(t, &m)
+	// a repeated field appears once, and out of order fields are reported in the order they appear
+	pb = append(pb, 2<<3|byte(protobuf3.WireFixed32), 9, 0, 0, 0)
+	pb = append(pb, 0xa2, 0x06, 2, 'h', 'i') // tag 100, WireBytes
+
+	tags, err := protobuf3.PresentTags(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("tags", []uint32{2, 3, 9, 11, 100}, tags, t)
+
+	tags, err = protobuf3.PresentTags(nil)
+	if err != nil || len(tags) != 0 {
+		t.Errorf("PresentTags(nil) = %v, %v", tags, err)
+	}
+
+	_, err = protobuf3.PresentTags(pb[:len(pb)-1])
+	if err == nil {
+		t.Error("PresentTags(truncated) should have failed")
+	}
+}
+
+type MapOrderMsg struct {
+	Sorted   map[string]int32 `protobuf:"bytes,1,order=sorted" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+	Default  map[int64]bool   `protobuf:"bytes,2" protobuf_key:"zigzag64,1" protobuf_val:"varint,2"`
+	Unsorted map[uint32]int32 `protobuf:"bytes,3,order=unsorted" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+}
+
+func TestMapOrder(t *testing.T) {
+	m := MapOrderMsg{
+		Sorted:   map[string]int32{},
+		Default:  map[int64]bool{},
+		Unsorted: map[uint32]int32{},
+	}
+	for i := 0; i < 50; i++ {
+		m.Sorted[strconv.Itoa(i)] = int32(i)
+		m.Default[int64(25-i)] = i&1 != 0
+		m.Unsorted[uint32(i)] = int32(i)
+	}
+
+	// collect the keys of each map field in the order they were encoded
+	order := func(pb []byte) map[uint32][]string {
+		keys := make(map[uint32][]string)
+		err := protobuf3.UnmarshalStream(pb, func(tag uint32, wire protobuf3.WireType, value []byte) error {
+			_, k, _, err := protobuf3.GetField(value, 1)
+			keys[tag] = append(keys[tag], string(k))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	// the sorted field is always sorted
+	keys := order(mustMarshal(t, &m))
+	if !sort.StringsAreSorted(keys[1]) || len(keys[1]) != 50 {
+		t.Errorf("order=sorted keys are not sorted: %q", keys[1])
+	}
+
+	// Deterministic sorts the default field too, but not the unsorted one (which might happen to come out sorted,
+	// so there is nothing to check about it)
+	opts := protobuf3.MarshalOptions{Deterministic: true}
+	pb, err := opts.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = order(pb)
+	if !sort.StringsAreSorted(keys[1]) {
+		t.Errorf("order=sorted keys are not sorted: %q", keys[1])
+	}
+	prev := int64(-1 << 63)
+	for _, k := range keys[2] {
+		// the keys are zigzag64 varints
+		x, _ := protobuf3.DecodeVarint([]byte(k))
+		key := int64(x>>1) ^ -int64(x&1)
+		if key < prev {
+			t.Errorf("Deterministic keys are not sorted at %d", key)
+			break
+		}
+		prev = key
+	}
+	if len(keys[3]) != 50 {
+		t.Errorf("%d order=unsorted keys; expected 50", len(keys[3]))
+	}
+
+	var m2 MapOrderMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	_, err = protobuf3.Marshal(&struct {
+		M map[string]int32 `protobuf:"bytes,1,order=random" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+	}{})
+	if err == nil || !strings.Contains(err.Error(), "unknown map order") {
+		t.Errorf("Marshal(order=random) = %v; expected an error", err)
+	}
+}
+
+type BytesBufferMsg struct {
+	B *bytes.Buffer `protobuf:"bytes,1"`
+	S string        `protobuf:"bytes,2"`
+}
+
+type BytesBufferAsBytesMsg struct {
+	B []byte `protobuf:"bytes,1"`
+	S string `protobuf:"bytes,2"`
+}
+
+// failingReader returns some bytes and then an error
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	r.n--
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestBytesBuffer(t *testing.T) {
+	m := BytesBufferMsg{B: bytes.NewBufferString("hello"), S: "s"}
+	pb := mustMarshal(t, &m)
+	if m.B.String() != "hello" {
+		t.Errorf("Marshal drained the bytes.Buffer, leaving %q", m.B.String())
+	}
+
+	var b BytesBufferAsBytesMsg
+	err := protobuf3.Unmarshal(pb, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("b", BytesBufferAsBytesMsg{B: []byte("hello"), S: "s"}, b, t)
+
+	var m2 BytesBufferMsg
+	err = protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.B == nil || m2.B.String() != "hello" || m2.S != "s" {
+		t.Errorf("m2 = %q, %q", m2.B, m2.S)
+	}
+
+	// an empty bytes.Buffer is elided
+	pb = mustMarshal(t, &BytesBufferMsg{B: new(bytes.Buffer)})
+	if len(pb) != 0 {
+		t.Errorf("Marshal(empty bytes.Buffer) = % x; expected nothing", pb)
+	}
+
+	// EncodeReader encodes the same as EncodeBytes, even when the length needs more than one byte
+	long := strings.Repeat("0123456789", 20)
+	var w, expected protobuf3.WriteBuffer
+	n, err := w.EncodeReader(3, strings.NewReader(long))
+	if err != nil || n != int64(len(long)) {
+		t.Errorf("EncodeReader = %d, %v", n, err)
+	}
+	expected.EncodeBytes(3, []byte(long))
+	if !bytes.Equal(w.Bytes(), expected.Bytes()) {
+		t.Errorf("EncodeReader = % x; expected % x", w.Bytes(), expected.Bytes())
+	}
+
+	// a failed read leaves the buffer as it was
+	_, err = w.EncodeReader(4, &failingReader{n: 3})
+	if err != io.ErrClosedPipe || !bytes.Equal(w.Bytes(), expected.Bytes()) {
+		t.Errorf("EncodeReader(failing) = % x, %v", w.Bytes(), err)
+	}
+}
+
+func TestUnmarshalReuse(t *testing.T) {
+	pb := mustMarshal(t, &NestedPtrStructMsg{many: []*InnerMsg{&InnerMsg{1}, &InnerMsg{2}}})
+
+	a, b, c := &InnerMsg{7}, &InnerMsg{8}, &InnerMsg{9}
+	m := NestedPtrStructMsg{many: []*InnerMsg{a, b, c}[:0]}
+	err := protobuf3.UnmarshalOptions{Reuse: true}.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.many) != 2 || m.many[0] != a || m.many[1] != b {
+		t.Errorf("Unmarshal didn't reuse the messages")
+	}
+	if *a != (InnerMsg{1}) || *b != (InnerMsg{2}) || *c != (InnerMsg{9}) {
+		t.Errorf("Unmarshal decoded %v, %v, %v", *a, *b, *c)
+	}
+
+	// without Reuse new messages are allocated
+	m.many = m.many[:0]
+	err = protobuf3.Unmarshal(pb, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.many) != 2 || m.many[0] == a || m.many[1] == b || *a != (InnerMsg{1}) {
+		t.Errorf("Unmarshal reused the messages")
+	}
+}
+
+type TruncTimeMsg struct {
+	M time.Time `protobuf:"bytes,1,trunc=ms"`
+	S time.Time `protobuf:"bytes,2,trunc=s"`
+}
+
+type UntruncTimeMsg struct {
+	M time.Time `protobuf:"bytes,1"`
+	S time.Time `protobuf:"bytes,2"`
+}
+
+func TestTruncTime(t *testing.T) {
+	tm := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC)
+	pb := mustMarshal(t, &TruncTimeMsg{M: tm, S: tm})
+	expected := mustMarshal(t, &UntruncTimeMsg{M: tm.Truncate(time.Millisecond), S: tm.Truncate(time.Second)})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	// the sub-millisecond nanos are zero on the wire
+	var u UntruncTimeMsg
+	err := protobuf3.Unmarshal(pb, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.M.Nanosecond() != 123000000 || u.S.Nanosecond() != 0 {
+		t.Errorf("Unmarshal = %v, %v", u.M, u.S)
+	}
+
+	// decoding truncates too
+	var m TruncTimeMsg
+	err = protobuf3.Unmarshal(mustMarshal(t, &UntruncTimeMsg{M: tm, S: tm}), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.M.Equal(tm.Truncate(time.Millisecond)) || !m.S.Equal(tm.Truncate(time.Second)) {
+		t.Errorf("Unmarshal = %v, %v", m.M, m.S)
+	}
+
+	_, err = protobuf3.Marshal(&struct {
+		T time.Time `protobuf:"bytes,1,trunc=ns"`
+	}{})
+	if err == nil || !strings.Contains(err.Error(), "unknown truncation") {
+		t.Errorf("Marshal(trunc=ns) = %v; expected an error", err)
+	}
+	_, err = protobuf3.Marshal(&struct {
+		T time.Time `protobuf:"bytes,1,rfc3339,trunc=s"`
+	}{})
+	if err == nil {
+		t.Error("Marshal(rfc3339,trunc=s) succeeded")
+	}
+}
+
+type InterfaceMsg struct {
+	M protobuf3.Message `protobuf:"bytes,1"`
+	N int32             `protobuf:"varint,2"`
+}
+
+type InterfaceNoFactoryMsg struct {
+	M protobuf3.Message `protobuf:"bytes,1"`
+}
+
+func TestInterfaceField(t *testing.T) {
+	protobuf3.RegisterMessageFactory(reflect.TypeOf(InterfaceMsg{}), "M", func() protobuf3.Message { return new(InnerMsg) })
+
+	m := InterfaceMsg{M: &InnerMsg{i: 5}, N: 6}
+	pb := mustMarshal(t, &m)
+	expected := mustMarshal(t, &struct {
+		M *InnerMsg `protobuf:"bytes,1"`
+		N int32     `protobuf:"varint,2"`
+	}{&InnerMsg{i: 5}, 6})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var m2 InterfaceMsg
+	err := protobuf3.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// a nil interface and a nil pointer are both elided
+	pb = mustMarshal(t, &InterfaceMsg{N: 1})
+	if !bytes.Equal(pb, []byte{2<<3 | byte(protobuf3.WireVarint), 1}) {
+		t.Errorf("Marshal(nil) = % x", pb)
+	}
+	pb = mustMarshal(t, &InterfaceMsg{M: (*InnerMsg)(nil), N: 1})
+	if !bytes.Equal(pb, []byte{2<<3 | byte(protobuf3.WireVarint), 1}) {
+		t.Errorf("Marshal(nil pointer) = % x", pb)
+	}
+
+	// without a factory the message can only be decoded into a non-nil pointer
+	pb = mustMarshal(t, &InterfaceNoFactoryMsg{M: &InnerMsg{i: 7}})
+	var n InterfaceNoFactoryMsg
+	err = protobuf3.Unmarshal(pb, &n)
+	if err == nil || !strings.Contains(err.Error(), "RegisterMessageFactory") {
+		t.Errorf("Unmarshal(nil interface) = %v; expected an error", err)
+	}
+	n.M = new(InnerMsg)
+	err = protobuf3.Unmarshal(pb, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("n", InterfaceNoFactoryMsg{M: &InnerMsg{i: 7}}, n, t)
+}
+
+type VaryingSizeMsg struct {
+	Items []*InnerBytesMsg `protobuf:"bytes,1"`
+}
+
+type InnerBytesMsg struct {
+	B []byte `protobuf:"bytes,1"`
+}
+
+func TestLengthReservation(t *testing.T) {
+	// the lengths of the items vary so that the guessed size of each length is sometimes right, sometimes too short and sometimes too long
+	var m VaryingSizeMsg
+	var expected protobuf3.WriteBuffer
+	for _, n := range []int{10, 10, 200, 200, 20000, 5, 20000, 300, 0, 1, 127, 128, 126, 16384} {
+		item := &InnerBytesMsg{B: bytes.Repeat([]byte{'x'}, n)}
+		m.Items = append(m.Items, item)
+		expected.EncodeBytes(1, mustMarshal(t, item))
+	}
+	pb := mustMarshal(t, &m)
+	if !bytes.Equal(pb, expected.Bytes()) {
+		t.Error("Marshal doesn't match the concatenation of the items")
+	}
+
+	// sizing the items first produces the same encoding
+	pb, err := protobuf3.MarshalOptions{SizeCache: true}.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pb, expected.Bytes()) {
+		t.Error("Marshal with SizeCache doesn't match the concatenation of the items")
+	}
+}
+
+func TestSizeCache(t *testing.T) {
+	shared := &InnerMsg{i: 300}
+	many := make([]*InnerMsg, 2000) // enough elements to be encoded in parallel
+	for i := range many {
+		many[i] = &InnerMsg{i: int32(i * i)}
+	}
+	for _, m := range []protobuf3.Message{
+		&NestedPtrStructMsg{first: &InnerMsg{0x11}, many: []*InnerMsg{shared, {}, shared}, empty: []InnerMsg{{}, {-1}}},
+		&ChecksumMsg{Seq: 1, Payload: strings.Repeat("p", 200), Inner: &ChecksumMsg{Seq: 2, Inner: &ChecksumMsg{Payload: "x"}}},
+		&OneofTagMsg{ID: 4, Inner: &InnerMsg{i: 5}},
+		&SortedPairsMsg{Ps: []SortedPair{{A: 1, M: map[int32]int32{1: 2}}, {B: 5}}},
+		&VaryingSizeMsg{Items: []*InnerBytesMsg{{B: make([]byte, 127)}, {B: make([]byte, 128)}, {B: make([]byte, 20000)}, {}}},
+		&NestedPtrStructMsg{first: &InnerMsg{}, many: many},
+	} {
+		// (the maps are sorted so the encodings can be compared)
+		for _, opts := range []protobuf3.MarshalOptions{{Deterministic: true}, {Deterministic: true, NoElide: true}, {Deterministic: true, Parallelism: 4}} {
+			expected, err := opts.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.SizeCache = true
+			pb, err := opts.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pb, expected) {
+				t.Errorf("Marshal(%T, %+v) = % x; expected % x", m, opts, pb, expected)
+			}
+		}
+	}
+
+	// a message which changes between Marshals with the same Buffer is sized again
+	m := VaryingSizeMsg{Items: []*InnerBytesMsg{{B: make([]byte, 10)}}}
+	var buf protobuf3.Buffer
+	buf.SetSizeCache(true)
+	if err := buf.Marshal(&m); err != nil {
+		t.Fatal(err)
+	}
+	m.Items[0].B = make([]byte, 1000)
+	buf.Reset()
+	if err := buf.Marshal(&m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), mustMarshal(t, &m)) {
+		t.Error("Buffer.Marshal with SizeCache used a stale size")
+	}
+}
+
+// DescPerson is declared with the fields generated by StructTagsFromDescriptor(descPerson)
+type DescPerson struct {
+	Name       string           `protobuf:"bytes,1"`
+	Id         int32            `protobuf:"varint,2"`
+	Emails     []string         `protobuf:"bytes,3"`
+	Scores     map[string]int64 `protobuf:"bytes,4" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+	Home       *DescAddress     `protobuf:"bytes,5"`
+	Others     []*DescAddress   `protobuf:"bytes,6"`
+	Age        *int32           `protobuf:"zigzag32,7,optional"`
+	Kind       DescKind         `protobuf:"varint,8"`
+	Photo      []byte           `protobuf:"bytes,9"`
+	LatLng     []float64        `protobuf:"fixed64,10"`
+	PostalCode string           `protobuf:"bytes,11,name=postalCode"`
+}
+
+type DescAddress struct {
+	Street string `protobuf:"bytes,1"`
+}
+
+type DescKind int32
+
+var descPerson = protobuf3.DescriptorProto{
+	Name: "DescPerson",
+	Field: []*protobuf3.FieldDescriptorProto{
+		{Name: "name", Number: 1, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeString},
+		{Name: "id", Number: 2, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeInt32},
+		{Name: "emails", Number: 3, Label: protobuf3.FieldLabelRepeated, Type: protobuf3.FieldTypeString},
+		{Name: "scores", Number: 4, Label: protobuf3.FieldLabelRepeated, Type: protobuf3.FieldTypeMessage, TypeName: ".test.DescPerson.ScoresEntry"},
+		{Name: "home", Number: 5, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeMessage, TypeName: ".test.DescAddress"},
+		{Name: "others", Number: 6, Label: protobuf3.FieldLabelRepeated, Type: protobuf3.FieldTypeMessage, TypeName: ".test.DescAddress"},
+		{Name: "age", Number: 7, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeSint32, Proto3Optional: true},
+		{Name: "kind", Number: 8, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeEnum, TypeName: ".test.DescKind"},
+		{Name: "photo", Number: 9, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeBytes},
+		{Name: "lat_lng", Number: 10, Label: protobuf3.FieldLabelRepeated, Type: protobuf3.FieldTypeDouble},
+		{Name: "postalCode", Number: 11, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeString},
+	},
+	NestedType: []*protobuf3.DescriptorProto{
+		{
+			Name: "ScoresEntry",
+			Field: []*protobuf3.FieldDescriptorProto{
+				{Name: "key", Number: 1, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeString},
+				{Name: "value", Number: 2, Label: protobuf3.FieldLabelOptional, Type: protobuf3.FieldTypeInt64},
+			},
+			Options: &protobuf3.MessageOptions{MapEntry: true},
+		},
+	},
+}
+
+func TestStructTagsFromDescriptor(t *testing.T) {
+	s := protobuf3.StructTagsFromDescriptor(&descPerson)
+	expected := "" +
+		"\tName       string           `protobuf:\"bytes,1\"`\n" +
+		"\tId         int32            `protobuf:\"varint,2\"`\n" +
+		"\tEmails     []string         `protobuf:\"bytes,3\"`\n" +
+		"\tScores     map[string]int64 `protobuf:\"bytes,4\" protobuf_key:\"bytes,1\" protobuf_val:\"varint,2\"`\n" +
+		"\tHome       *DescAddress     `protobuf:\"bytes,5\"`\n" +
+		"\tOthers     []*DescAddress   `protobuf:\"bytes,6\"`\n" +
+		"\tAge        *int32           `protobuf:\"zigzag32,7,optional\"`\n" +
+		"\tKind       DescKind         `protobuf:\"varint,8\"`\n" +
+		"\tPhoto      []byte           `protobuf:\"bytes,9\"`\n" +
+		"\tLatLng     []float64        `protobuf:\"fixed64,10\"`\n" +
+		"\tPostalCode string           `protobuf:\"bytes,11,name=postalCode\"`\n"
+	if s != expected {
+		t.Errorf("StructTagsFromDescriptor =\n%s\nexpected\n%s", s, expected)
+	}
+
+	// the struct declared with those fields describes the same message
+	_, err := protobuf3.GetProperties(reflect.TypeOf(DescPerson{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := protobuf3.AsProtobuf(reflect.TypeOf(DescPerson{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{
+		"string name = 1;",
+		"int32 id = 2;",
+		"repeated string emails = 3;",
+		"map<string, int64> scores = 4;",
+		"DescAddress home = 5;",
+		"repeated DescAddress others = 6;",
+		"optional sint32 age = 7;",
+		"int32 kind = 8;", // DescKind isn't registered as an enum
+		"bytes photo = 9;",
+		"repeated double lat_lng = 10;",
+		"string postalCode = 11;",
+	} {
+		if !strings.Contains(p, "  "+f+"\n") {
+			t.Errorf("AsProtobuf doesn't contain %q:\n%s", f, p)
+		}
+	}
+
+	// and the descriptor types can be decoded from their encoding
+	var d protobuf3.DescriptorProto
+	err = protobuf3.Unmarshal(mustMarshal(t, &descPerson), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("descriptor", descPerson, d, t)
+}
+
+type EncryptedMsg struct {
+	Public string    `protobuf:"bytes,1"`
+	Secret string    `protobuf:"bytes,2,encrypt"`
+	Codes  []string  `protobuf:"bytes,3,encrypt"`
+	Inner  *InnerMsg `protobuf:"bytes,4,encrypt"`
+}
+
+// xorCipher is a toy Cipher for testing
+type xorCipher byte
+
+func (c xorCipher) Encrypt(b []byte) []byte {
+	for i := range b {
+		b[i] ^= byte(c) // encrypt in place, which the encoder must tolerate
+	}
+	return append([]byte("xor:"), b...)
+}
+
+func (c xorCipher) Decrypt(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte("xor:")) {
+		return nil, errors.New("not encrypted with xorCipher")
+	}
+	p := make([]byte, len(b)-4)
+	for i := range p {
+		p[i] = b[4+i] ^ byte(c)
+	}
+	return p, nil
+}
+
+func TestEncryptedFields(t *testing.T) {
+	m := EncryptedMsg{Public: "hello", Secret: "swordfish", Codes: []string{"1234", "5678"}, Inner: &InnerMsg{i: 9}}
+	pb, err := protobuf3.MarshalOptions{Cipher: xorCipher(0x5a)}.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pb, []byte("hello")) || bytes.Contains(pb, []byte("swordfish")) || bytes.Contains(pb, []byte("1234")) {
+		t.Errorf("Marshal = %q", pb)
+	}
+
+	var m2 EncryptedMsg
+	err = protobuf3.UnmarshalOptions{Cipher: xorCipher(0x5a)}.Unmarshal(pb, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("m2", m, m2, t)
+
+	// the encrypted fields are declared as bytes
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "bytes secret = 2;") || !strings.Contains(s, "bytes codes = 3;") {
+		t.Errorf("AsProtobuf =\n%s", s)
+	}
+
+	// the wrong key fails to decode
+	var m3 EncryptedMsg
+	err = protobuf3.UnmarshalOptions{Cipher: xorCipher(0x33)}.Unmarshal(pb, &m3)
+	if err == nil {
+		t.Error("Unmarshal with the wrong key succeeded")
+	}
+
+	// a Cipher is needed, unless the encrypted fields are all zero
+	_, err = protobuf3.Marshal(&m)
+	if err == nil || !strings.Contains(err.Error(), "Cipher") {
+		t.Errorf("Marshal without a Cipher = %v; expected an error", err)
+	}
+	err = protobuf3.Unmarshal(pb, &m3)
+	if err == nil || !strings.Contains(err.Error(), "Cipher") {
+		t.Errorf("Unmarshal without a Cipher = %v; expected an error", err)
+	}
+	pb = mustMarshal(t, &EncryptedMsg{Public: "hello"})
+	if !bytes.Equal(pb, append([]byte{1<<3 | byte(protobuf3.WireBytes), 5}, "hello"...)) {
+		t.Errorf("Marshal(no secrets) = % x", pb)
+	}
+
+	// a ciphertext moved to another field of the same wiretype is rejected
+	pb, err = protobuf3.MarshalOptions{Cipher: xorCipher(0x5a)}.Marshal(&EncryptedMsg{Secret: "swordfish"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb[0] = 3<<3 | byte(protobuf3.WireBytes)
+	err = protobuf3.UnmarshalOptions{Cipher: xorCipher(0x5a)}.Unmarshal(pb, &m3)
+	if err == nil || !strings.Contains(err.Error(), "has tag 2; expected 3") {
+		t.Errorf("Unmarshal(moved ciphertext) = %v; expected an error", err)
+	}
+
+	// errors within the plaintext are reported at the offset of the ciphertext
+	plaintext := []byte{4<<3 | byte(protobuf3.WireBytes), 2, 1<<3 | byte(protobuf3.WireVarint), 0x80} // a truncated varint in Inner
+	pb = append([]byte{1<<3 | byte(protobuf3.WireBytes), 1, 'x', 4<<3 | byte(protobuf3.WireBytes), byte(4 + len(plaintext))}, xorCipher(0x5a).Encrypt(plaintext)...)
+	err = protobuf3.UnmarshalOptions{Cipher: xorCipher(0x5a)}.Unmarshal(pb, &m3)
+	var de *protobuf3.DecodeError
+	if !errors.As(err, &de) || de.Offset != 5 {
+		t.Errorf("Unmarshal(bad plaintext) = %v; expected a DecodeError at offset 5", err)
+	}
+}
+
+type NanosMsg struct {
+	D  time.Duration   `protobuf:"bytes,1,nanos"`
+	V  time.Duration   `protobuf:"varint,2,nanos"`
+	S  []time.Duration `protobuf:"bytes,3,nanos"`
+	P  *time.Duration  `protobuf:"bytes,4,nanos"`
+	DM time.Duration   `protobuf:"bytes,5"`
+}
+
+type NanosIntMsg struct {
+	D  int64            `protobuf:"zigzag64,1"`
+	V  int64            `protobuf:"varint,2"`
+	S  []int64          `protobuf:"zigzag64,3"`
+	P  *int64           `protobuf:"zigzag64,4"`
+	DM DurationMsgValue `protobuf:"bytes,5"`
+}
+
+type DurationMsgValue struct {
+	Seconds int64 `protobuf:"varint,1"`
+	Nanos   int32 `protobuf:"varint,2"`
+}
+
+func TestNanosDuration(t *testing.T) {
+	p := -1500 * time.Millisecond
+	m := NanosMsg{
+		D:  -time.Nanosecond,
+		V:  90 * time.Minute,
+		S:  []time.Duration{0, time.Second, -time.Second, time.Duration(-1 << 63)},
+		P:  &p,
+		DM: -1500 * time.Millisecond,
+	}
+	pi := int64(p)
+	mi := NanosIntMsg{
+		D:  -1,
+		V:  int64(90 * time.Minute),
+		S:  []int64{0, int64(time.Second), -int64(time.Second), -1 << 63},
+		P:  &pi,
+		DM: DurationMsgValue{Seconds: -1, Nanos: -500000000},
+	}
+
+	pb, err := protobuf3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbi, err := protobuf3.Marshal(&mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pb, pbi) {
+		t.Errorf("nanos durations encoded as %x, expected %x", pb, pbi)
+	}
+
+	var u NanosMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("decoded %+v, expected %+v", u, m)
+	}
+
+	// nanos must be used on a time.Duration
+	type BadNanos struct {
+		N int64 `protobuf:"varint,1,nanos"`
+	}
+	if _, err := protobuf3.Marshal(&BadNanos{}); err == nil {
+		t.Error("expected an error from a nanos field which isn't a time.Duration")
+	}
+}
+
+type JSONMapKeyEnum int32
+
+func (e JSONMapKeyEnum) String() string { return "enum" }
+
+type JSONMapKeysMsg struct {
+	I map[int64]string          `protobuf:"bytes,1" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
+	B map[bool]int32            `protobuf:"bytes,2" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+	U map[uint32]bool           `protobuf:"bytes,3" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+	E map[JSONMapKeyEnum]string `protobuf:"bytes,4" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
+}
+
+func TestMarshalJSONMapKeys(t *testing.T) {
+	m := JSONMapKeysMsg{
+		I: map[int64]string{10: "ten", -3: "minus three", 2: "two", -1 << 63: "min"},
+		B: map[bool]int32{true: 1, false: 0},
+		U: map[uint32]bool{1<<32 - 1: true, 9: false},
+		E: map[JSONMapKeyEnum]string{1: "one", 0: "zero"},
+	}
+
+	j, err := protobuf3.MarshalJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same as jsonpb: keys are quoted decimals or "true"/"false", ordered by their values
+	expected := `{"i":{"-9223372036854775808":"min","-3":"minus three","2":"two","10":"ten"},"b":{"false":0,"true":1},"u":{"9":false,"4294967295":true},"e":{"0":"zero","1":"one"}}`
+	if string(j) != expected {
+		t.Errorf("MarshalJSON = %s; expected %s", j, expected)
+	}
+}
+
+func TestUnmarshalLengthDelimited(t *testing.T) {
+	m1 := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	m2 := GetFieldMsg{Tenant: 300, Tags: []string{"u", "v"}}
+
+	// a frame of a header byte, two length delimited messages, and a trailer byte
+	frame := []byte{0xfe}
+	for _, m := range []*GetFieldMsg{&m1, &m2} {
+		var mb protobuf3.Buffer
+		mb.EncodeRawBytes(mustMarshal(t, m))
+		frame = append(frame, mb.Bytes()...)
+	}
+	frame = append(frame, 0xff)
+
+	pos := 1
+	var d1, d2 GetFieldMsg
+	n, err := protobuf3.UnmarshalLengthDelimited(frame[pos:], &d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos += n
+	n, err = protobuf3.UnmarshalLengthDelimited(frame[pos:], &d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos += n
+	if pos != len(frame)-1 || frame[pos] != 0xff {
+		t.Errorf("consumed up to %d of % x; expected the trailer at %d", pos, frame, len(frame)-1)
+	}
+	if !reflect.DeepEqual(d1, m1) || !reflect.DeepEqual(d2, m2) {
+		t.Errorf("decoded %+v and %+v; expected %+v and %+v", d1, d2, m1, m2)
+	}
+
+	// a length prefix longer than the rest of the frame is an error
+	if _, err := protobuf3.UnmarshalLengthDelimited(frame[1:5], &d1); err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalLengthDelimited(truncated) = %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+type TypeURLMsg struct {
+	Type string `protobuf:"bytes,1,typeurl"`
+	N    int32  `protobuf:"varint,2"`
+}
+
+type UnregisteredTypeURLMsg struct {
+	Type string `protobuf:"bytes,1,typeurl"`
+}
+
+func init() {
+	if err := protobuf3.RegisterProtoName(reflect.TypeOf(TypeURLMsg{}), "test.SelfDescribing"); err != nil {
+		panic(err)
+	}
+}
+
+func TestTypeURLField(t *testing.T) {
+	const url = "type.googleapis.com/test.SelfDescribing"
+	if u := protobuf3.TypeURL(reflect.TypeOf(TypeURLMsg{})); u != url {
+		t.Errorf("TypeURL = %q; expected %q", u, url)
+	}
+
+	// the field is filled in with the type URL, whether it is empty or holds something else
+	for _, m := range []TypeURLMsg{{N: 7}, {Type: "something else", N: 7}} {
+		pb := mustMarshal(t, &m)
+		expected := append(append([]byte{1<<3 | byte(protobuf3.WireBytes), byte(len(url))}, url...), 2<<3|byte(protobuf3.WireVarint), 7)
+		if !bytes.Equal(pb, expected) {
+			t.Errorf("Marshal(%+v) = % x; expected % x", m, pb, expected)
+		}
+
+		// decoding leaves whatever was on the wire in the field
+		var u TypeURLMsg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Type != url || u.N != 7 {
+			t.Errorf("Unmarshal = %+v", u)
+		}
+	}
+
+	// the struct's protobuf name must be registered
+	_, err := protobuf3.Marshal(&UnregisteredTypeURLMsg{})
+	if err == nil || !strings.Contains(err.Error(), "RegisterProtoName") {
+		t.Errorf("Marshal(unregistered) = %v; expected an error", err)
+	}
+}
+
+type UserID int64
+
+type GroupName string
+
+type NamedMapKeysMsg struct {
+	Names  map[UserID]string    `protobuf:"bytes,1" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
+	Scores map[UserID]int32     `protobuf:"bytes,2" protobuf_key:"zigzag64,1" protobuf_val:"varint,2"`
+	Groups map[GroupName]UserID `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+// the equivalent map with unnamed types
+type UnnamedMapKeysMsg struct {
+	Names  map[int64]string `protobuf:"bytes,1" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
+	Scores map[int64]int32  `protobuf:"bytes,2" protobuf_key:"zigzag64,1" protobuf_val:"varint,2"`
+	Groups map[string]int64 `protobuf:"bytes,3" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+func TestNamedMapKeys(t *testing.T) {
+	m := NamedMapKeysMsg{
+		Names:  map[UserID]string{1: "alice", 1 << 40: "bob", -1: "nobody"},
+		Scores: map[UserID]int32{1: 10, -7: -70},
+		Groups: map[GroupName]UserID{"admins": 1, "users": 1 << 40},
+	}
+	opts := protobuf3.MarshalOptions{Deterministic: true}
+	pb, err := opts.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the named key types are encoded just like the types they are defined as
+	um := UnnamedMapKeysMsg{
+		Names:  map[int64]string{1: "alice", 1 << 40: "bob", -1: "nobody"},
+		Scores: map[int64]int32{1: 10, -7: -70},
+		Groups: map[string]int64{"admins": 1, "users": 1 << 40},
+	}
+	upb, err := opts.Marshal(&um)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pb, upb) {
+		t.Errorf("Marshal = % x; expected % x", pb, upb)
+	}
+
+	var u NamedMapKeysMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %+v; expected %+v", u, m)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "map<int64, string> names = 1;") || !strings.Contains(s, "map<sint64, int32> scores = 2;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+type NoElideMsg struct {
+	S  string          `protobuf:"bytes,1"`
+	B  []byte          `protobuf:"bytes,2"`
+	P  *InnerMsg       `protobuf:"bytes,3"`
+	D  float64         `protobuf:"fixed64,4"`
+	SS []string        `protobuf:"bytes,5"`
+	M  map[int32]int32 `protobuf:"bytes,6" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+}
+
+func TestMarshalNoElide(t *testing.T) {
+	opts := protobuf3.MarshalOptions{NoElide: true}
+
+	// every field of an all-zero VarMsg appears, scalars as 0 and packed slices as empty lists
+	pb, err := opts.Marshal(&VarMsg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b protobuf3.Buffer
+	for _, tag := range []uint64{1, 2, 3, 4, 5, 11, 12, 13, 14, 15} {
+		b.EncodeVarint(tag<<3 | uint64(protobuf3.WireVarint))
+		b.EncodeVarint(0)
+	}
+	for _, tag := range []uint64{21, 22, 23, 24, 25} {
+		b.EncodeVarint(tag<<3 | uint64(protobuf3.WireBytes))
+		b.EncodeVarint(0)
+	}
+	expected := b.Bytes()
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal(NoElide, VarMsg{}) = % x; expected % x", pb, expected)
+	}
+
+	// without NoElide nothing is encoded
+	if pb := mustMarshal(t, &VarMsg{}); len(pb) != 0 {
+		t.Errorf("Marshal(VarMsg{}) = % x; expected nothing", pb)
+	}
+
+	// strings, bytes and nil pointers to structs are encoded as empty. empty repeated strings and maps still encode nothing
+	pb, err = opts.Marshal(&NoElideMsg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{1<<3 | 2, 0, 2<<3 | 2, 0, 3<<3 | 2, 0, 4<<3 | 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal(NoElide, NoElideMsg{}) = % x; expected % x", pb, expected)
+	}
+	var m NoElideMsg
+	if err := protobuf3.Unmarshal(pb, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.P == nil || m.S != "" || m.D != 0 {
+		t.Errorf("Unmarshal = %+v; expected an empty InnerMsg", m)
+	}
+}
+
+type SortedMsg struct {
+	I  []int32     `protobuf:"varint,1,sorted"`
+	S  []string    `protobuf:"bytes,2,sorted"`
+	M  []InnerMsg  `protobuf:"bytes,3,sorted"`
+	PM []*InnerMsg `protobuf:"bytes,4,sorted"`
+	A  [3]float64  `protobuf:"fixed64,5,sorted"`
+}
+
+// the same wire format, without the "sorted" attributes
+type UnsortedMsg struct {
+	I  []int32     `protobuf:"varint,1"`
+	S  []string    `protobuf:"bytes,2"`
+	M  []InnerMsg  `protobuf:"bytes,3"`
+	PM []*InnerMsg `protobuf:"bytes,4"`
+	A  [3]float64  `protobuf:"fixed64,5"`
+}
+
+func TestSortedRepeatedFields(t *testing.T) {
+	m := SortedMsg{
+		I:  []int32{5, -3, 100, 0, 5, 1},
+		S:  []string{"pear", "apple", "fig"},
+		M:  []InnerMsg{{i: 300}, {i: 2}, {i: 1}},
+		PM: []*InnerMsg{{i: 9}, {i: 8}},
+		A:  [3]float64{2.5, -1, 0.5},
+	}
+	orig := m
+	orig.I = append([]int32(nil), m.I...)
+
+	pb := mustMarshal(t, &m)
+
+	// the output is the encoding of the sorted fields
+	expected := mustMarshal(t, &UnsortedMsg{
+		I:  []int32{-3, 0, 1, 5, 5, 100},
+		S:  []string{"apple", "fig", "pear"},
+		M:  []InnerMsg{{i: 1}, {i: 2}, {i: 300}},
+		PM: []*InnerMsg{{i: 8}, {i: 9}},
+		A:  [3]float64{-1, 0.5, 2.5},
+	})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	// the message itself isn't sorted
+	if !reflect.DeepEqual(m.I, orig.I) || m.S[0] != "pear" || m.M[0].i != 300 {
+		t.Errorf("Marshal modified the message: %+v", m)
+	}
+
+	// decoding preserves the wire order
+	var u SortedMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.I, []int32{-3, 0, 1, 5, 5, 100}) || !reflect.DeepEqual(u.S, []string{"apple", "fig", "pear"}) {
+		t.Errorf("Unmarshal = %+v", u)
+	}
+
+	type BadSorted struct {
+		M map[int32]int32 `protobuf:"bytes,1,sorted" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+	}
+	if _, err := protobuf3.Marshal(&BadSorted{}); err == nil {
+		t.Error("expected an error from a sorted map field")
+	}
+}
+
+type SortedPair struct {
+	A int32           `protobuf:"varint,1"`
+	B int32           `protobuf:"varint,2"`
+	M map[int32]int32 `protobuf:"bytes,3" protobuf_key:"varint,1" protobuf_val:"varint,2"`
+}
+
+type SortedPairsMsg struct {
+	Ps []SortedPair `protobuf:"bytes,1,sorted"`
+}
+
+func TestSortedRepeatedFieldsOptions(t *testing.T) {
+	// with NoElide the zero A of the second pair is encoded, and so that pair sorts first
+	m := SortedPairsMsg{Ps: []SortedPair{{A: 1}, {B: 5}}}
+	pb, err := protobuf3.MarshalOptions{NoElide: true}.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u SortedPairsMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Ps) != 2 || u.Ps[0].B != 5 {
+		t.Errorf("NoElide Marshal decoded to %+v; expected {B: 5} first", u)
+	}
+
+	// messages with maps are ordered by their deterministic encodings, even when the maps themselves aren't sorted
+	m = SortedPairsMsg{Ps: []SortedPair{{M: map[int32]int32{1: 2, 2: 1}}, {M: map[int32]int32{1: 1, 2: 2}}}}
+	for i := 0; i < 20; i++ {
+		var u SortedPairsMsg
+		if err := protobuf3.Unmarshal(mustMarshal(t, &m), &u); err != nil {
+			t.Fatal(err)
+		}
+		if len(u.Ps) != 2 || u.Ps[0].M[1] != 1 {
+			t.Fatalf("Marshal decoded to %+v; expected {1: 1, 2: 2} first", u)
+		}
+	}
+}
+
+func TestTrailerLength(t *testing.T) {
+	m1 := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	m2 := GetFieldMsg{Tenant: 300, Tags: []string{"u", "v"}}
+
+	// a single message streamed through a pipe
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(protobuf3.MarshalTrailerLength(w, &m1))
+	}()
+	var d GetFieldMsg
+	if err := protobuf3.ReadTrailerLength(r, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, m1) {
+		t.Errorf("ReadTrailerLength = %+v; expected %+v", d, m1)
+	}
+
+	// the frame is the message followed by its length as a little-endian uint32
+	var frames bytes.Buffer
+	if err := protobuf3.MarshalTrailerLength(&frames, &m1); err != nil {
+		t.Fatal(err)
+	}
+	body := mustMarshal(t, &m1)
+	expected := append(append([]byte(nil), body...), byte(len(body)), 0, 0, 0)
+	if !bytes.Equal(frames.Bytes(), expected) {
+		t.Errorf("MarshalTrailerLength = % x; expected % x", frames.Bytes(), expected)
+	}
+
+	// two frames in a row are decoded back to front
+	if err := protobuf3.MarshalTrailerLength(&frames, &m2); err != nil {
+		t.Fatal(err)
+	}
+	data := frames.Bytes()
+	var d1, d2 GetFieldMsg
+	start, err := protobuf3.UnmarshalTrailerLength(data, &d2)
+	if err != nil || start != len(expected) {
+		t.Fatalf("UnmarshalTrailerLength = %d, %v; expected %d", start, err, len(expected))
+	}
+	start, err = protobuf3.UnmarshalTrailerLength(data[:start], &d1)
+	if err != nil || start != 0 {
+		t.Fatalf("UnmarshalTrailerLength = %d, %v; expected 0", start, err)
+	}
+	if !reflect.DeepEqual(d1, m1) || !reflect.DeepEqual(d2, m2) {
+		t.Errorf("decoded %+v and %+v; expected %+v and %+v", d1, d2, m1, m2)
+	}
+
+	// ReadTrailerLength expects exactly one frame
+	if err := protobuf3.ReadTrailerLength(bytes.NewReader(data), &d); err == nil {
+		t.Error("ReadTrailerLength(2 frames) succeeded; expected an error")
+	}
+	// a length longer than the data is an error
+	if _, err := protobuf3.UnmarshalTrailerLength(expected[1:], &d); err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalTrailerLength(truncated) = %v; expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+// TagSetMsg merges by adding the tags it doesn't already have, rather than appending all of them
+type TagSetMsg struct {
+	Tags []string `protobuf:"bytes,1"`
+	N    int32    `protobuf:"varint,2"`
+}
+
+func (m *TagSetMsg) ProtoMerge(src protobuf3.Message) {
+	s := src.(*TagSetMsg)
+next:
+	for _, t := range s.Tags {
+		for _, u := range m.Tags {
+			if t == u {
+				continue next
+			}
+		}
+		m.Tags = append(m.Tags, t)
+	}
+	m.N += s.N
+}
+
+type TagSetHolderMsg struct {
+	S  TagSetMsg   `protobuf:"bytes,1"`
+	P  *TagSetMsg  `protobuf:"bytes,2"`
+	SS []TagSetMsg `protobuf:"bytes,3"`
+}
+
+func TestProtoMerge(t *testing.T) {
+	pb := mustMarshal(t, &TagSetMsg{Tags: []string{"b", "c"}, N: 2})
+
+	m := TagSetMsg{Tags: []string{"a", "b"}, N: 1}
+	if err := protobuf3.Unmarshal(pb, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, TagSetMsg{Tags: []string{"a", "b", "c"}, N: 3}) {
+		t.Errorf("Unmarshal = %+v", m)
+	}
+
+	// nested messages are merged too, including each time the field appears on the wire
+	h := TagSetHolderMsg{
+		S: TagSetMsg{Tags: []string{"x"}},
+		P: &TagSetMsg{Tags: []string{"y", "z"}},
+	}
+	pb = mustMarshal(t, &TagSetHolderMsg{
+		S:  TagSetMsg{Tags: []string{"x", "y"}},
+		P:  &TagSetMsg{Tags: []string{"z"}, N: 5},
+		SS: []TagSetMsg{{Tags: []string{"q", "q"}}},
+	})
+	pb = append(pb, mustMarshal(t, &TagSetHolderMsg{S: TagSetMsg{Tags: []string{"w", "x"}}})...)
+	if err := protobuf3.Unmarshal(pb, &h); err != nil {
+		t.Fatal(err)
+	}
+	expected := TagSetHolderMsg{
+		S:  TagSetMsg{Tags: []string{"x", "y", "w"}},
+		P:  &TagSetMsg{Tags: []string{"y", "z"}, N: 5},
+		SS: []TagSetMsg{{Tags: []string{"q", "q"}}}, // new elements of repeated fields aren't merged into anything
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("Unmarshal = %+v; expected %+v", h, expected)
+	}
+
+	// a nil pointer is decoded as usual
+	var h2 TagSetHolderMsg
+	if err := protobuf3.Unmarshal(mustMarshal(t, &TagSetHolderMsg{P: &TagSetMsg{Tags: []string{"a", "a"}}}), &h2); err != nil {
+		t.Fatal(err)
+	}
+	if h2.P == nil || !reflect.DeepEqual(h2.P.Tags, []string{"a", "a"}) {
+		t.Errorf("Unmarshal = %+v", h2.P)
+	}
+}
+
+type LoginEvent struct {
+	User string `protobuf:"bytes,1"`
+}
+
+type LogoutEvent struct {
+	User    string `protobuf:"bytes,1"`
+	Seconds int64  `protobuf:"varint,2"`
+}
+
+type EventListMsg struct {
+	Events []interface{} `protobuf:"bytes,1"`
+}
+
+func init() {
+	if err := protobuf3.RegisterProtoName(reflect.TypeOf(LoginEvent{}), "test.LoginEvent"); err != nil {
+		panic(err)
+	}
+	if err := protobuf3.RegisterProtoName(reflect.TypeOf(LogoutEvent{}), "test.LogoutEvent"); err != nil {
+		panic(err)
+	}
+}
+
+func TestSliceOfInterfaces(t *testing.T) {
+	m := EventListMsg{Events: []interface{}{
+		&LoginEvent{User: "alice"},
+		&LogoutEvent{User: "alice", Seconds: 60},
+		LoginEvent{User: "bob"}, // a value rather than a pointer encodes the same
+		&LoginEvent{},
+	}}
+	pb := mustMarshal(t, &m)
+
+	// each element is encoded as an Any
+	a1, _ := protobuf3.NewAny("type.googleapis.com/test.LoginEvent", &LoginEvent{User: "alice"})
+	a2, _ := protobuf3.NewAny("type.googleapis.com/test.LogoutEvent", &LogoutEvent{User: "alice", Seconds: 60})
+	a3, _ := protobuf3.NewAny("type.googleapis.com/test.LoginEvent", &LoginEvent{User: "bob"})
+	a4, _ := protobuf3.NewAny("type.googleapis.com/test.LoginEvent", &LoginEvent{})
+	type AnyListMsg struct {
+		Anys []protobuf3.Any `protobuf:"bytes,1"`
+	}
+	expected := mustMarshal(t, &AnyListMsg{Anys: []protobuf3.Any{a1, a2, a3, a4}})
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x; expected % x", pb, expected)
+	}
+
+	var u EventListMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	m.Events[2] = &LoginEvent{User: "bob"} // elements are decoded as pointers
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %+v; expected %+v", u, m)
+	}
+
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, `import "google/protobuf/any.proto";`) || !strings.Contains(s, "repeated google.protobuf.Any events = 1;") {
+		t.Errorf("unexpected AsProtobufFull result:\n%s", s)
+	}
+
+	// nil elements, and elements of unregistered types, are errors
+	if _, err := protobuf3.Marshal(&EventListMsg{Events: []interface{}{nil}}); err == nil {
+		t.Error("expected an error from a nil element")
+	}
+	if _, err := protobuf3.Marshal(&EventListMsg{Events: []interface{}{&InnerMsg{}}}); err == nil || !strings.Contains(err.Error(), "RegisterProtoName") {
+		t.Errorf("Marshal(unregistered element) = %v; expected an error", err)
+	}
+	a5, _ := protobuf3.NewAny("type.googleapis.com/test.Unknown", &InnerMsg{})
+	if err := protobuf3.Unmarshal(mustMarshal(t, &AnyListMsg{Anys: []protobuf3.Any{a5}}), &u); err == nil {
+		t.Error("expected an error decoding an unregistered type URL")
+	}
+}
+
+type FixedNanosMsg struct {
+	T time.Time `protobuf:"fixed64,1,fixed_nanos"`
+	B time.Time `protobuf:"bytes,2,fixed_nanos"` // bytes is accepted too, and encodes as fixed64
+}
+
+type TimestampMsg struct {
+	T time.Time `protobuf:"bytes,1"`
+}
+
+type VarintNanosMsg struct {
+	N int64 `protobuf:"varint,1"`
+}
+
+func TestFixedNanosTime(t *testing.T) {
+	for _, tm := range []time.Time{
+		time.Date(2020, 5, 17, 12, 34, 56, 789012345, time.UTC),
+		time.Unix(0, 0).UTC(),
+		time.Unix(-1, 999).UTC(),
+	} {
+		m := FixedNanosMsg{T: tm, B: tm}
+		pb := mustMarshal(t, &m)
+		var b protobuf3.Buffer
+		b.EncodeVarint(1<<3 | uint64(protobuf3.WireFixed64))
+		b.EncodeFixed64(uint64(tm.UnixNano()))
+		b.EncodeVarint(2<<3 | uint64(protobuf3.WireFixed64))
+		b.EncodeFixed64(uint64(tm.UnixNano()))
+		if !bytes.Equal(pb, b.Bytes()) {
+			t.Errorf("Marshal(%v) = % x; expected % x", tm, pb, b.Bytes())
+		}
+
+		var u FixedNanosMsg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		if !u.T.Equal(tm) || !u.B.Equal(tm) || u.T.Location() != time.UTC {
+			t.Errorf("Unmarshal = %+v; expected %v", u, tm)
+		}
+	}
+
+	// a recent time takes 9 bytes, compared with 14 for the Timestamp and 10 for varint nanoseconds
+	tm := time.Date(2020, 5, 17, 12, 34, 56, 789012345, time.UTC)
+	fixed := len(mustMarshal(t, &FixedNanosMsg{T: tm}))
+	timestamp := len(mustMarshal(t, &TimestampMsg{T: tm}))
+	varint := len(mustMarshal(t, &VarintNanosMsg{N: tm.UnixNano()}))
+	if fixed != 9 || timestamp != 14 || varint != 10 {
+		t.Errorf("sizes fixed_nanos %d, Timestamp %d, varint nanos %d", fixed, timestamp, varint)
+	}
+
+	// the zero time is elided, and times outside the range of int64 nanoseconds are an error
+	if pb := mustMarshal(t, &FixedNanosMsg{}); len(pb) != 0 {
+		t.Errorf("Marshal(zero) = % x; expected nothing", pb)
+	}
+	if _, err := protobuf3.Marshal(&FixedNanosMsg{T: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)}); err == nil {
+		t.Error("expected an error from a time after 2262")
+	}
+
+	type BadFixedNanos struct {
+		T time.Time `protobuf:"varint,1,fixed_nanos"`
+	}
+	if _, err := protobuf3.Marshal(&BadFixedNanos{}); err == nil {
+		t.Error("expected an error from a varint fixed_nanos field")
+	}
+}
+
+func TestUnmarshalAllowedTags(t *testing.T) {
+	m := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	pb := mustMarshal(t, &m)
+
+	opts := protobuf3.UnmarshalOptions{AllowedTags: map[uint32]bool{7: true, 9: true}}
+	var u GetFieldMsg
+	if err := opts.Unmarshal(pb, &u); err != nil || !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %v, %+v; expected %+v", err, u, m)
+	}
+
+	// a field which GetFieldMsg has, but which isn't allowed, is an error
+	var b protobuf3.Buffer
+	b.EncodeVarint(1<<3 | uint64(protobuf3.WireBytes))
+	b.EncodeStringBytes("x")
+	disallowed := append(append([]byte(nil), pb...), b.Bytes()...)
+	var u2 GetFieldMsg
+	err := opts.Unmarshal(disallowed, &u2)
+	de, ok := err.(*protobuf3.DecodeError)
+	if !ok || de.Field != 1 || de.Offset != len(pb) {
+		t.Fatalf("Unmarshal(disallowed) = %v; expected a DecodeError for field 1 at offset %d", err, len(pb))
+	}
+	if !reflect.DeepEqual(u2, GetFieldMsg{}) {
+		t.Errorf("Unmarshal(disallowed) decoded %+v; expected nothing", u2)
+	}
+
+	// without AllowedTags the same buffer decodes
+	if err := protobuf3.Unmarshal(disallowed, &u2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnmarshalOnUnknown(t *testing.T) {
+	m := GetFieldMsg{Tenant: 3, Tags: []string{"t"}}
+	var b protobuf3.Buffer
+	b.EncodeVarint(8<<3 | uint64(protobuf3.WireVarint))
+	b.EncodeVarint(300)
+	b.EncodeVarint(100<<3 | uint64(protobuf3.WireBytes))
+	b.EncodeStringBytes("xyz")
+	pb := append(mustMarshal(t, &m), b.Bytes()...)
+
+	type unknown struct {
+		tag   uint32
+		wire  protobuf3.WireType
+		value string
+	}
+	var unknowns []unknown
+	opts := protobuf3.UnmarshalOptions{OnUnknown: func(tag uint32, wire protobuf3.WireType, value []byte) {
+		unknowns = append(unknowns, unknown{tag, wire, string(value)})
+	}}
+	var u GetFieldMsg
+	if err := opts.Unmarshal(pb, &u); err != nil || !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %v, %+v; expected %+v", err, u, m)
+	}
+	expected := []unknown{
+		{8, protobuf3.WireVarint, "\xac\x02"},
+		{100, protobuf3.WireBytes, "xyz"},
+	}
+	if !reflect.DeepEqual(unknowns, expected) {
+		t.Errorf("OnUnknown was called with %+v; expected %+v", unknowns, expected)
+	}
+}
+
+type UnknownV1Msg struct {
+	A       int32  `protobuf:"varint,1"`
+	B       string `protobuf:"bytes,2"`
+	Unknown []byte `protobuf:"unknown"`
+}
+
+type UnknownV2Msg struct {
+	A int32          `protobuf:"varint,1"`
+	B string         `protobuf:"bytes,2"`
+	C []int64        `protobuf:"varint,3"`
+	D *UnknownV1Msg  `protobuf:"bytes,4"`
+	E map[string]int `protobuf:"bytes,5" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+}
+
+func TestUnknownFields(t *testing.T) {
+	m2 := UnknownV2Msg{A: 1, B: "b", C: []int64{-1, 2}, D: &UnknownV1Msg{A: 3}, E: map[string]int{"e": 5}}
+	pb := mustMarshal(t, &m2)
+
+	// an older reader keeps the fields it doesn't know about
+	var m1 UnknownV1Msg
+	if err := protobuf3.Unmarshal(pb, &m1); err != nil {
+		t.Fatal(err)
+	}
+	if m1.A != 1 || m1.B != "b" || len(m1.Unknown) == 0 {
+		t.Errorf("Unmarshal = %+v", m1)
+	}
+
+	// and re-encodes them after the fields it knows, which here is the original order
+	pb1 := mustMarshal(t, &m1)
+	if !bytes.Equal(pb1, pb) {
+		t.Errorf("re-encoded % x; expected % x", pb1, pb)
+	}
+	if n, err := protobuf3.Size(&m1); err != nil || n != len(pb1) {
+		t.Errorf("Size = %d, %v; expected %d", n, err, len(pb1))
+	}
+	var u UnknownV2Msg
+	if err := protobuf3.Unmarshal(pb1, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("round trip", m2, u, t)
+
+	// the unknown field isn't part of the schema
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(s, "unknown") {
+		t.Errorf("AsProtobuf declared the unknown field:\n%s", s)
+	}
+
+	type BadUnknown struct {
+		Unknown string `protobuf:"unknown"`
+	}
+	if _, err := protobuf3.Marshal(&BadUnknown{}); err == nil {
+		t.Error("Marshal(string unknown field) succeeded")
+	}
+}
+
+type MergeInnerMsg struct {
+	X int32   `protobuf:"varint,1"`
+	Y string  `protobuf:"bytes,2"`
+	Z []int32 `protobuf:"varint,3"`
+}
+
+type MergeMsg struct {
+	A int32            `protobuf:"varint,1"`
+	S []int64          `protobuf:"varint,2"`
+	T []string         `protobuf:"bytes,3"`
+	P *MergeInnerMsg   `protobuf:"bytes,4"`
+	V MergeInnerMsg    `protobuf:"bytes,5"`
+	R []*MergeInnerMsg `protobuf:"bytes,6"`
+	M map[string]int32 `protobuf:"bytes,7" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+	B []byte           `protobuf:"bytes,8"`
+}
+
+func TestUnmarshalMerge(t *testing.T) {
+	// a message split across two payloads
+	first := mustMarshal(t, &MergeMsg{A: 1, S: []int64{1}, T: []string{"a"}, P: &MergeInnerMsg{X: 1, Z: []int32{1}}, V: MergeInnerMsg{X: 1}, R: []*MergeInnerMsg{{X: 1}}, M: map[string]int32{"a": 1, "c": 1}, B: []byte("a")})
+	second := mustMarshal(t, &MergeMsg{A: 2, S: []int64{2}, T: []string{"b"}, P: &MergeInnerMsg{Y: "y", Z: []int32{2}}, V: MergeInnerMsg{Y: "y"}, R: []*MergeInnerMsg{{X: 2}}, M: map[string]int32{"b": 2, "c": 3}, B: []byte("b")})
+
+	var m MergeMsg
+	if err := protobuf3.UnmarshalMerge(first, &m); err != nil {
+		t.Fatal(err)
+	}
+	p := m.P
+	if err := protobuf3.UnmarshalMerge(second, &m); err != nil {
+		t.Fatal(err)
+	}
+	// scalars (including bytes) are overwritten, repeated fields are appended to, messages are merged, and map
+	// entries are added or overwritten
+	expected := MergeMsg{
+		A: 2,
+		S: []int64{1, 2},
+		T: []string{"a", "b"},
+		P: &MergeInnerMsg{X: 1, Y: "y", Z: []int32{1, 2}},
+		V: MergeInnerMsg{X: 1, Y: "y"},
+		R: []*MergeInnerMsg{{X: 1}, {X: 2}},
+		M: map[string]int32{"a": 1, "b": 2, "c": 3},
+		B: []byte("b"),
+	}
+	eq("merged", expected, m, t)
+	if m.P != p {
+		t.Error("the existing *MergeInnerMsg was replaced rather than merged into")
+	}
+
+	// merging the concatenated payloads is the same
+	var m2 MergeMsg
+	if err := protobuf3.UnmarshalMerge(append(first, second...), &m2); err != nil {
+		t.Fatal(err)
+	}
+	eq("concatenated", expected, m2, t)
+}
+
+type DeltaTimesMsg struct {
+	Times []time.Time `protobuf:"bytes,1,delta"`
+}
+
+type TimesMsg struct {
+	Times []time.Time `protobuf:"bytes,1"`
+}
+
+func TestDeltaTimes(t *testing.T) {
+	start := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	var m DeltaTimesMsg
+	for i := 0; i < 1000; i++ {
+		m.Times = append(m.Times, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	m.Times[500] = m.Times[500].Add(-time.Hour) // a step backwards, and forwards again
+	pb := mustMarshal(t, &m)
+	if n, err := protobuf3.Size(&m); err != nil || n != len(pb) {
+		t.Errorf("Size = %d, %v; expected %d", n, err, len(pb))
+	}
+
+	var u DeltaTimesMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("round trip", m, u, t)
+
+	full := mustMarshal(t, &TimesMsg{Times: m.Times})
+	t.Logf("1000 times 1ms apart: %d bytes delta encoded, %d bytes as Timestamps", len(pb), len(full))
+	if len(pb)*3 > len(full) {
+		t.Errorf("delta encoding took %d bytes; expected less than a third of the %d bytes of repeated Timestamps", len(pb), len(full))
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "bytes times = 1;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	if _, err := protobuf3.Marshal(&DeltaTimesMsg{Times: []time.Time{{}}}); err == nil {
+		t.Error("Marshal(zero time.Time) succeeded")
+	}
+
+	type BadDelta struct {
+		T time.Time `protobuf:"bytes,1,delta"`
+	}
+	if _, err := protobuf3.Marshal(&BadDelta{}); err == nil {
+		t.Error("Marshal(delta time.Time) succeeded")
+	}
+}
+
+type ValidatedMsg struct {
+	Count int32  `protobuf:"varint,1"`
+	Name  string `protobuf:"bytes,2"`
+}
+
+func (m *ValidatedMsg) Validate() error {
+	if m.Count < 0 {
+		return fmt.Errorf("count %d is negative", m.Count)
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	var u ValidatedMsg
+	if err := protobuf3.Unmarshal(mustMarshal(t, &ValidatedMsg{Count: 3, Name: "n"}), &u); err != nil {
+		t.Errorf("Unmarshal(valid) = %v", err)
+	}
+
+	pb := mustMarshal(t, &ValidatedMsg{Count: -1, Name: "n"})
+	u = ValidatedMsg{}
+	err := protobuf3.Unmarshal(pb, &u)
+	if err == nil || err.Error() != "count -1 is negative" {
+		t.Errorf("Unmarshal(invalid) = %v; expected the validation error", err)
+	}
+	if u.Count != -1 {
+		t.Errorf("Unmarshal(invalid) decoded %+v", u) // the message is decoded before it is validated
+	}
+
+	u = ValidatedMsg{}
+	if err := (protobuf3.UnmarshalOptions{SkipValidate: true}).Unmarshal(pb, &u); err != nil || u.Count != -1 {
+		t.Errorf("Unmarshal(SkipValidate) = %v, %+v", err, u)
+	}
+
+	// nested messages aren't validated, whether they are held in a message field or an interface field
+	nested := mustMarshal(t, &struct {
+		V *ValidatedMsg `protobuf:"bytes,1"`
+	}{&ValidatedMsg{Count: -1}})
+	var sm struct {
+		V *ValidatedMsg `protobuf:"bytes,1"`
+	}
+	if err := protobuf3.Unmarshal(nested, &sm); err != nil || sm.V.Count != -1 {
+		t.Errorf("Unmarshal(nested) = %v, %+v", err, sm.V)
+	}
+	im := InterfaceNoFactoryMsg{M: new(ValidatedMsg)}
+	if err := protobuf3.Unmarshal(nested, &im); err != nil || im.M.(*ValidatedMsg).Count != -1 {
+		t.Errorf("Unmarshal(nested in interface) = %v, %+v", err, im.M)
+	}
+}
+
+type NetHeaderMsg struct {
+	Magic uint32          `protobuf:"fixed32,1"`
+	Seq   int64           `protobuf:"fixed64,2"`
+	Ratio float64         `protobuf:"fixed64,3"`
+	Ports []uint32        `protobuf:"fixed32,4"`
+	Addrs [2]uint32       `protobuf:"fixed32,5"`
+	N     uint32          `protobuf:"varint,6"`
+	Inner InnerFixedMsg   `protobuf:"bytes,7"`
+	M     map[int32]int64 `protobuf:"bytes,8" protobuf_key:"varint,1" protobuf_val:"fixed64,2"`
+}
+
+func (*NetHeaderMsg) ProtoBigEndian() bool { return true }
+
+// InnerFixedMsg isn't big-endian, even when it is nested in a big-endian message
+type InnerFixedMsg struct {
+	X uint32 `protobuf:"fixed32,1"`
+}
+
+func TestBigEndianStruct(t *testing.T) {
+	m := NetHeaderMsg{
+		Magic: 0x01020304,
+		Seq:   -2,
+		Ratio: 1.5,
+		Ports: []uint32{0x0a0b0c0d, 0x11121314},
+		Addrs: [2]uint32{0xc0a80001, 0x7f000001},
+		N:     300,
+		Inner: InnerFixedMsg{X: 0x01020304},
+		M:     map[int32]int64{1: 0x0102030405060708},
+	}
+	pb := mustMarshal(t, &m)
+
+	expected := []byte{1<<3 | 5, 1, 2, 3, 4}
+	expected = append(expected, 2<<3|1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe)
+	expected = append(expected, 3<<3|1, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0)
+	expected = append(expected, 4<<3|2, 8, 0x0a, 0x0b, 0x0c, 0x0d, 0x11, 0x12, 0x13, 0x14)
+	expected = append(expected, 5<<3|2, 8, 0xc0, 0xa8, 0, 1, 0x7f, 0, 0, 1)
+	expected = append(expected, 6<<3|0, 0xac, 0x02)
+	expected = append(expected, 7<<3|2, 5, 1<<3|5, 4, 3, 2, 1) // little-endian, since InnerFixedMsg isn't big-endian
+	expected = append(expected, 8<<3|2, 11, 1<<3|0, 1, 2<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	if !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal = % x\nexpected  % x", pb, expected)
+	}
+
+	var u NetHeaderMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %+v; expected %+v", u, m)
+	}
+}
+
+type HTTPMetadataMsg struct {
+	Header http.Header `protobuf:"bytes,1,stringlist" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	Query  url.Values  `protobuf:"bytes,2,stringlist" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+}
+
+func TestStringSliceMap(t *testing.T) {
+	m := HTTPMetadataMsg{
+		Header: http.Header{
+			"Accept":     {"text/html", "application/json"},
+			"Set-Cookie": {"a=1", "b=2", "c=3"},
+			"X-Empty":    {""},
+		},
+		Query: url.Values{"q": {"protobuf"}},
+	}
+	pb := mustMarshal(t, &m)
+
+	// each map entry's value is a StringList message
+	type StringListMapMsg struct {
+		Header map[string]protobuf3.StringList `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+		Query  map[string]protobuf3.StringList `protobuf:"bytes,2" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	}
+	var l StringListMapMsg
+	if err := protobuf3.Unmarshal(pb, &l); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l.Header["Set-Cookie"].Values, []string{"a=1", "b=2", "c=3"}) || len(l.Header) != 3 || !reflect.DeepEqual(l.Query["q"].Values, []string{"protobuf"}) {
+		t.Errorf("decoded as %+v", l)
+	}
+
+	var u HTTPMetadataMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %+v; expected %+v", u, m)
+	}
+
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "map<string, StringList> header = 1;") || !strings.Contains(s, "message StringList {\n  repeated string values = 1;\n}") {
+		t.Errorf("unexpected AsProtobufFull result:\n%s", s)
+	}
+
+	// without the stringlist attribute the values are repeated strings within the map entries, as they always were
+	type PlainStringSliceMapMsg struct {
+		M map[string][]string `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	}
+	pm := PlainStringSliceMapMsg{M: map[string][]string{"a": {"x", "y"}}}
+	pb = mustMarshal(t, &pm)
+	if expected := []byte{0x0a, 0x09, 0x0a, 0x01, 'a', 0x12, 0x01, 'x', 0x12, 0x01, 'y'}; !bytes.Equal(pb, expected) {
+		t.Errorf("Marshal(map[string][]string) = % x; expected % x", pb, expected)
+	}
+	var pm2 PlainStringSliceMapMsg
+	if err := protobuf3.Unmarshal(pb, &pm2); err != nil || !reflect.DeepEqual(pm, pm2) {
+		t.Errorf("Unmarshal(map[string][]string) = %+v, %v", pm2, err)
+	}
+
+	// the attribute needs []string values
+	type BadStringList struct {
+		M map[string]string `protobuf:"bytes,1,stringlist" protobuf_key:"bytes,1" protobuf_val:"bytes,2"`
+	}
+	_, err = protobuf3.Marshal(&BadStringList{})
+	if err == nil || !strings.Contains(err.Error(), `stringlist field "M"`) {
+		t.Errorf("Marshal(BadStringList) = %v; expected an error", err)
+	}
+}
+
+type EmptyOKMsg struct {
+	Name        string `protobuf:"bytes,1,emptyok"`
+	NamePresent bool   `protobuf:"-"`
+	Data        []byte `protobuf:"bytes,2,emptyok"`
+	DataPresent bool   `protobuf:"-"`
+}
+
+func TestEmptyOK(t *testing.T) {
+	// absent and empty-present encode differently
+	if pb := mustMarshal(t, &EmptyOKMsg{}); len(pb) != 0 {
+		t.Errorf("Marshal(absent) = % x; expected nothing", pb)
+	}
+	pb := mustMarshal(t, &EmptyOKMsg{NamePresent: true})
+	if !bytes.Equal(pb, []byte{1<<3 | 2, 0}) {
+		t.Errorf("Marshal(empty present) = % x; expected 0a 00", pb)
+	}
+
+	var u EmptyOKMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u, EmptyOKMsg{NamePresent: true}) {
+		t.Errorf("Unmarshal(empty present) = %+v", u)
+	}
+	var a EmptyOKMsg
+	if err := protobuf3.Unmarshal(nil, &a); err != nil || a.NamePresent || a.DataPresent {
+		t.Errorf("Unmarshal(absent) = %v, %+v", err, a)
+	}
+
+	// non-empty values are encoded even if the companion field wasn't set, and decoding them sets it
+	pb = mustMarshal(t, &EmptyOKMsg{Name: "x", Data: []byte{1}})
+	var u2 EmptyOKMsg
+	if err := protobuf3.Unmarshal(pb, &u2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u2, EmptyOKMsg{Name: "x", NamePresent: true, Data: []byte{1}, DataPresent: true}) {
+		t.Errorf("Unmarshal = %+v", u2)
+	}
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(EmptyOKMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "optional string name = 1;") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	type NoCompanion struct {
+		Name string `protobuf:"bytes,1,emptyok"`
+	}
+	if _, err := protobuf3.Marshal(&NoCompanion{}); err == nil || !strings.Contains(err.Error(), "NamePresent") {
+		t.Errorf("Marshal(no companion) = %v; expected an error", err)
+	}
+}
+
+func TestMarshalByteStream(t *testing.T) {
+	ch := make(chan []byte)
+	go func() {
+		ch <- []byte("chunk1,")
+		ch <- nil
+		ch <- []byte("chunk2,")
+		ch <- []byte("chunk3")
+		close(ch)
+	}()
+	pb, err := protobuf3.MarshalByteStream(ch, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type BytesMsg struct {
+		Data []byte `protobuf:"bytes,2"`
+	}
+	var m BytesMsg
+	if err := protobuf3.Unmarshal(pb, &m); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != "chunk1,chunk2,chunk3" {
+		t.Errorf("MarshalByteStream() decoded to %q", m.Data)
+	}
+	if expected := mustMarshal(t, &BytesMsg{Data: []byte("chunk1,chunk2,chunk3")}); !bytes.Equal(pb, expected) {
+		t.Errorf("MarshalByteStream() = % x; expected % x", pb, expected)
+	}
+
+	// an empty stream encodes nothing, like an empty []byte field
+	ch = make(chan []byte, 1)
+	ch <- nil
+	close(ch)
+	if pb, err := protobuf3.MarshalByteStream(ch, 2); err != nil || len(pb) != 0 {
+		t.Errorf("MarshalByteStream(empty) = % x, %v; expected nothing", pb, err)
+	}
+
+	ch = make(chan []byte, 1)
+	ch <- []byte("x")
+	close(ch)
+	if _, err := protobuf3.MarshalByteStream(ch, 0); err == nil {
+		t.Error("MarshalByteStream(tag 0) succeeded")
+	}
+}
+
+type PresenceMaskMsg struct {
+	VarMsg           `protobuf:"embedded"`
+	XXX_PresenceMask uint16
+}
+
+func TestPresenceMask(t *testing.T) {
+	i64 := int64(0)
+	m := PresenceMaskMsg{VarMsg: VarMsg{u32: 7, b: true, pi64: &i64, su64: []uint64{1, 2}}}
+	m.XXX_PresenceMask = 0xffff // Marshal must clear the bits of the fields it doesn't emit
+	pb := mustMarshal(t, &m)
+
+	// fields are numbered in tag order: u32 is field 1, b is 4, pi64 is 7 and su64 is 13
+	const expected = 1<<1 | 1<<4 | 1<<7 | 1<<13
+	if m.XXX_PresenceMask != expected {
+		t.Errorf("Marshal set XXX_PresenceMask = %016b; expected %016b", m.XXX_PresenceMask, expected)
+	}
+
+	var u PresenceMaskMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.XXX_PresenceMask != expected {
+		t.Errorf("Unmarshal set XXX_PresenceMask = %016b; expected %016b", u.XXX_PresenceMask, expected)
+	}
+	if !reflect.DeepEqual(u, m) {
+		t.Errorf("Unmarshal = %+v; expected %+v", u, m)
+	}
+
+	type TooSmall struct {
+		A                int32 `protobuf:"varint,1"`
+		B                int32 `protobuf:"varint,2"`
+		C                int32 `protobuf:"varint,3"`
+		D                int32 `protobuf:"varint,4"`
+		E                int32 `protobuf:"varint,5"`
+		F                int32 `protobuf:"varint,6"`
+		G                int32 `protobuf:"varint,7"`
+		H                int32 `protobuf:"varint,8"`
+		I                int32 `protobuf:"varint,9"`
+		XXX_PresenceMask uint8
+	}
+	if _, err := protobuf3.Marshal(&TooSmall{}); err == nil || !strings.Contains(err.Error(), "XXX_PresenceMask") {
+		t.Errorf("Marshal(TooSmall) = %v; expected an error", err)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	for _, c := range []struct {
+		amount string
+		units  int64
+		nanos  int32
+		str    string
+	}{
+		{"12.34", 12, 340000000, "12.34"},
+		{"-12.34", -12, -340000000, "-12.34"},
+		{"-0.5", 0, -500000000, "-0.5"},
+		{"0", 0, 0, "0"},
+		{"0.000000001", 0, 1, "0.000000001"},
+		{"+7.", 7, 0, "7"},
+	} {
+		m, err := protobuf3.ParseMoney("USD", c.amount)
+		if err != nil {
+			t.Errorf("ParseMoney(%q) error %v", c.amount, err)
+			continue
+		}
+		if m.Units != c.units || m.Nanos != c.nanos || m.CurrencyCode != "USD" {
+			t.Errorf("ParseMoney(%q) = %+v; expected units %d nanos %d", c.amount, m, c.units, c.nanos)
+		}
+		if s := m.Amount(); s != c.str {
+			t.Errorf("ParseMoney(%q).Amount() = %q; expected %q", c.amount, s, c.str)
+		}
+
+		pb := mustMarshal(t, &m)
+		var m2 protobuf3.Money
+		if err := protobuf3.Unmarshal(pb, &m2); err != nil {
+			t.Fatal(err)
+		}
+		eq(c.amount, m, m2, t)
+	}
+
+	for _, bad := range []string{"", ".", "-", "1.2.3", "1e3", "0.1234567891", "99999999999999999999"} {
+		if m, err := protobuf3.ParseMoney("USD", bad); err == nil {
+			t.Errorf("ParseMoney(%q) = %+v; expected an error", bad, m)
+		}
+	}
+	if _, err := protobuf3.Marshal(&protobuf3.Money{CurrencyCode: "USD", Units: 1, Nanos: -1}); err == nil {
+		t.Error("Marshal(Money with nanos of the wrong sign) succeeded")
+	}
+
+	type PriceMsg struct {
+		Price *protobuf3.Money `protobuf:"bytes,1"`
+	}
+	str, err := protobuf3.AsProtobufFull(reflect.TypeOf(PriceMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(str, "google.type.Money price = 1;") || !strings.Contains(str, `import "google/type/money.proto";`) {
+		t.Errorf("unexpected AsProtobufFull result:\n%s", str)
+	}
+}
+
+type OneofTagMsg struct {
+	ID    uint32    `protobuf:"varint,1"`
+	Name  string    `protobuf:"bytes,2,oneof=choice"`
+	Count int64     `protobuf:"varint,3,oneof=choice"`
+	Inner *InnerMsg `protobuf:"bytes,4,oneof=choice"`
+}
+
+func TestOneofTag(t *testing.T) {
+	for _, m := range []OneofTagMsg{
+		{ID: 1},
+		{ID: 2, Name: "x"},
+		{Count: -3},
+		{ID: 4, Inner: &InnerMsg{i: 5}},
+	} {
+		pb := mustMarshal(t, &m)
+		var u OneofTagMsg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		eq("oneof", m, u, t)
+	}
+
+	_, err := protobuf3.Marshal(&OneofTagMsg{Name: "x", Inner: &InnerMsg{}})
+	if err == nil || !strings.Contains(err.Error(), "Name and Inner of oneof choice are both set") {
+		t.Errorf("Marshal(two fields of the oneof set) = %v; expected an error", err)
+	}
+
+	// decoding a field of the oneof zeros the others, so the last one on the wire wins
+	pb := append(mustMarshal(t, &OneofTagMsg{Name: "x"}), mustMarshal(t, &OneofTagMsg{Count: 7})...)
+	u := OneofTagMsg{Inner: &InnerMsg{}}
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("last wins", OneofTagMsg{Count: 7}, u, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(OneofTagMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "  oneof choice {\n    string name = 2;\n    int64 count = 3;\n    InnerMsg inner = 4;\n  }") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	type RepeatedOneof struct {
+		A []int32 `protobuf:"varint,1,oneof=x"`
+	}
+	if _, err := protobuf3.Marshal(&RepeatedOneof{}); err == nil {
+		t.Error("Marshal(repeated oneof field) succeeded")
+	}
+}
+
+type OneofIfaceMsg struct {
+	ID     uint32        `protobuf:"varint,1"`
+	Choice isOneofChoice `protobuf_oneof:"choice"`
+}
+
+type isOneofChoice interface{ isOneofChoice() }
+
+type OneofIfaceMsg_Name struct {
+	Name string `protobuf:"bytes,2"`
+}
+type OneofIfaceMsg_Count struct {
+	Count int64 `protobuf:"varint,3"`
+}
+type OneofIfaceMsg_Inner struct {
+	Inner *InnerMsg `protobuf:"bytes,4"`
+}
+
+func (*OneofIfaceMsg_Name) isOneofChoice()  {}
+func (*OneofIfaceMsg_Count) isOneofChoice() {}
+func (*OneofIfaceMsg_Inner) isOneofChoice() {}
+
+func TestOneofInterface(t *testing.T) {
+	err := protobuf3.RegisterOneof(reflect.TypeOf((*isOneofChoice)(nil)).Elem(),
+		reflect.TypeOf(OneofIfaceMsg_Name{}), reflect.TypeOf(OneofIfaceMsg_Count{}), reflect.TypeOf(&OneofIfaceMsg_Inner{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []OneofIfaceMsg{
+		{ID: 1},
+		{ID: 2, Choice: &OneofIfaceMsg_Name{Name: "x"}},
+		{Choice: &OneofIfaceMsg_Count{Count: -3}},
+		{ID: 4, Choice: &OneofIfaceMsg_Inner{Inner: &InnerMsg{i: 5}}},
+		{Choice: &OneofIfaceMsg_Count{}}, // the zero value of a field of the oneof is still encoded
+	} {
+		pb := mustMarshal(t, &m)
+		var u OneofIfaceMsg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		eq("oneof", m, u, t)
+	}
+
+	// the encoding is the same as that of the equivalent oneof= fields
+	if a, b := mustMarshal(t, &OneofIfaceMsg{ID: 2, Choice: &OneofIfaceMsg_Name{Name: "x"}}), mustMarshal(t, &OneofTagMsg{ID: 2, Name: "x"}); !bytes.Equal(a, b) {
+		t.Errorf("oneof interface encoded to % x; expected % x", a, b)
+	}
+
+	// decoding a field of the oneof replaces the wrapper, so the last one on the wire wins
+	pb := append(mustMarshal(t, &OneofTagMsg{Name: "x"}), mustMarshal(t, &OneofTagMsg{Count: 7})...)
+	u := OneofIfaceMsg{Choice: &OneofIfaceMsg_Name{Name: "y"}}
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("last wins", OneofIfaceMsg{Choice: &OneofIfaceMsg_Count{Count: 7}}, u, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(OneofIfaceMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "  oneof choice {\n    string name = 2;\n    int64 count = 3;\n    InnerMsg inner = 4;\n  }") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+
+	j, err := protobuf3.MarshalJSON(&OneofIfaceMsg{ID: 1, Choice: &OneofIfaceMsg_Count{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"id":1,"count":0}` {
+		t.Errorf("MarshalJSON = %s", j)
+	}
+
+	type UnregisteredOneof struct {
+		X fmt.Stringer `protobuf_oneof:"x"`
+	}
+	if _, err := protobuf3.Marshal(&UnregisteredOneof{}); err == nil {
+		t.Error("Marshal(unregistered oneof interface) succeeded")
+	}
+}
+
+func TestTimeInterval(t *testing.T) {
+	start := time.Date(2020, 3, 4, 5, 6, 7, 8, time.UTC)
+	end := start.Add(90 * time.Minute)
+	for _, ti := range []protobuf3.TimeInterval{
+		protobuf3.NewTimeInterval(start, end),
+		protobuf3.NewTimeInterval(start, time.Time{}), // open-ended
+	} {
+		pb := mustMarshal(t, &ti)
+		var u protobuf3.TimeInterval
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatal(err)
+		}
+		if !u.Start.Equal(ti.Start) || !u.End.Equal(ti.End) || u.End.IsZero() != ti.End.IsZero() {
+			t.Errorf("Unmarshal(Marshal(%v)) = %v", ti, u)
+		}
+	}
+
+	open := protobuf3.NewTimeInterval(start, time.Time{})
+	if pb := mustMarshal(t, &open); pb[0] != 1<<3|byte(protobuf3.WireBytes) || len(pb) != 2+int(pb[1]) {
+		t.Errorf("Marshal(open interval) = % x; expected only the start_time", pb)
+	}
+	if !open.IsOpen() || !open.Contains(end.Add(time.Hour)) || open.Contains(start.Add(-1)) || open.Duration() != 0 {
+		t.Errorf("open interval %v misbehaves", open)
+	}
+	bounded := protobuf3.NewTimeInterval(start, end)
+	if bounded.IsOpen() || !bounded.Contains(start) || bounded.Contains(end) || bounded.Duration() != 90*time.Minute {
+		t.Errorf("bounded interval %v misbehaves", bounded)
+	}
+
+	type WindowMsg struct {
+		Window protobuf3.TimeInterval `protobuf:"bytes,1"`
+	}
+	s, err := protobuf3.AsProtobufFull(reflect.TypeOf(WindowMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "google.type.Interval window = 1;") || !strings.Contains(s, `import "google/type/interval.proto";`) {
+		t.Errorf("unexpected AsProtobufFull result:\n%s", s)
+	}
+}
+
+type LEB128Msg struct {
+	X  int64   `protobuf:"varint,1,codec=sleb128"`
+	Xs []int32 `protobuf:"varint,2,packed,codec=sleb128"`
+	Y  int64   `protobuf:"varint,3"`
+}
+
+func TestVarintCodec(t *testing.T) {
+	pb := mustMarshal(t, &LEB128Msg{X: -1})
+	if !bytes.Equal(pb, []byte{1<<3 | byte(protobuf3.WireVarint), 0x7f}) {
+		t.Errorf("Marshal(X: -1) = % x; expected 08 7f", pb)
+	}
+
+	for _, m := range []LEB128Msg{
+		{X: 63, Y: -1},
+		{X: 64},
+		{X: -64},
+		{X: -65, Xs: []int32{0, -1, 1, 1 << 30, -1 << 31}},
+		{X: math.MinInt64},
+		{X: math.MaxInt64},
+	} {
+		pb := mustMarshal(t, &m)
+		var u LEB128Msg
+		if err := protobuf3.Unmarshal(pb, &u); err != nil {
+			t.Fatalf("Unmarshal(% x) error %v", pb, err)
+		}
+		eq("sleb128", m, u, t)
+
+		// peers without the codec can still skip the fields
+		var y struct {
+			Y int64 `protobuf:"varint,3"`
+		}
+		if err := protobuf3.Unmarshal(pb, &y); err != nil || y.Y != m.Y {
+			t.Errorf("Unmarshal(% x) without the codec = %v, %v", pb, y, err)
+		}
+	}
+
+	type Unregistered struct {
+		X int64 `protobuf:"varint,1,codec=nonesuch"`
+	}
+	if _, err := protobuf3.Marshal(&Unregistered{}); err == nil || !strings.Contains(err.Error(), "nonesuch") {
+		t.Errorf("Marshal(Unregistered) = %v; expected an error", err)
+	}
+}
+
+func TestUnmarshalWithPresence(t *testing.T) {
+	zero := int64(0)
+	m := FixedMsg{u32: 1, f64: 2.5, pi64: &zero, sf32: []float32{1}}
+	pb := mustMarshal(t, &m)
+
+	var u FixedMsg
+	seen, err := protobuf3.UnmarshalWithPresence(pb, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("u", m, u, t)
+	// the *int64 holding 0 was sent, and so is present, while the other zero fields weren't
+	eq("seen", map[uint32]bool{2: true, 9: true, 13: true, 28: true}, seen, t)
+
+	// unknown fields are present too, but the fields of nested messages aren't
+	n := OneofTagMsg{ID: 1, Inner: &InnerMsg{i: 5}}
+	pb = append(mustMarshal(t, &n), 15<<3|byte(protobuf3.WireVarint), 1)
+	seen, err = protobuf3.UnmarshalWithPresence(pb, &OneofTagMsg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq("nested seen", map[uint32]bool{1: true, 4: true, 15: true}, seen, t)
+}
+
+func TestImage(t *testing.T) {
+	// a 3x2 image of 2 byte pixels, with rows padded to 8 bytes
+	img := protobuf3.Image{Width: 3, Height: 2, Stride: 8, Pixels: []byte{
+		1, 2, 3, 4, 5, 6, 0, 0,
+		7, 8, 9, 10, 11, 12, 0, 0,
+	}}
+	pb := mustMarshal(t, &img)
+	var u protobuf3.Image
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("padded image", img, u, t)
+	if row := u.Row(1); !bytes.Equal(row, []byte{7, 8, 9, 10, 11, 12, 0, 0}) {
+		t.Errorf("Row(1) = %v", row)
+	}
+
+	// a sub-image, whose last row isn't padded
+	sub := protobuf3.Image{Width: 2, Height: 2, Stride: 8, Pixels: img.Pixels[2:14]}
+	pb = mustMarshal(t, &sub)
+	var u2 protobuf3.Image
+	if err := protobuf3.Unmarshal(pb, &u2); err != nil {
+		t.Fatal(err)
+	}
+	eq("sub-image", sub, u2, t)
+	c := u2.Compact(2)
+	eq("compacted", protobuf3.Image{Width: 2, Height: 2, Stride: 4, Pixels: []byte{3, 4, 5, 6, 9, 10, 11, 12}}, c, t)
+
+	if _, err := protobuf3.Marshal(&protobuf3.Image{Width: 3, Height: 2, Stride: 8, Pixels: make([]byte, 6)}); err == nil {
+		t.Error("Marshal(Image with too few pixels) succeeded")
+	}
+}
+
+type DeprecatedMsg struct {
+	Name    string `protobuf:"bytes,1"`
+	OldName string `protobuf:"bytes,2,deprecated"`
+}
+
+func TestDeprecatedField(t *testing.T) {
+	var calls []string
+	protobuf3.OnDeprecatedField = func(msgType, fieldName string) {
+		calls = append(calls, msgType+"."+fieldName)
+	}
+	defer func() { protobuf3.OnDeprecatedField = nil }()
+
+	// a zero deprecated field isn't encoded, and so isn't reported
+	mustMarshal(t, &DeprecatedMsg{Name: "x"})
+	if len(calls) != 0 {
+		t.Errorf("OnDeprecatedField called %v for a zero field", calls)
+	}
+
+	// sizing a message doesn't report its deprecated fields
+	if _, err := protobuf3.Size(&DeprecatedMsg{OldName: "y"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("OnDeprecatedField called %v by Size", calls)
+	}
+
+	pb := mustMarshal(t, &DeprecatedMsg{OldName: "y"})
+	eq("encode calls", []string{"protobuf3_test.DeprecatedMsg.OldName"}, calls, t)
+
+	calls = nil
+	var u DeprecatedMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("decode calls", []string{"protobuf3_test.DeprecatedMsg.OldName"}, calls, t)
+	eq("u", DeprecatedMsg{OldName: "y"}, u, t)
+
+	s, err := protobuf3.AsProtobuf(reflect.TypeOf(DeprecatedMsg{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, "string old_name = 2 [deprecated = true];") {
+		t.Errorf("unexpected AsProtobuf result:\n%s", s)
+	}
+}
+
+// Int32Heap is a min-heap of int32s, as in the container/heap example
+type Int32Heap []int32
+
+func (h Int32Heap) Len() int            { return len(h) }
+func (h Int32Heap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h Int32Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *Int32Heap) Push(x interface{}) { *h = append(*h, x.(int32)) }
+func (h *Int32Heap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+type HeapSortedMsg struct {
+	Q Int32Heap `protobuf:"varint,1,heapsorted"`
+}
+
+func TestHeapSorted(t *testing.T) {
+	var m HeapSortedMsg
+	for _, x := range []int32{5, 2, 8, 1, 9, 3, 3} {
+		heap.Push(&m.Q, x)
+	}
+	orig := append(Int32Heap(nil), m.Q...)
+
+	pb := mustMarshal(t, &m)
+	eq("heap after Marshal", orig, m.Q, t)
+
+	var u HeapSortedMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("decoded", Int32Heap{1, 2, 3, 3, 5, 8, 9}, u.Q, t)
+
+	type NotAHeap struct {
+		Q []int32 `protobuf:"varint,1,heapsorted"`
+	}
+	if _, err := protobuf3.Marshal(&NotAHeap{}); err == nil {
+		t.Error("Marshal(heapsorted []int32) succeeded")
+	}
+}
+
+func TestMarshalBudget(t *testing.T) {
+	m := BytesMsg{s: strings.Repeat("a", 10), ss: []string{strings.Repeat("b", 10), strings.Repeat("c", 10)}, sb: []byte("dddddddddd")}
+	full := mustMarshal(t, &m) // 4 fields of 12 bytes each
+
+	pb, truncated, err := protobuf3.MarshalBudget(&m, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || !bytes.Equal(pb, full[:36]) {
+		t.Errorf("MarshalBudget(40) = % x, %v; expected the first 3 fields", pb, truncated)
+	}
+	var u BytesMsg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("truncated", BytesMsg{s: m.s, ss: m.ss}, u, t)
+
+	pb, truncated, err = protobuf3.MarshalBudget(&m, 5)
+	if err != nil || !truncated || len(pb) != 0 {
+		t.Errorf("MarshalBudget(5) = % x, %v, %v; expected nothing", pb, truncated, err)
+	}
+
+	pb, truncated, err = protobuf3.MarshalBudget(&m, len(full))
+	if err != nil || truncated || !bytes.Equal(pb, full) {
+		t.Errorf("MarshalBudget(%d) = % x, %v, %v; expected all of it", len(full), pb, truncated, err)
+	}
+
+	// a negative budget is an error, rather than a very large budget
+	pb, _, err = protobuf3.MarshalBudget(&m, -1)
+	if err == nil || pb != nil {
+		t.Errorf("MarshalBudget(-1) = % x, %v; expected an error", pb, err)
+	}
+
+	// the checksum of a truncated message is recomputed over the fields which were kept
+	c := ChecksumMsg{Seq: 1, Payload: strings.Repeat("p", 20)}
+	pb, truncated, err = protobuf3.MarshalBudget(&c, 20)
+	if err != nil || !truncated || len(pb) > 20 {
+		t.Fatalf("MarshalBudget(ChecksumMsg, 20) = % x, %v, %v", pb, truncated, err)
+	}
+	var uc ChecksumMsg
+	if err := protobuf3.Unmarshal(pb, &uc); err != nil {
+		t.Fatalf("Unmarshal(% x) failed: %v", pb, err)
+	}
+	if uc.Seq != 1 || uc.Payload != "" {
+		t.Errorf("MarshalBudget(ChecksumMsg, 20) decoded to %+v; expected only Seq", uc)
+	}
+	pb, _, err = protobuf3.MarshalBudget(&c, 4)
+	if err == nil || pb != nil {
+		t.Errorf("MarshalBudget(ChecksumMsg, 4) = % x, %v; expected an error since the checksum doesn't fit", pb, err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	i32, u64, b, s := int32(-5), uint64(1<<40), true, "ptr"
+	d := -(time.Second + time.Millisecond)
+	custom := CustomMarshalerFixed(7)
+	for _, m := range []protobuf3.Message{
+		&FixedMsg{},
+		&FixedMsg{i32: -1, u64: 2, f32: 3.5, f64: -4.5, pi32: &i32, pu64: &u64, si32: []int32{1, -2}, sf64: []float64{6}},
+		&VarMsg{i32: -1, u32: 300, i64: -1 << 40, u64: 1 << 63, b: true, pi32: &i32, pu64: &u64, pb: &b, si32: []int32{-1, 2, 300}, su64: []uint64{1 << 50}, sb: []bool{true, false}},
+		&ZigZagMsg{i32: -1, i64: -1 << 40, pi32: &i32, si32: []int32{-3, 3}, si64: []int64{-1 << 20}},
+		&BytesMsg{s: strings.Repeat("x", 200), ps: &s, ss: []string{"", "a"}, sb: []byte{1, 2, 3}},
+		&IntMsg{i: -1, u: 1 << 20, i8: -8, u8: 200, i16: -300, u16: 60000, z32: -7, z64: 1 << 33, si: []int{-1, 1}, su8: []uint8{1, 2}, sz32: []int{-2}},
+		&NestedPtrStructMsg{first: &InnerMsg{0x11}, many: []*InnerMsg{{0x33}, {}}, empty: []InnerMsg{{}, {-1}}},
+		&MapMsg{m: map[string]int32{"123": 123, "abc": 0}, n: map[int32][]byte{125: []byte("abc"), 0: nil}, e: map[int32]struct{}{-127: {}}},
+		&TimeMsg{tm: time.Unix(112233, 445566), dur: time.Second*10 + time.Microsecond, dur2: &d, dur3: []time.Duration{0, 15 * time.Second}, dur4: [1]time.Duration{time.Nanosecond}},
+		&TimeMsg{},
+		&CustomMarshalerMsg{Slice: CustomMarshalerSlice{[]uint32{1, 2}, []uint32{3, 4, 5}}, Int: 5, Fixedp: &custom},
+		&ChecksumMsg{Seq: 1, Payload: "hello", Inner: &ChecksumMsg{Seq: 2}},
+		&OneofTagMsg{ID: 4, Inner: &InnerMsg{i: 5}},
+		&LEB128Msg{X: -1, Xs: []int32{-64, 64}, Y: -1},
+	} {
+		n, err := protobuf3.Size(m)
+		if err != nil {
+			t.Errorf("Size(%T) failed: %v", m, err)
+			continue
+		}
+		if pb := mustMarshal(t, m); n != len(pb) {
+			t.Errorf("Size(%T %+v) = %d; expected %d", m, m, n, len(pb))
+		}
+	}
+
+	// messages which can't be marshaled can't be sized either
+	if _, err := protobuf3.Size(&OneofTagMsg{Name: "x", Count: 1}); err == nil {
+		t.Error("Size of a message with two fields of a oneof set succeeded")
+	}
+	if _, err := protobuf3.Size(&NestedPtrStructMsg{many: []*InnerMsg{nil}}); err == nil {
+		t.Error("Size of a message with a nil repeated element succeeded")
+	}
+}
+
+type Base64Msg struct {
+	Data []byte `protobuf:"bytes,1,base64"`
+}
+
+type Base64PeerMsg struct {
+	Data string `protobuf:"bytes,1"`
+}
+
+func TestBase64(t *testing.T) {
+	m := Base64Msg{Data: []byte{0, 1, 0xfe, 0xff, 'x'}}
+	pb := mustMarshal(t, &m)
+
+	// a peer sees a string holding the base64 encoding
+	var peer Base64PeerMsg
+	if err := protobuf3.Unmarshal(pb, &peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.Data != "AAH+/3g=" {
+		t.Errorf("peer decoded %q; expected %q", peer.Data, "AAH+/3g=")
+	}
+
+	var u Base64Msg
+	if err := protobuf3.Unmarshal(pb, &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("round trip", m, u, t)
+	if n, err := protobuf3.Size(&m); err != nil || n != len(pb) {
+		t.Errorf("Size = %d, %v; expected %d", n, err, len(pb))
+	}
+
+	if err := protobuf3.Unmarshal(mustMarshal(t, &Base64PeerMsg{Data: "not base64!"}), &u); err == nil {
+		t.Error("Unmarshal of invalid base64 succeeded")
+	}
+
+	def, err := protobuf3.AsProtobuf(reflect.TypeOf(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(def, "string data = 1;") {
+		t.Errorf("AsProtobuf = %s; expected a string field", def)
+	}
+}
+
+type DeterministicMapMsg struct {
+	S map[string]uint32 `protobuf:"bytes,1" protobuf_key:"bytes,1" protobuf_val:"varint,2"`
+	I map[int32]string  `protobuf:"bytes,2" protobuf_key:"varint,1" protobuf_val:"bytes,2"`
+}
+
+func TestSetDeterministic(t *testing.T) {
+	m := DeterministicMapMsg{
+		S: map[string]uint32{"b": 2, "a": 1, "c": 3},
+		I: map[int32]string{-1: "x", 5: "y", 0: "z"},
+	}
+	expected := []byte{
+		1<<3 | 2, 5, 1<<3 | 2, 1, 'a', 2 << 3, 1,
+		1<<3 | 2, 5, 1<<3 | 2, 1, 'b', 2 << 3, 2,
+		1<<3 | 2, 5, 1<<3 | 2, 1, 'c', 2 << 3, 3,
+		2<<3 | 2, 14, 1 << 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 2<<3 | 2, 1, 'x',
+		2<<3 | 2, 3, 2<<3 | 2, 1, 'z',
+		2<<3 | 2, 5, 1 << 3, 5, 2<<3 | 2, 1, 'y',
+	}
+
+	buf := protobuf3.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	for i := 0; i < 10; i++ {
+		buf.Reset()
+		if err := buf.Marshal(&m); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("deterministic Marshal = % x; expected % x", buf.Bytes(), expected)
+		}
+	}
+
+	var u DeterministicMapMsg
+	if err := protobuf3.Unmarshal(buf.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	eq("round trip", m, u, t)
+}
@@ -0,0 +1,278 @@
+// Go support for Protocol Buffers - Google's data interchange format
+//
+// Copyright 2016 Mist Systems. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//     * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//     * Neither the name of Google Inc. nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protobuf3
+
+/*
+ * Go types which encode as the protobuf well-known types (other than google.protobuf.Timestamp
+ * and google.protobuf.Duration, which are time.Time and time.Duration and are built into the encoder)
+ */
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// FieldMask encodes as a google.protobuf.FieldMask. It is a list of paths to fields, each a
+// dot separated list of protobuf field names (not Go field names).
+type FieldMask []string
+
+// NewFieldMask returns a FieldMask containing the paths
+func NewFieldMask(paths ...string) FieldMask {
+	return FieldMask(paths)
+}
+
+// MarshalProtobuf3 encodes the paths as the repeated string field 1 of a google.protobuf.FieldMask
+func (fm *FieldMask) MarshalProtobuf3() ([]byte, error) {
+	if len(*fm) == 0 {
+		return nil, nil
+	}
+	var b WriteBuffer
+	for _, path := range *fm {
+		b.buf = append(b.buf, 1<<3|byte(WireBytes))
+		b.EncodeStringBytes(path)
+	}
+	return b.buf, nil
+}
+
+// UnmarshalProtobuf3 decodes a google.protobuf.FieldMask, appending the paths to fm
+func (fm *FieldMask) UnmarshalProtobuf3(data []byte) error {
+	b := newBuffer(data)
+	defer b.release()
+	for !b.EOF() {
+		tag, err := b.DecodeVarint()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case 1<<3 | uint64(WireBytes):
+			path, err := b.DecodeStringBytes()
+			if err != nil {
+				return err
+			}
+			*fm = append(*fm, path)
+		default:
+			// do the protobuf thing and ignore unknown tags
+			err = b.skip(nil, WireType(tag)&7)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AsProtobuf3 returns the name of the well-known type and the file which must be imported to use it
+func (*FieldMask) AsProtobuf3() (string, string, []string) {
+	return "google.protobuf.FieldMask", "", []string{"google/protobuf/field_mask.proto"}
+}
+
+// Contains returns true if path, or the path of one of its parent messages, is in the mask
+func (fm FieldMask) Contains(path string) bool {
+	for _, p := range fm {
+		if p == path || (strings.HasPrefix(path, p) && path[len(p)] == '.') {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply copies the fields named by the paths in the mask from src to dst, leaving the rest of dst alone.
+// This is the usual way of applying a PATCH style update. dst and src must be pointers to the same type of struct.
+// Intermediate nil pointers to messages in dst are allocated as needed. A nil pointer in src zeros the
+// corresponding field in dst. The values copied are deep copies, so dst doesn't share any memory with src.
+func (fm FieldMask) Apply(dst, src Message) error {
+	dv := reflect.ValueOf(dst)
+	sv := reflect.ValueOf(src)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Struct || sv.Type() != dv.Type() || sv.IsNil() {
+		return fmt.Errorf("protobuf3: FieldMask.Apply(%T, %T): arguments must be non-nil pointers to the same type of struct", dst, src)
+	}
+
+	for _, path := range fm {
+		d, s := dv.Elem(), sv.Elem()
+		names := strings.Split(path, ".")
+		for i, name := range names {
+			f, err := fieldByProtobufName(d.Type(), name)
+			if err != nil {
+				return fmt.Errorf("protobuf3: FieldMask path %q: %v", path, err)
+			}
+			d, s = settable(d.FieldByIndex(f.Index)), settable(s.FieldByIndex(f.Index))
+
+			if i == len(names)-1 {
+				deepCopy(d, s)
+				break
+			}
+
+			// dig down into the inner message
+			if d.Kind() == reflect.Ptr {
+				if s.IsNil() {
+					// the rest of the path is the zero value in src. set the pointer in dst to match
+					d.Set(s)
+					break
+				}
+				if d.IsNil() {
+					d.Set(reflect.New(d.Type().Elem()))
+				}
+				d, s = d.Elem(), s.Elem()
+			}
+			if d.Kind() != reflect.Struct {
+				return fmt.Errorf("protobuf3: FieldMask path %q: %s is not a message", path, name)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldByProtobufName returns the field of struct type t whose protobuf field name is name
+func fieldByProtobufName(t reflect.Type, name string) (reflect.StructField, error) {
+	prop, err := GetProperties(t)
+	if err != nil {
+		return reflect.StructField{}, err
+	}
+	for i := range prop.props {
+		p := &prop.props[i]
+		if p.protobufFieldName(t) == name {
+			if f, ok := t.FieldByName(p.Name); ok {
+				return f, nil
+			}
+		}
+	}
+	return reflect.StructField{}, fmt.Errorf("%s has no field named %q", t, name)
+}
+
+// settable returns an equivalent reflect.Value which can be set, even if v was obtained through an unexported field
+func settable(v reflect.Value) reflect.Value {
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+// deepCopy sets dst to a copy of src which shares no pointers, slices or maps with src. dst and src must be addressable.
+// time.Time is copied as is, since its *Location is never modified.
+func deepCopy(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		n := reflect.New(src.Type().Elem())
+		deepCopy(n.Elem(), src.Elem())
+		dst.Set(n)
+
+	case reflect.Slice:
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		n := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			deepCopy(n.Index(i), src.Index(i))
+		}
+		dst.Set(n)
+
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			deepCopy(dst.Index(i), src.Index(i))
+		}
+
+	case reflect.Map:
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		n := reflect.MakeMapWithSize(src.Type(), src.Len())
+		for it := src.MapRange(); it.Next(); {
+			// map values aren't addressable, so copy them
+			v := reflect.New(src.Type().Elem()).Elem()
+			v.Set(it.Value())
+			e := reflect.New(src.Type().Elem()).Elem()
+			deepCopy(e, v)
+			n.SetMapIndex(it.Key(), e)
+		}
+		dst.Set(n)
+
+	case reflect.Interface:
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		v := reflect.New(src.Elem().Type()).Elem()
+		v.Set(src.Elem())
+		e := reflect.New(src.Elem().Type()).Elem()
+		deepCopy(e, v)
+		dst.Set(e)
+
+	case reflect.Struct:
+		if src.Type() == time_Time_type {
+			dst.Set(src)
+			return
+		}
+		for i := 0; i < src.NumField(); i++ {
+			deepCopy(settable(dst.Field(i)), settable(src.Field(i)))
+		}
+
+	default:
+		dst.Set(src)
+	}
+}
+
+// StringList is the message in which each []string value of a map[string][]string field (such as a url.Values or
+// http.Header) with the "stringlist" attribute is encoded, since protobuf map values can't be repeated fields. Without
+// the attribute the values are encoded as repeated strings within the map entries, which only this package decodes.
+type StringList struct {
+	Values []string `protobuf:"bytes,1"`
+}
+
+// Any encodes as a google.protobuf.Any: a message of any type, encoded as bytes, along with a URL identifying its type.
+type Any struct {
+	TypeURL string `protobuf:"bytes,1,name=type_url"`
+	Value   []byte `protobuf:"bytes,2"`
+}
+
+// NewAny marshals pb into an Any with the given type URL (conventionally "type.googleapis.com/" followed by the
+// fully qualified protobuf name of the message)
+func NewAny(typeURL string, pb Message) (Any, error) {
+	value, err := Marshal(pb)
+	if err != nil {
+		return Any{}, err
+	}
+	return Any{TypeURL: typeURL, Value: value}, nil
+}
+
+// UnmarshalTo decodes the message held in the Any into pb. It is up to the caller to check the type URL first.
+func (a *Any) UnmarshalTo(pb Message) error {
+	return Unmarshal(a.Value, pb)
+}
+
+// AsProtobuf3 returns the name of the well-known type and the file which must be imported to use it
+func (*Any) AsProtobuf3() (string, string, []string) {
+	return "google.protobuf.Any", "", []string{"google/protobuf/any.proto"}
+}